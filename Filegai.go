@@ -33,11 +33,10 @@ package main
 import(
     "fmt"
     "database/sql"
-    _ "github.com/mattn/go-sqlite3"
+    "github.com/mattn/go-sqlite3"
     "io/ioutil"
     "os"
     "os/exec"
-    "syscall"
     // "golang.org/x/sys/windows"
     "strings"
     "strconv"
@@ -49,33 +48,52 @@ import(
     "time"
     "regexp"
     "html/template"
+    "html"
     "path/filepath"
     "flag"
     "sort"
     "runtime"
+    "sync"
+    "context"
+    "archive/zip"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "io"
+    "unicode/utf8"
+    "unicode"
+    "net/url"
 )
 
 // Basic types
 type Fnode struct{
     Name string
     IsDir bool
-    Dev int32  // type is the same as the API return value
-    Ino uint64  // type is the same as the API return value
-    Parent_dev int32
+    Dev uint64 // see File_identity
+    Ino uint64
+    Parent_dev uint64
     Parent_ino uint64
+    Size int64
+    Mtime int64 // unix time
 }
 
 type Fnode_view struct{
     Name string
     IsDir bool
-    Dev int32  // type is the same as the API return value
-    Ino uint64  // type is the same as the API return value
-    Parent_dev int32
+    Dev uint64
+    Ino uint64
+    Parent_dev uint64
     Parent_ino uint64
     Tag string
     Note string
     Color string
     Note_visible string 
+    Note_format int
+    Note_count int // notes on the file, Note is the latest one
+    Reply_count int
+    Labels []Label_record // set on the file
+    Note_labels []Label_record // on its notes, not on the file
+    Note_tip string // a folder's note in plain text, shown on hovering the folder
     Active_css_class string 
     Pin_class string
     Pin_value string
@@ -99,6 +117,11 @@ type Note_record struct{
     File_dir string
     File_name string
     Ndate string
+    Snippet string // html, the search hit
+    Parent_tag string // the note replied to, "" for a note of its own
+    Format int // text_format_html or text_format_markdown
+    Labels []Label_record
+    Anchor Note_anchor // Page is 0 for a note on the whole file
 }
 
 type Resource_record struct{
@@ -119,35 +142,77 @@ type Db_column struct{
     Value string
 }
 
+type Db_cond struct{
+    Name string
+    Op string // one of db_ops
+    Value string
+}
+
+// values never go into the sql text, they are bound to the "?" placeholders
+type Db_query struct{
+    Sql string
+    Args []interface{}
+}
+
 type Db_table struct{
     Name string
-    Columns map[string]bool
-    Data map[string]string  // for insert and update
+    Columns map[string]bool  // true for text columns, false for numeric columns
+    Data map[string]string  // for insert and update, also the "=" conditions of select and delete
+    Exprs map[string]string // sql expressions for update, like ref_count=ref_count+1
+    Conds []Db_cond // explicit comparisons
+}
+
+// the comparison operators allowed in Db_table.where
+var db_ops = map[string]string{
+    "=":"=",
+    "<>":"<>",
+    "<":"<",
+    "<=":"<=",
+    ">":">",
+    ">=":">=",
+    "like":" like ",
 }
 
 func (tab *Db_table) set_name(name string)  *Db_table{
     tab.Name = name
     tab.Columns = make(map[string]bool)
     tab.Data = make(map[string]string)
+    tab.Exprs = make(map[string]string)
+    tab.Conds = []Db_cond{}
     return tab
 }
 
-func (tab *Db_table) add_column(name string, to_quote bool)  *Db_table{
-    tab.Columns[name]=to_quote
+func (tab *Db_table) add_column(name string, is_text bool)  *Db_table{
+    tab.Columns[name]=is_text
     return tab
 }
 
 func (tab *Db_table) set(name string, value string) *Db_table{
-    to_quote,ok := tab.Columns[name]
-    if ok{
-        if to_quote{
-            tab.Data[name]="\""+strings.ReplaceAll(value,"\"","\"\"")+"\""
-        }else{
-            tab.Data[name]=value
-        }
-    }else{
+    if _,ok := tab.Columns[name];!ok{
+        panic("table column "+name+" not defined")
+    }
+    tab.Data[name]=value
+    return tab
+}
+
+// set_expr is for the update only, expr is put into the sql as it is,
+// never pass user input to it
+func (tab *Db_table) set_expr(name string, expr string) *Db_table{
+    if _,ok := tab.Columns[name];!ok{
         panic("table column "+name+" not defined")
     }
+    tab.Exprs[name]=expr
+    return tab
+}
+
+func (tab *Db_table) where(name string, op string, value string) *Db_table{
+    if _,ok := tab.Columns[name];!ok{
+        panic("table column "+name+" not defined")
+    }
+    if _,ok := db_ops[op];!ok{
+        panic("operator "+op+" not supported")
+    }
+    tab.Conds = append(tab.Conds,Db_cond{Name:name,Op:op,Value:value})
     return tab
 }
 
@@ -155,36 +220,91 @@ func (tab *Db_table) clear(){
     tab.Name = ""
     tab.Columns=make(map[string]bool)
     tab.Data=make(map[string]string)
+    tab.Exprs=make(map[string]string)
+    tab.Conds=[]Db_cond{}
+}
+
+// arg converts the value of numeric columns to numbers,
+// text columns are bound as they are
+func (tab *Db_table) arg(name string,value string) interface{}{
+    if tab.Columns[name]{
+        return value
+    }
+    if i,err := strconv.ParseInt(value,10,64);err ==nil{
+        return i
+    }
+    if f,err := strconv.ParseFloat(value,64);err ==nil{
+        return f
+    }
+    return value
+}
+
+// like_escape escapes the wildcards of like, use it before adding your own % 
+func like_escape(value string) string{
+    value = strings.ReplaceAll(value,"\\","\\\\")
+    value = strings.ReplaceAll(value,"%","\\%")
+    return strings.ReplaceAll(value,"_","\\_")
+}
+
+func str_args(values []string) []interface{}{
+    args :=make([]interface{},len(values))
+    for i,v :=range values{
+        args[i]=v
+    }
+    return args
 }
 
-func (tab *Db_table) pack_insert() string{
+func placeholders(n int) string{
+    if n<1{
+        return ""
+    }
+    return strings.Repeat("?,",n-1)+"?"
+}
+
+func (tab *Db_table) pack_where(data_cols []string) (string,[]interface{}){
+    where_arr :=[]string{}
+    var args []interface{}
+    for _,col := range data_cols{
+        where_arr = append(where_arr,col+"=?")
+        args = append(args,tab.arg(col,tab.Data[col]))
+    }
+    for _,cond := range tab.Conds{
+        if cond.Op=="like"{
+            where_arr = append(where_arr,cond.Name+" like ? escape '\\'")
+        }else{
+            where_arr = append(where_arr,cond.Name+db_ops[cond.Op]+"?")
+        }
+        args = append(args,tab.arg(cond.Name,cond.Value))
+    }
+    if len(where_arr)==0{
+        return "",args
+    }
+    return " WHERE "+strings.Join(where_arr," and "),args
+}
+
+func (tab *Db_table) data_cols() []string{
     var cols []string
-    var values []string
-    for col,value :=range tab.Data{
+    for col,_ :=range tab.Data{
         cols=append(cols,col)
-        values =append(values,value)        
     }
-    str :="INSERT INTO "+tab.Name+"("+strings.Join(cols,",")+") VALUES ("+ strings.Join(values,",") +")"
-    return str
+    sort.Strings(cols)
+    return cols
+}
+
+func (tab *Db_table) pack_insert() *Db_query{
+    var values []interface{}
+    cols := tab.data_cols()
+    for _,col :=range cols{
+        values =append(values,tab.arg(col,tab.Data[col]))
+    }
+    str :="INSERT INTO "+tab.Name+"("+strings.Join(cols,",")+") VALUES ("+ placeholders(len(cols)) +")"
+    return &Db_query{Sql:str,Args:values}
 }
 
-func (tab *Db_table) pack_select(q_cols string, order string, limit string) string{
-    where_str :=""
-    where_arr:=[]string{}
+func (tab *Db_table) pack_select(q_cols string, order string, limit string) *Db_query{
     order_str :=""
     limit_str :=""
-    for col,value := range tab.Data{
-        if strings.Contains(value,"%"){
-            where_arr = append(where_arr, col+" like "+value)
-        }else if strings.HasPrefix(value,">") || strings.HasPrefix(value,"<"){
-            where_arr = append(where_arr,col+value)
-        }else{
-            where_arr = append(where_arr,col+"="+value)
-        }  
-    }
-    if len(where_arr)>0{
-        where_str = " WHERE "+strings.Join(where_arr," and ")
-    }
+    where_str,args := tab.pack_where(tab.data_cols())
     if order !=""{
         order_str = " ORDER BY "+order
     }
@@ -192,57 +312,73 @@ func (tab *Db_table) pack_select(q_cols string, order string, limit string) stri
         limit_str =" LIMIT "+limit
     }
     str :="SELECT "+q_cols+" FROM  "+tab.Name+" "+where_str + order_str + limit_str
-    return str
+    return &Db_query{Sql:str,Args:args}
 }
 
-func (tab *Db_table) pack_count(count_col string) string{
+func (tab *Db_table) pack_count(count_col string) *Db_query{
     return tab.pack_select("count(*) as "+count_col,"","")
 }
 
-func (tab *Db_table) pack_update(check []string) string{
+func (tab *Db_table) pack_update(check []string) *Db_query{
     set_arr:=[]string{}
-    where_str :=""
-    where_arr:=[]string{}
-    for col,value :=range tab.Data{
-        set_arr=append(set_arr,col+"="+value)
-    }
-
+    var args []interface{}
+    is_check := make(map[string]bool)
     for _,col := range check{
-        where_arr = append(where_arr,col+"="+tab.Data[col])
+        is_check[col]=true
     }
-    if len(where_arr)>0{
-        where_str = " WHERE "+strings.Join(where_arr," and ")
+    for _,col :=range tab.data_cols(){
+        if is_check[col]{
+            continue
+        }
+        set_arr=append(set_arr,col+"=?")
+        args=append(args,tab.arg(col,tab.Data[col]))
     }
-    if len(set_arr)>0{
-        str :="UPDATE "+tab.Name+" SET "+strings.Join(set_arr,",")+where_str
-        return str
-    }else{
-        return ""
-    }    
-}
-
-func (tab *Db_table) pack_delete() string{
-    where_str :=""
-    where_arr:=[]string{}
-    for col,value := range tab.Data{
-        where_arr = append(where_arr,col+"="+value)
+    for col,expr :=range tab.Exprs{
+        set_arr=append(set_arr,col+"="+expr)
     }
-    if len(where_arr)>0{
-        where_str = " WHERE "+strings.Join(where_arr," and ")
+    if len(set_arr)==0{
+        return &Db_query{}
     }
-    return "DELETE FROM "+tab.Name+where_str
+    where_str,where_args := tab.pack_where(check)
+    str :="UPDATE "+tab.Name+" SET "+strings.Join(set_arr,",")+where_str
+    return &Db_query{Sql:str,Args:append(args,where_args...)}
+}
+
+func (tab *Db_table) pack_delete() *Db_query{
+    where_str,args := tab.pack_where(tab.data_cols())
+    return &Db_query{Sql:"DELETE FROM "+tab.Name+where_str,Args:args}
 }
 
 
 // extending the db object methods
-func do_insert(db_link *sql.DB,sql_insert string)(int64,error){
-    sql_run, err := db_link.Prepare(sql_insert)
+// *sql.DB and *sql.Tx are both Db_link
+type Db_link interface{
+    Exec(query string, args ...interface{}) (sql.Result, error)
+    Prepare(query string) (*sql.Stmt, error)
+    Query(query string, args ...interface{}) (*sql.Rows, error)
+    QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func do_prepare(db_link Db_link,q *Db_query)(*sql.Stmt,error){
+    if q.Sql==""{
+        return nil,errors.New("empty sql")
+    }
+    sql_run, err := db_link.Prepare(q.Sql)
     if err !=nil{
         fmt.Println("?? error in db operation:")
-        fmt.Println(sql_insert)
+        fmt.Println(q.Sql)
+        return nil,err
+    }
+    return sql_run,nil
+}
+
+func do_insert(db_link Db_link,q *Db_query)(int64,error){
+    sql_run, err := do_prepare(db_link,q)
+    if err !=nil{
         return 0,err
     }
-    res, err :=sql_run.Exec()
+    defer sql_run.Close()
+    res, err :=sql_run.Exec(q.Args...)
     if err !=nil{
         return 0,err
     }
@@ -253,14 +389,13 @@ func do_insert(db_link *sql.DB,sql_insert string)(int64,error){
     return id,err
 }
 
-func do_exec(db_link *sql.DB,sql_cmd string)(int64,error){
-    sql_run, err := db_link.Prepare(sql_cmd)
+func do_exec(db_link Db_link,q *Db_query)(int64,error){
+    sql_run, err := do_prepare(db_link,q)
     if err !=nil{
-        fmt.Println("?? error in db operation:")
-        fmt.Println(sql_cmd)
         return 0,err
     }
-    res, err :=sql_run.Exec()
+    defer sql_run.Close()
+    res, err :=sql_run.Exec(q.Args...)
     if err !=nil{
         return 0,err
     }
@@ -270,20 +405,35 @@ func do_exec(db_link *sql.DB,sql_cmd string)(int64,error){
     }
     return count,nil
 }
-func do_update(db_link *sql.DB,sql_update string)(int64,error){
-    return do_exec(db_link,sql_update)
+func do_update(db_link Db_link,q *Db_query)(int64,error){
+    return do_exec(db_link,q)
 }
 
-func do_delete(db_link *sql.DB,sql_delete string)(int64,error){
-    return do_exec(db_link,sql_delete)
+func do_delete(db_link Db_link,q *Db_query)(int64,error){
+    return do_exec(db_link,q)
 }
 
-func do_count(db_link *sql.DB,sql_count string)(int64,error){
-    rows, err := db_link.Query(sql_count)
-    defer rows.Close()
+func do_query(db_link Db_link,q *Db_query)(*sql.Rows,error){
+    // the statement is prepared by Query and closed with the rows,
+    // closing it here would break the rows of a *sql.Tx
+    if q.Sql==""{
+        return nil,errors.New("empty sql")
+    }
+    rows, err := db_link.Query(q.Sql,q.Args...)
+    if err !=nil{
+        fmt.Println("?? error in db operation:")
+        fmt.Println(q.Sql)
+        return nil,err
+    }
+    return rows,nil
+}
+
+func do_count(db_link Db_link,q *Db_query)(int64,error){
+    rows, err := do_query(db_link,q)
     if err !=nil{
         return 0,err
     }
+    defer rows.Close()
     rows.Next()
     var count  int64
     err = rows.Scan(&count)
@@ -294,8 +444,8 @@ func do_count(db_link *sql.DB,sql_count string)(int64,error){
     return count,nil
 }
 
-func do_select_id(db_link *sql.DB,sql_select string)([]int64,error){
-    rows, err := db_link.Query(sql_select)
+func do_select_id(db_link Db_link,q *Db_query)([]int64,error){
+    rows, err := do_query(db_link,q)
     r :=[]int64{}
     if err !=nil{
         return r,err
@@ -320,21 +470,46 @@ func get_table(tab_name string) *Db_table{
         tab.add_column("title",true).add_column("color",false).add_column("shelf_id",false).add_column("adate",true)
     case "article_page":
         tab.set_name("article_page").add_column("pgid",false).add_column("pg_tag",true).add_column("tag",true)
-        tab.add_column("pdate",true).add_column("order_id",false)
+        tab.add_column("pdate",true).add_column("order_id",false).add_column("format",false)
     case "file_note":
         tab.set_name("file_note")
         tab.add_column("tag",true).add_column("file_dir",true).add_column("file_name",true).add_column("tag",true)
         tab.add_column("note",true).add_column("color",false).add_column("ndate",true).add_column("nid",false)
+        tab.add_column("parent_tag",true).add_column("format",false)
     case "ino_tree":
         tab.set_name("ino_tree").add_column("id",false).add_column("host_name",true)
         tab.add_column("device_id",false).add_column("ino",false).add_column("parent_ino",false)
         tab.add_column("name",true).add_column("type",true).add_column("state",true)
+        tab.add_column("size",false).add_column("mtime",false).add_column("scan_mtime",false)
     case "resource":
         tab.set_name("resource").add_column("rsid",false)
         tab.add_column("tag",true).add_column("page",false).add_column("name",true)
         tab.add_column("type",false).add_column("rs_date",true).add_column("ref_count",false)
+        tab.add_column("hash",true)
+    case "label":
+        tab.set_name("label").add_column("lid",false).add_column("name",true).add_column("color",true).add_column("ldate",true)
+    case "label_link":
+        tab.set_name("label_link").add_column("llid",false).add_column("lid",false).add_column("app",false).add_column("app_tag",true)
+    case "note_revision":
+        tab.set_name("note_revision").add_column("rvid",false).add_column("tag",true).add_column("rev_tag",true)
+        tab.add_column("host_name",true).add_column("rdate",true).add_column("format",false)
+    case "note_anchor":
+        tab.set_name("note_anchor").add_column("naid",false).add_column("tag",true).add_column("page",false)
+        tab.add_column("quote",true).add_column("rect",true)
+    case "wiki_link":
+        tab.set_name("wiki_link").add_column("wlid",false).add_column("app",false).add_column("app_tag",true)
+        tab.add_column("owner",true).add_column("kind",true).add_column("target",true)
+        tab.add_column("host_name",true).add_column("device_id",false).add_column("ino",false)
+    case "file_fingerprint":
+        tab.set_name("file_fingerprint").add_column("fpid",false).add_column("file_dir",true).add_column("file_name",true)
+        tab.add_column("size",false).add_column("mtime",false).add_column("hash",true).add_column("fdate",true)
+    case "note_template":
+        tab.set_name("note_template").add_column("ntid",false).add_column("name",true).add_column("format",false)
+        tab.add_column("exts",true).add_column("folder",true).add_column("body",true).add_column("tdate",true)
     case "resource_link":
         tab.set_name("resource_link").add_column("tag",true).add_column("app",false).add_column("app_tag",true)
+    case "root_folder":
+        tab.set_name("root_folder").add_column("rid",false).add_column("host_name",true).add_column("name",true).add_column("dir",true)
     case "settings":
         tab.set_name("settings").add_column("id",false).add_column("key",true).add_column("value",true).add_column("note",true)
     case "shortcut":
@@ -370,112 +545,18 @@ func str_db_delim(input string)string{
 }
 
 
-// windows specific codes -------------------------------------------------------------
 // for fs handling
-// func win_dev_ino(fname string,is_dir bool)(int32,uint64, error) {
-//     _fname, err := windows.UTF16PtrFromString(fname)
-//     if err != nil {
-//         return 0, 0, err
-//     }
-//     var handle windows.Handle
-//     if is_dir{
-//         handle, err = windows.CreateFile(_fname,windows.GENERIC_READ,windows.FILE_SHARE_READ,nil,windows.OPEN_EXISTING, windows.FILE_FLAG_BACKUP_SEMANTICS, 0)
-//         if err != nil {
-//             return 0,0, err
-//         }
-//     }else{
-//         handle, err = windows.CreateFile(_fname,windows.GENERIC_READ,windows.FILE_SHARE_READ,nil,windows.OPEN_EXISTING, 0 , 0)
-//         if err != nil {
-//             return 0,0, err
-//         }
-//     }
-
-//     defer windows.CloseHandle(handle)
-//     var data windows.ByHandleFileInformation
-//     if err = windows.GetFileInformationByHandle(handle, &data); err != nil {
-//         return 0, 0, err
-//     }
-//     return int32(data.VolumeSerialNumber), (uint64(data.FileIndexHigh) << 32) | uint64(data.FileIndexLow), nil
-// }
-// }
-
-// func folder_entries(path string) []*Fnode{
-//     var values  []*Fnode
-//     // pnt_fileinfo, _ := os.Stat(path)
-//     // pnt_stat, ok := pnt_fileinfo.Sys().(*syscall.Stat_t)
-
-//     device_id,pnt_fileid,err := win_dev_ino(path,true)
-//     if err !=nil{
-//         return values
-//     }
-//     if err!=nil {
-//         return values //empty
-//     }
-//     fileInfos,err := ioutil.ReadDir(path)
-//     if err !=nil{return values}
-//     for _,info :=range fileInfos{
-//         // stat, ok := info.Sys().(*syscall.Stat_t)
-//         _,file_id,err := win_dev_ino(path+info.Name(),info.IsDir())
-//         if err ==nil{
-//             if ! strings.HasPrefix(info.Name(),"."){
-//                 // values=append(values,&Fnode{info.Name(),info.IsDir(),stat.Dev,stat.Ino,pnt_stat.Dev,pnt_stat.Ino})
-//                 values=append(values,&Fnode{info.Name(),info.IsDir(),device_id,file_id,device_id,pnt_fileid})
-//             }
-//         }        
-//     }
-//     return values
-// }
-
-
-// func get_Fnode(path string,is_root bool) (*Fnode,error){
-//     var result Fnode
-//     delim :=sys_delim()
-//     if delim=="\\"{
-//         path = strings.ReplaceAll(path, "/","\\")
-//     }
-//     info, err := os.Stat(path)
-//     if err!=nil{
-//         return &result,err
-//     }
-   
-//     if err!=nil{
-//         return &result,err
-//     }
-//     result.IsDir=info.IsDir()
-//     result.Dev,result.Ino,err = win_dev_ino(path,info.IsDir())
-//     if err!=nil{
-//         return &result,err
-//     }
-//     if is_root{
-//         ensure_folder(&path,delim)
-//         if strings.HasSuffix(path,delim){
-//             result.Name=path[0:(len(path)-1)]
-//         }else{
-//             result.Name=path
-//         }        
-//         result.Parent_dev=result.Dev
-//         result.Parent_ino=result.Ino
-//     }else{
-//         result.Name=info.Name()
-//         var tmp_path string
-//         if strings.HasSuffix(path,delim){
-//             tmp_path =path_dir_name(path[0:(len(path)-1)],delim)
-//         }else{
-//             tmp_path =path_dir_name(path[0:(len(path))],delim)
-//         }
-         
-//         result.Parent_dev,result.Parent_ino, err = win_dev_ino(tmp_path,true)
-//         if err!=nil{
-//             return &result,err
-//         }
-//     }
-//     return &result,nil
-// }
-
-//---------------------- end of windows specific code-----------------------------------
-//++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// File_identity tells the device and the file number of a path, which find the
+// file again after it is renamed or moved. Each system has its own, see
+// Filegai_identity_*.go: the stat of the file on mac and linux, the file
+// information of its handle on windows. The numbers are kept as uint64 within
+// the range of the INTEGER of sqlite.
+type File_identity interface{
+    // identify gives the device and the file number of path, info is its os.Stat
+    identify(path string,info os.FileInfo)(uint64,uint64,error)
+}
 
-//  mac specific codes
+// get_Fnode gives the node of path with its parent, the root is its own parent
 func get_Fnode(path string,is_root bool) (*Fnode,error){
     var result Fnode
     delim :=sys_delim()
@@ -486,14 +567,13 @@ func get_Fnode(path string,is_root bool) (*Fnode,error){
     if err!=nil{
         return &result,err
     }
-    stat, ok := info.Sys().(*syscall.Stat_t)
-    if !ok {
-        return &result,errors.New("error in geting stat") //empty
-    }
-    
     result.IsDir=info.IsDir()
-    result.Dev=stat.Dev
-    result.Ino=stat.Ino
+    result.Dev,result.Ino,err = file_identity.identify(path,info)
+    if err!=nil{
+        return &result,err
+    }
+    result.Size=info.Size()
+    result.Mtime=info.ModTime().Unix()
     if is_root{
         ensure_folder(&path,delim)
         if strings.HasSuffix(path,delim){
@@ -501,8 +581,8 @@ func get_Fnode(path string,is_root bool) (*Fnode,error){
         }else{
             result.Name=path
         }        
-        result.Parent_dev=stat.Dev
-        result.Parent_ino=stat.Ino
+        result.Parent_dev=result.Dev
+        result.Parent_ino=result.Ino
     }else{
         result.Name=info.Name()
         var tmp_path string
@@ -511,37 +591,45 @@ func get_Fnode(path string,is_root bool) (*Fnode,error){
         }else{
             tmp_path =path_dir_name(path[0:(len(path))],delim)
         }
-        info, _ := os.Stat(tmp_path)
-        stat, _ := info.Sys().(*syscall.Stat_t)
-        result.Parent_dev=stat.Dev
-        result.Parent_ino=stat.Ino
+        pnt_info, err := os.Stat(tmp_path)
+        if err!=nil{
+            return &result,err
+        }
+        result.Parent_dev,result.Parent_ino,err = file_identity.identify(tmp_path,pnt_info)
+        if err!=nil{
+            return &result,err
+        }
     }
     return &result,nil
 }
 
+// folder_entries gives the nodes in the folder, the hidden ones left out
 func folder_entries(path string) []*Fnode{
     var values  []*Fnode
-    pnt_fileinfo, _ := os.Stat(path)
-    pnt_stat, ok := pnt_fileinfo.Sys().(*syscall.Stat_t)
-    if !ok {
+    pnt_info, err := os.Stat(path)
+    if err !=nil{
         return values //empty
     }
+    pnt_dev,pnt_ino,err := file_identity.identify(path,pnt_info)
+    if err !=nil{
+        return values
+    }
     fileInfos,err := ioutil.ReadDir(path)
     if err !=nil{return values}
     for _,info :=range fileInfos{
-        stat, ok := info.Sys().(*syscall.Stat_t)
-        if ok{
-            if ! strings.HasPrefix(info.Name(),"."){
-                values=append(values,&Fnode{info.Name(),info.IsDir(),stat.Dev,stat.Ino,pnt_stat.Dev,pnt_stat.Ino})
-            }
+        if strings.HasPrefix(info.Name(),"."){
+            continue
+        }
+        dev,ino,err := file_identity.identify(filepath.Join(path,info.Name()),info)
+        if err ==nil{
+            values=append(values,&Fnode{info.Name(),info.IsDir(),dev,ino,pnt_dev,pnt_ino,info.Size(),info.ModTime().Unix()})
         }        
     }
     return values
 }
-// end of mac specific codes++++++++++++++++++++++++++++++++++++++++++++++++++
 
 func (fnode *Fnode) dev_ino() string{
-    return strconv.FormatUint(uint64(fnode.Dev),10)+"_"+strconv.FormatUint(fnode.Ino,10)
+    return strconv.FormatUint(fnode.Dev,10)+"_"+strconv.FormatUint(fnode.Ino,10)
 }
 
 func (fnode *Fnode) parent_dev_ino()string{
@@ -549,7 +637,7 @@ func (fnode *Fnode) parent_dev_ino()string{
 }
 
 func (fnode *Fnode) device_id() string{
-    return strconv.FormatUint(uint64(fnode.Dev),10)
+    return strconv.FormatUint(fnode.Dev,10)
 }
 
 func (fnode *Fnode) ino() string{
@@ -564,7 +652,7 @@ func (fnode *Fnode) parent_ino() string{
 //====================================================================================================
 // for ino_tree
 
-func register_ino(db_link *sql.DB,node *Fnode)(bool,error){
+func register_ino(db_link Db_link,node *Fnode)(bool,error){
 // do query first
     table:=get_table("ino_tree")    
     tp := "f"
@@ -588,7 +676,6 @@ func register_ino(db_link *sql.DB,node *Fnode)(bool,error){
 
     if count ==1 {
         // update the nodes
-        table.set("name",node.Name).set("parent_ino",strconv.FormatUint(node.Parent_ino,10)).set("type",tp).set("state","a")
         _,err :=update_ino(db_link,node)
         if err !=nil{
             return false,err
@@ -597,6 +684,7 @@ func register_ino(db_link *sql.DB,node *Fnode)(bool,error){
 
     if count==0 || count>1{
         table.set("name",node.Name).set("parent_ino",strconv.FormatUint(node.Parent_ino,10)).set("type",tp).set("state","a")
+        table.set("size",strconv.FormatInt(node.Size,10)).set("mtime",strconv.FormatInt(node.Mtime,10))
         _,err = do_insert(db_link,table.pack_insert())
         if err !=nil{
             return false,err
@@ -606,14 +694,15 @@ func register_ino(db_link *sql.DB,node *Fnode)(bool,error){
 }
 
 
-func update_ino(db_link *sql.DB,node *Fnode)(bool,error){
+func update_ino(db_link Db_link,node *Fnode)(bool,error){
     table:=get_table("ino_tree")    
     tp := "f"
     if node.IsDir {
         tp="d"
     }
-    table.set("device_id",strconv.FormatUint(uint64(node.Dev),10)).set("ino",strconv.FormatUint(node.Ino,10))
+    table.set("device_id",strconv.FormatUint(node.Dev,10)).set("ino",strconv.FormatUint(node.Ino,10))
     table.set("name",node.Name).set("parent_ino",strconv.FormatUint(node.Parent_ino,10)).set("type",tp).set("state","a")
+    table.set("size",strconv.FormatInt(node.Size,10)).set("mtime",strconv.FormatInt(node.Mtime,10))
 
     check := []string{"device_id","ino"}
     _,err:=do_update(db_link,table.pack_update(check))
@@ -623,10 +712,10 @@ func update_ino(db_link *sql.DB,node *Fnode)(bool,error){
     return true,nil
 }
 
-func delete_ino(db_link *sql.DB,node *Fnode)(bool,error){
+func delete_ino(db_link Db_link,node *Fnode)(bool,error){
     table:=get_table("ino_tree")    
     host_name :=get_host_name()
-    table.set("device_id",strconv.FormatUint(uint64(node.Dev),10)).set("ino",strconv.FormatUint(node.Ino,10)).set("host_name",host_name)
+    table.set("device_id",strconv.FormatUint(node.Dev,10)).set("ino",strconv.FormatUint(node.Ino,10)).set("host_name",host_name)
     _,err:=do_delete(db_link,table.pack_delete())
     if err !=nil{
         return false,err
@@ -634,14 +723,14 @@ func delete_ino(db_link *sql.DB,node *Fnode)(bool,error){
     return true,nil
 }
 
-func clear_ino(db_link *sql.DB,root_dir string)(bool,error){
+func clear_ino(db_link Db_link,root_dir string)(bool,error){
     host_name :=get_host_name()
     fnode,err :=get_Fnode(root_dir,true)
     if err !=nil{
         return false,err
     }
     table:=get_table("ino_tree")
-    table.set("device_id",strconv.FormatUint(uint64(fnode.Dev),10)).set("host_name",host_name)
+    table.set("device_id",strconv.FormatUint(fnode.Dev,10)).set("host_name",host_name)
     _,err =do_delete(db_link,table.pack_delete())
     if err !=nil{
         return false,err
@@ -649,13 +738,13 @@ func clear_ino(db_link *sql.DB,root_dir string)(bool,error){
     return true,nil
 }
 
-func query_fnode(db_link *sql.DB,device_id uint64, ino uint64) (*Fnode,error){
+func query_fnode(db_link Db_link,device_id uint64, ino uint64) (*Fnode,error){
     table:=get_table("ino_tree")
     host_name:=get_host_name()
     table.set("device_id",strconv.FormatUint(device_id,10)).set("ino",strconv.FormatUint(ino,10)).set("host_name",host_name)
     var node Fnode
     tp :="f"
-    rows, err := db_link.Query(table.pack_select("device_id,ino,parent_ino,name,type","name asc","1"))
+    rows, err := do_query(db_link,table.pack_select("device_id,ino,parent_ino,name,type","name asc","1"))
     defer rows.Close()
     if err !=nil{
         return &node,err
@@ -678,19 +767,19 @@ func query_fnode(db_link *sql.DB,device_id uint64, ino uint64) (*Fnode,error){
     return &node,nil
 }
 
-func search_fnodes(db_link *sql.DB,host_name string,name string)([]Fnode,error){
+func search_fnodes(db_link Db_link,host_name string,name string)([]Fnode,error){
     var node Fnode
     var result []Fnode
     table := get_table("ino_tree")
-    table.set("host_name",host_name).set("name","%"+name+"%")
-    rows, err := db_link.Query(table.pack_select("device_id,ino,parent_ino,name,type","name asc",""))
+    table.set("host_name",host_name).where("name","like","%"+like_escape(name)+"%")
+    rows, err := do_query(db_link,table.pack_select("device_id,ino,parent_ino,name,type,size,mtime","name asc",""))
     defer rows.Close()
     if err !=nil{
         return result,err
     }
     tp :="f"
     for rows.Next(){        
-        err = rows.Scan(&node.Dev,&node.Ino,&node.Parent_ino,&node.Name,&tp)
+        err = rows.Scan(&node.Dev,&node.Ino,&node.Parent_ino,&node.Name,&tp,&node.Size,&node.Mtime)
         if err ==nil{
             node.IsDir=false
             if tp=="d"{
@@ -702,7 +791,7 @@ func search_fnodes(db_link *sql.DB,host_name string,name string)([]Fnode,error){
     return result,err  
 }
 
-func file_url(db_link *sql.DB,device_id uint64, ino uint64,max_level int,delim string) (string,error){
+func file_url(db_link Db_link,device_id uint64, ino uint64,max_level int,delim string) (string,error){
     node, err := query_fnode(db_link,device_id,ino)
     if max_level<0{
         // guard against infinite loop error
@@ -729,7 +818,7 @@ func file_url(db_link *sql.DB,device_id uint64, ino uint64,max_level int,delim s
 
 
 // set calculation
-func inos_in_parent(db_link *sql.DB,device_id uint64,parent_id uint64)([]int64){
+func inos_in_parent(db_link Db_link,device_id uint64,parent_id uint64)([]int64){
     table:=get_table("ino_tree")
     host_name:=get_host_name()
     table.set("parent_ino",strconv.FormatUint(parent_id,10)).set("device_id",strconv.FormatUint(device_id,10))
@@ -784,7 +873,15 @@ func inos_to_delete(nodes_fs []*Fnode,inos_db []int64)(map[uint64]bool){
     return result
 }
 
-func refresh_folder(db_link *sql.DB,folder string,is_root bool){    
+func refresh_folder(db_link Db_link,folder string,is_root bool){    
+    if fs_watch !=nil{
+        // a listing coming before the watcher must not lose a move, the removals are left to it
+        fs_watch.lock.Lock()
+        fs_watch.sync_folder(db_link,folder,false)
+        fs_watch.lock.Unlock()
+        fs_watch.touch(folder)
+        return
+    }
     this_fnode,err := get_Fnode(folder,is_root)
     if err !=nil{
         return
@@ -797,7 +894,7 @@ func refresh_folder(db_link *sql.DB,folder string,is_root bool){
     if is_root{
         folder_entries=append(folder_entries,this_fnode)
     }
-    inos_db := inos_in_parent(db_link,uint64(this_fnode.Dev),this_fnode.Ino)
+    inos_db := inos_in_parent(db_link,this_fnode.Dev,this_fnode.Ino)
     delete_set := inos_to_delete(folder_entries,inos_db)
 
     var temp_fnode Fnode
@@ -947,7 +1044,7 @@ func folder_split(folder string,root_dir string,delim string) []string{
     return r
 }
 
-func register_chain_ino(db_link *sql.DB,folder string,root_dir string,delim string){
+func register_chain_ino(db_link Db_link,folder string,root_dir string,delim string){
     lst :=folder_split(folder,root_dir,delim)
     is_root :=false
     for _,item :=range(lst){
@@ -1065,6 +1162,190 @@ func relative_path_of(url string,root_dir string)string{
     }
     return url
 }
+
+//====================================================================================================
+// for the roots, the served folders given as [name=]folder on the command line.
+// The paths kept in the database (notes, pins, fingerprints, labels and links of files)
+// are relative to their root and start with its key, the name and ":/" as in
+// lit:/papers/a.pdf. The default root, the folder given without a name, has the key ""
+// so the paths of the databases of a single folder stay as they were.
+
+type Root struct{
+    Name string
+    Dir string // native, ends with the deliminator
+    Key string
+    Served bool // false for the roots of the database not given this time
+    Kept string // the folder kept in the database when it is not Dir
+}
+
+type Roots []*Root
+
+const default_root_name = "default"
+
+var root_name_reg = regexp.MustCompile(`^[A-Za-z0-9_-]{1,20}$`)
+
+func root_key(name string)string{
+    if name==default_root_name{
+        return ""
+    }
+    return name+":/"
+}
+
+// parse_roots reads the folders of the command line, at most one goes without a name
+func parse_roots(args []string)(Roots,error){
+    var roots Roots
+    delim := sys_delim()
+    for _,arg :=range(args){
+        name := default_root_name
+        dir := arg
+        if idx:=strings.Index(arg,"=");idx>0 && root_name_reg.MatchString(arg[:idx]){
+            if ok,_ := file_exists(arg);!ok{
+                name = arg[:idx]
+                dir = arg[idx+1:]
+            }
+        }
+        dir = get_abs_path(dir)
+        ensure_folder(&dir,delim)
+        if ok,_ :=file_exists(dir);!ok{
+            return nil,errors.New("Serving folder ["+dir+"] does not exists")
+        }
+        for _,root :=range(roots){
+            if root.Name==name{
+                if name==default_root_name{
+                    return nil,errors.New("only one folder can go without a name, the others are name=folder")
+                }
+                return nil,errors.New("the name ["+name+"] is given twice")
+            }
+            if strings.HasPrefix(dir,root.Dir) || strings.HasPrefix(root.Dir,dir){
+                return nil,errors.New("the folders ["+root.Dir+"] and ["+dir+"] are in each other")
+            }
+        }
+        roots = append(roots,&Root{Name:name,Dir:dir,Key:root_key(name),Served:true})
+    }
+    if len(roots)==0{
+        return nil,errors.New("no folder to serve")
+    }
+    return roots,nil
+}
+
+// served gives the roots given this time, the default root first
+func (roots Roots) served()Roots{
+    var r Roots
+    for _,root :=range(roots){
+        if root.Served{
+            if root.Key==""{
+                r = append(Roots{root},r...)
+            }else{
+                r = append(r,root)
+            }
+        }
+    }
+    return r
+}
+
+// main gives the root shown first
+func (roots Roots) main()*Root{
+    r := roots.served()
+    if len(r)==0{
+        return nil
+    }
+    return r[0]
+}
+
+func (roots Roots) by_name(name string)*Root{
+    for _,root :=range(roots){
+        if root.Name==name && root.Served{
+            return root
+        }
+    }
+    return nil
+}
+
+// of gives the served root holding the native path, nil when it is out of them
+func (roots Roots) of(url string)*Root{
+    for _,root :=range(roots){
+        if root.Served && (strings.HasPrefix(url,root.Dir) || url+sys_delim()==root.Dir){
+            return root
+        }
+    }
+    return nil
+}
+
+// is_root tells whether the native path is one of the served folders
+func (roots Roots) is_root(url string)bool{
+    for _,root :=range(roots){
+        if root.Served && (url==root.Dir || url+sys_delim()==root.Dir){
+            return true
+        }
+    }
+    return false
+}
+
+// rel gives the path of the database for a native path, the key of its root and the
+// path in it, in the native form as relative_path_of. A path out of the roots is
+// given back as it is.
+func (roots Roots) rel(url string)string{
+    root := roots.of(url)
+    if root==nil{
+        return url
+    }
+    if url+sys_delim()==root.Dir{
+        return str_native_delim(root.Key)
+    }
+    return str_native_delim(root.Key)+relative_path_of(url,root.Dir)
+}
+
+// split gives the root of a path of the database and the path in it,
+// nil when its root is not served
+func (roots Roots) split(rel string)(*Root,string){
+    rel = str_db_delim(rel)
+    var main *Root
+    for _,root :=range(roots){
+        if root.Key==""{
+            main = root
+        }else if strings.HasPrefix(rel,root.Key){
+            if !root.Served{
+                return nil,rel
+            }
+            return root,rel[len(root.Key):]
+        }
+    }
+    if main==nil || !main.Served{
+        return nil,rel
+    }
+    return main,rel
+}
+
+// abs gives the native path of a path of the database, "" when its root is not served
+func (roots Roots) abs(rel string)string{
+    root,path := roots.split(rel)
+    if root==nil{
+        return ""
+    }
+    return root.Dir+str_native_delim(path)
+}
+
+var typed_key_reg = regexp.MustCompile(`^([A-Za-z0-9_-]{1,20}):/*`)
+
+// folder_key gives the path of the database of a folder typed in without the
+// trailing "/": papers/2020, or lit:papers of the root lit, or lit: for its top
+func folder_key(folder string)string{
+    if folder==""{
+        return folder
+    }
+    folder = typed_key_reg.ReplaceAllString(folder,"$1:/")
+    if strings.HasSuffix(folder,"/"){
+        return folder
+    }
+    return folder+"/"
+}
+
+// in_served tells whether the path of the database is in a served root
+func (roots Roots) in_served(rel string)bool{
+    root,_ := roots.split(rel)
+    return root !=nil
+}
+
 func path_file_name(url string,delim string)string{
     if(strings.Contains(url,delim)){
         if strings.LastIndex(url,delim) ==len(url)-1{
@@ -1316,78 +1597,311 @@ func get_host_name()string{
     return host_name
 }
 
+// WAL lets the readers go on while a request is writing, and the busy timeout
+// makes a writer wait for the lock instead of failing with "database is locked".
+// Transactions take the write lock when they begin, so two of them can not
+// deadlock on upgrading a read lock.
+const db_dsn_options = "?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate"
+
+// the reading handle begins its transactions deferred: in WAL mode a reader
+// keeps its snapshot without holding up the writers, for as long as it reads
+const db_dsn_read_options = "?_busy_timeout=5000&_txlock=deferred&_query_only=1"
+
 func get_db(db_file string) (*sql.DB,error){
     // fmt.Println("Opening a database link")
-    db, err := sql.Open("sqlite3",db_file)
+    db, err := sql.Open("sqlite3",db_file+db_dsn_options)
     if err !=nil{
         fmt.Println("?? error when openning db file: "+db_file)
         return db,err
     }
+    err = db.Ping()
+    if err !=nil{
+        fmt.Println("?? error when openning db file: "+db_file)
+        db.Close()
+        return nil,err
+    }
     return db,nil
 }
 
-//====================================================================================================
-// for blob
-func random_str(n int) string{
-    var buf bytes.Buffer
-    b := make([]byte, n)
-    rand.Read(b)
-    str :="abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPSTUVWXYZ1234567890"
-    for _,i:=range(b){
-        buf.WriteByte(str[int(i)%(len(str))])
-    }
-    return buf.String()
+// Store holds the database handles of a database folder. It is opened once in
+// main and shared by all the requests: a *sql.DB is a connection pool and safe
+// for concurrent use, so nobody opens or closes a handle per request.
+type Store struct{
+    folder string
+    roots Roots // the roots of this host, nil when not serving
+    db *sql.DB
+    rdb *sql.DB // read only, for the long reads
+    blob_lock sync.Mutex
+    blobs map[string]*sql.DB // blob page -> handle, opened on first use
+    retired map[string]bool // the blob pages dropped by compact, not to be made again
 }
 
-func tag_exist(db_link *sql.DB,tag string)(bool,error){
-    table := get_table("tags")
-    table.set("tag_str",tag)
-    cnt,err:=do_count(db_link,table.pack_count("cnt"))
+func open_store(db_folder string)(*Store,error){
+    db,err := get_db(db_folder+"Filegai.db")
     if err !=nil{
-        return false,err
+        return nil,err
     }
-    if cnt==0{
-        return false,nil
+    rdb,err := sql.Open("sqlite3",db_folder+"Filegai.db"+db_dsn_read_options)
+    if err !=nil{
+        db.Close()
+        return nil,err
     }
-    return true,nil
+    st := &Store{folder:db_folder,db:db,rdb:rdb,blobs:map[string]*sql.DB{},retired:map[string]bool{}}
+    return st,nil
 }
 
-func tag_gen(db_link *sql.DB)(string,error){
-    var tag string
-    for{
-        tag =random_str(10)
-        ok,_:=tag_exist(db_link,tag)
-        if ok{
-            continue
+func (st *Store) blob_file(page string)string{
+    return st.folder+"blob"+page+".db"
+}
+
+// blob returns the handle of a blob page, the page file is created when it
+// does not exist yet.
+func (st *Store) blob(page string)(*sql.DB,error){
+    st.blob_lock.Lock()
+    defer st.blob_lock.Unlock()
+    if st.retired[page]{
+        // a reader of the resource rows before the compaction, an empty page is not made for it
+        return nil,errors.New("blob page "+page+" was dropped by compact")
+    }
+    if db,ok := st.blobs[page];ok{
+        return db,nil
+    }
+    blob_file := st.blob_file(page)
+    if ok,_:=file_exists(blob_file);!ok{
+        _,err := blob_create_file(blob_file)
+        if err !=nil{
+            return nil,err
         }
-        break
     }
-    
-    table := get_table("tags")
-    table.set("tag_str",tag)
-    _,err := do_insert(db_link,table.pack_insert())
+    db,err := get_db(blob_file)
     if err !=nil{
-        return tag,err
+        return nil,err
     }
-    return tag,nil
+    st.blobs[page] = db
+    return db,nil
 }
 
-func tag_clear(db_link *sql.DB,tag string)(bool,error){
-    table := get_table("tags")
-    table.set("tag_str",tag)
-    _,err :=do_delete(db_link,table.pack_delete())
-    if err !=nil{
-        return false,err
+// drop_blob closes the handle of a blob page and removes its files. The page is
+// retired first: blob() does not open it again nor make a new empty one, the
+// new blobs go on the highest page which compact keeps
+func (st *Store) drop_blob(page string)error{
+    st.blob_lock.Lock()
+    defer st.blob_lock.Unlock()
+    st.retired[page] = true
+    if db,ok := st.blobs[page];ok{
+        db.Close()
+        delete(st.blobs,page)
     }
-    return true,nil
+    blob_file := st.blob_file(page)
+    for _,suffix :=range([]string{"-wal","-shm"}){
+        err := os.Remove(blob_file+suffix)
+        if err !=nil && !os.IsNotExist(err){
+            return err
+        }
+    }
+    return os.Remove(blob_file)
 }
 
-func get_blob_file_page(path string,size_limit int64)(string,error){
-    fileInfos,err := ioutil.ReadDir(path)
-    if err !=nil{
-        return "", err
+func (st *Store) close(){
+    st.blob_lock.Lock()
+    defer st.blob_lock.Unlock()
+    for page,db := range(st.blobs){
+        db.Close()
+        delete(st.blobs,page)
     }
-    reg := regexp.MustCompile(`blob(\d+)\.db`)
+    st.rdb.Close()
+    st.db.Close()
+}
+
+// Unit is a unit of work over the main database and the blob pages. The main
+// database part runs in one transaction. The blob pages are other files and can
+// not join it, so their writes are done at once and undone when the unit rolls
+// back, while blob deletes are held back until the transaction has committed.
+type Unit struct{
+    st *Store
+    tx *sql.Tx
+    undo []func() error // blob writes to revert, in reverse order
+    after []func() error // blob deletes to run after the commit
+}
+
+func (st *Store) begin()(*Unit,error){
+    tx,err := st.db.Begin()
+    if err !=nil{
+        fmt.Println("?? error starting transaction:"+err.Error())
+        return nil,err
+    }
+    return &Unit{st:st,tx:tx},nil
+}
+
+// view begins a unit that only reads: it sees the database as it was at its
+// first query and does not take the write lock, so the saves go on meanwhile.
+// It is ended with rollback.
+func (st *Store) view()(*Unit,error){
+    tx,err := st.rdb.Begin()
+    if err !=nil{
+        fmt.Println("?? error starting transaction:"+err.Error())
+        return nil,err
+    }
+    return &Unit{st:st,tx:tx},nil
+}
+
+func (u *Unit) blob_save(page string,tag string,data []byte,rs_type int)error{
+    blob_db,err := u.st.blob(page)
+    if err !=nil{
+        return err
+    }
+    _,err = blob_save(blob_db,tag,data,rs_type)
+    if err !=nil{
+        return err
+    }
+    u.undo = append(u.undo,func() error{
+        _,err := blob_delete(blob_db,tag)
+        return err
+    })
+    return nil
+}
+
+func (u *Unit) blob_update(page string,tag string,data []byte,rs_type int)error{
+    blob_db,err := u.st.blob(page)
+    if err !=nil{
+        return err
+    }
+    old_type,old_data,err := blob_read(blob_db,tag)
+    if err !=nil{
+        return err
+    }
+    _,err = blob_update(blob_db,tag,data,rs_type)
+    if err !=nil{
+        return err
+    }
+    u.undo = append(u.undo,func() error{
+        _,err := blob_update(blob_db,tag,old_data,old_type)
+        return err
+    })
+    return nil
+}
+
+func (u *Unit) blob_delete(page string,tag string){
+    u.after = append(u.after,func() error{
+        blob_db,err := u.st.blob(page)
+        if err !=nil{
+            return err
+        }
+        _,err = blob_delete(blob_db,tag)
+        return err
+    })
+}
+
+func (u *Unit) undo_blobs(){
+    for i:=len(u.undo)-1;i>=0;i--{
+        err := u.undo[i]()
+        if err !=nil{
+            fmt.Println("?? error reverting a blob write:"+err.Error())
+        }
+    }
+    u.undo = nil
+    u.after = nil
+}
+
+func (u *Unit) rollback(){
+    err := u.tx.Rollback()
+    if err !=nil{
+        fmt.Println("?? error rolling back:"+err.Error())
+    }
+    u.undo_blobs()
+}
+
+func (u *Unit) commit()error{
+    err := u.tx.Commit()
+    if err !=nil{
+        fmt.Println("?? error committing:"+err.Error())
+        u.undo_blobs()
+        return err
+    }
+    // the records are gone, a blob left behind here is only wasted space
+    for _,fn :=range(u.after){
+        err = fn()
+        if err !=nil{
+            fmt.Println("?? error deleting a blob:"+err.Error())
+        }
+    }
+    u.undo = nil
+    u.after = nil
+    return nil
+}
+
+// finish ends the unit with the result of its work: it commits when err is nil
+// and rolls back otherwise.
+func (u *Unit) finish(err error)error{
+    if err !=nil{
+        u.rollback()
+        return err
+    }
+    return u.commit()
+}
+
+//====================================================================================================
+// for blob
+func random_str(n int) string{
+    var buf bytes.Buffer
+    b := make([]byte, n)
+    rand.Read(b)
+    str :="abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPSTUVWXYZ1234567890"
+    for _,i:=range(b){
+        buf.WriteByte(str[int(i)%(len(str))])
+    }
+    return buf.String()
+}
+
+func tag_exist(db_link Db_link,tag string)(bool,error){
+    table := get_table("tags")
+    table.set("tag_str",tag)
+    cnt,err:=do_count(db_link,table.pack_count("cnt"))
+    if err !=nil{
+        return false,err
+    }
+    if cnt==0{
+        return false,nil
+    }
+    return true,nil
+}
+
+func tag_gen(db_link Db_link)(string,error){
+    var tag string
+    for{
+        tag =random_str(10)
+        ok,_:=tag_exist(db_link,tag)
+        if ok{
+            continue
+        }
+        break
+    }
+    
+    table := get_table("tags")
+    table.set("tag_str",tag)
+    _,err := do_insert(db_link,table.pack_insert())
+    if err !=nil{
+        return tag,err
+    }
+    return tag,nil
+}
+
+func tag_clear(db_link Db_link,tag string)(bool,error){
+    table := get_table("tags")
+    table.set("tag_str",tag)
+    _,err :=do_delete(db_link,table.pack_delete())
+    if err !=nil{
+        return false,err
+    }
+    return true,nil
+}
+
+func get_blob_file_page(path string,size_limit int64)(string,error){
+    fileInfos,err := ioutil.ReadDir(path)
+    if err !=nil{
+        return "", err
+    }
+    reg := regexp.MustCompile(`blob(\d+)\.db`)
     max:=0
     var max_size int64 =0    
     for _,info:= range(fileInfos){
@@ -1406,6 +1920,10 @@ func get_blob_file_page(path string,size_limit int64)(string,error){
     if max == 0{
         return "1",nil
     }
+    // the new writes wait in the write-ahead log until a checkpoint
+    if info,err := os.Stat(path+"blob"+strconv.Itoa(max)+".db-wal");err ==nil{
+        max_size += info.Size()
+    }
     if max > 0 && max_size > size_limit{ // 1M
         return strconv.Itoa(max+1),nil
     }
@@ -1413,117 +1931,86 @@ func get_blob_file_page(path string,size_limit int64)(string,error){
 }
 
 func blob_create_file(file_name string)(bool,error){
-    db, err := sql.Open("sqlite3",file_name)
-    sql_str:="CREATE TABLE blob_obj(id integer primary key autoincrement,type TINYINT UNSIGNED,tag CHAR(10),data blob);"
-    sql_str +="CREATE INDEX blob_idx ON blob_obj(tag);"
-   
-    _, err = db.Exec(sql_str)
-    defer db.Close()
+    _,err := migrate_file(file_name,true,path_dir_name(file_name,sys_delim()),"",false)
     if err != nil {
-        fmt.Printf("?? error creating blob_obj table:\n%s\n",sql_str)
+        fmt.Printf("?? error creating blob_obj table:%s\n",err.Error())
         return false,err
     }
     return true,nil
 }
 
-func blob_save(db_file string,tag string,bin_data []byte,file_type int)(string,error){
-    db, err := sql.Open("sqlite3",db_file)
-    defer db.Close()
+func blob_save(db_link Db_link,tag string,bin_data []byte,file_type int)(string,error){
     sql_str:="Insert into blob_obj(tag,type,data)values(?,?,?)"
-    sql_run, err := db.Prepare(sql_str)
+    _, err :=db_link.Exec(sql_str,tag,file_type,bin_data)
     if err !=nil{
         fmt.Println("?? error in db operation:")
         fmt.Println(sql_str)
         return tag,err
-    }
-    _, err =sql_run.Exec(tag,file_type,bin_data)
-    if err !=nil{
-        return tag,err
     }    
     return tag,nil
 }
 
-func blob_update(db_file string,tag string,bin_data []byte,file_type int)(bool,error){
-    db, err := sql.Open("sqlite3",db_file)
-    defer db.Close()
+func blob_update(db_link Db_link,tag string,bin_data []byte,file_type int)(bool,error){
     sql_str:="Update blob_obj set data=?,type=? where tag=?"
-    sql_run, err := db.Prepare(sql_str)
+    _, err :=db_link.Exec(sql_str,bin_data,file_type,tag)
     if err !=nil{
         fmt.Println("?? error in db operation:")
         fmt.Println(sql_str)
         return false,err
     }
-    _, err =sql_run.Exec(bin_data,file_type,tag)
-    if err !=nil{
-        return false,err
-    }
     return true,nil
 }
 
 
-func blob_read(db_file string,tag string)(int,[]byte,error){
-    db,err :=sql.Open("sqlite3",db_file)
-    defer db.Close()
-    sql_str :="select type,data from blob_obj where tag=\""+tag+"\""
-    rows,err :=db.Query(sql_str)
-    defer rows.Close()
+func blob_read(db_link Db_link,tag string)(int,[]byte,error){
+    sql_str :="select type,data from blob_obj where tag=?"
+    var rs_type int
+    var data []byte
+    err :=db_link.QueryRow(sql_str,tag).Scan(&rs_type,&data)
     if err !=nil{
         return 0,[]byte{},err
     }
-    rows.Next()
-    var rs_type int
-    var data []byte
-    err = rows.Scan(&rs_type,&data)
     return rs_type,data,nil
 }
 
-func blob_save_file(db_file string,tag string,bin_file string,file_type int)(string,error){
+func blob_save_file(db_link Db_link,tag string,bin_file string,file_type int)(string,error){
     bin_handler, err := os.Open(bin_file)
-    defer  bin_handler.Close()
     if err!=nil{
         return tag,err
     }
+    defer  bin_handler.Close()
     bin_data,err:=ioutil.ReadAll(bin_handler)
     if err !=nil{
         return tag,err
     }
-    _,err=blob_save(db_file,tag,bin_data,file_type)
+    _,err=blob_save(db_link,tag,bin_data,file_type)
     if err !=nil{
         return tag,err
     }
     return tag,nil
 }
 
-func blob_delete(db_file string,tag string)(bool,error){
-    db,err :=sql.Open("sqlite3",db_file)
-    defer db.Close()
-    sql_del := "delete from blob_obj where tag=\""+tag+"\""
-    sql_run, err := db.Prepare(sql_del)
+func blob_delete(db_link Db_link,tag string)(bool,error){
+    sql_del := "delete from blob_obj where tag=?"
+    _, err :=db_link.Exec(sql_del,tag)
     if err !=nil{
         fmt.Println("?? error in db operation:")
         fmt.Println(sql_del)
         return false,err
     }
-    _, err =sql_run.Exec()
-    if err !=nil{
-        return false,err
-    }
     return true,nil
 }
 
-func blob_search(db_file string,target string)([]string,error){
-    db,err :=sql.Open("sqlite3",db_file)
+func blob_search(db_link Db_link,target string)([]string,error){
     var result []string
-    defer db.Close()
-    target=strings.ReplaceAll(target,"\"","\"\"")
-    sql_search := "select tag from blob_obj where type>30 and data like \"%"+target+"%\""
-    rs,err := db.Query(sql_search)
-    defer rs.Close()
+    sql_search := "select tag from blob_obj where type>30 and data like ? escape '\\'"
+    rs,err := db_link.Query(sql_search,"%"+like_escape(target)+"%")
     if err !=nil{
         fmt.Printf("?? error doing blob_obj search:%s\n",err.Error())
         fmt.Println(sql_search)
         return result,err
     }
+    defer rs.Close()
 	var tag string
     for rs.Next(){
 		rs.Scan(&tag)
@@ -1535,66 +2022,86 @@ func blob_search(db_file string,target string)([]string,error){
 // ====================================================================================================
 // for resource
 
-func resource_deposite(db_link *sql.DB,name string,rs_type int,data []byte,db_folder string)(string,error){
-    tab_resource:=get_table("resource")
-    page,err:=get_blob_file_page(db_folder,50000000) // use constant later on
+func resource_deposite(u *Unit,name string,rs_type int,data []byte)(string,error){
+    // the same bytes again get the tag they already have,
+    // the references are counted by resource_link as before
+    if rs_type !=33{
+        tag,err := resource_by_hash(u.tx,resource_hash(data))
+        if err !=nil{
+            return "",err
+        }
+        if tag !=""{
+            return tag,nil
+        }
+    }
+    page,err:=get_blob_file_page(u.st.folder,get_blob_page_limit(u.tx))
     if err !=nil{
         fmt.Println("?? get page failed")
         return "",err
     }
-    blob_file := db_folder + "blob"+page+".db"
-
-    if ok,_:=file_exists(blob_file);!ok{
-        _,err := blob_create_file(blob_file)
-        if err !=nil{
-            return "",err
-        }
-     }
 
-    tag,err :=tag_gen(db_link)
+    tag,err :=tag_gen(u.tx)
     if err !=nil{
         fmt.Println("?? tag generation failed")
         return "",err
     }
+    err=resource_deposite_tag(u,tag,page,name,rs_type,data)
+    if err !=nil{
+        return "",err
+    }
+    return tag,nil
+}
 
-    _,err=blob_save(blob_file,tag,data,rs_type)
+// resource_deposite_tag stores the data under a tag already taken in the tags table
+func resource_deposite_tag(u *Unit,tag string,page string,name string,rs_type int,data []byte)error{
+    tab_resource:=get_table("resource")
+    // the tag goes away with the rollback of the unit
+    err:=u.blob_save(page,tag,data,rs_type)
     if err !=nil{
-        // delete the tag first [missing here]
-        // then return
         fmt.Println("?? Blob save failed")
-        return "",err
+        return err
     }
 
     tab_resource.set("tag",tag).set("page",page).set("name",name).set("type",strconv.Itoa(rs_type))
     tab_resource.set("ref_count","0").set("rs_date",get_now_string())
+    // texts are edited in place, they are never shared
+    if rs_type !=33{
+        tab_resource.set("hash",resource_hash(data))
+    }
 
-    _,err=do_insert(db_link,tab_resource.pack_insert())
+    _,err=do_insert(u.tx,tab_resource.pack_insert())
     if err !=nil{
         fmt.Println("?? Resource table save failed")
-        return "",err
+        return err
     }
-    return tag,nil
+    return nil
 }
 
-func resource_deposite_file(db_link *sql.DB,name string,rs_type int,file_name string,db_folder string)(string,error){
-    handler, err := os.Open(file_name)
-    defer  handler.Close()
-    if err!=nil{
-        fmt.Println("?? open file failed")
-        return "",err
-    }
-    data,err:=ioutil.ReadAll(handler)
+// resource_hash is the hex SHA-256 of the bytes of a resource
+func resource_hash(data []byte)string{
+    sum := sha256.Sum256(data)
+    return hex.EncodeToString(sum[:])
+}
+
+// resource_by_hash returns the tag of the resource holding the bytes, "" if none
+func resource_by_hash(db_link Db_link,hash string)(string,error){
+    tab := get_table("resource")
+    tab.set("hash",hash)
+    rows,err := do_query(db_link,tab.pack_select("tag","rsid asc","1"))
     if err !=nil{
-        fmt.Println("?? read file failed")
         return "",err
     }
-    tag,err :=resource_deposite(db_link,name,rs_type,data,db_folder)
+    defer rows.Close()
+    var tag string
+    if rows.Next(){
+        err = rows.Scan(&tag)
+    }
     return tag,err
 }
 
-func resource_ref_count_inc(db_link *sql.DB,tag string)(bool,error){
+func resource_ref_count_inc(db_link Db_link,tag string)(bool,error){
     tab_resource:=get_table("resource")
-    tab_resource.set("ref_count","ref_count+1").set("tag",tag)
+    tab_resource.set_expr("ref_count","ref_count+1").set("tag",tag)
     check:=[]string{"tag"}
     _,err := do_update(db_link,tab_resource.pack_update(check))
     if err !=nil{
@@ -1604,9 +2111,9 @@ func resource_ref_count_inc(db_link *sql.DB,tag string)(bool,error){
     return true,nil
 }
 
-func resource_ref_count_dec(db_link *sql.DB,tag string)(bool,error){
+func resource_ref_count_dec(db_link Db_link,tag string)(bool,error){
     tab_resource:=get_table("resource")
-    tab_resource.set("ref_count","ref_count-1").set("tag",tag)
+    tab_resource.set_expr("ref_count","ref_count-1").set("tag",tag)
     check:=[]string{"tag"}
     _,err := do_update(db_link,tab_resource.pack_update(check))
     if err !=nil{
@@ -1616,7 +2123,7 @@ func resource_ref_count_dec(db_link *sql.DB,tag string)(bool,error){
     return true,nil
 }
 
-func resource_update_name(db_link *sql.DB,tag string,name string)(bool,error){
+func resource_update_name(db_link Db_link,tag string,name string)(bool,error){
     tab_resource:=get_table("resource")
     tab_resource.set("name",name).set("tag",tag)
     check:=[]string{"tag"}
@@ -1628,7 +2135,7 @@ func resource_update_name(db_link *sql.DB,tag string,name string)(bool,error){
     return true,nil
 }
 
-func resource_update_type(db_link *sql.DB,tag string,rs_type int)(bool,error){
+func resource_update_type(db_link Db_link,tag string,rs_type int)(bool,error){
     tab_resource:=get_table("resource")
     tab_resource.set("type",strconv.Itoa(rs_type)).set("tag",tag)
     check:=[]string{"tag"}
@@ -1640,7 +2147,7 @@ func resource_update_type(db_link *sql.DB,tag string,rs_type int)(bool,error){
     return true,nil
 }
 
-func get_resource_record(db_link *sql.DB,tag string)(Resource_record,error) {
+func get_resource_record(db_link Db_link,tag string)(Resource_record,error) {
     tab_resource:=get_table("resource")
     tab_resource.set("tag",tag)
     var record Resource_record
@@ -1652,7 +2159,7 @@ func get_resource_record(db_link *sql.DB,tag string)(Resource_record,error) {
     if cnt <1{
         return record,errors.New("no record")
     }
-    rows,err:=db_link.Query(tab_resource.pack_select("name,page,type,rs_date,ref_count","",""))
+    rows,err:=do_query(db_link,tab_resource.pack_select("name,page,type,rs_date,ref_count","",""))
     defer rows.Close()
     if err !=nil{
         fmt.Println("?? resource get row failed")
@@ -1672,26 +2179,29 @@ func get_resource_record(db_link *sql.DB,tag string)(Resource_record,error) {
 }
 
 
-func get_image(db_link *sql.DB, db_folder string,tag string)(int,[]byte,error){
+func get_image(db_link Db_link, st *Store,tag string)(int,[]byte,error){
     tab_resource:=get_table("resource")
     tab_resource.set("tag",tag)
     page,err:=do_select_id(db_link,tab_resource.pack_select("page","",""))
     if err !=nil{
-        fmt.Printf("sql:%s,error:%#v",tab_resource.pack_select("page","",""),err)
+        fmt.Printf("sql:%s,error:%#v",tab_resource.pack_select("page","","").Sql,err)
         return 0,[]byte{},err
     }
     if len(page)==0{
         return 0,[]byte{},errors.New("no record")
     }
-    blob_file := db_folder +"blob"+strconv.FormatInt(page[0],10)+".db"
-    rs_type,data,err :=blob_read(blob_file,tag)
+    blob_db,err := st.blob(strconv.FormatInt(page[0],10))
+    if err !=nil{
+        return 0,[]byte{},err
+    }
+    rs_type,data,err :=blob_read(blob_db,tag)
     if err !=nil{
         return 0,[]byte{},err
     }
     return rs_type,data,nil
 }
 
-func get_image_mime(db_link *sql.DB, tag string)(string,error){
+func get_image_mime(db_link Db_link, tag string)(string,error){
     tab_resource:=get_table("resource")
     tab_resource.set("tag",tag)
     rs_type,err:=do_select_id(db_link,tab_resource.pack_select("type","",""))
@@ -1701,8 +2211,8 @@ func get_image_mime(db_link *sql.DB, tag string)(string,error){
     return mime_decode(int(rs_type[0])),nil
 }
 
-func get_text(db_link *sql.DB, db_folder string,tag string)(int,string,error){
-    rs_type,data,err:=get_image(db_link,db_folder,tag)
+func get_text(db_link Db_link, st *Store,tag string)(int,string,error){
+    rs_type,data,err:=get_image(db_link,st,tag)
     var result string
     if len(data) >0{
         result = string(data)
@@ -1710,16 +2220,14 @@ func get_text(db_link *sql.DB, db_folder string,tag string)(int,string,error){
     return rs_type,result,err
 }
 
-func image_count(db_link *sql.DB)(int64,error){
-    tab_resource :=new(Db_table)
-    tab_resource.set_name("resource")
-    tab_resource.add_column("type<",false)
-    tab_resource.set("type<","10")
+func image_count(db_link Db_link)(int64,error){
+    tab_resource :=get_table("resource")
+    tab_resource.where("type","<=","10")
     cnt,err:=do_count(db_link,tab_resource.pack_count("cnt"))
     return cnt,err 
 }
 
-func list_images(db_link *sql.DB, page_len int,page int) []Resource_record{
+func list_images(db_link Db_link, page_len int,page int) []Resource_record{
     var result =  []Resource_record{}
     if page_len <1{
         return result
@@ -1743,10 +2251,8 @@ func list_images(db_link *sql.DB, page_len int,page int) []Resource_record{
     start :=(page-1)*page_len
 
     tab_resource:=get_table("resource")
-    tab_resource.add_column("type<",false)
-
-    tab_resource.set("type<","10")
-    rows,err :=db_link.Query(tab_resource.pack_select("tag,name,type,rs_date,ref_count","rsid desc",strconv.Itoa(start)+","+strconv.Itoa(page_len)))
+    tab_resource.where("type","<=","10")
+    rows,err :=do_query(db_link,tab_resource.pack_select("tag,name,type,rs_date,ref_count","rsid desc",strconv.Itoa(start)+","+strconv.Itoa(page_len)))
     defer rows.Close();
     if err !=nil{
         return result
@@ -1761,10 +2267,11 @@ func list_images(db_link *sql.DB, page_len int,page int) []Resource_record{
     return result
 }
 
-func search_images(db_link *sql.DB, target string) ([]Resource_record,error){
+func search_images(db_link Db_link, target string) ([]Resource_record,error){
     var result =  []Resource_record{}
-    sql_str:="select tag,name,type,rs_date,ref_count from resource where type<10 and name like \"%"+target+"%\" order by rsid desc"
-    rows,err :=db_link.Query(sql_str)
+    tab_resource :=get_table("resource")
+    tab_resource.where("type","<","10").where("name","like","%"+like_escape(target)+"%")
+    rows,err :=do_query(db_link,tab_resource.pack_select("tag,name,type,rs_date,ref_count","rsid desc",""))
     defer rows.Close();
     if err !=nil{
         return result,err
@@ -1779,13 +2286,11 @@ func search_images(db_link *sql.DB, target string) ([]Resource_record,error){
     return result,nil
 }
 
-func orphan_images(db_link *sql.DB) []Resource_record{
+func orphan_images(db_link Db_link) []Resource_record{
     var result =  []Resource_record{}
-    tab_resource :=new(Db_table)
-    tab_resource.set_name("resource")
-    tab_resource.add_column("tag",true).add_column("type<",false).add_column("name",true).add_column("ref_count<",false)
-    tab_resource.set("type<","10").set("ref_count<","0")
-    rows,err :=db_link.Query(tab_resource.pack_select("tag,name,type,rs_date,ref_count","rsid desc",""))
+    tab_resource :=get_table("resource")
+    tab_resource.where("type","<=","10").where("ref_count","<=","0")
+    rows,err :=do_query(db_link,tab_resource.pack_select("tag,name,type,rs_date,ref_count","rsid desc",""))
     defer rows.Close()
     if err !=nil{
         return result
@@ -1808,24 +2313,37 @@ func img_name_tag(name string)string{
     return name
 }
 
+// md_img_reg finds the images of a markdown text: ![alt](/get_image/TAG.png "title")
+var md_img_reg = regexp.MustCompile(`!\[((?:[^\]\\]|\\.)*)\]\(\s*<?\.?\.?/?get_image/([\w\d\.]+)`)
+
 func extract_tags(text string)[]string{
-    if !strings.Contains(text,`<img `){
+    if !strings.Contains(text,`<img `) && !strings.Contains(text,"get_image/"){
         return []string{}
     }
     var result []string
+    seen := make_set([]string{})
     img_reg := regexp.MustCompile(`<img (.*?)>`)
 	img_mats :=img_reg.FindAllStringSubmatch(text,-1)
-	if len(img_mats)==0{
-		return []string{} //empty
-	}
 	reg :=regexp.MustCompile(`src="\.?\.?/?get_image/([\w\d\.]+)"`)
-
+    var srcs []string
     for _,r := range img_mats{
 		mats:=reg.FindStringSubmatch(r[1])
 		if len(mats)==0{
 			continue
 		}
-        t :=img_name_tag(mats[1])
+        srcs = append(srcs,mats[1])
+    }
+    // the images of a markdown note
+    for _,mats :=range(md_img_reg.FindAllStringSubmatch(text,-1)){
+        srcs = append(srcs,mats[2])
+    }
+    for _,src :=range(srcs){
+        t :=img_name_tag(src)
+        // an image shown twice is one reference of the note
+        if seen.Has(t){
+            continue
+        }
+        seen.Add(t)
         result = append(result,t)
     }
     return result
@@ -1833,15 +2351,15 @@ func extract_tags(text string)[]string{
 
 func extract_img_names(text string)map[string]string{
     var result =make(map[string]string)
-	if !strings.Contains(text,`<img `){
+	if !strings.Contains(text,`<img `) && !strings.Contains(text,"get_image/"){
         return result
     }
+    for _,mats :=range(md_img_reg.FindAllStringSubmatch(text,-1)){
+        result[img_name_tag(mats[2])] = html_text(md_inline(mats[1]))
+    }
    
     img_reg := regexp.MustCompile(`<img (.*?)>`)
 	img_mats :=img_reg.FindAllStringSubmatch(text,-1)
-	if len(img_mats)==0{
-		return result
-	}
 	reg_src :=regexp.MustCompile(`src="\.?\.?/?get_image/([\w\d\.]+)"`)
 	reg_alt :=regexp.MustCompile(`alt="(.*?)"`)
 
@@ -1862,43 +2380,39 @@ func extract_img_names(text string)map[string]string{
     return result
 }
 
-func resource_delete(db_link *sql.DB,tag string,db_folder string)(bool,error){
+func resource_delete(u *Unit,tag string)(bool,error){
     tab_resource:=get_table("resource")
     tab_resource.set("tag",tag)
-    cnt,err := do_count(db_link,tab_resource.pack_count("cnt"))
+    cnt,err := do_count(u.tx,tab_resource.pack_count("cnt"))
     if err !=nil{
         return false,errors.New("record count error")
     }
     if cnt ==0{
         return false,errors.New("no record error")
     }
-    resource_record,err :=get_resource_record(db_link,tag )
+    resource_record,err :=get_resource_record(u.tx,tag )
     if err !=nil{
         return false,err
     }
-    page :=resource_record.Page
-    blob_file := db_folder+"blob"+strconv.Itoa(page)+".db"
-    ok,err:=blob_delete(blob_file,tag)
+    _,err =do_delete(u.tx,tab_resource.pack_delete())
     if err !=nil{
         return false,err
     }
-    if !ok{
-        return false,err
-    }
-    _,err =do_delete(db_link,tab_resource.pack_delete())
+    _,err =tag_clear(u.tx,tag)
     if err !=nil{
         return false,err
     }
-    tag_clear(db_link,tag)
+    // the blob is deleted when the unit commits
+    u.blob_delete(strconv.Itoa(resource_record.Page),tag)
     return true,nil
 }
 
 
-func resource_update(db_link *sql.DB,tag string,rs_type int,data []byte,db_folder string)(bool,error){
+func resource_update(u *Unit,tag string,rs_type int,data []byte)(bool,error){
     tab_resource:=get_table("resource")
     tab_resource.set("tag",tag)
 
-    cnt,err := do_count(db_link,tab_resource.pack_count("cnt"))
+    cnt,err := do_count(u.tx,tab_resource.pack_count("cnt"))
     if err !=nil{
         return false,errors.New("record count error")
     }
@@ -1906,86 +2420,295 @@ func resource_update(db_link *sql.DB,tag string,rs_type int,data []byte,db_folde
         return false,errors.New("no record error")
     }
 
-    resource_record,err :=get_resource_record(db_link,tag )
+    resource_record,err :=get_resource_record(u.tx,tag )
     if err !=nil{
         return false,err
     }
     page :=resource_record.Page
-    blob_file := db_folder+"blob"+strconv.Itoa(page)+".db"
-    ok,err:=blob_update(blob_file,tag,data,rs_type)
+    err=u.blob_update(strconv.Itoa(page),tag,data,rs_type)
     if err !=nil{
         return false,err
     }
-    if !ok{
+    _,err=resource_update_type(u.tx,tag,rs_type)
+    if err !=nil{
         return false,err
     }
-    resource_update_type(db_link,tag,rs_type)
+    if rs_type !=33{
+        tab_hash:=get_table("resource")
+        tab_hash.set("tag",tag).set("hash",resource_hash(data))
+        _,err=do_update(u.tx,tab_hash.pack_update([]string{"tag"}))
+        if err !=nil{
+            return false,err
+        }
+    }
     return true,nil
 }
 
-func resource_search(db_folder,target string,pages string)([]string,error){
-    var result []string
-    page_max,err := strconv.Atoi(pages)
-    if err!=nil{
+// Resource_owner is a note (app 1) or an article (app 2) showing an image
+type Resource_owner struct{
+    App int
+    App_tag string
+    Title string
+}
+
+// resource_owners lists the notes and the articles showing the image
+func resource_owners(db_link Db_link,tag string)([]Resource_owner,error){
+    var result []Resource_owner
+    sql_str := `select l.app,l.app_tag,n.file_dir||'/'||n.file_name from resource_link l
+        join file_note n on n.tag=l.app_tag where l.tag=? and l.app=1
+        union all
+        select l.app,l.app_tag,a.title from resource_link l
+        join article a on a.tag=l.app_tag where l.tag=? and l.app=2`
+    rows,err := db_link.Query(sql_str,tag,tag)
+    if err !=nil{
         return result,err
     }
-    var tags []string
-    for i:=1;i<(page_max+1);i++{
-        blob_file := db_folder+"blob"+strconv.Itoa(i)+".db"
-        tags,err=blob_search(blob_file,target)
+    defer rows.Close()
+    for rows.Next(){
+        var owner Resource_owner
+        err = rows.Scan(&owner.App,&owner.App_tag,&owner.Title)
         if err !=nil{
             return result,err
         }
-        if len(tags)>0{
-            for _,tag :=range(tags){
-                result = append(result,tag)
-            }
-        }
+        result = append(result,owner)
     }
-    return result,nil
+    return result,rows.Err()
 }
 
-func resource_ref_update_by_text(db_link *sql.DB,app int,app_tag string,old_note string,new_note string){
-    old_tags := extract_tags(old_note)
-    new_tags := extract_tags(new_note)
-    new_tags_map :=extract_img_names(new_note)
-    tags_to_update:=set_intersect(old_tags,new_tags)
-    tags_to_delete:=set_substract(old_tags,tags_to_update)
-    tags_to_insert:=set_substract(new_tags,tags_to_update)
-
-    //update the names of the images in the new note
-    for _,item :=range(new_tags){
-        item_name,ok:=new_tags_map[item]
-        if ok{
-            if item_name == ""{
-                continue
-            }
-            resource_update_name(db_link,item,item_name)
+// resource_update_owned changes the image tag as the owner app/app_tag shows
+// it and returns the tag the owner shows afterwards. An image shown by other
+// notes or articles too is not changed in place: the new bytes get a resource
+// of their own and only the owner is moved to it.
+func resource_update_owned(u *Unit,tag string,app int,app_tag string,rs_type int,data []byte)(string,error){
+    if app ==0{
+        // the only note or article showing it, the revisions keep the old one
+        owners,err := resource_owners(u.tx,tag)
+        if err !=nil{
+            return "",err
+        }
+        if len(owners)==1{
+            app,app_tag = owners[0].App,owners[0].App_tag
         }
     }
-
-    for _,item :=range(tags_to_insert){
-        resource_ref_count_inc(db_link,item)
-        resource_link_add(db_link,item,app,app_tag)
-    }
-
-    //only decrease the ref_count, break the resource_link
-    for _,item :=range(tags_to_delete){
-        resource_ref_count_dec(db_link,item)
-        resource_link_del(db_link,item,app,app_tag)
-    }
-}
-
-func resource_ref_dec_by_text(db_link *sql.DB,app int,app_tag string,note_text string){
-    res_tags := extract_tags(note_text)
-    for _,tag := range(res_tags){
-        resource_ref_count_dec(db_link,tag)
-        resource_link_del(db_link,tag,app,app_tag)
+    var links,owned int64
+    err := u.tx.QueryRow("select count(*),count(case when app=? and app_tag=? then 1 end) from resource_link where tag=?",
+        app,app_tag,tag).Scan(&links,&owned)
+    if err !=nil{
+        return "",err
     }
-}
-
+    if links<=owned || (owned ==0 && links<=1){
+        // the new bytes may be another image already: its owners go to that one,
+        // two rows of one hash would not be told apart by resource_by_hash
+        same := ""
+        if rs_type !=33{
+            same,err = resource_by_hash(u.tx,resource_hash(data))
+            if err !=nil{
+                return "",err
+            }
+        }
+        if same =="" || same ==tag{
+            _,err = resource_update(u,tag,rs_type,data)
+            return tag,err
+        }
+        owners,err := resource_owners(u.tx,tag)
+        if err !=nil{
+            return "",err
+        }
+        for _,owner :=range(owners){
+            err = resource_owner_move(u,owner.App,owner.App_tag,tag,same)
+            if err !=nil{
+                return "",err
+            }
+        }
+        return same,nil
+    }
+    if owned ==0{
+        return "",errors.New("the image is shown by several notes or articles, choose the one to change")
+    }
+    record,err := get_resource_record(u.tx,tag)
+    if err !=nil{
+        return "",err
+    }
+    new_tag,err := resource_deposite(u,record.Name,rs_type,data)
+    if err !=nil || new_tag ==tag{
+        return tag,err
+    }
+    err = resource_owner_move(u,app,app_tag,tag,new_tag)
+    if err !=nil{
+        return "",err
+    }
+    return new_tag,nil
+}
+
+// resource_owner_move makes the note or the article show new_tag in place of
+// tag, in its texts and its links
+func resource_owner_move(u *Unit,app int,app_tag string,tag string,new_tag string)error{
+    err := resource_owner_retag(u,app,app_tag,map[string]string{tag:new_tag})
+    if err !=nil{
+        return err
+    }
+    // the owner may show the new bytes already, it links them once
+    var has_new int64
+    err = u.tx.QueryRow("select count(*) from resource_link where tag=? and app=? and app_tag=?",new_tag,app,app_tag).Scan(&has_new)
+    if err !=nil{
+        return err
+    }
+    err = resource_ref_del(u.tx,tag,app,app_tag)
+    if err ==nil && has_new ==0{
+        err = resource_ref_add(u.tx,new_tag,app,app_tag)
+    }
+    return err
+}
+
+// resource_owner_retag changes the images the texts of a note or of the pages
+// of an article show, as tag_map says
+func resource_owner_retag(u *Unit,app int,app_tag string,tag_map map[string]string)error{
+    var text_tags []string
+    switch app{
+    case 1:
+        record,err := get_note_by_tag(u.tx,app_tag)
+        if err !=nil{
+            return err
+        }
+        reg:=regexp.MustCompile(`#<0x_([\d\w]+)_>`)
+        mats:= reg.FindStringSubmatch(record.Note)
+        if len(mats)>1{
+            text_tags = append(text_tags,mats[1])
+        }
+    case 2:
+        tab := get_table("article_page")
+        tab.set("tag",app_tag)
+        rows,err := do_query(u.tx,tab.pack_select("pg_tag","",""))
+        if err !=nil{
+            return err
+        }
+        for rows.Next(){
+            var pg_tag string
+            err = rows.Scan(&pg_tag)
+            if err !=nil{
+                rows.Close()
+                return err
+            }
+            text_tags = append(text_tags,pg_tag)
+        }
+        rows.Close()
+    }
+    for _,text_tag :=range(text_tags){
+        _,text,err := get_text(u.tx,u.st,text_tag)
+        if err !=nil{
+            return err
+        }
+        new_text := retag_image_refs(text,tag_map)
+        if new_text ==text{
+            continue
+        }
+        _,err = resource_update(u,text_tag,33,[]byte(new_text))
+        if err !=nil{
+            return err
+        }
+    }
+    return nil
+}
+
+func resource_search(st *Store,target string,pages string)([]string,error){
+    var result []string
+    page_max,err := strconv.Atoi(pages)
+    if err!=nil{
+        return result,err
+    }
+    var tags []string
+    for i:=1;i<(page_max+1);i++{
+        if ok,_:=file_exists(st.blob_file(strconv.Itoa(i)));!ok{
+            continue
+        }
+        blob_db,err := st.blob(strconv.Itoa(i))
+        if err !=nil{
+            return result,err
+        }
+        tags,err=blob_search(blob_db,target)
+        if err !=nil{
+            return result,err
+        }
+        if len(tags)>0{
+            for _,tag :=range(tags){
+                result = append(result,tag)
+            }
+        }
+    }
+    return result,nil
+}
+
+func resource_ref_update_by_text(db_link Db_link,app int,app_tag string,old_note string,new_note string)error{
+    old_tags := extract_tags(old_note)
+    new_tags := extract_tags(new_note)
+    new_tags_map :=extract_img_names(new_note)
+    tags_to_update:=set_intersect(old_tags,new_tags)
+    tags_to_delete:=set_substract(old_tags,tags_to_update)
+    tags_to_insert:=set_substract(new_tags,tags_to_update)
+
+    //update the names of the images in the new note
+    for _,item :=range(new_tags){
+        item_name,ok:=new_tags_map[item]
+        if ok{
+            if item_name == ""{
+                continue
+            }
+            _,err:=resource_update_name(db_link,item,item_name)
+            if err !=nil{
+                return err
+            }
+        }
+    }
+
+    for _,item :=range(tags_to_insert){
+        err:=resource_ref_add(db_link,item,app,app_tag)
+        if err !=nil{
+            return err
+        }
+    }
+
+    //only decrease the ref_count, break the resource_link
+    for _,item :=range(tags_to_delete){
+        err:=resource_ref_del(db_link,item,app,app_tag)
+        if err !=nil{
+            return err
+        }
+    }
+    return nil
+}
+
+func resource_ref_dec_by_text(db_link Db_link,app int,app_tag string,note_text string)error{
+    res_tags := extract_tags(note_text)
+    for _,tag := range(res_tags){
+        err:=resource_ref_del(db_link,tag,app,app_tag)
+        if err !=nil{
+            return err
+        }
+    }
+    return nil
+}
+
+// resource_ref_add counts a reference from app_tag to the resource and links them
+func resource_ref_add(db_link Db_link,tag string,app int,app_tag string)error{
+    _,err:=resource_ref_count_inc(db_link,tag)
+    if err !=nil{
+        return err
+    }
+    _,err=resource_link_add(db_link,tag,app,app_tag)
+    return err
+}
+
+func resource_ref_del(db_link Db_link,tag string,app int,app_tag string)error{
+    _,err:=resource_ref_count_dec(db_link,tag)
+    if err !=nil{
+        return err
+    }
+    _,err=resource_link_del(db_link,tag,app,app_tag)
+    return err
+}
+
 // resource link======================================================================================
-func resource_link_add(db_link *sql.DB,tag string, app int, app_tag string)(bool,error){
+func resource_link_add(db_link Db_link,tag string, app int, app_tag string)(bool,error){
     tab := get_table("resource_link")
     tab.set("tag",tag).set("app",strconv.Itoa(app)).set("app_tag",app_tag)
     _,err :=do_insert(db_link,tab.pack_insert())
@@ -1995,28 +2718,34 @@ func resource_link_add(db_link *sql.DB,tag string, app int, app_tag string)(bool
     return true,nil
 }
 
-func resource_link_del(db_link *sql.DB,tag string, app int, app_tag string)(bool,error){
+func resource_link_del(db_link Db_link,tag string, app int, app_tag string)(bool,error){
     tab := get_table("resource_link")
     tab.set("tag",tag).set("app",strconv.Itoa(app)).set("app_tag",app_tag)
-    _,err :=do_insert(db_link,tab.pack_delete())
+    _,err :=do_delete(db_link,tab.pack_delete())
     if err !=nil{
         return false,err
     }
     return true,nil
 }
 
-func resource_link_read(db_link *sql.DB,tag string)(int, string, error){
+func resource_link_read(db_link Db_link,tag string)(int, string, error){
     tab := get_table("resource_link")
     tab.set("tag",tag)
     var app int
     var app_tag string
-    rows,err:=db_link.Query(tab.pack_select("app,app_tag","",""))
+    rows,err:=do_query(db_link,tab.pack_select("app,app_tag","",""))
     defer rows.Close()
     if err !=nil{
         return 0,"",err
     }
     for rows.Next(){
-        rows.Scan(&app,&app_tag)
+        var row_app int
+        var row_tag string
+        rows.Scan(&row_app,&row_tag)
+        // a note or an article before a revision
+        if app ==0 || app ==3{
+            app,app_tag = row_app,row_tag
+        }
     }
     if app !=0{ // let's assume there is only one reference
         return app,app_tag,nil
@@ -2027,107 +2756,229 @@ func resource_link_read(db_link *sql.DB,tag string)(int, string, error){
 //====================================================================================================
 // for file_note
 //====================================================================================================
-func add_note(db_link *sql.DB,host_name string,device_id string,ino string,note string,color string,root_dir string,db_folder string)(string,error){
-    tab_note:=get_table("file_note")
+// ino_note_path gives the file_dir and file_name of the notes on device_id/ino
+func ino_note_path(db_link Db_link,roots Roots,device_id string,ino string)(string,string,error){
     device_id_uint64,err :=strconv.ParseUint(device_id,10,64)
     delim:=sys_delim()
     if err !=nil{
-        return "",err
+        return "","",err
     }
-    ino_uint64,_:=strconv.ParseUint(ino,10,64)
+    ino_uint64,err:=strconv.ParseUint(ino,10,64)
     if err !=nil{
-        return "",err
+        return "","",err
     }
     url,err := file_url(db_link,device_id_uint64,ino_uint64,100,delim)
     if err !=nil{
-        return "",err
+        return "","",err
     }
-    relative_url:=relative_path_of(url,root_dir)
+    relative_url:=roots.rel(url)
     if delim == "\\"{
         // on windows
         // in the file_note table, the standard deliminator is "/" 
         relative_url = strings.ReplaceAll(relative_url, "\\","/")
     }
-    file_name := path_file_name(relative_url,"/")
-    file_dir := path_dir_name(relative_url,"/")
-    tag,err := tag_gen(db_link)
+    return path_dir_name(relative_url,"/"),path_file_name(relative_url,"/"),nil
+}
+
+// add_note adds a note on the file device_id/ino. fp is the fingerprint of the
+// file from note_fingerprint, nil when it has one already.
+func add_note(u *Unit,host_name string,device_id string,ino string,note string,format int,color string,roots Roots,fp *File_fingerprint)(string,error){
+    file_dir,file_name,err := ino_note_path(u.tx,roots,device_id,ino)
+    if err !=nil{
+        return "",err
+    }
+    tag,err := tag_gen(u.tx)
     if err !=nil{
-        // delete the tag
         return tag,err
     }
+    err=add_note_record(u,tag,file_dir,file_name,"",note,format,color,get_now_string())
+    // the fingerprint finds the file again when it is moved outside Filegai
+    if err ==nil && fp !=nil && fp.File_dir ==file_dir && fp.File_name ==file_name{
+        err = fingerprint_put(u.tx,*fp)
+    }
+    return tag,err
+}
+
+// add_thread_note adds a note on the file of the note `tag`, a reply when
+// parent_tag is given. A reply to a reply goes to the note it replied to.
+func add_thread_note(u *Unit,tag string,parent_tag string,note string,format int,color string)(string,error){
+    record,err := get_note_by_tag(u.tx,tag)
+    if err !=nil{
+        return "",err
+    }
+    if parent_tag !=""{
+        parent,err := get_note_by_tag(u.tx,parent_tag)
+        if err !=nil{
+            return "",err
+        }
+        if parent.File_dir !=record.File_dir || parent.File_name !=record.File_name{
+            return "",errors.New("the note replied to is on another file")
+        }
+        if parent.Parent_tag !=""{
+            parent_tag = parent.Parent_tag
+        }
+    }
+    new_tag,err := tag_gen(u.tx)
+    if err !=nil{
+        return "",err
+    }
+    err=add_note_record(u,new_tag,record.File_dir,record.File_name,parent_tag,note,format,color,get_now_string())
+    return new_tag,err
+}
 
+// add_note_record saves the note text and the file_note row under a taken tag,
+// file_dir and file_name are relative to the root with "/" as deliminator
+func add_note_record(u *Unit,tag string,file_dir string,file_name string,parent_tag string,note string,format int,color string,ndate string)error{
+    tab_note:=get_table("file_note")
     // change from: blob_tag,err:=resource_deposite(db_link,"0x_text_"+get_now_string(),33,[]byte(note),db_folder)
     // the `name` field in resource table is now app tag
     // blob_tag is `tag` field in the resource table
-    blob_tag,err:=resource_deposite(db_link,tag,33,[]byte(note),db_folder)
+    blob_tag,err:=resource_deposite(u,tag,33,[]byte(note))
     if err !=nil{
-        // delete the tag
-        return tag,err
+        return err
     }
     tab_note.set("note","#<0x_"+blob_tag+"_>").set("color",color)    
-    tab_note.set("file_name",file_name).set("file_dir",file_dir).set("tag",tag).set("ndate",get_now_string())
+    tab_note.set("file_name",file_name).set("file_dir",file_dir).set("tag",tag).set("ndate",ndate)
+    tab_note.set("parent_tag",parent_tag).set("format",strconv.Itoa(format))
     
-    _,err=do_insert(db_link,tab_note.pack_insert())
+    _,err=do_insert(u.tx,tab_note.pack_insert())
     if err !=nil{
-        return tag,err
+        return err
+    }
+    err=resource_ref_add(u.tx,blob_tag,1,tag) // for note search
+    if err !=nil{
+        return err
+    }
+    err=search_index_put(u.tx,1,tag,tag,text_html(note,format))
+    if err !=nil{
+        return err
+    }
+    err=wiki_links_put(u,wiki_app_note,tag,tag,note)
+    if err !=nil{
+        return err
     }
-    resource_ref_count_inc(db_link,blob_tag)
-    resource_link_add(db_link,blob_tag,1,tag) // for note search
     
     // other resource_ref_count_inc in the note
     image_tags := extract_tags(note)
     // fmt.Printf("tags:%q",image_tags)
     for _,img_tag := range(image_tags){
-        resource_ref_count_inc(db_link,img_tag)
-        resource_link_add(db_link,img_tag,1,tag)
+        err=resource_ref_add(u.tx,img_tag,1,tag)
+        if err !=nil{
+            return err
+        }
     }
     image_name_map := extract_img_names(note)
     for img_tag,name :=range image_name_map{
-        resource_update_name(db_link,img_tag,name)
+        _,err=resource_update_name(u.tx,img_tag,name)
+        if err !=nil{
+            return err
+        }
     }
-    return tag,nil    
+    return nil
 }
 
-func get_note_record(db_link *sql.DB,file_dir string, file_name string) (Note_record,error){
+// get_note_record gives the latest note of the file, not a reply
+func get_note_record(db_link Db_link,file_dir string, file_name string) (Note_record,error){
     var result Note_record
     tab_note:=get_table("file_note")
-    tab_note.set("file_dir",file_dir).set("file_name",file_name)
-    rows,err :=db_link.Query(tab_note.pack_select("tag,file_dir,file_name,note,ndate,color","",""))
+    tab_note.set("file_dir",file_dir).set("file_name",file_name).where("parent_tag","=","")
+    rows,err :=do_query(db_link,tab_note.pack_select("tag,file_dir,file_name,note,ndate,color,parent_tag,format","nid desc","1"))
     defer rows.Close()
     if err !=nil{
         return result,err
     }
     if rows.Next(){
-        rows.Scan(&result.Tag,&result.File_dir, &result.File_name, &result.Note,&result.Ndate,&result.Color)
+        rows.Scan(&result.Tag,&result.File_dir, &result.File_name, &result.Note,&result.Ndate,&result.Color,&result.Parent_tag,&result.Format)
         return result,nil
     }
     return result,errors.New("no record")
 }
 
-func get_note_by_tag(db_link *sql.DB,tag string)(Note_record,error){
+// file_notes gives the notes and replies on the file with their texts, the oldest first
+func file_notes(db_link Db_link,st *Store,file_dir string,file_name string)([]Note_record,error){
+    var result []Note_record
+    tab_note:=get_table("file_note")
+    tab_note.set("file_dir",file_dir).set("file_name",file_name)
+    rows,err :=do_query(db_link,tab_note.pack_select("tag,file_dir,file_name,note,ndate,color,parent_tag,format","nid asc",""))
+    if err !=nil{
+        return result,err
+    }
+    for rows.Next(){
+        var row Note_record
+        err = rows.Scan(&row.Tag,&row.File_dir,&row.File_name,&row.Note,&row.Ndate,&row.Color,&row.Parent_tag,&row.Format)
+        if err !=nil{
+            rows.Close()
+            return result,err
+        }
+        result = append(result,row)
+    }
+    rows.Close()
+    for i:=range(result){
+        result[i].Color_str = color_decode(result[i].Color)
+        text,err := note_text(db_link,st,result[i].Note)
+        if err ==nil{
+            result[i].Note = text
+        }
+    }
+    return result,nil
+}
+
+// Note_thread is a note with the replies to it
+type Note_thread struct{
+    Note Note_record
+    Replies []Note_record
+}
+
+// note_threads groups the notes of a file, in the order given. A reply whose
+// note is gone is shown as a note of its own.
+func note_threads(records []Note_record)[]Note_thread{
+    var result []Note_thread
+    index := make(map[string]int)
+    for _,record :=range(records){
+        if record.Parent_tag ==""{
+            index[record.Tag] = len(result)
+            result = append(result,Note_thread{Note:record})
+        }
+    }
+    for _,record :=range(records){
+        if record.Parent_tag ==""{
+            continue
+        }
+        i,ok := index[record.Parent_tag]
+        if !ok{
+            result = append(result,Note_thread{Note:record})
+            continue
+        }
+        result[i].Replies = append(result[i].Replies,record)
+    }
+    return result
+}
+
+func get_note_by_tag(db_link Db_link,tag string)(Note_record,error){
     var result Note_record
     tab_note:=get_table("file_note")
     tab_note.set("tag",tag)
-    rows,err :=db_link.Query(tab_note.pack_select("tag,file_dir,file_name,note,ndate,color","",""))
+    rows,err :=do_query(db_link,tab_note.pack_select("tag,file_dir,file_name,note,ndate,color,parent_tag,format","",""))
     defer rows.Close()
     if err !=nil{
         return result,err
     }
     if rows.Next(){
-        rows.Scan(&result.Tag,&result.File_dir, &result.File_name, &result.Note,&result.Ndate,&result.Color)
+        rows.Scan(&result.Tag,&result.File_dir, &result.File_name, &result.Note,&result.Ndate,&result.Color,&result.Parent_tag,&result.Format)
         return result,nil
     }
     return result,errors.New("no record")
 
 }
 
-func notes_count(db_link *sql.DB)(int64,error){
+func notes_count(db_link Db_link)(int64,error){
     tab_note:=get_table("file_note")
+    tab_note.where("parent_tag","=","")
     cnt,err :=do_count(db_link,tab_note.pack_count("cnt"))
     return cnt,err
 }
 
-func list_notes_record(db_link *sql.DB,page_len int,page int)([]Note_record,error){
+func list_notes_record(db_link Db_link,page_len int,page int)([]Note_record,error){
     var result []Note_record
     if page_len <1{
         return result,errors.New("page len error")
@@ -2147,20 +2998,21 @@ func list_notes_record(db_link *sql.DB,page_len int,page int)([]Note_record,erro
     start :=(page-1)*page_len
 
     tab_note:=get_table("file_note")
-    rows,err :=db_link.Query(tab_note.pack_select("tag,file_dir,file_name,note,ndate,color","nid desc",strconv.Itoa(start)+","+strconv.Itoa(page_len)))
+    tab_note.where("parent_tag","=","")
+    rows,err :=do_query(db_link,tab_note.pack_select("tag,file_dir,file_name,note,ndate,color,format","nid desc",strconv.Itoa(start)+","+strconv.Itoa(page_len)))
     defer rows.Close()
     if err !=nil{
         return result,err
     }    
     var row Note_record
     for rows.Next(){
-        rows.Scan(&row.Tag,&row.File_dir,&row.File_name,&row.Note,&row.Ndate,&row.Color)
+        rows.Scan(&row.Tag,&row.File_dir,&row.File_name,&row.Note,&row.Ndate,&row.Color,&row.Format)
         result =append(result,row)
     }
     return result,nil
 }
 
-func list_notes(db_link *sql.DB,page_len int,page int,db_folder string)([]Note_record,error){
+func list_notes(db_link Db_link,page_len int,page int,st *Store)([]Note_record,error){
     var result =  []Note_record{}
     result,err := list_notes_record(db_link,page_len,page)
     if err!=nil{
@@ -2173,7 +3025,7 @@ func list_notes(db_link *sql.DB,page_len int,page int,db_folder string)([]Note_r
         mats :=reg.FindStringSubmatch(row.Note)
         if len(mats)>1{
             text_tag := mats[1]
-            _,real_note,err :=get_text(db_link,db_folder,text_tag)
+            _,real_note,err :=get_text(db_link,st,text_tag)
             if err ==nil{
                 row.Note = real_note
             }
@@ -2182,7 +3034,35 @@ func list_notes(db_link *sql.DB,page_len int,page int,db_folder string)([]Note_r
     return result,nil
 }
 
-func orphan_notes(db_link *sql.DB,db_folder string,root_dir string)([]Note_record,error){
+// label_notes gives the notes having the label, the newest first
+func label_notes(db_link Db_link,st *Store,lid int64)([]Note_record,error){
+    var result []Note_record
+    rows,err :=db_link.Query(`select tag,file_dir,file_name,note,ndate,color,format from file_note where tag in
+        (select app_tag from label_link where lid=? and app=?) order by nid desc`,lid,label_app_note)
+    if err !=nil{
+        return result,err
+    }
+    for rows.Next(){
+        var row Note_record
+        err =rows.Scan(&row.Tag,&row.File_dir,&row.File_name,&row.Note,&row.Ndate,&row.Color,&row.Format)
+        if err !=nil{
+            rows.Close()
+            return result,err
+        }
+        result = append(result,row)
+    }
+    rows.Close()
+    for i:=range(result){
+        result[i].Color_str=color_decode(result[i].Color)
+        text,err :=note_text(db_link,st,result[i].Note)
+        if err ==nil{
+            result[i].Note = text
+        }
+    }
+    return result,nil
+}
+
+func orphan_notes(db_link Db_link,st *Store,roots Roots)([]Note_record,error){
     var result =  []Note_record{}
     page_len :=100000 //max
     page :=1
@@ -2193,14 +3073,18 @@ func orphan_notes(db_link *sql.DB,db_folder string,root_dir string)([]Note_recor
     reg :=regexp.MustCompile(`#<0x_([\d\w]+)_>`)
     for i:=0;i<len(all);i++{
         row :=all[i]
-        path :=root_dir + row.File_dir+row.File_name
+        path :=roots.abs(row.File_dir+row.File_name)
+        if path==""{
+            // the root of the note is not served this time
+            continue
+        }
         ok,_:=file_exists(path)
         if !ok{
             row.Color_str=color_decode(row.Color)
             mats :=reg.FindStringSubmatch(row.Note)
             if len(mats)>1{
                 text_tag := mats[1]
-                _,real_note,err :=get_text(db_link,db_folder,text_tag)
+                _,real_note,err :=get_text(db_link,st,text_tag)
                 if err ==nil{
                     row.Note = real_note
                 }
@@ -2211,21 +3095,50 @@ func orphan_notes(db_link *sql.DB,db_folder string,root_dir string)([]Note_recor
     return result,nil
 }
 
-func search_notes(db_link *sql.DB,db_folder string,target string)([]Note_record,error){
+// search_notes looks the target up in the full text index of the notes,
+// the best hits come first
+func search_notes(db_link Db_link,st *Store,target string)([]Note_record,error){
+    var result []Note_record
+    hits,err := search_index_query(db_link,1,target,200)
+    if err !=nil{
+        return result,err
+    }
+    if len(hits)==0{
+        return result,errors.New("no record")
+    }
+    for _,hit :=range(hits){
+        row,err := get_note_by_tag(db_link,hit.Owner)
+        if err !=nil{
+            continue // the index is ahead of a deleted note
+        }
+        text,err := note_text(db_link,st,row.Note)
+        if err ==nil{
+            row.Note = text
+        }
+        row.Color_str = color_decode(row.Color)
+        row.Snippet = hit.Snippet
+        result = append(result,row)
+    }
+    return result,nil
+}
+
+// search_notes_raw looks for the target in the html of the notes,
+// it finds the notes showing an image by its tag
+func search_notes_raw(db_link Db_link,st *Store,target string)([]Note_record,error){
     var result []Note_record
-    max_pages,err := get_blob_file_page(db_folder,50000000) // use constant later on
+    max_pages,err := get_blob_file_page(st.folder,get_blob_page_limit(db_link))
     if err !=nil{
         return result, err
     }
-    all_tags,err := resource_search(db_folder,target,max_pages)
+    all_tags,err := resource_search(st,target,max_pages)
     if err!=nil{
         return result,err
     }
     if len(all_tags)==0{
         return result,errors.New("no record")        
     }
-    sql:="select app_tag from resource_link where tag in(\""+strings.Join(all_tags,"\",\"")+"\")"
-    res,err :=db_link.Query(sql)
+    sql_str:="select app_tag from resource_link where app=1 and tag in("+placeholders(len(all_tags))+")"
+    res,err :=db_link.Query(sql_str,str_args(all_tags)...)
     defer res.Close()
     if err !=nil{
         return result,err
@@ -2239,8 +3152,8 @@ func search_notes(db_link *sql.DB,db_folder string,target string)([]Note_record,
     if len(app_tags)==0{
         return result,errors.New("no record") 
     }
-    sql ="SELECT tag,file_dir,file_name,note,ndate,color from file_note where tag in(\""+strings.Join(app_tags,"\",\"")+"\") order by nid desc"
-    rows,err :=db_link.Query(sql)
+    sql_str ="SELECT tag,file_dir,file_name,note,ndate,color,format from file_note where tag in("+placeholders(len(app_tags))+") order by nid desc"
+    rows,err :=db_link.Query(sql_str,str_args(app_tags)...)
     defer rows.Close()
     if err !=nil{
         return result,err
@@ -2248,12 +3161,12 @@ func search_notes(db_link *sql.DB,db_folder string,target string)([]Note_record,
     var row Note_record
     reg :=regexp.MustCompile(`#<0x_([\d\w]+)_>`)
     for rows.Next(){
-        rows.Scan(&row.Tag,&row.File_dir,&row.File_name,&row.Note,&row.Ndate,&row.Color)
+        rows.Scan(&row.Tag,&row.File_dir,&row.File_name,&row.Note,&row.Ndate,&row.Color,&row.Format)
         row.Color_str=color_decode(row.Color)
         mats :=reg.FindStringSubmatch(row.Note)
         if len(mats)>1{
             text_tag := mats[1]
-            _,real_note,err :=get_text(db_link,db_folder,text_tag)
+            _,real_note,err :=get_text(db_link,st,text_tag)
             if err ==nil{
                 row.Note = real_note
             }
@@ -2263,91 +3176,130 @@ func search_notes(db_link *sql.DB,db_folder string,target string)([]Note_record,
     return result,nil
 }
 
-func del_note(db_link *sql.DB,file_dir string, file_name string,db_folder string)(bool,error){
-    if sys_delim()=="\\"{
-        file_dir =strings.ReplaceAll(file_dir,"\\","/")
-        file_name=strings.ReplaceAll(file_name,"\\","/")
+// note_release drops the text resource of a note and the references made by
+// the text, the file_note row itself is left to the caller
+func note_release(u *Unit,record Note_record)error{
+    err:=search_index_del(u.tx,1,record.Tag)
+    if err !=nil{
+        return err
     }
-    record,err := get_note_record(db_link,file_dir,file_name)
+    err=wiki_links_del(u.tx,wiki_app_note,record.Tag)
     if err !=nil{
-        return false,err
+        return err
+    }
+    err=note_revisions_release(u,record.Tag)
+    if err !=nil{
+        return err
     }
     reg:=regexp.MustCompile(`#<0x_([\d\w]+)_>`)
     mats:= reg.FindStringSubmatch(record.Note)
-    var text_tag string
     // there are others to delete:
     // 1. the resource related to this note
     // 2. the blob
-    if len(mats)>1{
-        text_tag = mats[1]
-        _,note_text,err :=get_text(db_link, db_folder ,text_tag )
-        if err ==nil{
-            res_tags := extract_tags(note_text)
-            for _,tag := range(res_tags){
-                resource_ref_count_dec(db_link,tag)
-                resource_link_del(db_link,tag,1,record.Tag)
-            }
-            // delete the text_resouce, decrease the ref_count
-            // resource_ref_count_dec(db_link,text_tag)
-            resource_link_del(db_link,text_tag,1,record.Tag)
-            _,err:=resource_delete(db_link,text_tag,db_folder)
-            if err !=nil{
-                fmt.Printf("delete text resource error:%#v",err)
-            }
-        }
+    if len(mats)<2{
+        return nil
     }
-    tab_note:=get_table("file_note")
-    tab_note.set("file_dir",file_dir).set("file_name",file_name)
-    _,err=do_delete(db_link,tab_note.pack_delete())
+    text_tag := mats[1]
+    _,note_text,err :=get_text(u.tx, u.st,text_tag )
+    if err !=nil{
+        // the text is lost already, nothing to release
+        fmt.Printf("?? text of note %s not found:%s\n",record.Tag,err.Error())
+        return nil
+    }
+    err=resource_ref_dec_by_text(u.tx,1,record.Tag,note_text)
+    if err !=nil{
+        return err
+    }
+    // delete the text_resouce, the ref_count goes with the record
+    _,err=resource_link_del(u.tx,text_tag,1,record.Tag)
+    if err !=nil{
+        return err
+    }
+    _,err=resource_delete(u,text_tag)
+    if err !=nil{
+        fmt.Printf("delete text resource error:%#v",err)
+        return err
+    }
+    return nil
+}
+
+func del_note(u *Unit,file_dir string, file_name string)(bool,error){
+    if sys_delim()=="\\"{
+        file_dir =strings.ReplaceAll(file_dir,"\\","/")
+        file_name=strings.ReplaceAll(file_name,"\\","/")
+    }
+    // the latest note of the file goes, the one shown in the list
+    record,err := get_note_record(u.tx,file_dir,file_name)
     if err !=nil{
-        fmt.Printf("error:%#v",err)
         return false,err
     }
-    tag_clear(db_link,record.Tag)
-    return true,nil
+    return del_note_by_tag(u,record.Tag)
 }
 
-func del_note_by_tag(db_link *sql.DB,note_tag string,db_folder string)(bool,error){
-    record,err := get_note_by_tag(db_link,note_tag)
+// del_note_by_tag deletes the note, the replies to it go with it
+func del_note_by_tag(u *Unit,note_tag string)(bool,error){
+    record,err := get_note_by_tag(u.tx,note_tag)
     if err !=nil{
         return false,err
     }
-    reg:=regexp.MustCompile(`#<0x_([\d\w]+)_>`)
-    mats:= reg.FindStringSubmatch(record.Note)
-    var text_tag string
-    // there are others to delete:
-    // 1. the resource related to this note
-    // 2. the blob
-    if len(mats)>1{
-        text_tag = mats[1]
-        _,note_text,err :=get_text(db_link, db_folder ,text_tag )
-        if err ==nil{
-            res_tags := extract_tags(note_text)
-            for _,tag := range(res_tags){
-                resource_ref_count_dec(db_link,tag)
-                resource_link_del(db_link,tag,1,record.Tag)
-            }
-             
-            resource_link_del(db_link,text_tag,1,note_tag)          
-            _,err:=resource_delete(db_link,text_tag,db_folder)
-            if err !=nil{
-                fmt.Printf("delete text resource error:%#v",err)
-            }
+    replies,err := note_replies(u.tx,note_tag)
+    if err !=nil{
+        return false,err
+    }
+    for _,reply :=range(replies){
+        _,err=del_note_by_tag(u,reply)
+        if err !=nil{
+            return false,err
         }
     }
+    err=note_release(u,record)
+    if err !=nil{
+        return false,err
+    }
     tab_note:=get_table("file_note")
     tab_note.set("tag",note_tag)
-    _,err=do_delete(db_link,tab_note.pack_delete())
+    _,err=do_delete(u.tx,tab_note.pack_delete())
     if err !=nil{
         fmt.Printf("error:%s\n",err.Error())
         return false,err
     }
-    tag_clear(db_link,note_tag)
+    _,err=tag_clear(u.tx,note_tag)
+    if err !=nil{
+        return false,err
+    }
+    err=label_unlink(u.tx,label_app_note,note_tag)
+    if err !=nil{
+        return false,err
+    }
+    err=anchor_del(u.tx,note_tag)
+    if err !=nil{
+        return false,err
+    }
     return true,nil
 }
 
-func edit_note(db_link *sql.DB,tag string,note string,color string,db_folder string)(bool,error){
-    record,err := get_note_by_tag(db_link,tag)
+func note_replies(db_link Db_link,note_tag string)([]string,error){
+    var result []string
+    tab_note:=get_table("file_note")
+    tab_note.set("parent_tag",note_tag)
+    rows,err :=do_query(db_link,tab_note.pack_select("tag","nid asc",""))
+    if err !=nil{
+        return result,err
+    }
+    defer rows.Close()
+    for rows.Next(){
+        var tag string
+        err = rows.Scan(&tag)
+        if err !=nil{
+            return result,err
+        }
+        result = append(result,tag)
+    }
+    return result,rows.Err()
+}
+
+func edit_note(u *Unit,tag string,note string,color string)(bool,error){
+    record,err := get_note_by_tag(u.tx,tag)
     if err !=nil{
         fmt.Printf("error editing note:%s\n",err.Error())
         return false,err
@@ -2356,40 +3308,30 @@ func edit_note(db_link *sql.DB,tag string,note string,color string,db_folder str
     mats:= reg.FindStringSubmatch(record.Note)
     if len(mats)>1{
         text_tag := mats[1]
-        _,note_text,err :=get_text(db_link, db_folder ,text_tag )
+        _,note_text,err :=get_text(u.tx, u.st,text_tag )
         if err ==nil{
-            old_tags := extract_tags(note_text)
-            new_tags := extract_tags(note)
-            new_tags_map :=extract_img_names(note)
-            tags_to_update:=set_intersect(old_tags,new_tags)
-            tags_to_delete:=set_substract(old_tags,tags_to_update)
-            tags_to_insert:=set_substract(new_tags,tags_to_update)
-
-            //update the names of the images in the new note
             //for tinyMCE editor already stored the images
-            for _,item :=range(new_tags){
-                item_name,ok:=new_tags_map[item]
-                if ok{
-                    if item_name == ""{
-                        continue
-                    }
-                    resource_update_name(db_link,item,item_name)
-                }
-            }
-
-            for _,item :=range(tags_to_insert){
-                resource_ref_count_inc(db_link,item)
-                resource_link_add(db_link,item,1,tag)
+            err=resource_ref_update_by_text(u.tx,1,tag,note_text,note)
+            if err !=nil{
+                return false,err
             }
-
-            //only decrease the ref_count, break the resource_link
-            for _,item :=range(tags_to_delete){
-                resource_ref_count_dec(db_link,item)
-                resource_link_del(db_link,item,1,tag)
+            if note_text !=note{
+                err=note_revision_add(u,tag,note_text,record.Format,get_host_name())
+                if err !=nil{
+                    return false,err
+                }
             }
         }
         // update the text resource
-        _,err=resource_update(db_link,text_tag,33,[]byte(note),db_folder)
+        _,err=resource_update(u,text_tag,33,[]byte(note))
+        if err !=nil{
+            return false,err
+        }
+        err=search_index_put(u.tx,1,tag,tag,text_html(note,record.Format))
+        if err !=nil{
+            return false,err
+        }
+        err=wiki_links_put(u,wiki_app_note,tag,tag,note)
         if err !=nil{
             return false,err
         }
@@ -2400,7 +3342,7 @@ func edit_note(db_link *sql.DB,tag string,note string,color string,db_folder str
     if record.Color != new_color{
         tab_note.set("tag",tag).set("color",color)
         check:=[]string{"tag"}
-        _,err = do_update(db_link,tab_note.pack_update(check))
+        _,err = do_update(u.tx,tab_note.pack_update(check))
     }   
     if err!=nil{
         return false,err
@@ -2408,197 +3350,758 @@ func edit_note(db_link *sql.DB,tag string,note string,color string,db_folder str
     return true,nil
 }
 
-func note_update_name(db_link *sql.DB,file_dir string, file_name string,new_name string)(bool,error){
-    if sys_delim() =="\\"{
-        file_dir =strings.ReplaceAll(file_dir,"\\","/")
+// note_set_format changes the format the note text is read in, the text is left as it is
+func note_set_format(u *Unit,tag string,format int)error{
+    record,err := get_note_by_tag(u.tx,tag)
+    if err !=nil{
+        return err
     }
-    
-    note,err:=get_note_record(db_link,file_dir, file_name)
-    if err!=nil {
-        return false, err
+    if record.Format ==format{
+        return nil
     }
     tab_note:=get_table("file_note")
-    tab_note.set("file_name",new_name).set("tag",note.Tag)
-    check:=[]string{"tag"}
-    _,err= do_update(db_link,tab_note.pack_update(check))
+    tab_note.set("tag",tag).set("format",strconv.Itoa(format))
+    _,err = do_update(u.tx,tab_note.pack_update([]string{"tag"}))
     if err !=nil{
-        return false, err
+        return err
     }
-    return true,nil
+    text,err := note_text(u.tx,u.st,record.Note)
+    if err !=nil{
+        return err
+    }
+    return search_index_put(u.tx,1,tag,tag,text_html(text,format))
 }
 
-func note_update_folder(db_link *sql.DB,file_dir string, file_name string,new_name string)(bool,error){
-    if sys_delim() =="\\"{
-        file_dir =strings.ReplaceAll(file_dir,"\\","/")
-    }    
-    note,err:=get_note_record(db_link,file_dir, file_name)
-    
-    if err!=nil {
-        fmt.Printf("not found:file_dir:%s,file_name:%s\n",file_dir,file_name)
-        return false, err
+// note_convert turns the note into html or markdown, the text before goes
+// into the history like any other save
+func note_convert(u *Unit,tag string,format int)error{
+    record,err := get_note_by_tag(u.tx,tag)
+    if err !=nil{
+        return err
     }
-    tab_note:=get_table("file_note")
-    tab_note.set("file_dir",new_name).set("tag",note.Tag)
-    check:=[]string{"tag"}
-    _,err= do_update(db_link,tab_note.pack_update(check))
+    if record.Format ==format{
+        return nil
+    }
+    text,err := note_text(u.tx,u.st,record.Note)
     if err !=nil{
-        return false, err
+        return err
     }
-    return true,nil
+    if format ==text_format_markdown{
+        text = html_markdown(text)
+    }else{
+        text = markdown_html(text)
+    }
+    _,err = edit_note(u,tag,text,strconv.Itoa(record.Color))
+    if err !=nil{
+        return err
+    }
+    return note_set_format(u,tag,format)
 }
 
-func note_folder_like(db_link *sql.DB, folder_prefix string)([]Note_record,error){
-    var result []Note_record
-    sql_str  := "select tag,file_dir,file_name,note,color,ndate from file_note where file_dir like \""+folder_prefix+"%\""
-    rows,err :=db_link.Query(sql_str)
+//====================================================================================================
+// for note_revision
+//====================================================================================================
+// Every save of a note keeps the text it replaced as a text resource, linked
+// with app 3 to the note. A row is one save: rev_tag is the text before it,
+// host_name and rdate tell who saved and when. The images of an old text are
+// linked with app 3 to its rev_tag, so they are not unused while a revision
+// shows them.
+type Note_revision struct{
+    Rvid int64
+    Tag string
+    Rev_tag string
+    Host_name string
+    Rdate string
+    Format int // of the text kept
+}
+
+// Note_version is a text of the note in the history page, Rvid 0 is the current one
+type Note_version struct{
+    Rvid int64
+    Label string
+    Written string
+    Host_name string
+}
+
+func get_note_revision_keep(db_link Db_link)int{
+    return get_setting_with_digit(db_link,"note_revision_keep",50)
+}
+
+func set_note_revision_keep(db_link Db_link,keep string)(bool,error){
+    return set_sys_setting(db_link,"note_revision_keep",keep)
+}
+
+func note_revision_add(u *Unit,tag string,old_text string,format int,host_name string)error{
+    rev_tag,err:=resource_deposite(u,tag,33,[]byte(old_text))
+    if err !=nil{
+        return err
+    }
+    err=resource_ref_add(u.tx,rev_tag,3,tag)
+    if err !=nil{
+        return err
+    }
+    err=revision_images_add(u.tx,rev_tag,old_text)
+    if err !=nil{
+        return err
+    }
+    tab:=get_table("note_revision")
+    tab.set("tag",tag).set("rev_tag",rev_tag).set("host_name",host_name).set("rdate",get_now_string())
+    tab.set("format",strconv.Itoa(format))
+    _,err=do_insert(u.tx,tab.pack_insert())
+    if err !=nil{
+        return err
+    }
+    // the oldest ones go when there are too many
+    revisions,err:=note_revisions(u.tx,tag)
+    if err !=nil{
+        return err
+    }
+    keep :=get_note_revision_keep(u.tx)
+    if keep <1{
+        keep = 1
+    }
+    for i:=keep;i<len(revisions);i++{
+        err=note_revision_drop(u,revisions[i])
+        if err !=nil{
+            return err
+        }
+    }
+    return nil
+}
+
+// note_revisions lists the revisions of the note, the newest first
+func note_revisions(db_link Db_link,tag string)([]Note_revision,error){
+    var result []Note_revision
+    tab:=get_table("note_revision")
+    tab.set("tag",tag)
+    rows,err:=do_query(db_link,tab.pack_select("rvid,tag,rev_tag,host_name,rdate,format","rvid desc",""))
     if err !=nil{
         return result,err
     }
-    var row Note_record
     defer rows.Close()
     for rows.Next(){
-        err =rows.Scan(&row.Tag,&row.File_dir,&row.File_name,&row.Note,&row.Color,&row.Ndate)
+        var row Note_revision
+        err=rows.Scan(&row.Rvid,&row.Tag,&row.Rev_tag,&row.Host_name,&row.Rdate,&row.Format)
         if err !=nil{
-            return result, err
+            return result,err
         }
         result = append(result,row)
     }
-    return result, nil
+    return result,rows.Err()
 }
 
-func note_change_path(db_link *sql.DB, folder_prefix string, new_prefix string)(bool, error){
-    if folder_prefix==""{
-        return false,errors.New("changing root_dir is not allowed")
-    }
-    records,err := note_folder_like(db_link, folder_prefix)
-    if err !=nil{
-        return false, err
+func get_note_revision(db_link Db_link,rvid int64)(Note_revision,error){
+    var row Note_revision
+    err:=db_link.QueryRow("select rvid,tag,rev_tag,host_name,rdate,format from note_revision where rvid=?",rvid).Scan(
+        &row.Rvid,&row.Tag,&row.Rev_tag,&row.Host_name,&row.Rdate,&row.Format)
+    if err ==sql.ErrNoRows{
+        return row,errors.New("no record")
     }
+    return row,err
+}
 
-    tab:=get_table("file_note")
-    check := []string{"tag"}
-    for _,record:=range(records){
-        if strings.HasPrefix(record.File_dir,folder_prefix){
-            new_file_dir := strings.Replace(record.File_dir,folder_prefix,new_prefix,1)
-            tab.set("tag",record.Tag).set("file_dir",new_file_dir)
-            _,err :=do_update(db_link,tab.pack_update(check))
-            if err!=nil{
-                return false, err
-            }
+// revision_images_add links the images of a revision text that are there
+func revision_images_add(db_link Db_link,rev_tag string,text string)error{
+    for _,img_tag :=range(extract_tags(text)){
+        ok,err:=tag_exist_resource(db_link,img_tag)
+        if err !=nil{
+            return err
+        }
+        if !ok{
+            continue
+        }
+        err=resource_ref_add(db_link,img_tag,3,rev_tag)
+        if err !=nil{
+            return err
         }
     }
-    return true,nil
+    return nil
 }
 
+func tag_exist_resource(db_link Db_link,tag string)(bool,error){
+    tab:=get_table("resource")
+    tab.set("tag",tag)
+    cnt,err:=do_count(db_link,tab.pack_count("cnt"))
+    return cnt>0,err
+}
 
-func note_update_dirs(db_link *sql.DB, old_dir string,new_name string,root_dir string,delim string,full_path bool)(bool,error){
-    // old_dir and root_dir is in native form
-    old_name :=old_dir
-    if strings.HasSuffix(old_dir,delim){
-        old_name = old_dir[0:(len(old_dir)-1)] 
-    }
-    query_path:=relative_path_of(old_dir,root_dir)
-    if delim=="\\"{
-        //for windows
-        query_path = strings.ReplaceAll(query_path,"\\","/")
+func note_revision_drop(u *Unit,rev Note_revision)error{
+    _,err:=resource_link_del(u.tx,rev.Rev_tag,3,rev.Tag)
+    if err !=nil{
+        return err
     }
-    sql_str  := "select tag,file_dir from file_note where file_dir like \""+query_path+"%\""
-    row,err :=db_link.Query(sql_str)
-    defer row.Close()
+    // the images of the revision
+    var img_tags []string
+    rows,err:=u.tx.Query("select tag from resource_link where app=3 and app_tag=?",rev.Rev_tag)
     if err !=nil{
-        row.Close()
-        return false,err
+        return err
     }
-    tag :=""
-    file_dir :=""
-    data :=make(map[string]string)
-    for row.Next(){
-        row.Scan(&tag,&file_dir)
-        data[tag]=file_dir
+    for rows.Next(){
+        var img_tag string
+        err=rows.Scan(&img_tag)
+        if err !=nil{
+            rows.Close()
+            return err
+        }
+        img_tags = append(img_tags,img_tag)
     }
-    
-    name_len := len(path_file_name(old_name,delim))
-    dir_prefix:=relative_path_of(path_dir_name(old_name,delim),root_dir)
-
-    has_error:=false
-    for k,v :=range(data){
-        if strings.HasPrefix(v,dir_prefix){
-            //guand against bad return of previous query
-            var new_file_dir string
-            if full_path{
-                new_file_dir=new_name
-            }else{
-                idx_start:=len(dir_prefix)+name_len
-                if idx_start >=len(v){
-                    continue
-                }
-                tail := v[idx_start:len(v)]
-                new_file_dir=dir_prefix+new_name+tail
-            }
-            if delim=="\\"{
-                //for windows, in the file_note table, delim is normalized to "/"
-                new_file_dir = strings.ReplaceAll(new_file_dir,"\\","/")
-            }
-            sql_str ="update file_note set file_dir=\""+new_file_dir +"\" where tag =\""+k+"\""
-            sql_run,err :=db_link.Prepare(sql_str)
-            if err !=nil{
-                has_error =true
-                fmt.Println("for Debug:"+sql_str)
-                fmt.Println("error:"+err.Error())               
-                continue
-            }
-            _,err=sql_run.Exec()
-            if err !=nil{
-                fmt.Println("error:"+err.Error()) 
-                has_error =true
-            }
-
+    rows.Close()
+    for _,img_tag :=range(img_tags){
+        err=resource_ref_del(u.tx,img_tag,3,rev.Rev_tag)
+        if err !=nil{
+            return err
         }
     }
-    if has_error{
-        return false,err
+    _,err=resource_delete(u,rev.Rev_tag)
+    if err !=nil{
+        // the text is lost already, the row goes anyway
+        fmt.Printf("?? revision text %s of note %s:%s\n",rev.Rev_tag,rev.Tag,err.Error())
     }
-    return true, nil
+    tab:=get_table("note_revision")
+    tab.set("rvid",strconv.FormatInt(rev.Rvid,10))
+    _,err=do_delete(u.tx,tab.pack_delete())
+    return err
 }
 
-func get_note_map(db_link *sql.DB,device_id uint64,ino uint64,root_dir string,db_folder string) (map[string]Note_record, error){
-    tab_note:=get_table("file_note")
-    delim :=sys_delim()
-    result := make(map[string]Note_record)
-    this_url,err:=file_url(db_link,device_id,ino,100,delim)
+func note_revisions_release(u *Unit,tag string)error{
+    revisions,err:=note_revisions(u.tx,tag)
     if err !=nil{
-        return result,err
+        return err
+    }
+    for _,rev :=range(revisions){
+        err=note_revision_drop(u,rev)
+        if err !=nil{
+            return err
+        }
     }
+    return nil
+}
 
-    rel_file_url:=relative_path_of(this_url,root_dir)
-    rel_file_dir := path_dir_name (rel_file_url,delim)
-    if delim=="\\"{
-        rel_file_dir=strings.ReplaceAll(rel_file_dir,"\\","/")
+// note_versions lists the texts of the note, the current one first. A text
+// was written by the save before it, the oldest one kept has no such save.
+func note_versions(revisions []Note_revision)[]Note_version{
+    var result []Note_version
+    written,host_name := "",""
+    if len(revisions)>0{
+        written,host_name = revisions[0].Rdate,revisions[0].Host_name
+    }
+    result = append(result,Note_version{Rvid:0,Label:"current",Written:written,Host_name:host_name})
+    for i,rev :=range(revisions){
+        version := Note_version{Rvid:rev.Rvid,Label:"#"+strconv.FormatInt(rev.Rvid,10)}
+        if i+1<len(revisions){
+            version.Written,version.Host_name = revisions[i+1].Rdate,revisions[i+1].Host_name
+        }
+        result = append(result,version)
     }
+    return result
+}
 
-    tab_note.set("file_dir",rel_file_dir)
-    rows, err := db_link.Query(tab_note.pack_select("tag,file_name,note,color","",""))
-    defer rows.Close()
-    if err !=nil{
-        return result,err
+// note_version_text reads a text of the note as html, rvid 0 is the current text
+func note_version_text(db_link Db_link,st *Store,tag string,rvid int64)(string,error){
+    if rvid ==0{
+        record,err:=get_note_by_tag(db_link,tag)
+        if err !=nil{
+            return "",err
+        }
+        text,err:=note_text(db_link,st,record.Note)
+        return text_html(text,record.Format),err
+    }
+    rev,err:=get_note_revision(db_link,rvid)
+    if err !=nil{
+        return "",err
+    }
+    if rev.Tag !=tag{
+        return "",errors.New("revision of another note")
+    }
+    _,text,err:=get_text(db_link,st,rev.Rev_tag)
+    return text_html(text,rev.Format),err
+}
+
+// restore_note_revision puts an old text back with edit_note, so the current
+// text becomes a revision and the image references follow the text. It
+// returns the note tag and the images of the text that are not there any
+// more: the revisions kept before their images were linked may show images
+// cleared since then.
+func restore_note_revision(u *Unit,rvid int64)(string,[]string,error){
+    var missing []string
+    rev,err:=get_note_revision(u.tx,rvid)
+    if err !=nil{
+        return "",missing,err
+    }
+    record,err:=get_note_by_tag(u.tx,rev.Tag)
+    if err !=nil{
+        return "",missing,err
+    }
+    _,text,err:=get_text(u.tx,u.st,rev.Rev_tag)
+    if err !=nil{
+        return "",missing,err
+    }
+    for _,img_tag :=range(extract_tags(text)){
+        ok,err:=tag_exist_resource(u.tx,img_tag)
+        if err !=nil{
+            return "",missing,err
+        }
+        if !ok{
+            missing = append(missing,img_tag)
+        }
+    }
+    _,err=edit_note(u,rev.Tag,text,strconv.Itoa(record.Color))
+    if err !=nil{
+        return "",missing,err
+    }
+    // the old text is read in its own format
+    err=note_set_format(u,rev.Tag,rev.Format)
+    if err !=nil{
+        return "",missing,err
+    }
+    _,err=u.tx.Exec(`delete from resource_link where app=1 and app_tag=? and
+        tag not in (select tag from resource where tag is not null)`,rev.Tag)
+    if err !=nil{
+        return "",missing,err
+    }
+    return rev.Tag,missing,nil
+}
+
+// html_diff marks the changes from old_html to new_html: the words taken out
+// are in <del>, the new ones in <ins>. The markup of new_html is kept, the
+// markup taken out is dropped except the images.
+func html_diff(old_html string,new_html string)string{
+    reg:=regexp.MustCompile(`<[^>]*>|[^<\s]+|\s+`)
+    a:=reg.FindAllString(old_html,-1)
+    b:=reg.FindAllString(new_html,-1)
+    // the same head and tail are left out of the table
+    head :=0
+    for head<len(a) && head<len(b) && a[head]==b[head]{
+        head++
+    }
+    tail :=0
+    for tail<len(a)-head && tail<len(b)-head && a[len(a)-1-tail]==b[len(b)-1-tail]{
+        tail++
+    }
+    mid_a := a[head:len(a)-tail]
+    mid_b := b[head:len(b)-tail]
+
+    // ops: '=' both, '-' only in old, '+' only in new
+    var ops []byte
+    var toks []string
+    n,m := len(mid_a),len(mid_b)
+    if n*m >4000000{
+        // too big to compare word by word, all of it changed
+        for _,tok :=range(mid_a){
+            ops,toks = append(ops,'-'),append(toks,tok)
+        }
+        for _,tok :=range(mid_b){
+            ops,toks = append(ops,'+'),append(toks,tok)
+        }
+    }else{
+        // longest common subsequence from the end
+        lcs := make([][]int32,n+1)
+        for i:=range(lcs){
+            lcs[i] = make([]int32,m+1)
+        }
+        for i:=n-1;i>=0;i--{
+            for j:=m-1;j>=0;j--{
+                if mid_a[i]==mid_b[j]{
+                    lcs[i][j] = lcs[i+1][j+1]+1
+                }else if lcs[i+1][j]>=lcs[i][j+1]{
+                    lcs[i][j] = lcs[i+1][j]
+                }else{
+                    lcs[i][j] = lcs[i][j+1]
+                }
+            }
+        }
+        i,j:=0,0
+        for i<n || j<m{
+            if i<n && j<m && mid_a[i]==mid_b[j]{
+                ops,toks = append(ops,'='),append(toks,mid_a[i])
+                i++
+                j++
+            }else if i<n && (j==m || lcs[i+1][j]>=lcs[i][j+1]){
+                ops,toks = append(ops,'-'),append(toks,mid_a[i])
+                i++
+            }else{
+                ops,toks = append(ops,'+'),append(toks,mid_b[j])
+                j++
+            }
+        }
+    }
+    ops,toks = diff_runs(ops,toks)
+
+    var out strings.Builder
+    for _,tok :=range(a[:head]){
+        out.WriteString(tok)
+    }
+    open := byte(0) // the mark open now, '-' for <del>, '+' for <ins>
+    close_mark := func(){
+        if open=='-'{
+            out.WriteString("</del>")
+        }else if open=='+'{
+            out.WriteString("</ins>")
+        }
+        open = 0
+    }
+    for k,tok :=range(toks){
+        op := ops[k]
+        is_tag := strings.HasPrefix(tok,"<")
+        is_img := strings.HasPrefix(strings.ToLower(tok),"<img")
+        switch{
+        case op=='=':
+            close_mark()
+            out.WriteString(tok)
+        case is_tag && !is_img:
+            // the markup taken out is dropped, the new one is kept as it is
+            close_mark()
+            if op=='+'{
+                out.WriteString(tok)
+            }
+        default:
+            if open !=op{
+                close_mark()
+                if op=='-'{
+                    out.WriteString("<del>")
+                }else{
+                    out.WriteString("<ins>")
+                }
+                open = op
+            }
+            out.WriteString(tok)
+        }
+    }
+    close_mark()
+    for _,tok :=range(b[len(b)-tail:]){
+        out.WriteString(tok)
+    }
+    return out.String()
+}
+
+// diff_runs makes the changes read as phrases: the spaces kept between two
+// changes become part of them, and in each change the old words come first
+func diff_runs(ops []byte,toks []string)([]byte,[]string){
+    var run_ops []byte
+    var run_toks []string
+    var new_ops []byte
+    var new_toks []string
+    flush := func(){
+        for k,op :=range(run_ops){
+            if op=='-'{
+                new_ops,new_toks = append(new_ops,op),append(new_toks,run_toks[k])
+            }
+        }
+        for k,op :=range(run_ops){
+            if op=='+'{
+                new_ops,new_toks = append(new_ops,op),append(new_toks,run_toks[k])
+            }
+        }
+        run_ops,run_toks = nil,nil
+    }
+    for k:=0;k<len(ops);k++{
+        if ops[k] !='='{
+            run_ops,run_toks = append(run_ops,ops[k]),append(run_toks,toks[k])
+            continue
+        }
+        // the same tokens up to the next change
+        end := k
+        blank := true
+        for end<len(ops) && ops[end]=='='{
+            if strings.TrimSpace(toks[end]) !=""{
+                blank = false
+            }
+            end++
+        }
+        if blank && len(run_ops)>0 && end<len(ops){
+            for _,tok :=range(toks[k:end]){
+                run_ops,run_toks = append(run_ops,'-','+'),append(run_toks,tok,tok)
+            }
+        }else{
+            flush()
+            new_ops,new_toks = append(new_ops,ops[k:end]...),append(new_toks,toks[k:end]...)
+        }
+        k = end-1
+    }
+    flush()
+    return new_ops,new_toks
+}
+
+func note_update_name(db_link Db_link,file_dir string, file_name string,new_name string)(bool,error){
+    if sys_delim() =="\\"{
+        file_dir =strings.ReplaceAll(file_dir,"\\","/")
+    }
+    
+    err:=label_file_rename(db_link,file_dir+file_name,file_dir+new_name)
+    if err ==nil{
+        err = wiki_file_rename(db_link,file_dir+file_name,file_dir+new_name)
+    }
+    if err !=nil{
+        return false,err
+    }
+    // all the notes and replies of the file
+    tab_note:=get_table("file_note")
+    tab_note.set("file_name",new_name).where("file_dir","=",file_dir).where("file_name","=",file_name)
+    cnt,err:= do_update(db_link,tab_note.pack_update(nil))
+    if err !=nil{
+        return false, err
+    }
+    if cnt ==0{
+        return false,errors.New("no record")
+    }
+    return true,nil
+}
+
+// note_move_file puts the notes and replies of a file on another one, with their labels and links
+func note_move_file(db_link Db_link,file_dir string,file_name string,new_dir string,new_name string)(bool,error){
+    err:=label_file_rename(db_link,file_dir+file_name,new_dir+new_name)
+    if err ==nil{
+        err = wiki_file_rename(db_link,file_dir+file_name,new_dir+new_name)
+    }
+    if err !=nil{
+        return false,err
+    }
+    tab_note:=get_table("file_note")
+    tab_note.set("file_dir",new_dir).set("file_name",new_name).where("file_dir","=",file_dir).where("file_name","=",file_name)
+    cnt,err:= do_update(db_link,tab_note.pack_update(nil))
+    if err !=nil{
+        return false, err
+    }
+    if cnt ==0{
+        return false,errors.New("no record")
+    }
+    return true,nil
+}
+
+func note_update_folder(db_link Db_link,file_dir string, file_name string,new_name string)(bool,error){
+    if sys_delim() =="\\"{
+        file_dir =strings.ReplaceAll(file_dir,"\\","/")
+    }    
+    err:=label_file_rename(db_link,file_dir+file_name,new_name+file_name)
+    if err ==nil{
+        err = wiki_file_rename(db_link,file_dir+file_name,new_name+file_name)
+    }
+    if err !=nil{
+        return false,err
+    }
+    tab_note:=get_table("file_note")
+    tab_note.set("file_dir",new_name).where("file_dir","=",file_dir).where("file_name","=",file_name)
+    cnt,err:= do_update(db_link,tab_note.pack_update(nil))
+    if err !=nil{
+        return false, err
+    }
+    if cnt ==0{
+        fmt.Printf("not found:file_dir:%s,file_name:%s\n",file_dir,file_name)
+        return false,errors.New("no record")
+    }
+    return true,nil
+}
+
+func note_folder_like(db_link Db_link, folder_prefix string)([]Note_record,error){
+    var result []Note_record
+    tab_note :=get_table("file_note")
+    tab_note.where("file_dir","like",like_escape(folder_prefix)+"%")
+    rows,err :=do_query(db_link,tab_note.pack_select("tag,file_dir,file_name,note,color,ndate","",""))
+    if err !=nil{
+        return result,err
+    }
+    var row Note_record
+    defer rows.Close()
+    for rows.Next(){
+        err =rows.Scan(&row.Tag,&row.File_dir,&row.File_name,&row.Note,&row.Color,&row.Ndate)
+        if err !=nil{
+            return result, err
+        }
+        result = append(result,row)
+    }
+    return result, nil
+}
+
+func note_change_path(db_link Db_link, folder_prefix string, new_prefix string)(bool, error){
+    if folder_prefix==""{
+        return false,errors.New("changing root_dir is not allowed")
+    }
+    err := label_files_move(db_link,folder_prefix,new_prefix)
+    if err ==nil{
+        err = wiki_files_move(db_link,folder_prefix,new_prefix)
+    }
+    if err !=nil{
+        return false, err
+    }
+    records,err := note_folder_like(db_link, folder_prefix)
+    if err !=nil{
+        return false, err
+    }
+
+    tab:=get_table("file_note")
+    check := []string{"tag"}
+    for _,record:=range(records){
+        if strings.HasPrefix(record.File_dir,folder_prefix){
+            new_file_dir := strings.Replace(record.File_dir,folder_prefix,new_prefix,1)
+            tab.set("tag",record.Tag).set("file_dir",new_file_dir)
+            _,err :=do_update(db_link,tab.pack_update(check))
+            if err!=nil{
+                return false, err
+            }
+        }
+    }
+    return true,nil
+}
+
+
+func note_update_dirs(db_link Db_link, old_dir string,new_name string,roots Roots,delim string,full_path bool)(bool,error){
+    // old_dir and root_dir is in native form
+    old_name :=old_dir
+    if strings.HasSuffix(old_dir,delim){
+        old_name = old_dir[0:(len(old_dir)-1)] 
+    }
+    query_path:=roots.rel(old_dir)
+    if delim=="\\"{
+        //for windows
+        query_path = strings.ReplaceAll(query_path,"\\","/")
+    }
+    // the labels of the files in the folder
+    label_prefix := roots.rel(path_dir_name(old_name,delim))+new_name+delim
+    if full_path{
+        label_prefix = new_name
+    }
+    if delim=="\\"{
+        label_prefix = strings.ReplaceAll(label_prefix,"\\","/")
+    }
+    if query_path !="" && strings.HasSuffix(query_path,"/"){
+        err:=label_files_move(db_link,query_path,label_prefix)
+        if err ==nil{
+            err = wiki_files_move(db_link,query_path,label_prefix)
+        }
+        if err !=nil{
+            return false,err
+        }
+    }
+    tab_note :=get_table("file_note")
+    tab_note.where("file_dir","like",like_escape(query_path)+"%")
+    row,err :=do_query(db_link,tab_note.pack_select("tag,file_dir","",""))
+    if err !=nil{
+        return false,err
+    }
+    defer row.Close()
+    tag :=""
+    file_dir :=""
+    data :=make(map[string]string)
+    for row.Next(){
+        row.Scan(&tag,&file_dir)
+        data[tag]=file_dir
+    }
+    
+    name_len := len(path_file_name(old_name,delim))
+    dir_prefix:=roots.rel(path_dir_name(old_name,delim))
+
+    has_error:=false
+    for k,v :=range(data){
+        if strings.HasPrefix(v,dir_prefix){
+            //guand against bad return of previous query
+            var new_file_dir string
+            if full_path{
+                new_file_dir=new_name
+            }else{
+                idx_start:=len(dir_prefix)+name_len
+                if idx_start >=len(v){
+                    continue
+                }
+                tail := v[idx_start:len(v)]
+                new_file_dir=dir_prefix+new_name+tail
+            }
+            if delim=="\\"{
+                //for windows, in the file_note table, delim is normalized to "/"
+                new_file_dir = strings.ReplaceAll(new_file_dir,"\\","/")
+            }
+            tab_update :=get_table("file_note")
+            tab_update.set("tag",k).set("file_dir",new_file_dir)
+            _,err=do_update(db_link,tab_update.pack_update([]string{"tag"}))
+            if err !=nil{
+                fmt.Println("error:"+err.Error()) 
+                has_error =true
+            }
+
+        }
+    }
+    if has_error{
+        return false,err
+    }
+    return true, nil
+}
+
+// get_note_map gives the notes and replies of each file in the folder, the oldest first
+func get_note_map(db_link Db_link,device_id uint64,ino uint64,roots Roots,st *Store) (map[string][]Note_record, error){
+    tab_note:=get_table("file_note")
+    delim :=sys_delim()
+    result := make(map[string][]Note_record)
+    this_url,err:=file_url(db_link,device_id,ino,100,delim)
+    if err !=nil{
+        return result,err
+    }
+
+    rel_file_url:=roots.rel(this_url)
+    rel_file_dir := path_dir_name (rel_file_url,delim)
+    if delim=="\\"{
+        rel_file_dir=strings.ReplaceAll(rel_file_dir,"\\","/")
+    }
+
+    tab_note.set("file_dir",rel_file_dir)
+    rows, err := do_query(db_link,tab_note.pack_select("tag,file_name,note,color,ndate,parent_tag,format","nid asc",""))
+    defer rows.Close()
+    if err !=nil{
+        return result,err
     }
     reg :=regexp.MustCompile(`#<0x_([\d\w]+)_>`)
     for rows.Next(){
         var fnv Note_record
-        rows.Scan(&fnv.Tag,&fnv.Name,&fnv.Note,&fnv.Color)        
+        rows.Scan(&fnv.Tag,&fnv.Name,&fnv.Note,&fnv.Color,&fnv.Ndate,&fnv.Parent_tag,&fnv.Format)        
         mats := reg.FindStringSubmatch(fnv.Note)
         if len(mats)>1{
-            _,real_note,err:=get_text(db_link, db_folder,mats[1])
+            _,real_note,err:=get_text(db_link, st,mats[1])
             if err==nil{
                 fnv.Note=real_note
             }
         }
-        result[fnv.Name]=fnv
+        result[fnv.Name]=append(result[fnv.Name],fnv)
+    }
+    return result,nil
+}
+
+// folder_notes_map gives the latest note on each folder right under rel_dir, by
+// folder name. A folder's note is kept on file_dir "rel_dir/name/" with no file_name.
+func folder_notes_map(db_link Db_link,st *Store,rel_dir string)(map[string]Note_record,error){
+    result := make(map[string]Note_record)
+    tab_note:=get_table("file_note")
+    tab_note.set("file_name","").set("parent_tag","").where("file_dir","like",like_escape(rel_dir)+"%")
+    rows,err := do_query(db_link,tab_note.pack_select("tag,file_dir,note,color,ndate,format","nid asc",""))
+    if err !=nil{
+        return result,err
+    }
+    var records []Note_record
+    for rows.Next(){
+        var row Note_record
+        err = rows.Scan(&row.Tag,&row.File_dir,&row.Note,&row.Color,&row.Ndate,&row.Format)
+        if err !=nil{
+            rows.Close()
+            return result,err
+        }
+        records = append(records,row)
+    }
+    rows.Close()
+    for _,row :=range(records){
+        name := strings.TrimSuffix(row.File_dir[len(rel_dir):],"/")
+        if name=="" || strings.Contains(name,"/"){
+            // the folder itself or a deeper one
+            continue
+        }
+        text,err := note_text(db_link,st,row.Note)
+        if err ==nil{
+            row.Note = text
+        }
+        row.Name = name
+        row.Color_str = color_decode(row.Color)
+        result[name] = row
     }
     return result,nil
 }
 
-func assign_note(db_link *sql.DB,note_tag string, dev_ino string, root_dir string)(bool,error){
+func assign_note(db_link Db_link,note_tag string, dev_ino string, roots Roots)(bool,error){
     dev_id,ino,err:=dev_ino_uint64(dev_ino)
     sys_delim :=sys_delim()
     if err!=nil{
@@ -2612,7 +4115,7 @@ func assign_note(db_link *sql.DB,note_tag string, dev_ino string, root_dir strin
     if !ok || err!=nil{
         return false,errors.New("file not found")
     }
-    file_url_rel := relative_path_of(file_url,root_dir)
+    file_url_rel := roots.rel(file_url)
 
     if sys_delim=="\\"{
         file_url_rel=strings.ReplaceAll(file_url_rel,"\\","/")
@@ -2628,6 +4131,13 @@ func assign_note(db_link *sql.DB,note_tag string, dev_ino string, root_dir strin
     if err !=nil{
         return false, err
     }
+    // the replies go with the note
+    tab_replies:=get_table("file_note")
+    tab_replies.set("file_dir",file_dir).set("file_name",file_name).where("parent_tag","=",note_tag)
+    _,err=do_update(db_link,tab_replies.pack_update(nil))
+    if err !=nil{
+        return false, err
+    }
     return true,err
 }
 
@@ -2643,7 +4153,7 @@ func color_decode(id int) string{
 
 
 // for ino_tree talbe and fs things
-func rebuild(db_link *sql.DB,root_dir string)(bool, error){
+func rebuild(db_link Db_link,roots Roots)(bool, error){
     page_len := 50
     count,err := notes_count(db_link)
     if err !=nil{
@@ -2658,7 +4168,11 @@ func rebuild(db_link *sql.DB,root_dir string)(bool, error){
         }
         for _,nt:=range(notes){
             // register_ino(db,)
-            paths :=folder_split(root_dir+nt.File_dir+nt.File_name,root_dir,sys_delim())
+            root,rel := roots.split(nt.File_dir+nt.File_name)
+            if root==nil{
+                continue
+            }
+            paths :=folder_split(root.Dir+str_native_delim(rel),root.Dir,sys_delim())
             for _,path :=range(paths){
                 all_paths[path]=true
             }
@@ -2667,7 +4181,7 @@ func rebuild(db_link *sql.DB,root_dir string)(bool, error){
 
     for path,_ :=range(all_paths){
         is_root:=false
-        if path == root_dir{
+        if roots.is_root(path){
             is_root= true
         }
         refresh_folder(db_link,path,is_root)
@@ -2679,7 +4193,7 @@ func rebuild(db_link *sql.DB,root_dir string)(bool, error){
 
 }
 
-func file_rename(db_link *sql.DB,old_url string,new_name string,root_dir string)(bool,error){
+func file_rename(db_link Db_link,old_url string,new_name string,roots Roots)(bool,error){
     delim :=sys_delim()
  
     old_name := path_file_name(old_url,delim)
@@ -2701,7 +4215,7 @@ func file_rename(db_link *sql.DB,old_url string,new_name string,root_dir string)
     }
 
     // handle file_note
-    file_dir :=relative_path_of(dir,root_dir)
+    file_dir :=roots.rel(dir)
     // for windows
     if delim=="\\"{
         file_dir=strings.ReplaceAll(file_dir,"\\","/")
@@ -2709,21 +4223,20 @@ func file_rename(db_link *sql.DB,old_url string,new_name string,root_dir string)
 
     _,err=note_update_name(db_link,file_dir,old_name,new_name)
 
+    if err !=nil && err.Error()!="no record"{
+        return false, err
+    }
+    err = fingerprint_move(db_link,file_dir+old_name,file_dir+new_name)
     if err !=nil{
-        if err.Error()=="no record"{
-            return true,nil
-        }else{
-            return false, err
-        }       
+        return false,err
     }
-
     return true,nil  
 }
 
-func folder_rename(db_link *sql.DB,old_url,new_name string,root_dir string)(string,error){
+func folder_rename(db_link Db_link,old_url,new_name string,roots Roots)(string,error){
     delim :=sys_delim()
 
-    if old_url ==root_dir{
+    if roots.is_root(old_url){
         return "",errors.New("root_dir rename is not allowed")
     }
     old_path := old_url
@@ -2740,14 +4253,18 @@ func folder_rename(db_link *sql.DB,old_url,new_name string,root_dir string)(stri
         return "",err
     }
     // handle ino tree
-    refresh_folder(db_link,old_dir,old_dir==root_dir)
+    refresh_folder(db_link,old_dir,roots.is_root(old_dir))
     
     // handle file_note
-    _,err=note_update_dirs(db_link, old_url,new_name ,root_dir ,delim,false)
+    _,err=note_update_dirs(db_link, old_url,new_name ,roots ,delim,false)
 
     if err !=nil{
         return "", err     
     }
+    err = fingerprint_move(db_link,str_db_delim(roots.rel(old_path))+"/",str_db_delim(roots.rel(old_dir+new_name))+"/")
+    if err !=nil{
+        return "",err
+    }
     return new_path,nil
 }
 
@@ -2763,6 +4280,11 @@ func unescapeHtmlTag(input string)template.HTML{
     return template.HTML(input)
 }
 
+// text_view shows a note or a page in its format, with the wiki links made links
+func text_view(input string,format int)template.HTML{
+    return template.HTML(wiki_render(text_html(input,format)))
+}
+
 func draw_page_bar(page_count int, curr_page int,curr_style string,jump_url string)string{
     r :=""
     for i:=1;i<page_count+1;i++{
@@ -2786,7 +4308,7 @@ type Shortcut_record struct{
     Sc_type string
     Order_id int
 }
-func add_shortcut(db_link *sql.DB, file_dir string, file_name string, sc_type string)(bool,error){
+func add_shortcut(db_link Db_link, file_dir string, file_name string, sc_type string)(bool,error){
 	if sys_delim()=="\\"{
         // in shortcut, delim is normalized to "/"
         file_dir=strings.ReplaceAll(file_dir,"\\","/")
@@ -2807,7 +4329,7 @@ func add_shortcut(db_link *sql.DB, file_dir string, file_name string, sc_type st
 	return true,nil
 }
 
-func del_shortcut(db_link *sql.DB, file_dir string, file_name string,sc_type string)(bool,error){
+func del_shortcut(db_link Db_link, file_dir string, file_name string,sc_type string)(bool,error){
     if sys_delim()=="\\"{
         file_dir=strings.ReplaceAll(file_dir,"\\","/")
     }   
@@ -2822,7 +4344,7 @@ func del_shortcut(db_link *sql.DB, file_dir string, file_name string,sc_type str
 	return true,nil
 }
 
-func del_shortcut_id(db_link *sql.DB,scid string)(bool,error){
+func del_shortcut_id(db_link Db_link,scid string)(bool,error){
     tab := get_table("shortcut")
     tab.set("scid",scid)
 
@@ -2833,15 +4355,15 @@ func del_shortcut_id(db_link *sql.DB,scid string)(bool,error){
 	return true,nil
 }
 
-func get_shortcut_map(db_link *sql.DB, file_url string, root_dir string)(map[string]string,error){
+func get_shortcut_map(db_link Db_link, file_url string, roots Roots)(map[string]string,error){
     tab := get_table("shortcut")
-    rel_url:=relative_path_of(file_url,root_dir)
+    rel_url:=roots.rel(file_url)
     file_dir := path_dir_name(rel_url,sys_delim())
     if sys_delim()=="\\"{
         file_dir=strings.ReplaceAll(file_dir,"\\","/")
     }  
     tab.set("file_dir",file_dir)
-    rows,err:=db_link.Query(tab.pack_select("file_name,type","",""))
+    rows,err:=do_query(db_link,tab.pack_select("file_name,type","",""))
     defer rows.Close()
     result:=make(map[string]string)
     if err!=nil{
@@ -2869,18 +4391,14 @@ func get_shortcut_map(db_link *sql.DB, file_url string, root_dir string)(map[str
 }
 
 
-func get_shortcut_map_folder(db_link *sql.DB, file_url string, root_dir string)(map[string]string,error){
-    rel_dir := relative_path_of(file_url,root_dir) // here file_url should end with /
+func get_shortcut_map_folder(db_link Db_link, file_url string, roots Roots)(map[string]string,error){
+    rel_dir := roots.rel(file_url) // here file_url should end with /
     if sys_delim()=="\\"{
         rel_dir = strings.ReplaceAll(rel_dir,"\\","/")
     }
-    sql_str :=""
-    if rel_dir == ""{
-        sql_str ="select file_dir,type from shortcut where type in (\"d\",\"t\")" // all folders
-    }else{
-        sql_str = "select file_dir,type from shortcut where type in (\"d\",\"t\") and file_dir like \""+rel_dir+"%\""
-    }
-    rows,err:=db_link.Query(sql_str)
+    // all folders when rel_dir is empty
+    sql_str :="select file_dir,type from shortcut where type in ('d','t') and file_dir like ? escape '\\'"
+    rows,err:=db_link.Query(sql_str,like_escape(rel_dir)+"%")
     defer rows.Close()
     result:=make(map[string]string)
     if err!=nil{
@@ -2911,14 +4429,14 @@ func get_shortcut_map_folder(db_link *sql.DB, file_url string, root_dir string)(
     return result,nil
 }
 
-func shortcut_entry(db_link *sql.DB,sc_type string,root_dir string)(string,error){
+func shortcut_entry(db_link Db_link,sc_type string,roots Roots)(string,error){
     tab := get_table("shortcut")
 	tab.set("type",sc_type)
     var temp_list []string
     var file_dir string
     var file_name string
     var rst string 
-    rows,err := db_link.Query(tab.pack_select("file_dir,file_name","",""))
+    rows,err := do_query(db_link,tab.pack_select("file_dir,file_name","",""))
     defer rows.Close()
 
     if err !=nil{
@@ -2929,11 +4447,13 @@ func shortcut_entry(db_link *sql.DB,sc_type string,root_dir string)(string,error
         if err !=nil{
             continue
         }
-        is_root :=false
-        if file_dir =="" && file_name==""{
-            is_root=true
-        }        
-        fnode,err := get_Fnode(root_dir+file_dir+file_name,is_root)
+        path := roots.abs(file_dir+file_name)
+        if path==""{
+            // the root of the pin is not served this time
+            continue
+        }
+        is_root :=roots.is_root(path)
+        fnode,err := get_Fnode(path,is_root)
         if err !=nil{
             continue
         }
@@ -2942,18 +4462,18 @@ func shortcut_entry(db_link *sql.DB,sc_type string,root_dir string)(string,error
         if sc_type=="f"{
             title=file_name
             rst="{'title':'"+title+"',"+"'id':"+strconv.FormatUint(fnode.Ino,10)
-            rst = rst +",'href':'/list/"+strconv.FormatUint(uint64(fnode.Dev),10)+"_"+strconv.FormatUint(fnode.Parent_ino,10)
-            rst = rst +"&"+strconv.FormatUint(uint64(fnode.Dev),10)+"_"+strconv.FormatUint(fnode.Ino,10)+"'}"
+            rst = rst +",'href':'/list/"+strconv.FormatUint(fnode.Dev,10)+"_"+strconv.FormatUint(fnode.Parent_ino,10)
+            rst = rst +"&"+strconv.FormatUint(fnode.Dev,10)+"_"+strconv.FormatUint(fnode.Ino,10)+"'}"
         }
         if sc_type =="d"{
             if is_root{
-                title=root_dir
+                title=path
             }else{
-                tmp_folder_name :=file_dir[0:(len(file_dir)-1)]
-                title=path_file_name(tmp_folder_name,"/")
+                tmp_folder_name :=path[0:(len(path)-1)]
+                title=path_file_name(tmp_folder_name,sys_delim())
             }
             rst="{'title':'"+title+"',"+"'id':"+strconv.FormatUint(fnode.Ino,10)
-            rst = rst +",'href':'/list/"+strconv.FormatUint(uint64(fnode.Dev),10)+"_"+strconv.FormatUint(fnode.Ino,10)+"'}\n"
+            rst = rst +",'href':'/list/"+strconv.FormatUint(fnode.Dev,10)+"_"+strconv.FormatUint(fnode.Ino,10)+"'}\n"
         }
         temp_list=append(temp_list,rst)  
     }
@@ -2962,12 +4482,12 @@ func shortcut_entry(db_link *sql.DB,sc_type string,root_dir string)(string,error
 //  child:[{  title:'Cleaving-ribozyme',id:1380,href:'/list/16777218_1380'  },{  title:'CRISPR',id:1131,href:'/list/16777218_1131'  }]
 }
 
-func shortcut_list(db_link *sql.DB,sc_type string)([]Shortcut_record,error){
+func shortcut_list(db_link Db_link,sc_type string)([]Shortcut_record,error){
     tab := get_table("shortcut")
 	tab.set("type",sc_type)
     var result []Shortcut_record
     var record Shortcut_record 
-    rows,err := db_link.Query(tab.pack_select("scid,file_dir,file_name,type","",""))
+    rows,err := do_query(db_link,tab.pack_select("scid,file_dir,file_name,type","",""))
     defer rows.Close()
 
     if err !=nil{
@@ -2997,11 +4517,11 @@ func shortcut_map_to_str(sc_map map[string]string,sc_type string) string{
     return ""
 }
 
-func get_shortcut_records(db_link *sql.DB,file_dir string, file_name string)([]Shortcut_record,error){
+func get_shortcut_records(db_link Db_link,file_dir string, file_name string)([]Shortcut_record,error){
     tab := get_table("shortcut")
 	tab.set("file_dir",file_dir).set("file_name",file_name)
     var result []Shortcut_record    
-    rows,err := db_link.Query(tab.pack_select("scid,file_dir,file_name,type","",""))
+    rows,err := do_query(db_link,tab.pack_select("scid,file_dir,file_name,type","",""))
     defer rows.Close()
 
     if err !=nil{
@@ -3019,9 +4539,9 @@ func get_shortcut_records(db_link *sql.DB,file_dir string, file_name string)([]S
     return result,err
 }
 
-func shortcut_rename_file(db_link *sql.DB,old_url string, new_name string,root_dir string)(bool,error){
+func shortcut_rename_file(db_link Db_link,old_url string, new_name string,roots Roots)(bool,error){
     delim :=sys_delim()
-    rel_url := relative_path_of(old_url,root_dir)
+    rel_url := roots.rel(old_url)
     file_dir := path_dir_name(rel_url,delim)
     file_name := path_file_name(rel_url,delim)
     if delim=="\\"{
@@ -3048,13 +4568,14 @@ func shortcut_rename_file(db_link *sql.DB,old_url string, new_name string,root_d
     return true,nil
 }
 
-func shortcut_folder_like(db_link *sql.DB,folder_prefix string) ([]Shortcut_record,error){
+func shortcut_folder_like(db_link Db_link,folder_prefix string) ([]Shortcut_record,error){
     var result []Shortcut_record
     if folder_prefix==""{
         return result,errors.New("query empty")
     }
-    sql_str := "select scid,file_dir,file_name,type from shortcut where file_dir like \""+folder_prefix+"%\""
-    rows,err:=db_link.Query(sql_str)
+    tab := get_table("shortcut")
+    tab.where("file_dir","like",like_escape(folder_prefix)+"%")
+    rows,err:=do_query(db_link,tab.pack_select("scid,file_dir,file_name,type","",""))
     defer rows.Close()
     if err !=nil{
         return result,err
@@ -3070,7 +4591,7 @@ func shortcut_folder_like(db_link *sql.DB,folder_prefix string) ([]Shortcut_reco
     return result,nil
 }
 
-func shortcut_change_path(db_link *sql.DB,folder_prefix string, new_prefix string)(bool,error){
+func shortcut_change_path(db_link Db_link,folder_prefix string, new_prefix string)(bool,error){
     records,err :=shortcut_folder_like(db_link,folder_prefix)
     if err !=nil{
         return false,err
@@ -3091,13 +4612,14 @@ func shortcut_change_path(db_link *sql.DB,folder_prefix string, new_prefix strin
 }
 
 
-func shortcut_rename_folder(db_link *sql.DB,old_url string, new_name string,root_dir string,full_path bool)(bool,error){
-    rel_url := relative_path_of(old_url,root_dir)
+func shortcut_rename_folder(db_link Db_link,old_url string, new_name string,roots Roots,full_path bool)(bool,error){
+    rel_url := roots.rel(old_url)
     sys_delim :=sys_delim()
     file_dir := path_dir_name(rel_url,sys_delim)
     data := make(map[int]string)
-    sql_str := "select scid,file_dir from shortcut where file_dir like \""+file_dir+"%\""
-    rows,err:=db_link.Query(sql_str)
+    tab_query := get_table("shortcut")
+    tab_query.where("file_dir","like",like_escape(file_dir)+"%")
+    rows,err:=do_query(db_link,tab_query.pack_select("scid,file_dir","",""))
     defer rows.Close()
 
     if err!=nil{
@@ -3154,11 +4676,11 @@ func shortcut_rename_folder(db_link *sql.DB,old_url string, new_name string,root
 
 
 // for stash
-func get_shortcut_by_id(db_link *sql.DB,scid string) (Shortcut_record,error){
+func get_shortcut_by_id(db_link Db_link,scid string) (Shortcut_record,error){
     var result Shortcut_record
     tab := get_table("shortcut")
 	tab.set("scid",scid)
-    rows,err := db_link.Query(tab.pack_select("scid,file_dir,file_name,type","",""))
+    rows,err := do_query(db_link,tab.pack_select("scid,file_dir,file_name,type","",""))
     defer rows.Close()
     if err!=nil{
         return result, err
@@ -3171,24 +4693,28 @@ func get_shortcut_by_id(db_link *sql.DB,scid string) (Shortcut_record,error){
     return result,nil
 }
 
-func shortcut_update_folder(db_link *sql.DB,file_dir string, file_name string, new_name string)(bool,error){
-
-    new_name = strings.ReplaceAll(new_name,"\"","\"\"")
-    file_name = strings.ReplaceAll(file_name,"\"","\"\"")
-    file_dir = strings.ReplaceAll(file_dir,"\"","\"\"")
-    sql_str := "update shortcut set file_dir=\""+new_name+"\" where file_name=\""+file_name+"\" and file_dir=\""+file_dir+"\""
-    sql_run,err:= db_link.Prepare(sql_str)
-    if err !=nil{
-        return false, err
+func shortcut_update_folder(db_link Db_link,file_dir string, file_name string, new_name string)(bool,error){
+    tab := get_table("shortcut")
+    tab.set("file_dir",new_name).where("file_name","=",file_name).where("file_dir","=",file_dir)
+    _,err:= do_update(db_link,tab.pack_update([]string{}))
+    if err!=nil{
+        return false,err
     }
-    _,err=sql_run.Exec()
+    return true,nil
+}
+
+// shortcut_move_file follows a file moved to another folder, the paths are from the root
+func shortcut_move_file(db_link Db_link,file_dir string,file_name string,new_dir string,new_name string)(bool,error){
+    tab := get_table("shortcut")
+    tab.set("file_dir",new_dir).set("file_name",new_name).where("file_name","=",file_name).where("file_dir","=",file_dir)
+    _,err:= do_update(db_link,tab.pack_update([]string{}))
     if err!=nil{
         return false,err
     }
     return true,nil
 }
 
-func stash_putdown(db_link *sql.DB,scid string,dev_ino string, root_dir string) (bool,error){
+func stash_putdown(db_link Db_link,scid string,dev_ino string, roots Roots) (bool,error){
     delim :=sys_delim()
     stashed,err :=get_shortcut_by_id(db_link,scid)
     if err !=nil{
@@ -3206,12 +4732,16 @@ func stash_putdown(db_link *sql.DB,scid string,dev_ino string, root_dir string)
         return false,errors.New("not folder")
     }
 
-    new_dir := relative_path_of(url, root_dir)
+    new_dir := roots.rel(url)
     switch stashed.Sc_type{
     case "s":
         // 1.move the file
         // err=os.Rename(root_dir+stashed.File_dir+stashed.File_name,url+stashed.File_name)
-        _,err =file_safe_mv(str_native_delim(root_dir+stashed.File_dir+stashed.File_name),str_native_delim(url+stashed.File_name),false) // no force
+        src := roots.abs(stashed.File_dir+stashed.File_name)
+        if src==""{
+            return false,errors.New("the root of the stashed file is not served")
+        }
+        _,err =file_safe_mv(src,str_native_delim(url+stashed.File_name),false) // no force
         if err!=nil{
             return false,err
         }
@@ -3236,14 +4766,18 @@ func stash_putdown(db_link *sql.DB,scid string,dev_ino string, root_dir string)
             return false,errors.New("folder format problem")
         }
         
-        temp_path := stashed.File_dir[0:(len(stashed.File_dir)-1)]
-        name := path_file_name(temp_path,"/")
+        src := roots.abs(stashed.File_dir)
+        if src==""{
+            return false,errors.New("the root of the stashed folder is not served")
+        }
+        temp_path := src[0:(len(src)-1)]
+        name := path_file_name(temp_path,delim)
 
-        if strings.Contains(new_dir+name+"/",stashed.File_dir){
+        if strings.HasPrefix(str_db_delim(new_dir),stashed.File_dir) || str_db_delim(new_dir+name+"/")==stashed.File_dir{
             return false, errors.New("moving folder into sub-folders not allowed")
         }
         // 1.move the file 
-        _,err:=file_safe_mv(str_native_delim(root_dir+stashed.File_dir),str_native_delim(root_dir+new_dir+name+"/"),false)
+        _,err:=file_safe_mv(src,url+name+delim,false)
         if err !=nil{
             return false,err
         }
@@ -3269,587 +4803,6655 @@ func stash_putdown(db_link *sql.DB,scid string,dev_ino string, root_dir string)
     return true,nil
 }
 
-// for settings
-func has_setting(db_link *sql.DB,key string,note string) (bool,error){
-    tab :=get_table("settings")
-	tab.set("key",key)
-    if note !=""{
-        tab.set("note",note)
-    }
-	count,err := do_count(db_link,tab.pack_count("cnt"))
-	if err !=nil{
-		return false,err
-	}
-	if count ==0{
-		return false,nil
-	}
-	return true,nil
+//=====================================================================
+// for pdf annotations
+// An annotation is a note of the file with a note_anchor row, which keeps the
+// page and, if any, the quoted text and an area of the page. Everything else,
+// the text, the search, the labels, the history and the renames, is the note's.
+type Note_anchor struct{
+    Tag string
+    Page int // counts from 1
+    Quote string
+    Rect string // "x,y,w,h" in percents of the page, "" for none
 }
 
-func get_setting(db_link *sql.DB,key string,note string) (string,error){
-	tab :=get_table("settings")
-	tab.set("key",key)
-    if note !=""{
-        tab.set("note",note)
+// rect_parse checks the area typed in, "10,20,30,5" or with spaces, and gives
+// it back in the stored form
+func rect_parse(rect string)(string,error){
+    rect = strings.TrimSpace(rect)
+    if rect ==""{
+        return "",nil
     }
-	rows,err:=db_link.Query(tab.pack_select("value","",""))
-	defer rows.Close()
-	if err!=nil{
-		return "",err
-	}
-	if rows.Next(){
-		var value string
-		rows.Scan(&value)
-		return value,nil
-	}
-	return "",nil
+    parts := strings.FieldsFunc(rect,func(r rune)bool{ return r==',' || r==' ' })
+    if len(parts) !=4{
+        return "",errors.New("the area is x,y,width,height")
+    }
+    var nums []string
+    for _,part :=range(parts){
+        v,err := strconv.ParseFloat(part,64)
+        if err !=nil || v <0 || v >100{
+            return "",errors.New("the area is in percents of the page, 0 to 100")
+        }
+        nums = append(nums,strconv.FormatFloat(v,'f',-1,64))
+    }
+    return strings.Join(nums,","),nil
 }
 
-func set_setting(db_link *sql.DB,key string, value string,note string)(bool,error){
-	tab :=get_table("settings")
-	tab.set("key",key).set("value",value)
-	if note !=""{
-		tab.set("note",note)
-	}
-	yes,err:= has_setting(db_link,key,note)
-	if err!=nil{
-		return false,err
-	}
-	if yes{
-		update_sql:=""
-		if note !=""{
-			update_sql=tab.pack_update([]string{"key","note"})
-		}else{
-			update_sql=tab.pack_update([]string{"key"})
-		}
-		_,err:= do_update(db_link,update_sql)
-		if err!=nil{
-			return false,err
-		}
-		return true,nil
-	}
-	_,err= do_insert(db_link,tab.pack_insert())
-	if err!=nil{
-		return false,err
-	}
-	return true,nil
-}
-func clear_setting(db_link *sql.DB,key string, note string)(bool,error){
-	tab :=get_table("settings")
-	tab.set("key",key)
-    if note !=""{
-        tab.set("note",note)
+// anchor_set puts the note at the anchor, page 0 makes it a note of the whole file again
+func anchor_set(db_link Db_link,anchor Note_anchor)error{
+    err := anchor_del(db_link,anchor.Tag)
+    if err !=nil || anchor.Page ==0{
+        return err
     }
-	_,err:=do_delete(db_link,tab.pack_delete())
-	if err!=nil{
-		return false,err
-	}
-	return true, nil
+    if anchor.Page <0{
+        return errors.New("bad page number")
+    }
+    tab := get_table("note_anchor")
+    tab.set("tag",anchor.Tag).set("page",strconv.Itoa(anchor.Page)).set("quote",anchor.Quote).set("rect",anchor.Rect)
+    _,err = do_insert(db_link,tab.pack_insert())
+    return err
 }
 
-func set_host_setting(db_link *sql.DB,host_name string,key string,value string)(bool,error){
-    return set_setting(db_link,key,value,host_name)
+func anchor_del(db_link Db_link,tag string)error{
+    tab := get_table("note_anchor")
+    tab.set("tag",tag)
+    _,err := do_delete(db_link,tab.pack_delete())
+    return err
 }
 
-func get_host_setting(db_link *sql.DB,host_name string,key string,default_value string)(string){
-    val,err:=get_setting(db_link,key,host_name)
+// anchors_map gives the anchors of the notes that have one
+func anchors_map(db_link Db_link,tags []string)(map[string]Note_anchor,error){
+    result := make(map[string]Note_anchor)
+    if len(tags)==0{
+        return result,nil
+    }
+    rows,err := db_link.Query("select tag,page,quote,rect from note_anchor where tag in ("+placeholders(len(tags))+")",
+        str_args(tags)...)
     if err !=nil{
-        return default_value
+        return result,err
     }
-    if val==""{
-        return default_value
+    defer rows.Close()
+    for rows.Next(){
+        var row Note_anchor
+        var quote,rect sql.NullString
+        err = rows.Scan(&row.Tag,&row.Page,&quote,&rect)
+        if err !=nil{
+            return result,err
+        }
+        row.Quote = quote.String
+        row.Rect = rect.String
+        result[row.Tag] = row
     }
-    return val
-}
-
-func set_sys_setting(db_link *sql.DB,key string,value string)(bool,error){
-    return set_setting(db_link,key,value,"sys")
+    return result,nil
 }
 
-func get_sys_setting(db_link *sql.DB,key string,default_value string)string{
-    val,err:=get_setting(db_link,key,"sys")
+// note_anchors fills in the anchors of the notes
+func note_anchors(db_link Db_link,notes []Note_record)error{
+    var tags []string
+    for _,note :=range(notes){
+        tags = append(tags,note.Tag)
+    }
+    anchors,err := anchors_map(db_link,tags)
     if err !=nil{
-        return default_value
+        return err
     }
-    if val==""{
-        return default_value
+    for i:=range(notes){
+        notes[i].Anchor = anchors[notes[i].Tag]
     }
-    return val
-}
-
-func set_host_root(db_link *sql.DB,host_name string,root_dir string)(bool,error){
-	return set_setting(db_link,"root_dir",root_dir,host_name)
-}
-
-func get_host_root(db_link *sql.DB,host_name string)(string,error){
-	return get_setting(db_link,"root_dir",host_name)
-}
-
-func set_page_wrap_class(db_link *sql.DB,host_name string,cls string)(bool,error){
-	return set_setting(db_link,"wrap_class",cls,host_name)
-}
-func get_page_wrap_class(db_link *sql.DB,host_name string)(string){
-	return get_host_setting(db_link,host_name,"wrap_class","content_wrap")
+    return nil
 }
 
-func get_setting_with_digit(db_link *sql.DB,key string,default_val int)int{
-    len_str := get_sys_setting(db_link,"img_page_len","")
-    if len_str ==""{
-        return default_val // default
+// file_annotations gives the anchored notes of the file, by page.
+// The replies to them are left out, they are in the thread of the note.
+func file_annotations(db_link Db_link,st *Store,file_dir string,file_name string)([]Note_record,error){
+    var result []Note_record
+    notes,err := file_notes(db_link,st,file_dir,file_name)
+    if err !=nil{
+        return result,err
     }
-    len_int,err := strconv.Atoi(len_str)
-    if err!=nil{
-        return default_val
+    err = note_anchors(db_link,notes)
+    if err !=nil{
+        return result,err
     }
-    return len_int
-}
-
-func get_img_page_len(db_link *sql.DB)int{
-    return get_setting_with_digit(db_link,"img_page_len",20)
-}
-
-func set_img_page_len(db_link *sql.DB,length string)(bool,error){
-    return set_sys_setting(db_link,"img_page_len",length)
+    for _,note :=range(notes){
+        if note.Anchor.Page >0{
+            result = append(result,note)
+        }
+    }
+    sort.SliceStable(result,func(i,j int)bool{ return result[i].Anchor.Page < result[j].Anchor.Page })
+    return result,nil
 }
 
+//=====================================================================
+// for wiki links
+// [[note:TAG]], [[article:TAG]] and [[file:PATH]] in a note or an article page
+// link to another note, article or file, [[file:TAG]] to the file of the note
+// TAG. The text shown can follow a "|": [[file:papers/a.pdf|the paper]].
+// wiki_link keeps the links of each note and page, a file link keeps the ino
+// of the file too, so the file is found in ino_tree after it is renamed.
+const(
+    wiki_app_note = 1
+    wiki_app_page = 2
+)
 
-func get_article_list_len(db_link *sql.DB)int{
-    return get_setting_with_digit(db_link,"article_list_len",50)
-}
+var wiki_link_reg = regexp.MustCompile(`\[\[(note|article|file):([^\]|<>]+)(?:\|([^\]<>]*))?\]\]`)
 
-func set_article_list_len(db_link *sql.DB,length string)(bool,error){
-    return set_sys_setting(db_link,"article_list_len",length)
+type Wiki_link struct{
+    Wlid int64
+    App int
+    App_tag string // the note, or the article page
+    Owner string // the note, or the article of the page
+    Kind string // note, article or file
+    Target string // a tag, or a path from the root with "/"
+    Host_name string
+    Device_id uint64
+    Ino uint64
 }
 
-
-func get_notes_page_len(db_link *sql.DB)int{
-    return get_setting_with_digit(db_link,"notes_page_len",50)
+// Backlink is a note or an article linking to something
+type Backlink struct{
+    Kind string // note or article
+    Tag string
+    Title string
+    Link string
+    Target string // the link as written, [[kind:target]]
+}
+
+// wiki_targets gives the links in the text, each once. The text of an html
+// note has them escaped like the rest of it.
+func wiki_targets(text string)[][2]string{
+    var result [][2]string
+    seen := make(map[string]bool)
+    for _,mats :=range(wiki_link_reg.FindAllStringSubmatch(text,-1)){
+        target := strings.TrimSpace(strings.ReplaceAll(html.UnescapeString(mats[2]),"\u00a0"," "))
+        if target =="" || seen[mats[1]+":"+target]{
+            continue
+        }
+        seen[mats[1]+":"+target] = true
+        result = append(result,[2]string{mats[1],target})
+    }
+    return result
 }
 
-func set_notes_page_len(db_link *sql.DB,length string)(bool,error){
-    return set_sys_setting(db_link,"notes_page_len",length)
+// wiki_render makes the links of a shown text links to /wiki
+func wiki_render(text string)string{
+    return wiki_link_reg.ReplaceAllStringFunc(text,func(link string)string{
+        mats := wiki_link_reg.FindStringSubmatch(link)
+        target := strings.TrimSpace(html.UnescapeString(mats[2]))
+        shown := strings.TrimSpace(html.UnescapeString(mats[3]))
+        if shown ==""{
+            shown = target
+        }
+        return `<a class="wiki_link" href="/wiki/`+mats[1]+`?target=`+template.URLQueryEscaper(target)+`">`+
+            html.EscapeString(shown)+`</a>`
+    })
 }
 
-func set_db_version(db_link *sql.DB,version string)(bool,error){
-    return set_setting(db_link,"db_version",version,"sys")
+// wiki_path_ok keeps the file links inside the root
+func wiki_path_ok(path string)bool{
+    return !strings.Contains("/"+path+"/","/../") && !strings.HasPrefix(path,"/")
 }
 
-func get_host_opener(db_link *sql.DB,file_type string)(string){
-    opener:= get_host_setting(db_link,get_host_name(),file_type+"_opener","")
-    if opener !=""{
-        return opener
+// wiki_links_put keeps the links in the text of the note or page
+func wiki_links_put(u *Unit,app int,app_tag string,owner string,text string)error{
+    err := wiki_links_del(u.tx,app,app_tag)
+    if err !=nil{
+        return err
     }
-    os_type :=runtime.GOOS
-    var default_opener=make( map[string]string)
-    switch(os_type){
-    case "darwin":
-        return "open"
-    case "linux":
-        default_opener["pdf"]="open"
-        default_opener["docx"]="open"
-        default_opener["doc"]="open"
-        default_opener["pptx"]="open"
-        default_opener["ppt"]="open"
-    case "windows":
-        default_opener["ppt"]="open"
-    default:
-
+    for _,target :=range(wiki_targets(text)){
+        tab := get_table("wiki_link")
+        tab.set("app",strconv.Itoa(app)).set("app_tag",app_tag).set("owner",owner)
+        tab.set("kind",target[0]).set("target",target[1])
+        if target[0]=="file" && u.st.roots.in_served(target[1]) && wiki_path_ok(target[1]){
+            // a note tag is left as it is, the notes follow their files already
+            fnode,err := get_Fnode(u.st.roots.abs(target[1]),false)
+            if err ==nil{
+                tab.set("host_name",get_host_name()).set("device_id",strconv.FormatUint(fnode.Dev,10))
+                tab.set("ino",strconv.FormatUint(fnode.Ino,10))
+            }
+        }
+        _,err = do_insert(u.tx,tab.pack_insert())
+        if err !=nil{
+            return err
+        }
     }
-    default_value,ok :=default_opener[file_type]
-    if !ok{
-        default_value=""
-    } 
-    return default_value
+    return nil
 }
 
-func set_host_opener(db_link *sql.DB,host_name string,file_type string,opener_path string)(bool,error){
-    return set_host_setting(db_link,host_name,file_type+"_opener",opener_path)
+func wiki_links_del(db_link Db_link,app int,app_tag string)error{
+    tab := get_table("wiki_link")
+    tab.set("app",strconv.Itoa(app)).set("app_tag",app_tag)
+    _,err := do_delete(db_link,tab.pack_delete())
+    return err
 }
 
-func enum_host_openers(db_link *sql.DB,host_name string)(string,error){
-    tab :=get_table("settings")
-    tab.set("note",host_name).set("key","%_opener")
-    rows,err:=db_link.Query(tab.pack_select("key,value","",""))
-    if err!=nil{
-        return "",err
+func wiki_links_query(db_link Db_link,where string,args ...interface{})([]Wiki_link,error){
+    var result []Wiki_link
+    rows,err := db_link.Query(`select wlid,app,app_tag,owner,kind,target,ifnull(host_name,''),ifnull(device_id,0),ifnull(ino,0)
+        from wiki_link where `+where+` order by wlid`,args...)
+    if err !=nil{
+        return result,err
     }
-    result:=""
+    defer rows.Close()
     for rows.Next(){
-        k:=""
-        v:=""
-        rows.Scan(&k,&v)
-        t:=strings.Split(k,"_")
-        result=result+t[0]+"="+v+"\n"
+        var row Wiki_link
+        err = rows.Scan(&row.Wlid,&row.App,&row.App_tag,&row.Owner,&row.Kind,&row.Target,&row.Host_name,&row.Device_id,&row.Ino)
+        if err !=nil{
+            return result,err
+        }
+        result = append(result,row)
     }
     return result,nil
 }
 
-func init_settings(db_link *sql.DB)error{
-    host_name := get_host_name()
-    _,err:=set_db_version(db_link,"0.2") // 2022-5-24
-    if err!=nil{
-        return err
+// wiki_file_path finds the file of a file link, by the ino kept for this PC
+// first, then by the note tag or the path. The path is from the root with "/".
+func wiki_file_path(db_link Db_link,roots Roots,link Wiki_link)(string,error){
+    if link.Ino !=0 && link.Host_name ==get_host_name(){
+        url,err := file_url(db_link,link.Device_id,link.Ino,100,sys_delim())
+        if err ==nil{
+            fnode,err := get_Fnode(url,false)
+            if err ==nil && fnode.Dev==link.Device_id && fnode.Ino==link.Ino{
+                return strings.TrimSuffix(strings.ReplaceAll(roots.rel(url),sys_delim(),"/"),"/"),nil
+            }
+        }
     }
-    _,err=set_page_wrap_class(db_link,host_name,"content_wrap")
-    if err!=nil{
-        return err
+    path := link.Target
+    note,err := get_note_by_tag(db_link,link.Target)
+    if err ==nil{
+        path = note.File_dir+note.File_name
     }
-    _,err=set_img_page_len(db_link,"20")
-    if err!=nil{
-        return err
+    if !wiki_path_ok(path){
+        return "",errors.New("the path is out of the served folder")
     }
-    return err
+    if !roots.in_served(path){
+        return "",errors.New("the root of the file is not served")
+    }
+    _,err = get_Fnode(roots.abs(path),false)
+    if err !=nil{
+        return "",errors.New("no such file")
+    }
+    return path,nil
 }
 
+// wiki_target_link gives where the link goes, an error when it is broken
+func wiki_target_link(db_link Db_link,roots Roots,link Wiki_link)(string,error){
+    switch link.Kind{
+    case "note":
+        _,err := get_note_by_tag(db_link,link.Target)
+        if err !=nil{
+            return "",errors.New("no such note")
+        }
+        return "/note_thread/"+link.Target,nil
+    case "article":
+        _,err := get_article_record(db_link,link.Target)
+        if err !=nil{
+            return "",errors.New("no such article")
+        }
+        return "/show_article/"+link.Target,nil
+    case "file":
+        path,err := wiki_file_path(db_link,roots,link)
+        if err !=nil{
+            return "",err
+        }
+        return note_list_link(roots,path_dir_name(path,"/"),path_file_name(path,"/"))
+    }
+    return "",errors.New("unknown link")
+}
 
-// =========================
-//for article table        
-//==========================
-
-type Article_record struct{
-    Artid int64
-    Tag string
-    Shelf_id int
-    Title string
-    Adate string
-    Color string
-}
-
-type Article_page_record struct{
-    Pgid int64
-    Pg_tag string
-    Tag string
-    Order_id int
-    Pdate string
-    Data string
+// wiki_backlinks gives where the links are, a note or an article once
+func wiki_backlinks(db_link Db_link,links []Wiki_link)[]Backlink{
+    var result []Backlink
+    seen := make(map[string]bool)
+    for _,link :=range(links){
+        target := "[["+link.Kind+":"+link.Target+"]]"
+        if link.App ==wiki_app_note{
+            if seen["n"+link.Owner]{
+                continue
+            }
+            seen["n"+link.Owner] = true
+            note,err := get_note_by_tag(db_link,link.Owner)
+            if err !=nil{
+                continue
+            }
+            result = append(result,Backlink{Kind:"note",Tag:link.Owner,Title:note.File_dir+note.File_name,
+                Link:"/note_thread/"+link.Owner,Target:target})
+        }else{
+            if seen["a"+link.Owner]{
+                continue
+            }
+            seen["a"+link.Owner] = true
+            article,err := get_article_record(db_link,link.Owner)
+            if err !=nil{
+                continue
+            }
+            result = append(result,Backlink{Kind:"article",Tag:link.Owner,Title:article.Title,
+                Link:"/show_article/"+link.Owner,Target:target})
+        }
+    }
+    return result
 }
 
-func new_article(db_link *sql.DB,title string,color string,shelf_id string)(string,error){
-    tab := get_table("article")
-    tag,err := tag_gen(db_link)
+// file_backlinks gives what links to the file or to one of its notes
+func file_backlinks(db_link Db_link,roots Roots,file_dir string,file_name string)([]Backlink,error){
+    path := file_dir+file_name
+    targets := []string{path}
+    tab_note := get_table("file_note")
+    tab_note.set("file_dir",file_dir).set("file_name",file_name)
+    rows,err := do_query(db_link,tab_note.pack_select("tag","nid asc",""))
     if err !=nil{
-        return tag,err
+        return nil,err
     }
-    if shelf_id==""{
-        shelf_id="0"
+    var note_tags []string
+    for rows.Next(){
+        var tag string
+        err = rows.Scan(&tag)
+        if err !=nil{
+            rows.Close()
+            return nil,err
+        }
+        note_tags = append(note_tags,tag)
     }
-    if color==""{
-        color="7" // grey
+    rows.Close()
+    targets = append(targets,note_tags...)
+    where := "(kind='file' and target in ("+placeholders(len(targets))+"))"
+    args := str_args(targets)
+    if len(note_tags)>0{
+        where += " or (kind='note' and target in ("+placeholders(len(note_tags))+"))"
+        args = append(args,str_args(note_tags)...)
+    }
+    fnode,err := get_Fnode(roots.abs(path),false)
+    if err ==nil{
+        where += " or (kind='file' and host_name=? and device_id=? and ino=?)"
+        args = append(args,get_host_name(),strconv.FormatUint(fnode.Dev,10),strconv.FormatUint(fnode.Ino,10))
+    }
+    links,err := wiki_links_query(db_link,where,args...)
+    if err !=nil{
+        return nil,err
     }
+    return wiki_backlinks(db_link,links),nil
+}
 
-    tab.set("title",title).set("tag",tag).set("color",color).set("shelf_id",shelf_id).set("adate",get_now_string())
-    _,err =do_insert(db_link,tab.pack_insert())
+func article_backlinks(db_link Db_link,tag string)([]Backlink,error){
+    links,err := wiki_links_query(db_link,"kind='article' and target=?",tag)
     if err !=nil{
-        return tag,err
+        return nil,err
     }
-    return tag,nil
+    return wiki_backlinks(db_link,links),nil
 }
 
-func count_articles(db_link *sql.DB)(int64, error){
-    tab := get_table("article")
-    count,err := do_count(db_link,tab.pack_count("cnt"))
+// wiki_broken gives the links that go nowhere, with where they are
+func wiki_broken(db_link Db_link,roots Roots)([]Backlink,error){
+    var result []Backlink
+    links,err := wiki_links_query(db_link,"1=1")
     if err !=nil{
-        return 0,err
+        return result,err
     }
-    return count,nil
+    for _,link :=range(links){
+        _,err = wiki_target_link(db_link,roots,link)
+        if err ==nil{
+            continue
+        }
+        backlinks := wiki_backlinks(db_link,[]Wiki_link{link})
+        for _,backlink :=range(backlinks){
+            backlink.Target += " "+err.Error()
+            result = append(result,backlink)
+        }
+    }
+    return result,nil
 }
 
+// wiki_file_rename follows a file renamed or moved in Filegai, the paths are from the root
+func wiki_file_rename(db_link Db_link,old_path string,new_path string)error{
+    tab := get_table("wiki_link")
+    tab.set("target",new_path).where("kind","=","file").where("target","=",old_path)
+    _,err := do_update(db_link,tab.pack_update(nil))
+    return err
+}
 
-func list_articles(db_link *sql.DB,page int,page_len int)([]Article_record,error){
-    var result []Article_record
-    cnt,err := count_articles(db_link)
-    if err!=nil{
-        return result,errors.New("count error")
-    } 
-    if page_len <1{
-        return result,errors.New("page len error")
+// wiki_files_move follows a folder renamed or moved, the prefixes end with "/"
+func wiki_files_move(db_link Db_link,old_prefix string,new_prefix string)error{
+    if old_prefix ==""{
+        return errors.New("moving the root is not allowed")
     }
-    page_count:= calc_pages(cnt, page_len)
-
-    if page>int(page_count){
-        page = int(page_count)
+    links,err := wiki_links_query(db_link,"kind='file' and target like ? escape '\\'",like_escape(old_prefix)+"%")
+    if err !=nil{
+        return err
     }
-    if page <1{
-        page =1
+    for _,link :=range(links){
+        if !strings.HasPrefix(link.Target,old_prefix){
+            continue
+        }
+        tab := get_table("wiki_link")
+        tab.set("wlid",strconv.FormatInt(link.Wlid,10)).set("target",new_prefix+link.Target[len(old_prefix):])
+        _,err = do_update(db_link,tab.pack_update([]string{"wlid"}))
+        if err !=nil{
+            return err
+        }
     }
-    start :=(page-1)*page_len
-    tab := get_table("article")
-    rows,err:=db_link.Query(tab.pack_select("tag,shelf_id,title,adate,color","artid desc",strconv.Itoa(start)+","+strconv.Itoa(page_len)))
-    defer rows.Close()
+    return nil
+}
 
-    if err !=nil{
-        return result, err
+//=====================================================================
+// for note templates
+// A template is the text a new note starts with. It is for the files with one
+// of its extensions, or in its folder (a path from the root with "/", the
+// subfolders too), or both when both are given; the one with the longest
+// folder wins. {{file}}, {{name}}, {{ext}}, {{folder}}, {{path}}, {{date}},
+// {{time}} and {{host}} in it are filled in for the file.
+type Note_template struct{
+    Ntid int64
+    Name string
+    Format int
+    Exts string // "pdf,csv", "" for any
+    Folder string // "papers/2022/", "" for any
+    Body string
+}
+
+// template_exts makes the list of extensions typed in the stored form
+func template_exts(exts string)string{
+    var result []string
+    for _,ext :=range(strings.FieldsFunc(strings.ToLower(exts),func(r rune)bool{ return r==',' || r==' ' || r==';' })){
+        ext = strings.TrimPrefix(ext,".")
+        if ext !=""{
+            result = append(result,ext)
+        }
     }
-    var record Article_record
-    for rows.Next(){
-        rows.Scan(&record.Tag,&record.Shelf_id,&record.Title,&record.Adate,&record.Color)
-        result = append(result,record)
+    return strings.Join(result,",")
+}
+
+// template_folder makes the folder typed in the stored form, "" or ending with "/"
+func template_folder(folder string)string{
+    folder = strings.Trim(strings.ReplaceAll(strings.TrimSpace(folder),"\\","/"),"/")
+    if folder ==""{
+        return ""
     }
-    return result,nil
+    return folder+"/"
 }
 
-func search_article(db_link *sql.DB,target string)([]Article_record,error){
-    var result []Article_record
-    sql_str :="select tag,shelf_id,title,adate,color from article where title like \"%"+target+"%\" order by  artid desc"
-    fmt.Println(sql_str)
-    rows,err:=db_link.Query(sql_str)
-    defer rows.Close()
+func list_note_templates(db_link Db_link)([]Note_template,error){
+    var result []Note_template
+    tab := get_table("note_template")
+    rows,err := do_query(db_link,tab.pack_select("ntid,ifnull(name,''),format,ifnull(exts,''),ifnull(folder,''),ifnull(body,'')","name collate nocase",""))
     if err !=nil{
-        return result, err
+        return result,err
     }
-    var record Article_record
+    defer rows.Close()
     for rows.Next(){
-        rows.Scan(&record.Tag,&record.Shelf_id,&record.Title,&record.Adate,&record.Color)
-        result = append(result,record)
+        var row Note_template
+        err = rows.Scan(&row.Ntid,&row.Name,&row.Format,&row.Exts,&row.Folder,&row.Body)
+        if err !=nil{
+            return result,err
+        }
+        result = append(result,row)
     }
-    return result,nil    
+    return result,nil
 }
 
-func update_article(db_link *sql.DB,tag string,new_title string,color string,shelf_id string)(bool,error){
-    tab := get_table("article")
-    tab.set("title",new_title).set("tag",tag)
-    if color !=""{
-        tab.set("color",color)
+// note_template_save adds the template when Ntid is 0, or changes it
+func note_template_save(db_link Db_link,record Note_template)(int64,error){
+    if strings.TrimSpace(record.Name) ==""{
+        return 0,errors.New("the template needs a name")
     }
-    if shelf_id !=""{
-        tab.set("shelf_id",shelf_id)
+    if record.Format !=text_format_html && record.Format !=text_format_markdown{
+        return 0,errors.New("bad format")
     }
-
-    check :=[]string{"tag"}
-    _,err:= do_update(db_link,tab.pack_update(check))
-    if err!=nil{
-        return false,err
+    tab := get_table("note_template")
+    tab.set("name",strings.TrimSpace(record.Name)).set("format",strconv.Itoa(record.Format))
+    tab.set("exts",template_exts(record.Exts)).set("folder",template_folder(record.Folder)).set("body",record.Body)
+    tab.set("tdate",get_now_string())
+    if record.Ntid ==0{
+        return do_insert(db_link,tab.pack_insert())
     }
-    return true,nil
+    tab.set("ntid",strconv.FormatInt(record.Ntid,10))
+    cnt,err := do_update(db_link,tab.pack_update([]string{"ntid"}))
+    if err ==nil && cnt ==0{
+        err = errors.New("no such template")
+    }
+    return record.Ntid,err
 }
 
-func del_article(db_link *sql.DB,tag string,db_folder string)(bool,error){
-    tab := get_table("article")
-    tab.set("tag",tag)
+func note_template_del(db_link Db_link,ntid int64)error{
+    tab := get_table("note_template")
+    tab.set("ntid",strconv.FormatInt(ntid,10))
+    _,err := do_delete(db_link,tab.pack_delete())
+    return err
+}
 
-    pages,err:=get_page_records_by_tag(db_link,tag)
+// note_template_for gives the template of the file, the path is from the root with "/"
+func note_template_for(db_link Db_link,rel_path string)(Note_template,bool,error){
+    var best Note_template
+    templates,err := list_note_templates(db_link)
     if err !=nil{
-        return false,err
+        return best,false,err
     }
-    for _,article_page :=range(pages){
-        _,err=del_article_page(db_link,article_page.Pg_tag,db_folder)
-        if err!=nil{
-            fmt.Println("error deleting article page:"+err.Error())
+    found := false
+    score := -1
+    ext := file_suffix(path_file_name(rel_path,"/"))
+    for _,record :=range(templates){
+        if record.Exts =="" && record.Folder ==""{
+            continue
+        }
+        if record.Folder !="" && !strings.HasPrefix(rel_path,record.Folder){
+            continue
+        }
+        if record.Exts !="" && !make_set(strings.Split(record.Exts,",")).Has(ext){
+            continue
+        }
+        // the longer folder first, then the one with extensions
+        this_score := len(record.Folder)*2
+        if record.Exts !=""{
+            this_score++
+        }
+        if this_score > score{
+            best,score,found = record,this_score,true
         }
     }
-    _,err=do_delete(db_link,tab.pack_delete())
-    if err!=nil{
-        return false,err
+    return best,found,nil
+}
+
+// note_template_fill puts the file into the placeholders of the template
+func note_template_fill(record Note_template,rel_path string,host_name string)string{
+    file_name := path_file_name(rel_path,"/")
+    ext := file_suffix(file_name)
+    name := file_name
+    if ext !=""{
+        name = strings.TrimSuffix(file_name,file_name[strings.LastIndex(file_name,"."):])
     }
-    tag_clear(db_link,tag)
-    return true,nil
+    now := get_now_string()
+    values := map[string]string{"file":file_name,"name":name,"ext":ext,"folder":path_dir_name(rel_path,"/"),
+        "path":rel_path,"date":strings.Split(now," ")[0],"time":now,"host":host_name}
+    return template_var_reg.ReplaceAllStringFunc(record.Body,func(v string)string{
+        value,ok := values[strings.TrimSpace(v[2:len(v)-2])]
+        if !ok{
+            return v
+        }
+        if record.Format ==text_format_markdown{
+            return md_escape(value)
+        }
+        return html.EscapeString(value)
+    })
 }
 
-func get_article_record(db_link *sql.DB,tag string)(Article_record, error){
-    var record Article_record
-    tab := get_table("article")
-    tab.set("tag",tag)
-    rows,err:=db_link.Query(tab.pack_select("tag,shelf_id,title,adate,color","artid desc",""))
-    defer rows.Close()
+var template_var_reg = regexp.MustCompile(`\{\{\s*\w+\s*\}\}`)
+
+//=====================================================================
+// for labels
+// A label is named and colored, label_link puts it on notes, articles and
+// files. A file is known by its path from the root, "/" as deliminator, the
+// same as in file_note, and the path follows the renames of the file.
+const(
+    label_app_note = 1
+    label_app_article = 2
+    label_app_file = 3
+)
+
+// the colors of the labels made from the color codes
+var label_colors = map[string]string{"green":"#5fb878","red":"#ff5722","blue":"#1e9fff","purple":"#a233c6",
+    "orange":"#ffb800","yellow":"#f7e84a","grey":"#999999"}
 
+type Label_record struct{
+    Lid int64
+    Name string
+    Color string
+    Count int // items labeled
+}
+
+func label_color_ok(color string)bool{
+    ok,_ := regexp.MatchString(`^#[0-9a-fA-F]{6}$`,color)
+    return ok
+}
+
+func list_labels(db_link Db_link)([]Label_record,error){
+    var result []Label_record
+    rows,err := db_link.Query(`select b.lid,b.name,b.color,count(l.llid) from label b
+        left join label_link l on l.lid=b.lid group by b.lid order by b.name collate nocase`)
     if err !=nil{
-        return record, err
+        return result,err
     }
-   
-    if rows.Next(){
-        err:=rows.Scan(&record.Tag,&record.Shelf_id,&record.Title,&record.Adate,&record.Color)
+    defer rows.Close()
+    for rows.Next(){
+        var row Label_record
+        err = rows.Scan(&row.Lid,&row.Name,&row.Color,&row.Count)
         if err !=nil{
-            return record,err
+            return result,err
         }
-        return record,nil
+        result = append(result,row)
     }
-    return record,errors.New("no record")
+    return result,rows.Err()
 }
 
+// label_by_name finds the label, the case of the name does not matter, 0 when there is none
+func label_by_name(db_link Db_link,name string)(int64,error){
+    var lid int64
+    err := db_link.QueryRow("select lid from label where name=? collate nocase",name).Scan(&lid)
+    if err ==sql.ErrNoRows{
+        return 0,nil
+    }
+    return lid,err
+}
 
-func add_article_page(db_link *sql.DB,tag string,note string,db_folder string)(string,error){
-    tab := get_table("article_page")
-  
-    // insert in the blob
-    blob_tag,err:=resource_deposite(db_link,tag,33,[]byte(note),db_folder)
-    // tag is the article tag
+func label_add(db_link Db_link,name string,color string)(int64,error){
+    name = strings.TrimSpace(name)
+    if name ==""{
+        return 0,errors.New("the label has no name")
+    }
+    color = strings.ToLower(color)
+    if !label_color_ok(color){
+        return 0,errors.New("bad color:"+color)
+    }
+    lid,err := label_by_name(db_link,name)
     if err !=nil{
-        return "",err
+        return 0,err
     }
+    if lid !=0{
+        return 0,errors.New("label exists:"+name)
+    }
+    tab := get_table("label")
+    tab.set("name",name).set("color",color).set("ldate",get_now_string())
+    return do_insert(db_link,tab.pack_insert())
+}
 
-    // pg_tag is the same as blob_tag
-    tab.set("pg_tag",blob_tag).set("tag",tag).set("pdate",get_now_string()).set("order_id","0")
-    _,err = do_insert(db_link,tab.pack_insert())
+// label_update renames and recolors the label everywhere it is used,
+// a name taken by another label is refused, merge them instead
+func label_update(db_link Db_link,lid int64,name string,color string)error{
+    name = strings.TrimSpace(name)
+    if name ==""{
+        return errors.New("the label has no name")
+    }
+    color = strings.ToLower(color)
+    if !label_color_ok(color){
+        return errors.New("bad color:"+color)
+    }
+    other,err := label_by_name(db_link,name)
     if err !=nil{
-        return "",err
+        return err
     }
-    resource_ref_count_inc(db_link,blob_tag)
-    resource_link_add(db_link,blob_tag, 2, tag)
-    new_tags := extract_tags(note)
-    new_tags_map :=extract_img_names(note)
-    for _,item :=range(new_tags){
-        item_name,ok:=new_tags_map[item]
-        if ok{
-            if item_name == ""{
-                continue
-            }
-            resource_update_name(db_link,item,item_name)
-            resource_ref_count_inc(db_link,item)
-            resource_link_add(db_link,item,2,tag)
-        }
+    if other !=0 && other !=lid{
+        return errors.New("label exists:"+name+", merge them instead")
     }
-    return blob_tag,nil  // blob_tag is the same as pg_tag in the article_page table
+    tab := get_table("label")
+    tab.set("lid",strconv.FormatInt(lid,10)).set("name",name).set("color",color)
+    cnt,err := do_update(db_link,tab.pack_update([]string{"lid"}))
+    if err !=nil{
+        return err
+    }
+    if cnt ==0{
+        return errors.New("no record")
+    }
+    return nil
 }
 
-func edit_article_page(db_link *sql.DB,pg_tag string,note string,db_folder string)(bool,error){
-    record,err:=get_page_by_pg_tag(db_link,pg_tag)
+// label_merge moves what has the label `from` to the label `into`, `from` is deleted
+func label_merge(db_link Db_link,from int64,into int64)error{
+    if from ==into{
+        return errors.New("a label can not be merged into itself")
+    }
+    var cnt int
+    err := db_link.QueryRow("select count(*) from label where lid=?",into).Scan(&cnt)
     if err !=nil{
-        return false,err
+        return err
     }
-    
-    _,old_note,err:=get_text(db_link, db_folder ,pg_tag )
-    if err ==nil{
-        //update the resource track in the text
-        resource_ref_update_by_text(db_link,2,record.Tag,old_note,note)
+    if cnt ==0{
+        return errors.New("no record")
     }
-    
-    // update the text resource
-    _,err=resource_update(db_link,pg_tag,33,[]byte(note),db_folder)
+    _,err = db_link.Exec(`update label_link set lid=? where lid=? and not exists
+        (select 1 from label_link b where b.lid=? and b.app=label_link.app and b.app_tag=label_link.app_tag)`,into,from,into)
     if err !=nil{
-        return false,err
+        return err
     }
-    return true,nil
+    return label_delete(db_link,from)
 }
 
-func article_page_set_order(db_link *sql.DB,pg_tag string,order_str string)(bool,error){
-    tab := get_table("article_page")
-    tab.set("pg_tag",pg_tag).set("order_id",order_str)
-    check:=[]string{"pg_tag"}
-    _,err :=do_update(db_link,tab.pack_update(check))
+func label_delete(db_link Db_link,lid int64)error{
+    tab := get_table("label_link")
+    tab.set("lid",strconv.FormatInt(lid,10))
+    _,err := do_delete(db_link,tab.pack_delete())
     if err !=nil{
-        return false,err
-    } 
-    return true,nil
+        return err
+    }
+    tab = get_table("label")
+    tab.set("lid",strconv.FormatInt(lid,10))
+    _,err = do_delete(db_link,tab.pack_delete())
+    return err
+}
+
+// label_set gives the item exactly the labels of lids
+func label_set(db_link Db_link,app int,app_tag string,lids []int64)error{
+    err := label_unlink(db_link,app,app_tag)
+    if err !=nil{
+        return err
+    }
+    for _,lid :=range(lids){
+        _,err = db_link.Exec("insert into label_link(lid,app,app_tag) select lid,?,? from label where lid=?",app,app_tag,lid)
+        if err !=nil{
+            return err
+        }
+    }
+    return nil
+}
+
+// lids_parse reads "1,3" into the label ids, what is not a number is left out
+func lids_parse(value string)[]int64{
+    var lids []int64
+    for _,item :=range(strings.Split(value,",")){
+        lid,err := strconv.ParseInt(strings.TrimSpace(item),10,64)
+        if err ==nil{
+            lids = append(lids,lid)
+        }
+    }
+    return lids
+}
+
+// label_unlink takes the labels off a deleted item
+func label_unlink(db_link Db_link,app int,app_tag string)error{
+    tab := get_table("label_link")
+    tab.set("app",strconv.Itoa(app)).set("app_tag",app_tag)
+    _,err := do_delete(db_link,tab.pack_delete())
+    return err
+}
+
+// labels_map gives the labels of each of the items, by name
+func labels_map(db_link Db_link,app int,app_tags []string)(map[string][]Label_record,error){
+    result := make(map[string][]Label_record)
+    if len(app_tags)==0{
+        return result,nil
+    }
+    sql_str := `select l.app_tag,b.lid,b.name,b.color from label_link l join label b on b.lid=l.lid
+        where l.app=? and l.app_tag in (`+placeholders(len(app_tags))+`) order by b.name collate nocase`
+    rows,err := db_link.Query(sql_str,append([]interface{}{app},str_args(app_tags)...)...)
+    if err !=nil{
+        return result,err
+    }
+    defer rows.Close()
+    for rows.Next(){
+        var app_tag string
+        var label Label_record
+        err = rows.Scan(&app_tag,&label.Lid,&label.Name,&label.Color)
+        if err !=nil{
+            return result,err
+        }
+        result[app_tag] = append(result[app_tag],label)
+    }
+    return result,rows.Err()
+}
+
+// label_tags gives the items of the app having the label
+func label_tags(db_link Db_link,lid int64,app int)([]string,error){
+    var result []string
+    tab := get_table("label_link")
+    tab.set("lid",strconv.FormatInt(lid,10)).set("app",strconv.Itoa(app))
+    rows,err := do_query(db_link,tab.pack_select("app_tag","llid",""))
+    if err !=nil{
+        return result,err
+    }
+    defer rows.Close()
+    for rows.Next(){
+        var app_tag string
+        err = rows.Scan(&app_tag)
+        if err !=nil{
+            return result,err
+        }
+        result = append(result,app_tag)
+    }
+    return result,rows.Err()
+}
+
+func fill_note_labels(db_link Db_link,notes []Note_record)error{
+    var tags []string
+    for _,note :=range(notes){
+        tags = append(tags,note.Tag)
+    }
+    labels,err := labels_map(db_link,label_app_note,tags)
+    if err !=nil{
+        return err
+    }
+    for i:=range(notes){
+        notes[i].Labels = labels[notes[i].Tag]
+    }
+    return nil
+}
+
+func fill_article_labels(db_link Db_link,articles []Article_record)error{
+    var tags []string
+    for _,article :=range(articles){
+        tags = append(tags,article.Tag)
+    }
+    labels,err := labels_map(db_link,label_app_article,tags)
+    if err !=nil{
+        return err
+    }
+    for i:=range(articles){
+        articles[i].Labels = labels[articles[i].Tag]
+    }
+    return nil
+}
+
+// label_merge_into adds the labels not in the list yet
+func label_merge_into(list []Label_record,more []Label_record)[]Label_record{
+    for _,label :=range(more){
+        found := false
+        for _,have :=range(list){
+            if have.Lid ==label.Lid{
+                found = true
+                break
+            }
+        }
+        if !found{
+            list = append(list,label)
+        }
+    }
+    return list
+}
+
+func label_has(list []Label_record,lid int64)bool{
+    for _,label :=range(list){
+        if label.Lid ==lid{
+            return true
+        }
+    }
+    return false
+}
+
+// label_file_rename follows a file renamed or moved, the paths are from the root
+func label_file_rename(db_link Db_link,old_path string,new_path string)error{
+    tab := get_table("label_link")
+    tab.set("app_tag",new_path).where("app","=",strconv.Itoa(label_app_file)).where("app_tag","=",old_path)
+    _,err := do_update(db_link,tab.pack_update(nil))
+    return err
+}
+
+// label_files_move follows a folder renamed or moved, the prefixes end with "/"
+func label_files_move(db_link Db_link,old_prefix string,new_prefix string)error{
+    if old_prefix ==""{
+        return errors.New("moving the root is not allowed")
+    }
+    tab := get_table("label_link")
+    tab.set("app",strconv.Itoa(label_app_file)).where("app_tag","like",like_escape(old_prefix)+"%")
+    rows,err := do_query(db_link,tab.pack_select("llid,app_tag","",""))
+    if err !=nil{
+        return err
+    }
+    moves := make(map[int64]string)
+    for rows.Next(){
+        var llid int64
+        var app_tag string
+        err = rows.Scan(&llid,&app_tag)
+        if err !=nil{
+            rows.Close()
+            return err
+        }
+        if strings.HasPrefix(app_tag,old_prefix){
+            moves[llid] = new_prefix+app_tag[len(old_prefix):]
+        }
+    }
+    rows.Close()
+    for llid,app_tag :=range(moves){
+        tab_update := get_table("label_link")
+        tab_update.set("llid",strconv.FormatInt(llid,10)).set("app_tag",app_tag)
+        _,err = do_update(db_link,tab_update.pack_update([]string{"llid"}))
+        if err !=nil{
+            return err
+        }
+    }
+    return nil
+}
+
+// for settings
+func has_setting(db_link Db_link,key string,note string) (bool,error){
+    tab :=get_table("settings")
+	tab.set("key",key)
+    if note !=""{
+        tab.set("note",note)
+    }
+	count,err := do_count(db_link,tab.pack_count("cnt"))
+	if err !=nil{
+		return false,err
+	}
+	if count ==0{
+		return false,nil
+	}
+	return true,nil
+}
+
+func get_setting(db_link Db_link,key string,note string) (string,error){
+	tab :=get_table("settings")
+	tab.set("key",key)
+    if note !=""{
+        tab.set("note",note)
+    }
+	rows,err:=do_query(db_link,tab.pack_select("value","",""))
+	defer rows.Close()
+	if err!=nil{
+		return "",err
+	}
+	if rows.Next(){
+		var value string
+		rows.Scan(&value)
+		return value,nil
+	}
+	return "",nil
+}
+
+func set_setting(db_link Db_link,key string, value string,note string)(bool,error){
+	tab :=get_table("settings")
+	tab.set("key",key).set("value",value)
+	if note !=""{
+		tab.set("note",note)
+	}
+	yes,err:= has_setting(db_link,key,note)
+	if err!=nil{
+		return false,err
+	}
+	if yes{
+		var update_sql *Db_query
+		if note !=""{
+			update_sql=tab.pack_update([]string{"key","note"})
+		}else{
+			update_sql=tab.pack_update([]string{"key"})
+		}
+		_,err:= do_update(db_link,update_sql)
+		if err!=nil{
+			return false,err
+		}
+		return true,nil
+	}
+	_,err= do_insert(db_link,tab.pack_insert())
+	if err!=nil{
+		return false,err
+	}
+	return true,nil
+}
+func clear_setting(db_link Db_link,key string, note string)(bool,error){
+	tab :=get_table("settings")
+	tab.set("key",key)
+    if note !=""{
+        tab.set("note",note)
+    }
+	_,err:=do_delete(db_link,tab.pack_delete())
+	if err!=nil{
+		return false,err
+	}
+	return true, nil
+}
+
+func set_host_setting(db_link Db_link,host_name string,key string,value string)(bool,error){
+    return set_setting(db_link,key,value,host_name)
+}
+
+func get_host_setting(db_link Db_link,host_name string,key string,default_value string)(string){
+    val,err:=get_setting(db_link,key,host_name)
+    if err !=nil{
+        return default_value
+    }
+    if val==""{
+        return default_value
+    }
+    return val
+}
+
+func set_sys_setting(db_link Db_link,key string,value string)(bool,error){
+    return set_setting(db_link,key,value,"sys")
+}
+
+func get_sys_setting(db_link Db_link,key string,default_value string)string{
+    val,err:=get_setting(db_link,key,"sys")
+    if err !=nil{
+        return default_value
+    }
+    if val==""{
+        return default_value
+    }
+    return val
+}
+
+// roots_load gives the served roots with the other roots of this host kept in the
+// database, the served ones new to the database are kept. A served root kept with
+// another folder gets it in Kept
+func roots_load(db_link Db_link,served Roots)(Roots,error){
+    host_name := get_host_name()
+    tab := get_table("root_folder")
+    tab.set("host_name",host_name)
+    rows,err := do_query(db_link,tab.pack_select("name,dir","rid asc",""))
+    if err !=nil{
+        return nil,err
+    }
+    roots := append(Roots{},served...)
+    kept := map[string]string{}
+    for rows.Next(){
+        var name,dir string
+        err = rows.Scan(&name,&dir)
+        if err !=nil{
+            rows.Close()
+            return nil,err
+        }
+        kept[name] = dir
+        if served.by_name(name)==nil{
+            roots = append(roots,&Root{Name:name,Dir:dir,Key:root_key(name)})
+        }
+    }
+    rows.Close()
+    for _,root :=range(served){
+        dir,ok := kept[root.Name]
+        if !ok{
+            tab_new := get_table("root_folder")
+            tab_new.set("host_name",host_name).set("name",root.Name).set("dir",root.Dir)
+            _,err = do_insert(db_link,tab_new.pack_insert())
+            if err !=nil{
+                return nil,err
+            }
+        }else if dir !=root.Dir{
+            root.Kept = dir
+        }
+    }
+    return roots,nil
+}
+
+func set_page_wrap_class(db_link Db_link,host_name string,cls string)(bool,error){
+	return set_setting(db_link,"wrap_class",cls,host_name)
+}
+func get_page_wrap_class(db_link Db_link,host_name string)(string){
+	return get_host_setting(db_link,host_name,"wrap_class","content_wrap")
+}
+
+func get_setting_with_digit(db_link Db_link,key string,default_val int)int{
+    len_str := get_sys_setting(db_link,key,"")
+    if len_str ==""{
+        return default_val // default
+    }
+    len_int,err := strconv.Atoi(len_str)
+    if err!=nil{
+        return default_val
+    }
+    return len_int
+}
+
+func get_img_page_len(db_link Db_link)int{
+    return get_setting_with_digit(db_link,"img_page_len",20)
+}
+
+func set_img_page_len(db_link Db_link,length string)(bool,error){
+    return set_sys_setting(db_link,"img_page_len",length)
+}
+
+
+func get_article_list_len(db_link Db_link)int{
+    return get_setting_with_digit(db_link,"article_list_len",50)
+}
+
+func set_article_list_len(db_link Db_link,length string)(bool,error){
+    return set_sys_setting(db_link,"article_list_len",length)
+}
+
+
+func get_notes_page_len(db_link Db_link)int{
+    return get_setting_with_digit(db_link,"notes_page_len",50)
+}
+
+func set_notes_page_len(db_link Db_link,length string)(bool,error){
+    return set_sys_setting(db_link,"notes_page_len",length)
+}
+
+// hours between the scheduled backups, 0 turns them off
+func get_backup_hours(db_link Db_link)int{
+    return get_setting_with_digit(db_link,"backup_hours",24)
+}
+
+func set_backup_hours(db_link Db_link,hours string)(bool,error){
+    return set_sys_setting(db_link,"backup_hours",hours)
+}
+
+func get_backup_keep(db_link Db_link)int{
+    return get_setting_with_digit(db_link,"backup_keep",10)
+}
+
+func set_backup_keep(db_link Db_link,keep string)(bool,error){
+    return set_sys_setting(db_link,"backup_keep",keep)
+}
+
+// blob pages are closed at this size and a new one is started, the pages are
+// kept small for the synchronizing folders
+func get_blob_page_limit(db_link Db_link)int64{
+    return int64(get_setting_with_digit(db_link,"blob_page_mb",50))*1000000
+}
+
+func set_blob_page_mb(db_link Db_link,mb string)(bool,error){
+    return set_sys_setting(db_link,"blob_page_mb",mb)
+}
+
+func set_db_version(db_link Db_link,version string)(bool,error){
+    return set_setting(db_link,"db_version",version,"sys")
+}
+
+func get_host_opener(db_link Db_link,file_type string)(string){
+    opener:= get_host_setting(db_link,get_host_name(),file_type+"_opener","")
+    if opener !=""{
+        return opener
+    }
+    os_type :=runtime.GOOS
+    var default_opener=make( map[string]string)
+    switch(os_type){
+    case "darwin":
+        return "open"
+    case "linux":
+        default_opener["pdf"]="open"
+        default_opener["docx"]="open"
+        default_opener["doc"]="open"
+        default_opener["pptx"]="open"
+        default_opener["ppt"]="open"
+    case "windows":
+        default_opener["ppt"]="open"
+    default:
+
+    }
+    default_value,ok :=default_opener[file_type]
+    if !ok{
+        default_value=""
+    } 
+    return default_value
+}
+
+func set_host_opener(db_link Db_link,host_name string,file_type string,opener_path string)(bool,error){
+    return set_host_setting(db_link,host_name,file_type+"_opener",opener_path)
+}
+
+func enum_host_openers(db_link Db_link,host_name string)(string,error){
+    tab :=get_table("settings")
+    tab.set("note",host_name).where("key","like","%"+like_escape("_opener"))
+    rows,err:=do_query(db_link,tab.pack_select("key,value","",""))
+    if err!=nil{
+        return "",err
+    }
+    result:=""
+    for rows.Next(){
+        k:=""
+        v:=""
+        rows.Scan(&k,&v)
+        t:=strings.Split(k,"_")
+        result=result+t[0]+"="+v+"\n"
+    }
+    return result,nil
+}
+
+func init_settings(db_link Db_link)error{
+    host_name := get_host_name()
+    _,err:=set_page_wrap_class(db_link,host_name,"content_wrap")
+    if err!=nil{
+        return err
+    }
+    _,err=set_img_page_len(db_link,"20")
+    if err!=nil{
+        return err
+    }
+    return err
+}
+
+
+// =========================
+//for article table        
+//==========================
+
+type Article_record struct{
+    Artid int64
+    Tag string
+    Shelf_id int
+    Title string
+    Adate string
+    Color string
+    Snippet string // html, the search hit
+    Labels []Label_record
+}
+
+type Article_page_record struct{
+    Pgid int64
+    Pg_tag string
+    Tag string
+    Order_id int
+    Pdate string
+    Data string
+    Format int
+}
+
+func new_article(db_link Db_link,title string,color string,shelf_id string)(string,error){
+    tab := get_table("article")
+    tag,err := tag_gen(db_link)
+    if err !=nil{
+        return tag,err
+    }
+    if shelf_id==""{
+        shelf_id="0"
+    }
+    if color==""{
+        color="7" // grey
+    }
+
+    tab.set("title",title).set("tag",tag).set("color",color).set("shelf_id",shelf_id).set("adate",get_now_string())
+    _,err =do_insert(db_link,tab.pack_insert())
+    if err !=nil{
+        return tag,err
+    }
+    return tag,nil
+}
+
+func count_articles(db_link Db_link)(int64, error){
+    tab := get_table("article")
+    count,err := do_count(db_link,tab.pack_count("cnt"))
+    if err !=nil{
+        return 0,err
+    }
+    return count,nil
+}
+
+
+func list_articles(db_link Db_link,page int,page_len int)([]Article_record,error){
+    var result []Article_record
+    cnt,err := count_articles(db_link)
+    if err!=nil{
+        return result,errors.New("count error")
+    } 
+    if page_len <1{
+        return result,errors.New("page len error")
+    }
+    page_count:= calc_pages(cnt, page_len)
+
+    if page>int(page_count){
+        page = int(page_count)
+    }
+    if page <1{
+        page =1
+    }
+    start :=(page-1)*page_len
+    tab := get_table("article")
+    rows,err:=do_query(db_link,tab.pack_select("tag,shelf_id,title,adate,color","artid desc",strconv.Itoa(start)+","+strconv.Itoa(page_len)))
+    defer rows.Close()
+
+    if err !=nil{
+        return result, err
+    }
+    var record Article_record
+    for rows.Next(){
+        rows.Scan(&record.Tag,&record.Shelf_id,&record.Title,&record.Adate,&record.Color)
+        result = append(result,record)
+    }
+    return result,nil
+}
+
+// label_articles gives the articles having the label, the newest first
+func label_articles(db_link Db_link,lid int64)([]Article_record,error){
+    var result []Article_record
+    rows,err :=db_link.Query(`select tag,shelf_id,title,adate,color from article where tag in
+        (select app_tag from label_link where lid=? and app=?) order by artid desc`,lid,label_app_article)
+    if err !=nil{
+        return result,err
+    }
+    defer rows.Close()
+    for rows.Next(){
+        var record Article_record
+        err =rows.Scan(&record.Tag,&record.Shelf_id,&record.Title,&record.Adate,&record.Color)
+        if err !=nil{
+            return result,err
+        }
+        result = append(result,record)
+    }
+    return result,rows.Err()
+}
+
+// search_article gives the articles with pages matching the target, best first,
+// then the ones with only the title matching
+func search_article(db_link Db_link,target string)([]Article_record,error){
+    var result []Article_record
+    seen := make_set([]string{})
+    hits,err := search_index_query(db_link,2,target,200)
+    if err !=nil{
+        return result,err
+    }
+    for _,hit :=range(hits){
+        if seen.Has(hit.Owner){
+            continue
+        }
+        record,err := get_article_record(db_link,hit.Owner)
+        if err !=nil{
+            continue
+        }
+        seen.Add(hit.Owner)
+        record.Snippet = hit.Snippet
+        result = append(result,record)
+    }
+
+    tab := get_table("article")
+    tab.where("title","like","%"+like_escape(target)+"%")
+    rows,err:=do_query(db_link,tab.pack_select("tag,shelf_id,title,adate,color","artid desc",""))
+    defer rows.Close()
+    if err !=nil{
+        return result, err
+    }
+    var record Article_record
+    for rows.Next(){
+        rows.Scan(&record.Tag,&record.Shelf_id,&record.Title,&record.Adate,&record.Color)
+        if seen.Has(record.Tag){
+            continue
+        }
+        result = append(result,record)
+    }
+    return result,nil    
+}
+
+func update_article(db_link Db_link,tag string,new_title string,color string,shelf_id string)(bool,error){
+    tab := get_table("article")
+    tab.set("title",new_title).set("tag",tag)
+    if color !=""{
+        tab.set("color",color)
+    }
+    if shelf_id !=""{
+        tab.set("shelf_id",shelf_id)
+    }
+
+    check :=[]string{"tag"}
+    _,err:= do_update(db_link,tab.pack_update(check))
+    if err!=nil{
+        return false,err
+    }
+    return true,nil
+}
+
+func del_article(u *Unit,tag string)(bool,error){
+    tab := get_table("article")
+    tab.set("tag",tag)
+
+    pages,err:=get_page_records_by_tag(u.tx,tag)
+    if err !=nil{
+        return false,err
+    }
+    for _,article_page :=range(pages){
+        _,err=del_article_page(u,article_page.Pg_tag)
+        if err!=nil{
+            fmt.Println("error deleting article page:"+err.Error())
+            return false,err
+        }
+    }
+    _,err=do_delete(u.tx,tab.pack_delete())
+    if err!=nil{
+        return false,err
+    }
+    _,err=tag_clear(u.tx,tag)
+    if err!=nil{
+        return false,err
+    }
+    err=label_unlink(u.tx,label_app_article,tag)
+    if err!=nil{
+        return false,err
+    }
+    return true,nil
+}
+
+func get_article_record(db_link Db_link,tag string)(Article_record, error){
+    var record Article_record
+    tab := get_table("article")
+    tab.set("tag",tag)
+    rows,err:=do_query(db_link,tab.pack_select("tag,shelf_id,title,adate,color","artid desc",""))
+    defer rows.Close()
+
+    if err !=nil{
+        return record, err
+    }
+   
+    if rows.Next(){
+        err:=rows.Scan(&record.Tag,&record.Shelf_id,&record.Title,&record.Adate,&record.Color)
+        if err !=nil{
+            return record,err
+        }
+        return record,nil
+    }
+    return record,errors.New("no record")
+}
+
+
+func add_article_page(u *Unit,tag string,note string,format int)(string,error){
+    tab := get_table("article_page")
+  
+    // insert in the blob
+    blob_tag,err:=resource_deposite(u,tag,33,[]byte(note))
+    // tag is the article tag
+    if err !=nil{
+        return "",err
+    }
+
+    // pg_tag is the same as blob_tag
+    tab.set("pg_tag",blob_tag).set("tag",tag).set("pdate",get_now_string()).set("order_id","0")
+    tab.set("format",strconv.Itoa(format))
+    _,err = do_insert(u.tx,tab.pack_insert())
+    if err !=nil{
+        return "",err
+    }
+    err=resource_ref_add(u.tx,blob_tag, 2, tag)
+    if err !=nil{
+        return "",err
+    }
+    err=search_index_put(u.tx,2,blob_tag,tag,text_html(note,format))
+    if err !=nil{
+        return "",err
+    }
+    err=wiki_links_put(u,wiki_app_page,blob_tag,tag,note)
+    if err !=nil{
+        return "",err
+    }
+    new_tags := extract_tags(note)
+    new_tags_map :=extract_img_names(note)
+    for _,item :=range(new_tags){
+        item_name,ok:=new_tags_map[item]
+        if ok{
+            if item_name == ""{
+                continue
+            }
+            _,err=resource_update_name(u.tx,item,item_name)
+            if err !=nil{
+                return "",err
+            }
+            err=resource_ref_add(u.tx,item,2,tag)
+            if err !=nil{
+                return "",err
+            }
+        }
+    }
+    return blob_tag,nil  // blob_tag is the same as pg_tag in the article_page table
+}
+
+func edit_article_page(u *Unit,pg_tag string,note string)(bool,error){
+    record,err:=get_page_by_pg_tag(u.tx,pg_tag)
+    if err !=nil{
+        return false,err
+    }
+    
+    _,old_note,err:=get_text(u.tx, u.st,pg_tag )
+    if err ==nil{
+        //update the resource track in the text
+        err=resource_ref_update_by_text(u.tx,2,record.Tag,old_note,note)
+        if err !=nil{
+            return false,err
+        }
+    }
+    
+    // update the text resource
+    _,err=resource_update(u,pg_tag,33,[]byte(note))
+    if err !=nil{
+        return false,err
+    }
+    err=search_index_put(u.tx,2,pg_tag,record.Tag,text_html(note,record.Format))
+    if err !=nil{
+        return false,err
+    }
+    err=wiki_links_put(u,wiki_app_page,pg_tag,record.Tag,note)
+    if err !=nil{
+        return false,err
+    }
+    return true,nil
+}
+
+// article_page_convert turns the page into html or markdown
+func article_page_convert(u *Unit,pg_tag string,format int)error{
+    record,err:=get_page_by_pg_tag(u.tx,pg_tag)
+    if err !=nil{
+        return err
+    }
+    if record.Format ==format{
+        return nil
+    }
+    _,text,err:=get_text(u.tx,u.st,pg_tag)
+    if err !=nil{
+        return err
+    }
+    if format ==text_format_markdown{
+        text = html_markdown(text)
+    }else{
+        text = markdown_html(text)
+    }
+    tab := get_table("article_page")
+    tab.set("pg_tag",pg_tag).set("format",strconv.Itoa(format))
+    _,err = do_update(u.tx,tab.pack_update([]string{"pg_tag"}))
+    if err !=nil{
+        return err
+    }
+    _,err = edit_article_page(u,pg_tag,text)
+    return err
+}
+
+func article_page_set_order(db_link Db_link,pg_tag string,order_str string)(bool,error){
+    tab := get_table("article_page")
+    tab.set("pg_tag",pg_tag).set("order_id",order_str)
+    check:=[]string{"pg_tag"}
+    _,err :=do_update(db_link,tab.pack_update(check))
+    if err !=nil{
+        return false,err
+    } 
+    return true,nil
+}
+
+func del_article_page(u *Unit,pg_tag string)(bool,error){
+    // pg_tag is the same as blob_tag
+    record,err:=get_page_by_pg_tag(u.tx,pg_tag)
+    if err !=nil{
+        return false,err
+    }
+    _,old_note,err:=get_text(u.tx, u.st,pg_tag)
+    
+     // 解除app_tag(article_tag,即record.Tag) 与old_note 中所有资源的引用连接
+    err=resource_ref_dec_by_text(u.tx,2,record.Tag,old_note)
+    if err!=nil{
+        return false,err
+    }
+    _,err=resource_link_del(u.tx,pg_tag,2,record.Tag) // text 资源的引用连接解除
+    if err!=nil{
+        return false,err
+    }
+    _,err=resource_delete(u,pg_tag) //删除text资源
+    if err!=nil{
+        return false,err
+    }
+    err=search_index_del(u.tx,2,pg_tag)
+    if err!=nil{
+        return false,err
+    }
+    err=wiki_links_del(u.tx,wiki_app_page,pg_tag)
+    if err!=nil{
+        return false,err
+    }
+    tab := get_table("article_page")
+    tab.set("pg_tag",pg_tag)
+    _,err= do_delete(u.tx,tab.pack_delete()) //删除page表中记录
+    if err!=nil{
+        return false,err
+    }
+    return true,nil
+}
+
+
+func list_article_pages(db_link Db_link,tag string,st *Store)([]Article_page_record,error){
+    var result []Article_page_record
+    tab := get_table("article_page")
+    tab.set("tag",tag)
+    rows,err :=do_query(db_link,tab.pack_select("pgid,pg_tag,tag,order_id,pdate,format","order_id desc,pgid asc",""))
+    defer rows.Close()
+    if err !=nil{
+        return result,err
+    }
+    var record Article_page_record
+    for rows.Next(){
+        err=rows.Scan(&record.Pgid,&record.Pg_tag,&record.Tag,&record.Order_id,&record.Pdate,&record.Format)
+        if err !=nil{
+            continue
+        }
+        _,note,err:=get_text(db_link,st,record.Pg_tag)
+        if err ==nil{
+            record.Data=note
+        }
+
+        result=append(result,record)
+    }
+    return result,err
+}
+
+func get_page_by_pg_tag(db_link Db_link,pg_tag string)(Article_page_record,error){
+    tab := get_table("article_page")
+    tab.set("pg_tag",pg_tag)
+    rows,err :=do_query(db_link,tab.pack_select("pgid,pg_tag,tag,order_id,pdate,format","",""))
+    defer rows.Close()
+    var record Article_page_record
+    if !rows.Next(){
+        return record,errors.New("no record")
+    }
+    err=rows.Scan(&record.Pgid,&record.Pg_tag,&record.Tag,&record.Order_id,&record.Pdate,&record.Format)
+    if err!=nil{
+        return record,err
+    }
+    return record,nil
+}
+
+func get_page_records_by_tag(db_link Db_link,tag string)([]Article_page_record,error){
+    var result []Article_page_record
+
+    tab := get_table("article_page")
+    tab.set("tag",tag)
+    rows,err :=do_query(db_link,tab.pack_select("pgid,pg_tag,tag,order_id,pdate,format","",""))
+    defer rows.Close()
+    if err !=nil{
+        return result,err
+    }
+    var record Article_page_record
+    for rows.Next(){
+        err=rows.Scan(&record.Pgid,&record.Pg_tag,&record.Tag,&record.Order_id,&record.Pdate,&record.Format)
+        if err !=nil{
+            continue
+        }
+        result = append(result,record)
+    }
+    return result,nil
+}
+
+//====================================================================================================
+// for markdown
+//====================================================================================================
+// A note or an article page is kept in one of two formats: the html of the
+// editor, or the markdown source typed by hand. Markdown is turned into html
+// here when it is shown and when it is indexed. Html in the source is shown
+// as text, and links only go to http(s), mailto or the pages of Filegai, so
+// what is rendered needs no cleaning afterwards.
+const(
+    text_format_html = 0
+    text_format_markdown = 1
+)
+
+// text_html gives the html to show of a text kept in the format
+func text_html(text string,format int)string{
+    if format ==text_format_markdown{
+        return markdown_html(text)
+    }
+    return text
+}
+
+var md_fence_reg = regexp.MustCompile("^ {0,3}(```+|~~~+)\\s*([\\w+#.-]*)")
+var md_heading_reg = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+var md_hr_reg = regexp.MustCompile(`^ {0,3}((\*[ \t]*){3,}|(-[ \t]*){3,}|(_[ \t]*){3,})$`)
+var md_bullet_reg = regexp.MustCompile(`^( {0,3})([-*+])([ \t]+|$)`)
+var md_ordered_reg = regexp.MustCompile(`^( {0,3})(\d{1,9})([.)])([ \t]+|$)`)
+var md_quote_reg = regexp.MustCompile(`^ {0,3}> ?`)
+var md_setext_reg = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+var md_table_sep_reg = regexp.MustCompile(`^ *\|? *:?-+:? *(\| *:?-+:? *)*\|? *$`)
+
+// markdown_html renders the markdown source to html
+func markdown_html(src string)string{
+    src = strings.ReplaceAll(src,"\r\n","\n")
+    src = strings.ReplaceAll(src,"\t","    ")
+    var sb strings.Builder
+    md_blocks(&sb,strings.Split(src,"\n"))
+    return sb.String()
+}
+
+func md_blank(line string)bool{
+    return strings.TrimSpace(line) ==""
+}
+
+// md_list_item tells if the line starts a list item, and its kind, start
+// number and the width of the marker
+func md_list_item(line string)(bool,bool,int,int){
+    if mats :=md_bullet_reg.FindStringSubmatch(line);mats !=nil{
+        if md_hr_reg.MatchString(line){
+            return false,false,0,0
+        }
+        return true,false,0,len(mats[0])
+    }
+    if mats :=md_ordered_reg.FindStringSubmatch(line);mats !=nil{
+        start,_ := strconv.Atoi(mats[2])
+        return true,true,start,len(mats[0])
+    }
+    return false,false,0,0
+}
+
+// md_block_start tells if the line ends a paragraph
+func md_block_start(line string)bool{
+    if md_fence_reg.MatchString(line) || md_heading_reg.MatchString(line) || md_hr_reg.MatchString(line){
+        return true
+    }
+    if md_quote_reg.MatchString(line){
+        return true
+    }
+    ok,_,_,_ := md_list_item(line)
+    return ok
+}
+
+func md_blocks(sb *strings.Builder,lines []string){
+    i := 0
+    for i <len(lines){
+        line := lines[i]
+        if md_blank(line){
+            i++
+            continue
+        }
+        // fenced code
+        if mats :=md_fence_reg.FindStringSubmatch(line);mats !=nil{
+            fence := mats[1]
+            lang := mats[2]
+            var code []string
+            i++
+            for i <len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]),fence[:3]){
+                code = append(code,lines[i])
+                i++
+            }
+            i++ // the closing fence
+            if lang !=""{
+                sb.WriteString(`<pre class="language-`+html.EscapeString(lang)+`"><code>`)
+            }else{
+                sb.WriteString("<pre><code>")
+            }
+            for _,c :=range(code){
+                sb.WriteString(html.EscapeString(c)+"\n")
+            }
+            sb.WriteString("</code></pre>\n")
+            continue
+        }
+        // indented code
+        if strings.HasPrefix(line,"    "){
+            var code []string
+            for i <len(lines) && (strings.HasPrefix(lines[i],"    ") || md_blank(lines[i])){
+                code = append(code,strings.TrimPrefix(lines[i],"    "))
+                i++
+            }
+            for len(code)>0 && md_blank(code[len(code)-1]){
+                code = code[:len(code)-1]
+            }
+            sb.WriteString("<pre><code>")
+            for _,c :=range(code){
+                sb.WriteString(html.EscapeString(c)+"\n")
+            }
+            sb.WriteString("</code></pre>\n")
+            continue
+        }
+        if mats :=md_heading_reg.FindStringSubmatch(line);mats !=nil{
+            level := strconv.Itoa(len(mats[1]))
+            sb.WriteString("<h"+level+">"+md_inline(strings.TrimSpace(mats[2]))+"</h"+level+">\n")
+            i++
+            continue
+        }
+        if md_hr_reg.MatchString(line){
+            sb.WriteString("<hr />\n")
+            i++
+            continue
+        }
+        if md_quote_reg.MatchString(line){
+            var quote []string
+            for i <len(lines) && !md_blank(lines[i]){
+                if md_quote_reg.MatchString(lines[i]){
+                    quote = append(quote,md_quote_reg.ReplaceAllString(lines[i],""))
+                }else if len(quote)>0 && !md_block_start(lines[i]){
+                    quote = append(quote,lines[i]) // a lazy line of the paragraph
+                }else{
+                    break
+                }
+                i++
+            }
+            sb.WriteString("<blockquote>\n")
+            md_blocks(sb,quote)
+            sb.WriteString("</blockquote>\n")
+            continue
+        }
+        if ok,ordered,start,_ := md_list_item(line);ok{
+            i = md_list(sb,lines,i,ordered,start)
+            continue
+        }
+        // a table is a row of cells over a row of dashes
+        if i+1 <len(lines) && strings.Contains(line,"|") && md_table_sep_reg.MatchString(lines[i+1]) && strings.Contains(lines[i+1],"-"){
+            i = md_table(sb,lines,i)
+            continue
+        }
+        // paragraph, or a heading underlined by === or ---
+        var para []string
+        for i <len(lines) && !md_blank(lines[i]){
+            if len(para)>0 && md_setext_reg.MatchString(lines[i]){
+                tag := "h2"
+                if strings.Contains(lines[i],"="){
+                    tag = "h1"
+                }
+                sb.WriteString("<"+tag+">"+md_inline(strings.TrimSpace(strings.Join(para,"\n")))+"</"+tag+">\n")
+                para = nil
+                i++
+                break
+            }
+            if len(para)>0 && md_block_start(lines[i]){
+                break
+            }
+            para = append(para,lines[i])
+            i++
+        }
+        if len(para)>0{
+            sb.WriteString("<p>"+md_inline(strings.TrimSpace(strings.Join(para,"\n")))+"</p>\n")
+        }
+    }
+}
+
+// md_list renders the list starting at lines[i], it gives the line after it
+func md_list(sb *strings.Builder,lines []string,i int,ordered bool,start int)int{
+    if ordered{
+        if start !=1{
+            sb.WriteString(`<ol start="`+strconv.Itoa(start)+`">`+"\n")
+        }else{
+            sb.WriteString("<ol>\n")
+        }
+    }else{
+        sb.WriteString("<ul>\n")
+    }
+    var items [][]string
+    loose := false
+    for i <len(lines){
+        ok,item_ordered,_,width := md_list_item(lines[i])
+        if !ok || item_ordered !=ordered{
+            break
+        }
+        item := []string{lines[i][width:]}
+        i++
+        for i <len(lines){
+            line := lines[i]
+            if md_blank(line){
+                // the item goes on if the next text is indented under it
+                j := i
+                for j <len(lines) && md_blank(lines[j]){
+                    j++
+                }
+                if j <len(lines) && strings.HasPrefix(lines[j],strings.Repeat(" ",md_min(width,4))){
+                    for ;i <j;i++{
+                        item = append(item,"")
+                    }
+                    loose = true
+                    continue
+                }
+                if j <len(lines){
+                    if next,next_ordered,_,_ := md_list_item(lines[j]);next && next_ordered ==ordered{
+                        loose = true
+                    }
+                }
+                i = j
+                break
+            }
+            if strings.HasPrefix(line,strings.Repeat(" ",md_min(width,4))){
+                item = append(item,line[md_min(width,4):])
+            }else if next,_,_,_ := md_list_item(line);next || md_block_start(line){
+                break
+            }else{
+                item = append(item,line) // a lazy line
+            }
+            i++
+        }
+        items = append(items,item)
+        if i <len(lines) && md_blank(lines[i]){
+            break
+        }
+    }
+    for _,item :=range(items){
+        var inner strings.Builder
+        md_blocks(&inner,item)
+        text := inner.String()
+        if !loose{
+            // a tight item shows its paragraphs without <p>
+            text = strings.ReplaceAll(text,"<p>","")
+            text = strings.ReplaceAll(text,"</p>\n","\n")
+        }
+        sb.WriteString("<li>"+strings.TrimSuffix(text,"\n")+"</li>\n")
+    }
+    if ordered{
+        sb.WriteString("</ol>\n")
+    }else{
+        sb.WriteString("</ul>\n")
+    }
+    return i
+}
+
+func md_min(a int,b int)int{
+    if a <b{
+        return a
+    }
+    return b
+}
+
+func md_table_cells(line string)[]string{
+    line = strings.TrimSpace(line)
+    line = strings.TrimPrefix(line,"|")
+    if strings.HasSuffix(line,"|") && !strings.HasSuffix(line,`\|`){
+        line = line[:len(line)-1]
+    }
+    var cells []string
+    var cell strings.Builder
+    for k:=0;k<len(line);k++{
+        if line[k]=='\\' && k+1<len(line) && line[k+1]=='|'{
+            cell.WriteByte('|')
+            k++
+            continue
+        }
+        if line[k]=='|'{
+            cells = append(cells,strings.TrimSpace(cell.String()))
+            cell.Reset()
+            continue
+        }
+        cell.WriteByte(line[k])
+    }
+    return append(cells,strings.TrimSpace(cell.String()))
+}
+
+func md_table(sb *strings.Builder,lines []string,i int)int{
+    head := md_table_cells(lines[i])
+    var aligns []string
+    for _,sep :=range(md_table_cells(lines[i+1])){
+        align := ""
+        if strings.HasPrefix(sep,":") && strings.HasSuffix(sep,":"){
+            align = "center"
+        }else if strings.HasSuffix(sep,":"){
+            align = "right"
+        }else if strings.HasPrefix(sep,":"){
+            align = "left"
+        }
+        aligns = append(aligns,align)
+    }
+    cell := func(tag string,k int,text string){
+        if k <len(aligns) && aligns[k] !=""{
+            sb.WriteString("<"+tag+` style="text-align:`+aligns[k]+`">`)
+        }else{
+            sb.WriteString("<"+tag+">")
+        }
+        sb.WriteString(md_inline(text)+"</"+tag+">")
+    }
+    sb.WriteString("<table>\n<thead>\n<tr>")
+    for k,text :=range(head){
+        cell("th",k,text)
+    }
+    sb.WriteString("</tr>\n</thead>\n<tbody>\n")
+    i += 2
+    for i <len(lines) && !md_blank(lines[i]) && strings.Contains(lines[i],"|"){
+        row := md_table_cells(lines[i])
+        sb.WriteString("<tr>")
+        for k:=0;k<len(head);k++{
+            text := ""
+            if k <len(row){
+                text = row[k]
+            }
+            cell("td",k,text)
+        }
+        sb.WriteString("</tr>\n")
+        i++
+    }
+    sb.WriteString("</tbody>\n</table>\n")
+    return i
+}
+
+// md_url keeps the links to the web, to mail and to the pages of Filegai.
+// The browsers drop the control characters and the line breaks of a link, so
+// "java\rscript:" runs as a script: a link with them, or with spaces, is not
+// kept, and the scheme is the one net/url finds.
+func md_url(dest string)string{
+    dest = strings.TrimSpace(dest)
+    dest = strings.TrimSuffix(strings.TrimPrefix(dest,"<"),">")
+    for _,r :=range(dest){
+        if unicode.IsControl(r) || unicode.IsSpace(r){
+            return "#"
+        }
+    }
+    parsed,err := url.Parse(dest)
+    if err !=nil{
+        return "#"
+    }
+    switch strings.ToLower(parsed.Scheme){
+    case "","http","https","mailto":
+        return html.EscapeString(dest)
+    }
+    return "#"
+}
+
+// md_link_end finds the ] closing the [ at i, and the ) of the (url "title")
+// after it. It gives the text, the url, the title and the index after it
+func md_link_end(text string,i int)(string,string,string,int,bool){
+    depth := 0
+    k := i
+    for ;k <len(text);k++{
+        if text[k]=='\\'{
+            k++
+            continue
+        }
+        if text[k]=='`'{
+            if end :=strings.Index(text[k+1:],"`");end >=0{
+                k += end+1
+                continue
+            }
+        }
+        if text[k]=='['{
+            depth++
+        }else if text[k]==']'{
+            depth--
+            if depth ==0{
+                break
+            }
+        }
+    }
+    if k >=len(text) || k+1 >=len(text) || text[k+1]!='('{
+        return "","","",0,false
+    }
+    label := text[i+1:k]
+    depth = 0
+    j := k+1
+    for ;j <len(text);j++{
+        if text[j]=='\\'{
+            j++
+            continue
+        }
+        if text[j]=='('{
+            depth++
+        }else if text[j]==')'{
+            depth--
+            if depth ==0{
+                break
+            }
+        }else if text[j]=='\n'{
+            return "","","",0,false
+        }
+    }
+    if j >=len(text){
+        return "","","",0,false
+    }
+    dest := strings.TrimSpace(text[k+2:j])
+    title := ""
+    if n :=strings.Index(dest,` "`);n >=0 && strings.HasSuffix(dest,`"`){
+        title = dest[n+2:len(dest)-1]
+        dest = strings.TrimSpace(dest[:n])
+    }
+    return label,dest,title,j+1,true
+}
+
+var md_autolink_reg = regexp.MustCompile(`^<((?:https?|mailto):[^ <>]+)>`)
+
+// md_inline renders the spans of a block: code, links, images, emphasis, breaks
+func md_inline(text string)string{
+    var sb strings.Builder
+    i := 0
+    for i <len(text){
+        ch := text[i]
+        switch{
+        case ch=='\\' && i+1 <len(text) && strings.IndexByte("\\`*_{}[]()#+-.!|~<>\"'",text[i+1])>=0:
+            sb.WriteString(html.EscapeString(text[i+1:i+2]))
+            i += 2
+            continue
+        case ch=='\\' && i+1 <len(text) && text[i+1]=='\n':
+            sb.WriteString("<br />\n")
+            i += 2
+            continue
+        case ch=='`':
+            n := 0
+            for i+n <len(text) && text[i+n]=='`'{
+                n++
+            }
+            ticks := text[i:i+n]
+            if end :=strings.Index(text[i+n:],ticks);end >=0{
+                code := text[i+n:i+n+end]
+                sb.WriteString("<code>"+html.EscapeString(strings.TrimSpace(code))+"</code>")
+                i += n+end+n
+                continue
+            }
+            sb.WriteString(ticks)
+            i += n
+            continue
+        case ch=='!' && i+1 <len(text) && text[i+1]=='[':
+            if alt,dest,title,end,ok := md_link_end(text,i+1);ok{
+                sb.WriteString(`<img src="`+md_url(dest)+`" alt="`+html.EscapeString(md_plain(alt))+`"`)
+                if title !=""{
+                    sb.WriteString(` title="`+html.EscapeString(title)+`"`)
+                }
+                sb.WriteString(" />")
+                i = end
+                continue
+            }
+        case ch=='[':
+            if label,dest,title,end,ok := md_link_end(text,i);ok{
+                sb.WriteString(`<a href="`+md_url(dest)+`"`)
+                if title !=""{
+                    sb.WriteString(` title="`+html.EscapeString(title)+`"`)
+                }
+                sb.WriteString(">"+md_inline(label)+"</a>")
+                i = end
+                continue
+            }
+        case ch=='<':
+            if mats :=md_autolink_reg.FindStringSubmatch(text[i:]);mats !=nil{
+                url := md_url(mats[1])
+                sb.WriteString(`<a href="`+url+`">`+html.EscapeString(mats[1])+"</a>")
+                i += len(mats[0])
+                continue
+            }
+        case ch=='*' || ch=='_' || ch=='~':
+            if out,end,ok := md_emphasis(text,i);ok{
+                sb.WriteString(out)
+                i = end
+                continue
+            }
+        case ch=='\n':
+            // two spaces at the end of a line break it
+            out := strings.TrimRight(sb.String()," ")
+            if len(out) <=len(sb.String())-2{
+                sb.Reset()
+                sb.WriteString(out+"<br />\n")
+            }else{
+                sb.WriteString("\n")
+            }
+            i++
+            continue
+        }
+        sb.WriteString(html.EscapeString(text[i:i+1]))
+        i++
+    }
+    return sb.String()
+}
+
+func md_word_char(ch byte)bool{
+    return ch >='0' && ch <='9' || ch >='a' && ch <='z' || ch >='A' && ch <='Z' || ch >=0x80
+}
+
+// md_emphasis renders **strong**, *em*, ***both***, ~~struck~~ and the _ forms
+// starting at i, the closing run is the first one that can close it
+func md_emphasis(text string,i int)(string,int,bool){
+    ch := text[i]
+    n := 0
+    for i+n <len(text) && text[i+n]==ch{
+        n++
+    }
+    if ch=='~'{
+        if n !=2{
+            return "",0,false
+        }
+    }else if n >3{
+        return "",0,false
+    }
+    if i+n >=len(text) || text[i+n]==' ' || text[i+n]=='\n'{
+        return "",0,false
+    }
+    // an _ inside a word is a letter, snake_case stays as it is
+    if ch=='_' && i >0 && md_word_char(text[i-1]){
+        return "",0,false
+    }
+    run := text[i:i+n]
+    for k:=i+n;k <len(text);k++{
+        if text[k]=='\\'{
+            k++
+            continue
+        }
+        if text[k]=='`'{
+            if end :=strings.Index(text[k+1:],"`");end >=0{
+                k += end+1
+                continue
+            }
+        }
+        if !strings.HasPrefix(text[k:],run) || text[k-1]==' ' || text[k-1]=='\n'{
+            continue
+        }
+        if k+n <len(text) && text[k+n]==ch{
+            continue // a longer run, e.g. the ** after an *em*
+        }
+        if ch=='_' && k+n <len(text) && md_word_char(text[k+n]){
+            continue
+        }
+        inner := md_inline(text[i+n:k])
+        switch{
+        case ch=='~':
+            inner = "<del>"+inner+"</del>"
+        case n==1:
+            inner = "<em>"+inner+"</em>"
+        case n==2:
+            inner = "<strong>"+inner+"</strong>"
+        default:
+            inner = "<em><strong>"+inner+"</strong></em>"
+        }
+        return inner,k+n,true
+    }
+    return "",0,false
+}
+
+// md_plain gives the text of the markdown spans, for the alt of an image
+func md_plain(text string)string{
+    return html_text(md_inline(text))
+}
+
+//====================================================================================================
+// html to markdown
+//====================================================================================================
+// html_markdown turns the html of the editor into markdown. The tags markdown
+// has no form for are dropped and their text kept, a table goes as a pipe
+// table, an image keeps its /get_image/ link, so the note keeps its images.
+
+type html_node struct{
+    tag string // "" for a text
+    text string
+    attrs map[string]string
+    kids []*html_node
+}
+
+var html_void_tags = make_set([]string{"br","hr","img","input","meta","link","col","area","base","wbr","source"})
+var html_token_reg = regexp.MustCompile(`(?s)<!--.*?-->|<(/?)([A-Za-z][A-Za-z0-9]*)((?:[^>"']|"[^"]*"|'[^']*')*)>`)
+var html_attr_reg = regexp.MustCompile(`([A-Za-z_:][-A-Za-z0-9_:.]*)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'=<>` + "`" + `]+)))?`)
+
+// html_parse makes a tree of the html, a tag closed out of order closes the
+// tags opened after it
+func html_parse(text string)*html_node{
+    root := &html_node{tag:"root"}
+    stack := []*html_node{root}
+    pos := 0
+    add_text := func(s string){
+        if s !=""{
+            top := stack[len(stack)-1]
+            top.kids = append(top.kids,&html_node{text:html.UnescapeString(s)})
+        }
+    }
+    for _,loc :=range(html_token_reg.FindAllStringSubmatchIndex(text,-1)){
+        add_text(text[pos:loc[0]])
+        pos = loc[1]
+        if loc[4] <0{
+            continue // a comment
+        }
+        name := strings.ToLower(text[loc[4]:loc[5]])
+        if loc[3] >loc[2]{
+            for k:=len(stack)-1;k >0;k--{
+                if stack[k].tag ==name{
+                    stack = stack[:k]
+                    break
+                }
+            }
+            continue
+        }
+        node := &html_node{tag:name,attrs:make(map[string]string)}
+        for _,mats :=range(html_attr_reg.FindAllStringSubmatch(text[loc[6]:loc[7]],-1)){
+            node.attrs[strings.ToLower(mats[1])] = html.UnescapeString(mats[2]+mats[3]+mats[4])
+        }
+        top := stack[len(stack)-1]
+        top.kids = append(top.kids,node)
+        if !html_void_tags.Has(name) && !strings.HasSuffix(strings.TrimSpace(text[loc[6]:loc[7]]),"/"){
+            stack = append(stack,node)
+        }
+    }
+    add_text(text[pos:])
+    return root
+}
+
+func html_markdown(text string)string{
+    var sb strings.Builder
+    md_write_blocks(&sb,html_parse(text).kids)
+    out := regexp.MustCompile(`\n{3,}`).ReplaceAllString(sb.String(),"\n\n")
+    return strings.TrimSpace(out)+"\n"
+}
+
+var md_block_tags = make_set([]string{"p","div","h1","h2","h3","h4","h5","h6","ul","ol","pre","blockquote","hr","table","section","article","header","footer","figure","li"})
+
+// md_write_blocks writes the nodes as blocks, the runs of inline nodes go as paragraphs
+func md_write_blocks(sb *strings.Builder,nodes []*html_node){
+    var run []*html_node
+    flush := func(){
+        line := strings.TrimSpace(md_spans(run))
+        if line !=""{
+            sb.WriteString(line+"\n\n")
+        }
+        run = nil
+    }
+    for _,node :=range(nodes){
+        if node.tag =="" || !md_block_tags.Has(node.tag){
+            run = append(run,node)
+            continue
+        }
+        flush()
+        switch node.tag{
+        case "h1","h2","h3","h4","h5","h6":
+            level,_ := strconv.Atoi(node.tag[1:])
+            sb.WriteString(strings.Repeat("#",level)+" "+strings.TrimSpace(strings.ReplaceAll(md_spans(node.kids),"\n"," "))+"\n\n")
+        case "hr":
+            sb.WriteString("---\n\n")
+        case "pre":
+            lang := ""
+            for _,class :=range(strings.Fields(node.attrs["class"]+" "+md_first_code_class(node))){
+                if strings.HasPrefix(class,"language-"){
+                    lang = strings.TrimPrefix(class,"language-")
+                }
+            }
+            code := strings.TrimRight(html_node_text(node),"\n")
+            fence := "```"
+            for strings.Contains(code,fence){
+                fence += "`"
+            }
+            sb.WriteString(fence+lang+"\n"+code+"\n"+fence+"\n\n")
+        case "blockquote":
+            var inner strings.Builder
+            md_write_blocks(&inner,node.kids)
+            for _,line :=range(strings.Split(strings.TrimSpace(inner.String()),"\n")){
+                sb.WriteString(strings.TrimRight("> "+line," ")+"\n")
+            }
+            sb.WriteString("\n")
+        case "ul","ol":
+            md_write_list(sb,node)
+            sb.WriteString("\n")
+        case "table":
+            md_write_table(sb,node)
+        default:
+            md_write_blocks(sb,node.kids)
+        }
+    }
+    flush()
+}
+
+func md_first_code_class(node *html_node)string{
+    for _,kid :=range(node.kids){
+        if kid.tag =="code"{
+            return kid.attrs["class"]
+        }
+    }
+    return ""
+}
+
+func md_write_list(sb *strings.Builder,node *html_node){
+    number := 1
+    if start,err := strconv.Atoi(node.attrs["start"]);err ==nil{
+        number = start
+    }
+    for _,kid :=range(node.kids){
+        if kid.tag !="li"{
+            continue
+        }
+        marker := "- "
+        if node.tag =="ol"{
+            marker = strconv.Itoa(number)+". "
+            number++
+        }
+        var inner strings.Builder
+        md_write_blocks(&inner,kid.kids)
+        // the blocks of a tight item are one line each
+        body := strings.TrimSpace(regexp.MustCompile(`\n\n+(\s*([-*+]|\d+\.) )`).ReplaceAllString(inner.String(),"\n$1"))
+        indent := strings.Repeat(" ",len(marker))
+        for k,line :=range(strings.Split(body,"\n")){
+            if k ==0{
+                sb.WriteString(marker+line+"\n")
+            }else if line ==""{
+                sb.WriteString("\n")
+            }else{
+                sb.WriteString(indent+line+"\n")
+            }
+        }
+    }
+}
+
+func md_write_table(sb *strings.Builder,node *html_node){
+    var rows [][]string
+    var walk func(n *html_node)
+    walk = func(n *html_node){
+        for _,kid :=range(n.kids){
+            if kid.tag =="tr"{
+                var row []string
+                for _,cell :=range(kid.kids){
+                    if cell.tag =="td" || cell.tag =="th"{
+                        text := strings.TrimSpace(strings.ReplaceAll(md_spans(cell.kids),"\n"," "))
+                        row = append(row,text)
+                    }
+                }
+                rows = append(rows,row)
+            }else if kid.tag !=""{
+                walk(kid)
+            }
+        }
+    }
+    walk(node)
+    if len(rows) ==0{
+        return
+    }
+    width := 0
+    for _,row :=range(rows){
+        if len(row) >width{
+            width = len(row)
+        }
+    }
+    for k,row :=range(rows){
+        for len(row) <width{
+            row = append(row,"")
+        }
+        sb.WriteString("| "+strings.Join(row," | ")+" |\n")
+        if k ==0{
+            sb.WriteString("|"+strings.Repeat(" --- |",width)+"\n")
+        }
+    }
+    sb.WriteString("\n")
+}
+
+// html_node_text gives the text in the node, the <br> as new lines
+func html_node_text(node *html_node)string{
+    if node.tag ==""{
+        return node.text
+    }
+    if node.tag =="br"{
+        return "\n"
+    }
+    var sb strings.Builder
+    for _,kid :=range(node.kids){
+        sb.WriteString(html_node_text(kid))
+    }
+    return sb.String()
+}
+
+var md_space_reg = regexp.MustCompile(`\s+`)
+var md_line_start_reg = regexp.MustCompile(`(?m)^(\s*)([#>+-]|\d+\.)(\s)`)
+
+// md_escape keeps a text from being read as markdown, an _ inside a word needs none
+func md_escape(text string)string{
+    var sb strings.Builder
+    for k:=0;k<len(text);k++{
+        ch := text[k]
+        if strings.IndexByte("\\`*_[]<>|",ch)>=0{
+            if !(ch=='_' && k>0 && k+1<len(text) && md_word_char(text[k-1]) && md_word_char(text[k+1])){
+                sb.WriteByte('\\')
+            }
+        }
+        sb.WriteByte(ch)
+    }
+    return md_line_start_reg.ReplaceAllString(sb.String(),`$1\$2$3`)
+}
+
+// md_spans writes the inline nodes as markdown spans
+func md_spans(nodes []*html_node)string{
+    var sb strings.Builder
+    for _,node :=range(nodes){
+        switch node.tag{
+        case "":
+            sb.WriteString(md_escape(md_space_reg.ReplaceAllString(node.text," ")))
+        case "br":
+            sb.WriteString("  \n")
+        case "strong","b":
+            sb.WriteString(md_wrap("**",md_spans(node.kids)))
+        case "em","i":
+            sb.WriteString(md_wrap("*",md_spans(node.kids)))
+        case "del","s","strike":
+            sb.WriteString(md_wrap("~~",md_spans(node.kids)))
+        case "code":
+            code := html_node_text(node)
+            ticks := "`"
+            for strings.Contains(code,ticks){
+                ticks += "`"
+            }
+            if strings.HasPrefix(code,"`") || strings.HasSuffix(code,"`"){
+                code = " "+code+" "
+            }
+            sb.WriteString(ticks+code+ticks)
+        case "a":
+            text := strings.TrimSpace(md_spans(node.kids))
+            href := node.attrs["href"]
+            if href ==""{
+                sb.WriteString(text)
+                continue
+            }
+            if text ==""{
+                text = md_escape(href)
+            }
+            sb.WriteString("["+text+"]("+md_dest(href)+md_title(node.attrs["title"])+")")
+        case "img":
+            sb.WriteString("!["+md_escape(node.attrs["alt"])+"]("+md_dest(node.attrs["src"])+md_title(node.attrs["title"])+")")
+        case "script","style":
+        default:
+            if md_block_tags.Has(node.tag){
+                var inner strings.Builder
+                md_write_blocks(&inner,[]*html_node{node})
+                sb.WriteString(strings.TrimSpace(inner.String()))
+            }else{
+                sb.WriteString(md_spans(node.kids))
+            }
+        }
+    }
+    return sb.String()
+}
+
+func md_dest(url string)string{
+    if strings.ContainsAny(url," ()<>"){
+        return "<"+strings.NewReplacer("<","%3C",">","%3E").Replace(url)+">"
+    }
+    return url
+}
+
+func md_title(title string)string{
+    if title ==""{
+        return ""
+    }
+    return ` "`+strings.ReplaceAll(title,`"`,`\"`)+`"`
+}
+
+// md_wrap puts the marks around the text, the spaces at its ends go outside
+func md_wrap(mark string,text string)string{
+    inner := strings.TrimSpace(text)
+    if inner ==""{
+        return text
+    }
+    lead := text[:len(text)-len(strings.TrimLeft(text," \n"))]
+    tail := text[len(strings.TrimRight(text," \n")):]
+    return lead+mark+inner+mark+tail
+}
+
+// ================ for full text search ========================
+// search_index is an FTS5 table of the text of the notes (app 1, owner is the
+// note tag) and of the article pages (app 2, tag is the pg_tag, owner the
+// article tag). The html is stripped before indexing, so the markup and the
+// image links are not found. It is kept in the same transaction as the notes.
+// A build without FTS5 keeps the same rows in the plain table search_plain and
+// looks them up with LIKE, see search_index_sync for going from one to the other.
+
+var fts5_once sync.Once
+var fts5_built bool
+
+// search_fts tells whether this build has FTS5, go build -tags sqlite_fts5
+func search_fts()bool{
+    fts5_once.Do(func(){
+        db,err := sql.Open("sqlite3",":memory:")
+        if err !=nil{
+            return
+        }
+        defer db.Close()
+        var used int
+        err = db.QueryRow("select sqlite_compileoption_used('ENABLE_FTS5')").Scan(&used)
+        fts5_built = err ==nil && used ==1
+    })
+    return fts5_built
+}
+
+// search_table is the index table of this build
+func search_table()string{
+    if search_fts(){
+        return "search_index"
+    }
+    return "search_plain"
+}
+
+func search_index_create(db_link Db_link)error{
+    sql_str := `CREATE TABLE IF NOT EXISTS search_plain(app INTEGER, tag CHAR(10), owner CHAR(10), text TEXT);
+CREATE INDEX IF NOT EXISTS idx_search_plain ON search_plain(app,tag);`
+    if search_fts(){
+        sql_str = `CREATE VIRTUAL TABLE IF NOT EXISTS search_index USING fts5(app UNINDEXED, tag UNINDEXED, owner UNINDEXED, text,
+    tokenize='unicode61 remove_diacritics 2');`
+    }
+    _,err := db_link.Exec(sql_str)
+    return err
+}
+
+type Search_hit struct{
+    App int
+    Tag string
+    Owner string
+    Snippet string // html escaped, the matches in <mark>
+    Rank float64
+}
+
+var html_drop_reg = regexp.MustCompile(`(?is)<(script|style)[^>]*>.*?</(script|style)>`)
+var html_tag_reg = regexp.MustCompile(`(?s)<[^>]*>`)
+
+// html_text gives the plain text of a note
+func html_text(text string)string{
+    text = html_drop_reg.ReplaceAllString(text," ")
+    text = html_tag_reg.ReplaceAllString(text," ")
+    text = html.UnescapeString(text)
+    return strings.Join(strings.Fields(text)," ")
+}
+
+func search_index_put(db_link Db_link,app int,tag string,owner string,text string)error{
+    err := search_index_del(db_link,app,tag)
+    if err !=nil{
+        return err
+    }
+    _,err = db_link.Exec("insert into "+search_table()+"(app,tag,owner,text) values(?,?,?,?)",app,tag,owner,html_text(text))
+    return err
+}
+
+func search_index_del(db_link Db_link,app int,tag string)error{
+    _,err := db_link.Exec("delete from "+search_table()+" where app=? and tag=?",app,tag)
+    return err
+}
+
+// search_quote makes every word of the target a phrase, for the targets
+// that are not a valid FTS5 query (e.g. 100% or a-b)
+func search_quote(target string)string{
+    var terms []string
+    for _,word :=range(strings.Fields(target)){
+        terms = append(terms,`"`+strings.ReplaceAll(word,`"`,`""`)+`"`)
+    }
+    return strings.Join(terms," ")
+}
+
+// search_index_query runs the target as an FTS5 query: "a phrase", prefix*,
+// AND, OR, NOT and ( ) work. The hits are ranked by bm25
+func search_index_query(db_link Db_link,app int,target string,limit int)([]Search_hit,error){
+    target = strings.TrimSpace(target)
+    if target ==""{
+        return []Search_hit{},nil
+    }
+    if !search_fts(){
+        return search_plain_run(db_link,app,target,limit)
+    }
+    // a bad query shows up only when the rows are read
+    result,err := search_index_run(db_link,app,target,limit)
+    if err !=nil{
+        result,err = search_index_run(db_link,app,search_quote(target),limit)
+    }
+    return result,err
+}
+
+func search_index_run(db_link Db_link,app int,match string,limit int)([]Search_hit,error){
+    var result []Search_hit
+    sql_str := `select app,tag,owner,snippet(search_index,3,char(1),char(2),'...',16),rank from search_index
+        where search_index match ? and app=? order by rank limit ?`
+    rows,err := db_link.Query(sql_str,match,app,limit)
+    if err !=nil{
+        return result,err
+    }
+    defer rows.Close()
+    marks := strings.NewReplacer("\x01","<mark>","\x02","</mark>")
+    for rows.Next(){
+        var hit Search_hit
+        err = rows.Scan(&hit.App,&hit.Tag,&hit.Owner,&hit.Snippet,&hit.Rank)
+        if err !=nil{
+            return result,err
+        }
+        hit.Snippet = marks.Replace(html.EscapeString(hit.Snippet))
+        result = append(result,hit)
+    }
+    return result,rows.Err()
+}
+
+// search_plain_run looks for the words of the target with LIKE, for the builds
+// without FTS5: all of them have to be there, but the ones after NOT, and the
+// newest texts come first
+func search_plain_run(db_link Db_link,app int,target string,limit int)([]Search_hit,error){
+    var result []Search_hit
+    sql_str := "select app,tag,owner,text from search_plain where app=?"
+    args := []interface{}{app}
+    var words []string
+    not := false
+    for _,word :=range(strings.Fields(target)){
+        switch word{
+        case "AND","OR":
+            continue
+        case "NOT":
+            not = true
+            continue
+        }
+        word = strings.Trim(word,`"()*`)
+        if word ==""{
+            continue
+        }
+        if not{
+            sql_str += " and text not like ? escape '\\'"
+            not = false
+        }else{
+            sql_str += " and text like ? escape '\\'"
+            words = append(words,word)
+        }
+        args = append(args,"%"+like_escape(word)+"%")
+    }
+    if len(words)==0{
+        return result,nil
+    }
+    sql_str += " order by rowid desc limit ?"
+    args = append(args,limit)
+    rows,err := db_link.Query(sql_str,args...)
+    if err !=nil{
+        return result,err
+    }
+    defer rows.Close()
+    for rows.Next(){
+        var hit Search_hit
+        var text string
+        err = rows.Scan(&hit.App,&hit.Tag,&hit.Owner,&text)
+        if err !=nil{
+            return result,err
+        }
+        hit.Snippet = plain_snippet(text,words)
+        result = append(result,hit)
+    }
+    return result,rows.Err()
+}
+
+// plain_snippet cuts the text around the first word found, as snippet() of
+// FTS5 does: html escaped, the words in <mark>
+func plain_snippet(text string,words []string)string{
+    var quoted []string
+    for _,word :=range(words){
+        quoted = append(quoted,regexp.QuoteMeta(word))
+    }
+    reg := regexp.MustCompile(`(?i)`+strings.Join(quoted,"|"))
+    start,end := 0,len(text)
+    if loc := reg.FindStringIndex(text);loc !=nil{
+        start = loc[0]-60
+        end = loc[1]+120
+    }
+    prefix,suffix := "...","..."
+    if start<=0{
+        start,prefix = 0,""
+    }
+    if end>=len(text){
+        end,suffix = len(text),""
+    }
+    // not in the middle of a character
+    for start>0 && !utf8.RuneStart(text[start]){
+        start--
+    }
+    for end<len(text) && !utf8.RuneStart(text[end]){
+        end++
+    }
+    part := text[start:end]
+    var buf bytes.Buffer
+    buf.WriteString(prefix)
+    last := 0
+    for _,loc :=range(reg.FindAllStringIndex(part,-1)){
+        buf.WriteString(html.EscapeString(part[last:loc[0]]))
+        buf.WriteString("<mark>"+html.EscapeString(part[loc[0]:loc[1]])+"</mark>")
+        last = loc[1]
+    }
+    buf.WriteString(html.EscapeString(part[last:]))
+    buf.WriteString(suffix)
+    return buf.String()
+}
+
+// ================ for unified search ========================
+// unified_search looks for the target in the file names, the notes, the
+// articles and the image names and gives one list of typed results. A filter
+// narrows the kinds it applies to and leaves out the kinds it can not apply
+// to: with a color only notes and articles are left, with a folder or an
+// extension only files and notes. The date of a file is its time, the files
+// not indexed yet have none and are left out by a date range.
+
+type Search_filter struct{
+    Kinds []string // file, note, article, image; empty for all
+    Color int // 0 for any
+    From string // YYYY-MM-DD, on ndate, adate, rs_date and the time of the files
+    To string
+    Folder string // relative to the root, "/" as deliminator
+    Ext string // file extension without the dot
+}
+
+type Search_result struct{
+    Kind string
+    Title string
+    Path string // relative path of files and notes
+    Snippet string // html
+    Date string
+    Color_str string
+    Link string
+}
+
+const search_result_limit = 200
+
+func (filter Search_filter) wants(kind string)bool{
+    if len(filter.Kinds)>0 && !make_set(filter.Kinds).Has(kind){
+        return false
+    }
+    switch kind{
+    case "file":
+        return filter.Color ==0
+    case "note":
+        return true
+    case "article":
+        return filter.Folder =="" && filter.Ext ==""
+    case "image":
+        return filter.Color ==0 && filter.Folder =="" && filter.Ext ==""
+    }
+    return false
+}
+
+func (filter Search_filter) date_ok(date string)bool{
+    if len(date)>10{
+        date = date[:10]
+    }
+    if filter.From !="" && date < filter.From{
+        return false
+    }
+    if filter.To !="" && date > filter.To{
+        return false
+    }
+    return true
+}
+
+// path_ok checks a relative "/" path against the folder and extension filters
+func (filter Search_filter) path_ok(rel_path string)bool{
+    folder := folder_key(strings.Trim(filter.Folder,"/"))
+    if folder !="" && !strings.HasPrefix(rel_path,folder){
+        return false
+    }
+    if filter.Ext !="" && file_suffix(rel_path) != strings.ToLower(strings.TrimPrefix(filter.Ext,".")){
+        return false
+    }
+    return true
+}
+
+// note_list_link is the /list link of the folder of a note with its file active
+func note_list_link(roots Roots,file_dir string,file_name string)(string,error){
+    path := roots.abs(file_dir+file_name)
+    if path==""{
+        return "",errors.New("the root of the file is not served")
+    }
+    fnode,err := get_Fnode(path,false)
+    if err !=nil{
+        return "",err
+    }
+    active_ino :=strconv.FormatUint(fnode.Dev,10)+"_"+strconv.FormatUint(fnode.Ino,10)
+    if fnode.IsDir{
+        // a folder note, the folder's listing has it on top
+        return "/list/"+active_ino,nil
+    }
+    parent_ino :=strconv.FormatUint(fnode.Dev,10)+"_"+strconv.FormatUint(fnode.Parent_ino,10)
+    return "/list/"+parent_ino+"&"+active_ino,nil
+}
+
+func unified_search(db_link Db_link,st *Store,host_name string,roots Roots,target string,filter Search_filter)([]Search_result,error){
+    var result []Search_result
+    target = strings.TrimSpace(target)
+    if target ==""{
+        return result,nil
+    }
+    if filter.wants("file"){
+        fnodes,err := search_fnodes(db_link,host_name,target)
+        if err !=nil{
+            return result,err
+        }
+        for _,node :=range(fnodes){
+            if len(result) >= search_result_limit{
+                break
+            }
+            if node.Ino == node.Parent_ino{
+                continue // the root
+            }
+            url,err := file_url(db_link,node.Dev,node.Ino,100,sys_delim())
+            if err !=nil || roots.of(url)==nil{
+                continue // not under a served root of this PC
+            }
+            rel_path := strings.ReplaceAll(roots.rel(url),sys_delim(),"/")
+            if !filter.path_ok(strings.TrimSuffix(rel_path,"/")){
+                continue
+            }
+            date := ""
+            if node.Mtime >0{
+                date = time.Unix(node.Mtime,0).Format("2006-01-02 15:04:05")
+            }
+            if (filter.From !="" || filter.To !="") && (date =="" || !filter.date_ok(date)){
+                continue
+            }
+            dev := strconv.FormatUint(node.Dev,10)
+            link := "/list/"+dev+"_"+strconv.FormatUint(node.Parent_ino,10)+"&"+dev+"_"+strconv.FormatUint(node.Ino,10)
+            if node.IsDir{
+                link = "/list/"+dev+"_"+strconv.FormatUint(node.Ino,10)
+            }
+            result = append(result,Search_result{Kind:"file",Title:node.Name,Path:rel_path,Date:date,Link:link})
+        }
+    }
+    if filter.wants("note"){
+        notes,err := search_notes(db_link,st,target)
+        if err !=nil && err.Error() !="no record"{
+            return result,err
+        }
+        err = note_anchors(db_link,notes)
+        if err !=nil{
+            return result,err
+        }
+        for _,note :=range(notes){
+            if filter.Color !=0 && note.Color != filter.Color{
+                continue
+            }
+            if !filter.date_ok(note.Ndate) || !filter.path_ok(note.File_dir+note.File_name){
+                continue
+            }
+            title := note.File_name
+            if note.Anchor.Page >0{
+                title += " p. "+strconv.Itoa(note.Anchor.Page)
+            }
+            link,err := note_list_link(roots,note.File_dir,note.File_name)
+            if err !=nil{
+                link = "/file_notes/1" // an orphan, the file is gone
+            }else if note.Anchor.Page >0{
+                link = "/show/"+note.Tag // the viewer at the page
+            }
+            result = append(result,Search_result{Kind:"note",Title:title,Path:note.File_dir+note.File_name,
+                Snippet:note.Snippet,Date:note.Ndate,Color_str:note.Color_str,Link:link})
+        }
+    }
+    if filter.wants("article"){
+        articles,err := search_article(db_link,target)
+        if err !=nil{
+            return result,err
+        }
+        for _,article :=range(articles){
+            color,_ := strconv.Atoi(article.Color)
+            if filter.Color !=0 && color != filter.Color{
+                continue
+            }
+            if !filter.date_ok(article.Adate){
+                continue
+            }
+            result = append(result,Search_result{Kind:"article",Title:article.Title,Snippet:article.Snippet,
+                Date:article.Adate,Color_str:color_decode(color),Link:"/show_article/"+article.Tag})
+        }
+    }
+    if filter.wants("image"){
+        images,err := search_images(db_link,target)
+        if err !=nil{
+            return result,err
+        }
+        for _,image :=range(images){
+            if !filter.date_ok(image.Rs_date){
+                continue
+            }
+            result = append(result,Search_result{Kind:"image",Title:image.Name,
+                Snippet:`<img class="search_thumb" src="/get_image/`+image.File_name+`">`,
+                Date:image.Rs_date,Link:"/track/"+image.Tag})
+        }
+    }
+    return result,nil
+}
+
+// ================ for fsck ========================
+// fsck cross-checks Filegai.db against the blob pages. The whole check runs in
+// one unit, so the writers wait for it and it sees a settled database.
+
+type Fsck_issue struct{
+    Kind string // ref_count, missing_blob, lost_text, dead_tag, foreign_ino, stray_blob
+    Tag string // the resource, note or tag concerned, the host name for foreign_ino
+    Detail string
+    Fixed bool
+}
+
+type Fsck_report struct{
+    Repair bool
+    Issues []Fsck_issue
+}
+
+// missing_blob and lost_text are lost data, the repair can not bring them back
+func (issue Fsck_issue) repairable()bool{
+    return issue.Kind !="missing_blob" && issue.Kind !="lost_text"
+}
+
+func (report *Fsck_report) add(kind string,tag string,detail string,fixed bool){
+    report.Issues = append(report.Issues,Fsck_issue{Kind:kind,Tag:tag,Detail:detail,Fixed:fixed})
+}
+
+func (report *Fsck_report) fixed_count()int{
+    cnt:=0
+    for _,issue :=range(report.Issues){
+        if issue.Fixed{
+            cnt++
+        }
+    }
+    return cnt
+}
+
+func (report *Fsck_report) String()string{
+    var buf bytes.Buffer
+    for _,issue :=range(report.Issues){
+        buf.WriteString("["+issue.Kind+"] "+issue.Tag+": "+issue.Detail)
+        if issue.Fixed{
+            buf.WriteString(" (fixed)")
+        }
+        buf.WriteString("\n")
+    }
+    buf.WriteString(fmt.Sprintf("%d problems found, %d fixed\n",len(report.Issues),report.fixed_count()))
+    return buf.String()
+}
+
+// fsck only reads unless it repairs, so the check does not hold up the saves
+func fsck(st *Store,repair bool)(*Fsck_report,error){
+    report := &Fsck_report{Repair:repair}
+    var u *Unit
+    var err error
+    if repair{
+        u,err = st.begin()
+    }else{
+        u,err = st.view()
+    }
+    if err !=nil{
+        return report,err
+    }
+    err = fsck_ref_counts(u,report)
+    if err ==nil{
+        err = fsck_blobs(u,report)
+    }
+    if err ==nil{
+        err = fsck_dead_tags(u,report)
+    }
+    if err ==nil{
+        err = fsck_foreign_inos(u,report)
+    }
+    if !repair{
+        u.rollback()
+        return report,err
+    }
+    err = u.finish(err)
+    return report,err
+}
+
+// the ref_count of a resource is the number of its resource_link rows
+func fsck_ref_counts(u *Unit,report *Fsck_report)error{
+    sql_str := `select r.tag,r.ref_count,count(l.rsl_id) from resource r
+        left join resource_link l on l.tag=r.tag group by r.rsid having r.ref_count<>count(l.rsl_id)`
+    rows,err := u.tx.Query(sql_str)
+    if err !=nil{
+        return err
+    }
+    type ref_count_diff struct{
+        tag string
+        ref_count int64
+        links int64
+    }
+    var diffs []ref_count_diff
+    for rows.Next(){
+        var diff ref_count_diff
+        err = rows.Scan(&diff.tag,&diff.ref_count,&diff.links)
+        if err !=nil{
+            rows.Close()
+            return err
+        }
+        diffs = append(diffs,diff)
+    }
+    rows.Close()
+    for _,diff :=range(diffs){
+        detail := fmt.Sprintf("ref_count %d, %d links",diff.ref_count,diff.links)
+        fixed := false
+        if report.Repair{
+            tab := get_table("resource")
+            tab.set("ref_count",strconv.FormatInt(diff.links,10)).set("tag",diff.tag)
+            _,err = do_update(u.tx,tab.pack_update([]string{"tag"}))
+            if err !=nil{
+                return err
+            }
+            fixed = true
+        }
+        report.add("ref_count",diff.tag,detail,fixed)
+    }
+    return nil
+}
+
+// fsck_blobs matches the resource rows with the blob pages: a resource without
+// its blob can not be fixed, a blob without its resource is moved to quarantine.
+// The notes are checked here too, as their text is a resource.
+func fsck_blobs(u *Unit,report *Fsck_report)error{
+    resources := map[string]int{} // tag -> page
+    tab := get_table("resource")
+    rows,err := do_query(u.tx,tab.pack_select("tag,page","",""))
+    if err !=nil{
+        return err
+    }
+    for rows.Next(){
+        var tag string
+        var page int
+        err = rows.Scan(&tag,&page)
+        if err !=nil{
+            rows.Close()
+            return err
+        }
+        resources[tag] = page
+    }
+    rows.Close()
+
+    pages,err := blob_pages(u.st.folder)
+    if err !=nil{
+        return err
+    }
+    blobs := map[string]int{} // tag -> page
+    for _,page :=range(pages){
+        blob_db,err := u.st.blob(strconv.Itoa(page))
+        if err !=nil{
+            return err
+        }
+        tags,err := blob_tags(blob_db)
+        if err !=nil{
+            return err
+        }
+        for _,tag :=range(tags){
+            blobs[tag] = page
+            if rs_page,ok := resources[tag];ok && rs_page == page{
+                continue
+            }
+            fixed := false
+            if report.Repair{
+                err = blob_quarantine(u,page,tag)
+                if err !=nil{
+                    return err
+                }
+                fixed = true
+            }
+            report.add("stray_blob",tag,"no resource for the blob in blob"+strconv.Itoa(page)+".db",fixed)
+        }
+    }
+
+    for tag,page :=range(resources){
+        if blob_page,ok := blobs[tag];!ok || blob_page != page{
+            report.add("missing_blob",tag,"blob not found in blob"+strconv.Itoa(page)+".db",false)
+        }
+    }
+
+    tab_note := get_table("file_note")
+    rows,err = do_query(u.tx,tab_note.pack_select("tag,file_dir,file_name,note","",""))
+    if err !=nil{
+        return err
+    }
+    defer rows.Close()
+    reg:=regexp.MustCompile(`#<0x_([\d\w]+)_>`)
+    for rows.Next(){
+        var record Note_record
+        err = rows.Scan(&record.Tag,&record.File_dir,&record.File_name,&record.Note)
+        if err !=nil{
+            return err
+        }
+        mats := reg.FindStringSubmatch(record.Note)
+        if len(mats)<2{
+            continue
+        }
+        page,ok := resources[mats[1]]
+        if blob_page,has_blob := blobs[mats[1]];ok && has_blob && blob_page == page{
+            continue
+        }
+        report.add("lost_text",record.Tag,"the text of the note on "+record.File_dir+"/"+record.File_name+" is missing",false)
+    }
+    return nil
+}
+
+func fsck_dead_tags(u *Unit,report *Fsck_report)error{
+    sql_str := `select tag_str from tags where
+        tag_str not in (select tag from file_note where tag is not null) and
+        tag_str not in (select tag from resource where tag is not null) and
+        tag_str not in (select tag from article where tag is not null)`
+    rows,err := u.tx.Query(sql_str)
+    if err !=nil{
+        return err
+    }
+    var tags []string
+    for rows.Next(){
+        var tag string
+        err = rows.Scan(&tag)
+        if err !=nil{
+            rows.Close()
+            return err
+        }
+        tags = append(tags,tag)
+    }
+    rows.Close()
+    for _,tag :=range(tags){
+        fixed := false
+        if report.Repair{
+            _,err = tag_clear(u.tx,tag)
+            if err !=nil{
+                return err
+            }
+            fixed = true
+        }
+        report.add("dead_tag",tag,"nothing uses the tag",fixed)
+    }
+    return nil
+}
+
+// ino_tree is a cache of the hosts sharing the database, a host is known when
+// it has a root
+func fsck_foreign_inos(u *Unit,report *Fsck_report)error{
+    sql_str := `select host_name,count(*) from ino_tree where host_name<>? and
+        host_name not in (select host_name from root_folder where host_name is not null)
+        group by host_name`
+    rows,err := u.tx.Query(sql_str,get_host_name())
+    if err !=nil{
+        return err
+    }
+    hosts := map[string]int64{}
+    for rows.Next(){
+        var host_name string
+        var cnt int64
+        err = rows.Scan(&host_name,&cnt)
+        if err !=nil{
+            rows.Close()
+            return err
+        }
+        hosts[host_name] = cnt
+    }
+    rows.Close()
+    for host_name,cnt :=range(hosts){
+        fixed := false
+        if report.Repair{
+            tab := get_table("ino_tree")
+            tab.set("host_name",host_name)
+            _,err = do_delete(u.tx,tab.pack_delete())
+            if err !=nil{
+                return err
+            }
+            fixed = true
+        }
+        report.add("foreign_ino",host_name,fmt.Sprintf("%d ino_tree rows of an unknown host",cnt),fixed)
+    }
+    return nil
+}
+
+func blob_tags(db_link Db_link)([]string,error){
+    var result []string
+    rows,err := db_link.Query("select tag from blob_obj")
+    if err !=nil{
+        return result,err
+    }
+    defer rows.Close()
+    for rows.Next(){
+        var tag string
+        err = rows.Scan(&tag)
+        if err !=nil{
+            return result,err
+        }
+        result = append(result,tag)
+    }
+    return result,nil
+}
+
+// blob_quarantine moves a blob into quarantine/blob<page>.db of the database
+// folder, where it is kept for copying back by hand. The copy is undone when
+// the unit rolls back.
+func blob_quarantine(u *Unit,page int,tag string)error{
+    q_folder := u.st.folder+"quarantine"+sys_delim()
+    err := os.MkdirAll(q_folder,0755)
+    if err !=nil{
+        return err
+    }
+    q_file := q_folder+"blob"+strconv.Itoa(page)+".db"
+    if ok,_:=file_exists(q_file);!ok{
+        _,err = blob_create_file(q_file)
+        if err !=nil{
+            return err
+        }
+    }
+    q_db,err := get_db(q_file)
+    if err !=nil{
+        return err
+    }
+    defer q_db.Close()
+    blob_db,err := u.st.blob(strconv.Itoa(page))
+    if err !=nil{
+        return err
+    }
+    rs_type,data,err := blob_read(blob_db,tag)
+    if err !=nil{
+        return err
+    }
+    _,err = blob_save(q_db,tag,data,rs_type)
+    if err !=nil{
+        return err
+    }
+    u.undo = append(u.undo,func() error{
+        q_db,err := get_db(q_file)
+        if err !=nil{
+            return err
+        }
+        defer q_db.Close()
+        _,err = blob_delete(q_db,tag)
+        return err
+    })
+    // the blob leaves its page with the commit, as the other blob deletes
+    u.blob_delete(strconv.Itoa(page),tag)
+    return nil
+}
+
+// ================ for compaction ========================
+// Deleting a resource leaves a hole in its blob page and new blobs only go to
+// the highest page, so the old pages stay as big as they ever were. Compaction
+// moves the live blobs of the pages that are less than half used into the
+// highest page, deletes the pages it empties and vacuums the rest.
+// The moves run in one unit: resource.page changes together for all of them,
+// the copies are undone on rollback and the old blobs go after the commit.
+
+type Compact_page struct{
+    Page int
+    Blobs int // blobs in the page before
+    Live int64 // bytes of the blobs with a resource on this page
+    Moved int
+    Dropped bool
+    Size int64 // file size before
+    Size_after int64
+}
+
+type Compact_report struct{
+    Pages []Compact_page
+}
+
+func (report *Compact_report) String()string{
+    var buf bytes.Buffer
+    var before,after int64
+    moved,dropped :=0,0
+    for _,p :=range(report.Pages){
+        buf.WriteString(fmt.Sprintf("blob%d.db: %d blobs, %d live bytes, %d moved, %d -> %d bytes",p.Page,p.Blobs,p.Live,p.Moved,p.Size,p.Size_after))
+        if p.Dropped{
+            buf.WriteString(" (deleted)")
+        }
+        buf.WriteString("\n")
+        before += p.Size
+        after += p.Size_after
+        moved += p.Moved
+        if p.Dropped{
+            dropped++
+        }
+    }
+    buf.WriteString(fmt.Sprintf("%d blobs moved, %d pages deleted, %d -> %d bytes\n",moved,dropped,before,after))
+    return buf.String()
+}
+
+// blob_page_size is the size of a page file with its write-ahead log
+func blob_page_size(st *Store,page int)int64{
+    var size int64
+    for _,suffix :=range([]string{"","-wal"}){
+        info,err := os.Stat(st.blob_file(strconv.Itoa(page))+suffix)
+        if err ==nil{
+            size += info.Size()
+        }
+    }
+    return size
+}
+
+func compact_blobs(st *Store,page_limit int64)(*Compact_report,error){
+    report := &Compact_report{}
+    pages,err := blob_pages(st.folder)
+    if err !=nil || len(pages)==0{
+        return report,err
+    }
+    u,err := st.begin()
+    if err !=nil{
+        return report,err
+    }
+    err = compact_move(u,report,pages,page_limit)
+    err = u.finish(err)
+    if err !=nil{
+        return report,err
+    }
+    // vacuum outside the unit, it does not change what the pages hold
+    for i:=range(report.Pages){
+        p := &report.Pages[i]
+        if p.Dropped{
+            continue
+        }
+        blob_db,err := st.blob(strconv.Itoa(p.Page))
+        if err !=nil{
+            return report,err
+        }
+        _,err = blob_db.Exec("VACUUM")
+        if err ==nil{
+            _,err = blob_db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+        }
+        if err !=nil{
+            return report,err
+        }
+        p.Size_after = blob_page_size(st,p.Page)
+    }
+    return report,nil
+}
+
+func compact_move(u *Unit,report *Compact_report,pages []int,page_limit int64)error{
+    highest := pages[len(pages)-1]
+    for _,page :=range(pages){
+        page_str := strconv.Itoa(page)
+        p := Compact_page{Page:page,Size:blob_page_size(u.st,page)}
+        blob_db,err := u.st.blob(page_str)
+        if err !=nil{
+            return err
+        }
+        blob_count,err := do_count(blob_db,&Db_query{Sql:"select count(*) as cnt from blob_obj"})
+        if err !=nil{
+            return err
+        }
+        p.Blobs = int(blob_count)
+
+        // the live blobs are the ones the resource table points at
+        var tags []string
+        tab := get_table("resource")
+        tab.set("page",page_str)
+        rows,err := do_query(u.tx,tab.pack_select("tag","rsid asc",""))
+        if err !=nil{
+            return err
+        }
+        for rows.Next(){
+            var tag string
+            err = rows.Scan(&tag)
+            if err !=nil{
+                rows.Close()
+                return err
+            }
+            tags = append(tags,tag)
+        }
+        rows.Close()
+        var live []string
+        for _,tag :=range(tags){
+            var size int64
+            err = blob_db.QueryRow("select length(data) from blob_obj where tag=?",tag).Scan(&size)
+            if err ==sql.ErrNoRows{
+                continue // fsck reports it
+            }
+            if err !=nil{
+                return err
+            }
+            p.Live += size
+            live = append(live,tag)
+        }
+
+        if page == highest || p.Live*2 >= page_limit{
+            report.Pages = append(report.Pages,p)
+            continue
+        }
+        for _,tag :=range(live){
+            target,err := get_blob_file_page(u.st.folder,page_limit)
+            if err !=nil{
+                return err
+            }
+            rs_type,data,err := blob_read(blob_db,tag)
+            if err !=nil{
+                return err
+            }
+            err = u.blob_save(target,tag,data,rs_type)
+            if err !=nil{
+                return err
+            }
+            tab := get_table("resource")
+            tab.set("tag",tag).set("page",target)
+            _,err = do_update(u.tx,tab.pack_update([]string{"tag"}))
+            if err !=nil{
+                return err
+            }
+            p.Moved++
+        }
+        if p.Moved == p.Blobs{
+            // nothing else is in the page, strays included
+            p.Dropped = true
+            u.after = append(u.after,func() error{
+                return u.st.drop_blob(page_str)
+            })
+        }else{
+            for _,tag :=range(live){
+                u.blob_delete(page_str,tag)
+            }
+        }
+        report.Pages = append(report.Pages,p)
+    }
+    return nil
+}
+
+// ================ for backup ========================
+// A backup is a folder backup/snapshot_YYYYMMDD_HHMMSS/ holding Filegai.db and
+// every blob page. A unit holds the write lock of Filegai.db only while a read
+// snapshot of each file is opened: all the writers of the blob pages work in
+// units, so the snapshots belong to one point in time. They are copied with the
+// online backup of SQLite after the unit, the saves go on meanwhile.
+
+type Backup_record struct{
+    Name string
+    Date string
+    Files int
+    Size string
+}
+
+const backup_prefix = "snapshot_"
+
+func backup_folder(db_folder string)string{
+    return db_folder+"backup"+sys_delim()
+}
+
+// snapshot_conn takes a connection of db and opens a read transaction on it:
+// until snapshot_end the connection sees the database as it is now, the writers
+// of WAL mode go on meanwhile
+func snapshot_conn(db *sql.DB)(*sql.Conn,error){
+    ctx := context.Background()
+    conn,err := db.Conn(ctx)
+    if err !=nil{
+        return nil,err
+    }
+    _,err = conn.ExecContext(ctx,"BEGIN DEFERRED")
+    if err ==nil{
+        // a deferred transaction takes its snapshot on the first read
+        var cnt int64
+        err = conn.QueryRowContext(ctx,"select count(*) from sqlite_master").Scan(&cnt)
+        if err !=nil{
+            conn.ExecContext(ctx,"ROLLBACK")
+        }
+    }
+    if err !=nil{
+        conn.Close()
+        return nil,err
+    }
+    return conn,nil
+}
+
+func snapshot_end(conn *sql.Conn){
+    _,err := conn.ExecContext(context.Background(),"ROLLBACK")
+    if err !=nil{
+        fmt.Println("?? error ending a snapshot:"+err.Error())
+    }
+    conn.Close()
+}
+
+// backup_file copies the main database of the snapshot src into target, page
+// by page
+func backup_file(src_conn *sql.Conn,target string)error{
+    dst,err := sql.Open("sqlite3",target)
+    if err !=nil{
+        return err
+    }
+    defer dst.Close()
+    ctx := context.Background()
+    dst_conn,err := dst.Conn(ctx)
+    if err !=nil{
+        return err
+    }
+    defer dst_conn.Close()
+    return dst_conn.Raw(func(dst_raw interface{})error{
+        return src_conn.Raw(func(src_raw interface{})error{
+            dst_sqlite,ok := dst_raw.(*sqlite3.SQLiteConn)
+            if !ok{
+                return errors.New("not a sqlite connection")
+            }
+            src_sqlite,ok := src_raw.(*sqlite3.SQLiteConn)
+            if !ok{
+                return errors.New("not a sqlite connection")
+            }
+            bk,err := dst_sqlite.Backup("main",src_sqlite,"main")
+            if err !=nil{
+                return err
+            }
+            _,err = bk.Step(-1)
+            if err !=nil{
+                bk.Finish()
+                return err
+            }
+            return bk.Finish()
+        })
+    })
+}
+
+// backup_now makes a snapshot of the database folder and returns its name
+func backup_now(st *Store)(string,error){
+    name := backup_prefix+strings.NewReplacer("-","",":",""," ","_").Replace(get_now_string())
+    target := backup_folder(st.folder)+name+sys_delim()
+    // the files are copied into a partial folder, only a complete set gets the name
+    partial := backup_folder(st.folder)+name+"_partial"+sys_delim()
+    err := os.MkdirAll(partial,0755)
+    if err !=nil{
+        return "",err
+    }
+    // the snapshots of all the files are taken under the write lock, so no unit
+    // is halfway through its blob writes, and the copies are made without it
+    files := map[string]*sql.Conn{} // file name -> snapshot
+    defer func(){
+        for _,conn :=range(files){
+            snapshot_end(conn)
+        }
+    }()
+    u,err := st.begin()
+    if err !=nil{
+        os.RemoveAll(partial)
+        return "",err
+    }
+    var conn *sql.Conn
+    conn,err = snapshot_conn(st.rdb)
+    if err ==nil{
+        files["Filegai.db"] = conn
+        var pages []int
+        pages,err = blob_pages(st.folder)
+        for _,page :=range(pages){
+            if err !=nil{
+                break
+            }
+            var blob_db *sql.DB
+            blob_db,err = st.blob(strconv.Itoa(page))
+            if err ==nil{
+                conn,err = snapshot_conn(blob_db)
+            }
+            if err ==nil{
+                files["blob"+strconv.Itoa(page)+".db"] = conn
+            }
+        }
+    }
+    // nothing was written in the unit
+    u.rollback()
+    for file_name,conn :=range(files){
+        if err !=nil{
+            break
+        }
+        err = backup_file(conn,partial+file_name)
+    }
+    if err ==nil{
+        err = os.Rename(partial,target)
+    }
+    if err !=nil{
+        fmt.Println("?? backup failed:"+err.Error())
+        os.RemoveAll(partial)
+        return "",err
+    }
+    return name,nil
+}
+
+func list_backups(db_folder string)([]Backup_record,error){
+    var result []Backup_record
+    infos,err := ioutil.ReadDir(backup_folder(db_folder))
+    if err !=nil{
+        if os.IsNotExist(err){
+            return result,nil
+        }
+        return result,err
+    }
+    reg := regexp.MustCompile(`^`+backup_prefix+`(\d{4})(\d{2})(\d{2})_(\d{2})(\d{2})(\d{2})$`)
+    for _,info :=range(infos){
+        m := reg.FindStringSubmatch(info.Name())
+        if !info.IsDir() || len(m)==0{
+            continue
+        }
+        record := Backup_record{Name:info.Name()}
+        record.Date = m[1]+"-"+m[2]+"-"+m[3]+" "+m[4]+":"+m[5]+":"+m[6]
+        files,err := ioutil.ReadDir(backup_folder(db_folder)+info.Name())
+        if err !=nil{
+            return result,err
+        }
+        var size int64
+        for _,file :=range(files){
+            record.Files++
+            size += file.Size()
+        }
+        record.Size = fmt.Sprintf("%.1f MB",float64(size)/1000000)
+        result = append(result,record)
+    }
+    // newest first
+    sort.Slice(result,func(i,j int)bool{
+        return result[i].Name > result[j].Name
+    })
+    return result,nil
+}
+
+// rotate_backups keeps the newest snapshots only
+func rotate_backups(db_folder string,keep int)error{
+    records,err := list_backups(db_folder)
+    if err !=nil{
+        return err
+    }
+    for i,record :=range(records){
+        if i<keep{
+            continue
+        }
+        err = os.RemoveAll(backup_folder(db_folder)+record.Name)
+        if err !=nil{
+            return err
+        }
+    }
+    return nil
+}
+
+// backup_schedule runs in the background, it makes a snapshot when the newest
+// one is older than backup_hours. The check is repeated every few minutes, so a
+// stopped server catches up when it starts again.
+func backup_schedule(st *Store){
+    for{
+        hours := get_backup_hours(st.db)
+        if hours >0{
+            records,err := list_backups(st.folder)
+            due := err ==nil && len(records)==0
+            if err ==nil && len(records)>0{
+                last,err := time.ParseInLocation("2006-01-02 15:04:05",records[0].Date,time.Local)
+                due = err !=nil || time.Since(last) >= time.Duration(hours)*time.Hour
+            }
+            if due{
+                name,err := backup_now(st)
+                if err ==nil{
+                    fmt.Println("backup done:"+name)
+                    err = rotate_backups(st.folder,get_backup_keep(st.db))
+                }
+                if err !=nil{
+                    fmt.Println("?? scheduled backup failed:"+err.Error())
+                }
+            }
+        }
+        time.Sleep(10*time.Minute)
+    }
+}
+
+// restore_backup puts a snapshot back in place of the database files, it fails
+// while the server is running. The files it replaces are moved to
+// backup/replaced_YYYYMMDD_HHMMSS/, so a restore can be undone; when it fails
+// on the way they are put back.
+func restore_backup(db_folder string,name string)(string,error){
+    delim := sys_delim()
+    source := backup_folder(db_folder)+name+delim
+    if ok,_:=file_exists(source+"Filegai.db");!ok || !strings.HasPrefix(name,backup_prefix){
+        return "",errors.New("no backup named "+name)
+    }
+    err := db_not_in_use(db_folder+"Filegai.db")
+    if err !=nil{
+        return "",err
+    }
+    snapshot_files,err := ioutil.ReadDir(source)
+    if err !=nil{
+        return "",err
+    }
+    stamp := strings.NewReplacer("-","",":",""," ","_").Replace(get_now_string())
+    // the snapshot is copied next to the database first, a failed copy leaves
+    // the database as it is
+    staging := backup_folder(db_folder)+"restoring_"+stamp+delim
+    err = os.MkdirAll(staging,0755)
+    if err !=nil{
+        return "",err
+    }
+    defer os.RemoveAll(staging)
+    var staged []string
+    for _,file :=range(snapshot_files){
+        if file.IsDir(){
+            continue
+        }
+        data,err := ioutil.ReadFile(source+file.Name())
+        if err ==nil{
+            err = ioutil.WriteFile(staging+file.Name(),data,0644)
+        }
+        if err !=nil{
+            return "",err
+        }
+        staged = append(staged,file.Name())
+    }
+    replaced := "replaced_"+stamp
+    replaced_dir := backup_folder(db_folder)+replaced+delim
+    err = os.MkdirAll(replaced_dir,0755)
+    if err !=nil{
+        return "",err
+    }
+    // the -wal and -shm files go with their database, a stale log must not be
+    // applied to the restored file
+    reg := regexp.MustCompile(`^(Filegai|blob\d+)\.db(-wal|-shm)?$`)
+    current_files,err := ioutil.ReadDir(db_folder)
+    if err !=nil{
+        return "",err
+    }
+    // the swap is by renames, undone in reverse order when one fails
+    var undo []func()
+    rollback := func(){
+        for i:=len(undo)-1;i>=0;i--{
+            undo[i]()
+        }
+        os.Remove(replaced_dir)
+    }
+    for _,file :=range(current_files){
+        if file.IsDir() || !reg.MatchString(file.Name()){
+            continue
+        }
+        from,to := db_folder+file.Name(),replaced_dir+file.Name()
+        err = os.Rename(from,to)
+        if err !=nil{
+            rollback()
+            return "",err
+        }
+        undo = append(undo,func(){ os.Rename(to,from) })
+    }
+    for _,file_name :=range(staged){
+        from,to := staging+file_name,db_folder+file_name
+        err = os.Rename(from,to)
+        if err !=nil{
+            rollback()
+            return "",err
+        }
+        undo = append(undo,func(){ os.Remove(to) })
+    }
+    return replaced,nil
+}
+
+// db_not_in_use fails when another program, the server most likely, has the
+// database open: leaving WAL mode takes the only connection to the file. The
+// file is put back in WAL mode, its log written into it
+func db_not_in_use(db_file string)error{
+    db,err := sql.Open("sqlite3",db_file+"?_busy_timeout=0")
+    if err !=nil{
+        return err
+    }
+    defer db.Close()
+    db.SetMaxOpenConns(1)
+    var mode string
+    err = db.QueryRow("PRAGMA journal_mode=DELETE").Scan(&mode)
+    if err !=nil || mode !="delete"{
+        return errors.New(path_file_name(db_file,sys_delim())+" is in use, stop the server first")
+    }
+    _,err = db.Exec("PRAGMA journal_mode=WAL")
+    return err
+}
+
+// ================ for export and import ========================
+// an export is one zip: filegai.json holds the notes, articles, shortcuts,
+// settings, labels, note templates and roots with the texts inline, the images
+// go raw under resources/.
+// The import keeps the tags unless the database already has them, then tag_gen
+// gives new ones and the get_image/<tag> references in the texts follow.
+// Version 2 added the labels, the note templates and the roots.
+
+const export_format = "filegai-export"
+const export_version = 2
+const export_manifest = "filegai.json"
+
+type Export_note struct{
+    Tag string `json:"tag"`
+    File_dir string `json:"file_dir"` // relative to the root, "/" as deliminator
+    File_name string `json:"file_name"`
+    Text string `json:"text"`
+    Color int `json:"color"`
+    Ndate string `json:"ndate"`
+    Parent_tag string `json:"parent_tag,omitempty"` // a reply to the note of this tag
+    Format int `json:"format,omitempty"` // 1 markdown
+    Page int `json:"page,omitempty"` // the anchor in a pdf file
+    Quote string `json:"quote,omitempty"`
+    Rect string `json:"rect,omitempty"`
+}
+
+type Export_page struct{
+    Text string `json:"text"`
+    Order_id int `json:"order_id"`
+    Pdate string `json:"pdate"`
+    Format int `json:"format,omitempty"`
+}
+
+type Export_article struct{
+    Tag string `json:"tag"`
+    Title string `json:"title"`
+    Color string `json:"color"`
+    Shelf_id int `json:"shelf_id"`
+    Adate string `json:"adate"`
+    Pages []Export_page `json:"pages"`
+}
+
+type Export_resource struct{
+    Tag string `json:"tag"`
+    Name string `json:"name"`
+    Type int `json:"type"`
+    Rs_date string `json:"rs_date"`
+    File string `json:"file"` // path in the zip
+}
+
+type Export_shortcut struct{
+    Track_id int `json:"track_id"`
+    File_dir string `json:"file_dir"`
+    File_name string `json:"file_name"`
+    Type string `json:"type"`
+    Order_id int `json:"order_id"`
+}
+
+type Export_setting struct{
+    Key string `json:"key"`
+    Value string `json:"value"`
+    Note string `json:"note"`
+}
+
+type Export_label_link struct{
+    App int `json:"app"` // label_app_note, label_app_article or label_app_file
+    App_tag string `json:"app_tag"` // the tag, or the path of a file
+}
+
+type Export_label struct{
+    Name string `json:"name"`
+    Color string `json:"color"`
+    Links []Export_label_link `json:"links"`
+}
+
+type Export_template struct{
+    Name string `json:"name"`
+    Format int `json:"format"`
+    Exts string `json:"exts"`
+    Folder string `json:"folder"`
+    Body string `json:"body"`
+}
+
+// Export_root is a root of the exporting host, the notes keep its name in their paths
+type Export_root struct{
+    Name string `json:"name"`
+    Dir string `json:"dir"`
+}
+
+type Export_archive struct{
+    Format string `json:"format"`
+    Version int `json:"version"`
+    Exported string `json:"exported"`
+    Host_name string `json:"host_name"`
+    Notes []Export_note `json:"notes"`
+    Articles []Export_article `json:"articles"`
+    Resources []Export_resource `json:"resources"`
+    Shortcuts []Export_shortcut `json:"shortcuts"`
+    Settings []Export_setting `json:"settings"`
+    Labels []Export_label `json:"labels,omitempty"`
+    Templates []Export_template `json:"templates,omitempty"`
+    Roots []Export_root `json:"roots,omitempty"`
+}
+
+type Import_result struct{
+    Notes int
+    Merged int // notes added to a file that has notes here already
+    Articles int
+    Pages int
+    Resources int
+    Retagged int
+    Shortcuts int
+    Settings int
+    Labels int // new here, the links go on the labels of the same names too
+    Templates int
+    Roots int
+    Skipped int // images, notes and articles that are here already
+}
+
+func (r Import_result) String()string{
+    return fmt.Sprintf("%d notes (%d merged), %d articles, %d pages, %d images (%d new tags), %d shortcuts, %d settings, %d labels, %d templates, %d roots, %d already here",
+        r.Notes,r.Merged,r.Articles,r.Pages,r.Resources,r.Retagged,r.Shortcuts,r.Settings,r.Labels,r.Templates,r.Roots,r.Skipped)
+}
+
+// note_text gives the text of a file_note.note field, old notes keep it inline
+func note_text(db_link Db_link,st *Store,note string)(string,error){
+    reg :=regexp.MustCompile(`#<0x_([\d\w]+)_>`)
+    mats :=reg.FindStringSubmatch(note)
+    if len(mats)<2{
+        return note,nil
+    }
+    _,text,err :=get_text(db_link,st,mats[1])
+    return text,err
+}
+
+// export_archive writes the zip to w. The records are read in one view, so they
+// are one state of Filegai.db; the texts and images are read from the blob pages
+// as they are then, a note saved meanwhile may go with its newer text. With
+// note_tags only those notes go, with their replies, images, labels and the
+// roots; nil exports everything
+func export_archive(st *Store,w io.Writer,note_tags []string)(Export_archive,error){
+    archive := Export_archive{Format:export_format,Version:export_version,Exported:get_now_string(),Host_name:get_host_name()}
+    // the zip may stream to a slow client, a read unit does not hold up the saves
+    u,err := st.view()
+    if err !=nil{
+        return archive,err
+    }
+    var only map[string]bool
+    if note_tags !=nil{
+        only = make(map[string]bool)
+        for _,tag :=range(note_tags){
+            only[tag] = true
+        }
+    }
+    zw := zip.NewWriter(w)
+    err = export_records(u,zw,&archive,only)
+    if err ==nil{
+        var manifest []byte
+        manifest,err = json.MarshalIndent(archive,""," ")
+        if err ==nil{
+            var f io.Writer
+            f,err = zw.Create(export_manifest)
+            if err ==nil{
+                _,err = f.Write(manifest)
+            }
+        }
+    }
+    if err ==nil{
+        err = zw.Close()
+    }
+    // nothing was written to the database
+    u.rollback()
+    return archive,err
+}
+
+func export_records(u *Unit,zw *zip.Writer,archive *Export_archive,only map[string]bool)error{
+    tab_note := get_table("file_note")
+    rows,err := do_query(u.tx,tab_note.pack_select("tag,file_dir,file_name,note,ifnull(ndate,''),ifnull(color,0),parent_tag,format","nid asc",""))
+    if err !=nil{
+        return err
+    }
+    for rows.Next(){
+        var note Export_note
+        var field string
+        err = rows.Scan(&note.Tag,&note.File_dir,&note.File_name,&field,&note.Ndate,&note.Color,&note.Parent_tag,&note.Format)
+        if err !=nil{
+            rows.Close()
+            return err
+        }
+        note.Text = field
+        if only !=nil && !only[note.Tag] && !only[note.Parent_tag]{
+            continue
+        }
+        archive.Notes = append(archive.Notes,note)
+    }
+    rows.Close()
+    for i:=range(archive.Notes){
+        text,err := note_text(u.tx,u.st,archive.Notes[i].Text)
+        if err !=nil{
+            return errors.New("text of note "+archive.Notes[i].Tag+":"+err.Error())
+        }
+        archive.Notes[i].Text = text
+    }
+    var note_tags []string
+    for _,note :=range(archive.Notes){
+        note_tags = append(note_tags,note.Tag)
+    }
+    anchors,err := anchors_map(u.tx,note_tags)
+    if err !=nil{
+        return err
+    }
+    for i,note :=range(archive.Notes){
+        anchor := anchors[note.Tag]
+        archive.Notes[i].Page,archive.Notes[i].Quote,archive.Notes[i].Rect = anchor.Page,anchor.Quote,anchor.Rect
+    }
+    err = export_roots(u,archive)
+    if err ==nil{
+        err = export_labels(u,archive,note_tags,only !=nil)
+    }
+    if err !=nil{
+        return err
+    }
+    if only !=nil{
+        return export_note_resources(u,zw,archive)
+    }
+
+    tab_article := get_table("article")
+    rows,err = do_query(u.tx,tab_article.pack_select("tag,ifnull(title,''),ifnull(color,'7'),ifnull(shelf_id,0),ifnull(adate,'')","artid asc",""))
+    if err !=nil{
+        return err
+    }
+    for rows.Next(){
+        var article Export_article
+        err = rows.Scan(&article.Tag,&article.Title,&article.Color,&article.Shelf_id,&article.Adate)
+        if err !=nil{
+            rows.Close()
+            return err
+        }
+        archive.Articles = append(archive.Articles,article)
+    }
+    rows.Close()
+    for i:=range(archive.Articles){
+        article := &archive.Articles[i]
+        pages,err := get_page_records_by_tag(u.tx,article.Tag)
+        if err !=nil{
+            return err
+        }
+        for _,page :=range(pages){
+            _,text,err := get_text(u.tx,u.st,page.Pg_tag)
+            if err !=nil{
+                return errors.New("text of page "+page.Pg_tag+":"+err.Error())
+            }
+            article.Pages = append(article.Pages,Export_page{Text:text,Order_id:page.Order_id,Pdate:page.Pdate,Format:page.Format})
+        }
+    }
+
+    // the texts (type 33) are inline above, the rest go as files
+    tab_resource := get_table("resource")
+    tab_resource.where("type","<>","33")
+    rows,err = do_query(u.tx,tab_resource.pack_select("tag,ifnull(name,''),type,ifnull(rs_date,'')","rsid asc",""))
+    if err !=nil{
+        return err
+    }
+    for rows.Next(){
+        var res Export_resource
+        err = rows.Scan(&res.Tag,&res.Name,&res.Type,&res.Rs_date)
+        if err !=nil{
+            rows.Close()
+            return err
+        }
+        res.File = "resources/"+res.Tag+"."+mime_decode_suffix(res.Type)
+        archive.Resources = append(archive.Resources,res)
+    }
+    rows.Close()
+    err = export_resource_files(u,zw,archive)
+    if err !=nil{
+        return err
+    }
+
+    tab_shortcut := get_table("shortcut")
+    rows,err = do_query(u.tx,tab_shortcut.pack_select("ifnull(track_id,0),file_dir,file_name,type,ifnull(order_id,0)","scid asc",""))
+    if err !=nil{
+        return err
+    }
+    for rows.Next(){
+        var sc Export_shortcut
+        err = rows.Scan(&sc.Track_id,&sc.File_dir,&sc.File_name,&sc.Type,&sc.Order_id)
+        if err !=nil{
+            rows.Close()
+            return err
+        }
+        archive.Shortcuts = append(archive.Shortcuts,sc)
+    }
+    rows.Close()
+
+    tab_settings := get_table("settings")
+    rows,err = do_query(u.tx,tab_settings.pack_select("key,ifnull(value,''),ifnull(note,'')","id asc",""))
+    if err !=nil{
+        return err
+    }
+    for rows.Next(){
+        var setting Export_setting
+        err = rows.Scan(&setting.Key,&setting.Value,&setting.Note)
+        if err !=nil{
+            rows.Close()
+            return err
+        }
+        archive.Settings = append(archive.Settings,setting)
+    }
+    rows.Close()
+
+    templates,err := list_note_templates(u.tx)
+    if err !=nil{
+        return err
+    }
+    for _,record :=range(templates){
+        archive.Templates = append(archive.Templates,Export_template{Name:record.Name,Format:record.Format,
+            Exts:record.Exts,Folder:record.Folder,Body:record.Body})
+    }
+    return nil
+}
+
+// export_roots takes the roots of this host, a note path names its root
+func export_roots(u *Unit,archive *Export_archive)error{
+    tab := get_table("root_folder")
+    tab.set("host_name",get_host_name())
+    rows,err := do_query(u.tx,tab.pack_select("name,dir","rid asc",""))
+    if err !=nil{
+        return err
+    }
+    defer rows.Close()
+    for rows.Next(){
+        var root Export_root
+        err = rows.Scan(&root.Name,&root.Dir)
+        if err !=nil{
+            return err
+        }
+        archive.Roots = append(archive.Roots,root)
+    }
+    return rows.Err()
+}
+
+// export_labels takes the labels with what they are on; for a partial export
+// only the labels of the notes in note_tags, on those notes
+func export_labels(u *Unit,archive *Export_archive,note_tags []string,partial bool)error{
+    labels,err := list_labels(u.tx)
+    if err !=nil{
+        return err
+    }
+    in_notes := make(map[string]bool)
+    for _,tag :=range(note_tags){
+        in_notes[tag] = true
+    }
+    for _,label :=range(labels){
+        exported := Export_label{Name:label.Name,Color:label.Color}
+        tab := get_table("label_link")
+        tab.set("lid",strconv.FormatInt(label.Lid,10))
+        rows,err := do_query(u.tx,tab.pack_select("app,app_tag","llid asc",""))
+        if err !=nil{
+            return err
+        }
+        for rows.Next(){
+            var link Export_label_link
+            err = rows.Scan(&link.App,&link.App_tag)
+            if err !=nil{
+                rows.Close()
+                return err
+            }
+            if partial && (link.App !=label_app_note || !in_notes[link.App_tag]){
+                continue
+            }
+            exported.Links = append(exported.Links,link)
+        }
+        rows.Close()
+        if partial && len(exported.Links)==0{
+            continue
+        }
+        archive.Labels = append(archive.Labels,exported)
+    }
+    return nil
+}
+
+// export_resource_files writes the blobs of archive.Resources into the zip
+func export_resource_files(u *Unit,zw *zip.Writer,archive *Export_archive)error{
+    for _,res :=range(archive.Resources){
+        _,data,err := get_image(u.tx,u.st,res.Tag)
+        if err !=nil{
+            return errors.New("blob of resource "+res.Tag+":"+err.Error())
+        }
+        f,err := zw.Create(res.File)
+        if err !=nil{
+            return err
+        }
+        _,err = f.Write(data)
+        if err !=nil{
+            return err
+        }
+    }
+    return nil
+}
+
+// export_note_resources takes the images of the exported notes, the
+// articles, the shortcuts and the settings stay out of a partial export
+func export_note_resources(u *Unit,zw *zip.Writer,archive *Export_archive)error{
+    var tags []string
+    for _,note :=range(archive.Notes){
+        tags = append(tags,note.Tag)
+    }
+    if len(tags)==0{
+        return nil
+    }
+    rows,err := u.tx.Query(`select tag,ifnull(name,''),type,ifnull(rs_date,'') from resource where type<>33 and tag in
+        (select tag from resource_link where app=1 and app_tag in (`+placeholders(len(tags))+`)) order by rsid asc`,str_args(tags)...)
+    if err !=nil{
+        return err
+    }
+    for rows.Next(){
+        var res Export_resource
+        err = rows.Scan(&res.Tag,&res.Name,&res.Type,&res.Rs_date)
+        if err !=nil{
+            rows.Close()
+            return err
+        }
+        res.File = "resources/"+res.Tag+"."+mime_decode_suffix(res.Type)
+        archive.Resources = append(archive.Resources,res)
+    }
+    rows.Close()
+    return export_resource_files(u,zw,archive)
+}
+
+// import_tag takes the tag in the tags table, a tag already taken is replaced
+// by a new one. The second result tells whether the tag was changed
+func import_tag(db_link Db_link,tag string)(string,bool,error){
+    if regexp.MustCompile(`^[\w\d]+$`).MatchString(tag){
+        ok,err := tag_exist(db_link,tag)
+        if err !=nil{
+            return "",false,err
+        }
+        if !ok{
+            table := get_table("tags")
+            table.set("tag_str",tag)
+            _,err = do_insert(db_link,table.pack_insert())
+            return tag,false,err
+        }
+    }
+    new_tag,err := tag_gen(db_link)
+    return new_tag,true,err
+}
+
+// retag_image_refs points the get_image/<tag> references at the new tags
+func retag_image_refs(text string,tag_map map[string]string)string{
+    if len(tag_map)==0{
+        return text
+    }
+    reg :=regexp.MustCompile(`get_image/([\w\d]+)`)
+    return reg.ReplaceAllStringFunc(text,func(ref string)string{
+        old_tag := ref[len("get_image/"):]
+        if new_tag,ok := tag_map[old_tag];ok{
+            return "get_image/"+new_tag
+        }
+        return ref
+    })
+}
+
+func import_archive(st *Store,zip_file string)(Import_result,error){
+    var result Import_result
+    zr,err := zip.OpenReader(zip_file)
+    if err !=nil{
+        return result,err
+    }
+    defer zr.Close()
+    files := make(map[string]*zip.File)
+    for _,f :=range(zr.File){
+        files[f.Name] = f
+    }
+    manifest,ok := files[export_manifest]
+    if !ok{
+        return result,errors.New("not a Filegai export, "+export_manifest+" is missing")
+    }
+    data,err := zip_read(manifest)
+    if err !=nil{
+        return result,err
+    }
+    var archive Export_archive
+    err = json.Unmarshal(data,&archive)
+    if err !=nil{
+        return result,err
+    }
+    if archive.Format != export_format{
+        return result,errors.New("not a Filegai export")
+    }
+    if archive.Version <1 || archive.Version > export_version{
+        return result,fmt.Errorf("export version %d is not supported, this build reads up to %d",archive.Version,export_version)
+    }
+
+    u,err := st.begin()
+    if err !=nil{
+        return result,err
+    }
+    err = import_records(u,files,&archive,&result)
+    err = u.finish(err)
+    return result,err
+}
+
+func zip_read(f *zip.File)([]byte,error){
+    handler,err := f.Open()
+    if err !=nil{
+        return []byte{},err
+    }
+    defer handler.Close()
+    return ioutil.ReadAll(handler)
+}
+
+func import_records(u *Unit,files map[string]*zip.File,archive *Export_archive,result *Import_result)error{
+    tag_map := make(map[string]string)
+    for _,res :=range(archive.Resources){
+        f,ok := files[res.File]
+        if !ok{
+            return errors.New(res.File+" is missing in the zip")
+        }
+        data,err := zip_read(f)
+        if err !=nil{
+            return err
+        }
+        // the same image under the same tag, e.g. a second import of one export
+        _,current,err := get_image(u.tx,u.st,res.Tag)
+        if err ==nil && bytes.Equal(current,data){
+            result.Skipped++
+            continue
+        }
+        // the same bytes under another tag
+        if res.Type !=33{
+            same_tag,err := resource_by_hash(u.tx,resource_hash(data))
+            if err !=nil{
+                return err
+            }
+            if same_tag !=""{
+                tag_map[res.Tag] = same_tag
+                result.Skipped++
+                continue
+            }
+        }
+        page,err := get_blob_file_page(u.st.folder,get_blob_page_limit(u.tx))
+        if err !=nil{
+            return err
+        }
+        tag,changed,err := import_tag(u.tx,res.Tag)
+        if err !=nil{
+            return err
+        }
+        err = resource_deposite_tag(u,tag,page,res.Name,res.Type,data)
+        if err !=nil{
+            return err
+        }
+        if res.Rs_date !=""{
+            tab := get_table("resource")
+            tab.set("tag",tag).set("rs_date",res.Rs_date)
+            _,err = do_update(u.tx,tab.pack_update([]string{"tag"}))
+            if err !=nil{
+                return err
+            }
+        }
+        if changed{
+            tag_map[res.Tag] = tag
+            result.Retagged++
+        }
+        result.Resources++
+    }
+
+    // the notes come before their replies, note_map has the tags they got here
+    note_map := make(map[string]string)
+    for _,note :=range(archive.Notes){
+        text := retag_image_refs(note.Text,tag_map)
+        here,err := file_notes(u.tx,u.st,note.File_dir,note.File_name)
+        if err !=nil{
+            return err
+        }
+        same := ""
+        for _,record :=range(here){
+            if record.Note ==text{
+                same = record.Tag
+            }
+        }
+        if same !=""{
+            note_map[note.Tag] = same
+            result.Skipped++
+            continue
+        }
+        parent_tag := ""
+        if note.Parent_tag !=""{
+            parent_tag = note_map[note.Parent_tag]
+        }
+        tag,_,err := import_tag(u.tx,note.Tag)
+        if err !=nil{
+            return err
+        }
+        ndate := note.Ndate
+        if ndate ==""{
+            ndate = get_now_string()
+        }
+        err = add_note_record(u,tag,note.File_dir,note.File_name,parent_tag,text,note.Format,strconv.Itoa(note.Color),ndate)
+        if err !=nil{
+            return err
+        }
+        err = anchor_set(u.tx,Note_anchor{Tag:tag,Page:note.Page,Quote:note.Quote,Rect:note.Rect})
+        if err !=nil{
+            return err
+        }
+        note_map[note.Tag] = tag
+        if len(here)>0{
+            result.Merged++
+        }
+        result.Notes++
+    }
+
+    article_map := make(map[string]string)
+    for _,article :=range(archive.Articles){
+        record,err := get_article_record(u.tx,article.Tag)
+        if err ==nil && record.Title == article.Title{
+            article_map[article.Tag] = article.Tag
+            result.Skipped++
+            continue
+        }
+        tag,_,err := import_tag(u.tx,article.Tag)
+        if err !=nil{
+            return err
+        }
+        article_map[article.Tag] = tag
+        tab := get_table("article")
+        tab.set("tag",tag).set("title",article.Title).set("color",article.Color)
+        tab.set("shelf_id",strconv.Itoa(article.Shelf_id)).set("adate",article.Adate)
+        _,err = do_insert(u.tx,tab.pack_insert())
+        if err !=nil{
+            return err
+        }
+        for _,page :=range(article.Pages){
+            pg_tag,err := add_article_page(u,tag,retag_image_refs(page.Text,tag_map),page.Format)
+            if err !=nil{
+                return err
+            }
+            tab_page := get_table("article_page")
+            tab_page.set("pg_tag",pg_tag).set("order_id",strconv.Itoa(page.Order_id)).set("pdate",page.Pdate)
+            _,err = do_update(u.tx,tab_page.pack_update([]string{"pg_tag"}))
+            if err !=nil{
+                return err
+            }
+            result.Pages++
+        }
+        result.Articles++
+    }
+
+    for _,sc :=range(archive.Shortcuts){
+        tab := get_table("shortcut")
+        tab.set("file_dir",sc.File_dir).set("file_name",sc.File_name).set("type",sc.Type)
+        cnt,err := do_count(u.tx,tab.pack_count("cnt"))
+        if err !=nil{
+            return err
+        }
+        if cnt>0{
+            continue
+        }
+        tab.set("track_id",strconv.Itoa(sc.Track_id)).set("order_id",strconv.Itoa(sc.Order_id))
+        _,err = do_insert(u.tx,tab.pack_insert())
+        if err !=nil{
+            return err
+        }
+        result.Shortcuts++
+    }
+
+    // the settings of this database win, only the missing ones are taken
+    for _,setting :=range(archive.Settings){
+        if setting.Key =="db_version"{
+            continue
+        }
+        yes,err := has_setting(u.tx,setting.Key,setting.Note)
+        if err !=nil{
+            return err
+        }
+        if yes{
+            continue
+        }
+        _,err = set_setting(u.tx,setting.Key,setting.Value,setting.Note)
+        if err !=nil{
+            return err
+        }
+        result.Settings++
+    }
+    err := import_roots(u,archive.Roots,result)
+    if err ==nil{
+        err = import_templates(u,archive.Templates,result)
+    }
+    if err ==nil{
+        err = import_labels(u,archive.Labels,note_map,article_map,result)
+    }
+    return err
+}
+
+// import_roots keeps the roots this host does not know by name with their
+// folders, the imported notes are not orphans until it is given the folder
+func import_roots(u *Unit,roots []Export_root,result *Import_result)error{
+    host_name := get_host_name()
+    for _,root :=range(roots){
+        if !root_name_reg.MatchString(root.Name){
+            continue
+        }
+        tab := get_table("root_folder")
+        tab.set("host_name",host_name).set("name",root.Name)
+        cnt,err := do_count(u.tx,tab.pack_count("cnt"))
+        if err !=nil{
+            return err
+        }
+        if cnt>0{
+            continue
+        }
+        tab.set("dir",root.Dir)
+        _,err = do_insert(u.tx,tab.pack_insert())
+        if err !=nil{
+            return err
+        }
+        result.Roots++
+    }
+    return nil
+}
+
+// import_templates takes the templates of names not here, as for the settings
+// the ones of this database win
+func import_templates(u *Unit,templates []Export_template,result *Import_result)error{
+    here,err := list_note_templates(u.tx)
+    if err !=nil{
+        return err
+    }
+    names := make(map[string]bool)
+    for _,record :=range(here){
+        names[strings.ToLower(record.Name)] = true
+    }
+    for _,record :=range(templates){
+        if names[strings.ToLower(strings.TrimSpace(record.Name))]{
+            result.Skipped++
+            continue
+        }
+        _,err = note_template_save(u.tx,Note_template{Name:record.Name,Format:record.Format,Exts:record.Exts,
+            Folder:record.Folder,Body:record.Body})
+        if err !=nil{
+            return errors.New("template "+record.Name+":"+err.Error())
+        }
+        names[strings.ToLower(strings.TrimSpace(record.Name))] = true
+        result.Templates++
+    }
+    return nil
+}
+
+// import_labels puts the labels on the notes and articles by the tags they got
+// here, a label of the same name here is used as it is
+func import_labels(u *Unit,labels []Export_label,note_map map[string]string,article_map map[string]string,result *Import_result)error{
+    for _,label :=range(labels){
+        lid,err := label_by_name(u.tx,label.Name)
+        if err !=nil{
+            return err
+        }
+        if lid ==0{
+            color := strings.ToLower(label.Color)
+            if !label_color_ok(color){
+                color = label_colors["grey"]
+            }
+            lid,err = label_add(u.tx,label.Name,color)
+            if err !=nil{
+                return errors.New("label "+label.Name+":"+err.Error())
+            }
+            result.Labels++
+        }
+        for _,link :=range(label.Links){
+            app_tag := link.App_tag
+            switch link.App{
+            case label_app_note:
+                app_tag = note_map[link.App_tag]
+            case label_app_article:
+                app_tag = article_map[link.App_tag]
+            case label_app_file:
+                // the path from the root, as the notes keep it
+            default:
+                app_tag = ""
+            }
+            if app_tag ==""{
+                continue // not in the archive
+            }
+            _,err = u.tx.Exec(`insert into label_link(lid,app,app_tag) select ?,?,? where not exists
+                (select 1 from label_link where lid=? and app=? and app_tag=?)`,lid,link.App,app_tag,lid,link.App,app_tag)
+            if err !=nil{
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// ================ for bulk operations on notes ========================
+// The notes are picked by tag or by the query of a list, a reply picked counts
+// as its note and the replies go with their notes. One unit does the whole
+// operation, a failure leaves every note as it was.
+
+type Bulk_query struct{
+    All bool // all the notes, the query has to say so
+    Orphans bool // the notes whose file is gone
+    Q string // full text search
+    Label int64
+    Color int
+}
+
+func (q Bulk_query) empty()bool{
+    return !q.All && !q.Orphans && q.Q=="" && q.Label==0 && q.Color==0
+}
+
+type Bulk_result struct{
+    Action string
+    Notes int // picked
+    Changed int
+    Replies int // went with their notes
+    Skipped []string // "file: why"
+}
+
+func (r Bulk_result) String()string{
+    s := fmt.Sprintf("%s: %d of %d notes",r.Action,r.Changed,r.Notes)
+    if r.Replies >0{
+        s += fmt.Sprintf(", %d replies with them",r.Replies)
+    }
+    if len(r.Skipped)>0{
+        s += fmt.Sprintf(", %d skipped\n",len(r.Skipped))+strings.Join(r.Skipped,"\n")
+    }
+    return s
+}
+
+// bulk_pick gives the notes of the tags, or those of the query when no tag is given
+// bulk_query_tags gives the tags of every note the query may pick, the
+// search is not cut at the hits shown on a page
+func bulk_query_tags(db_link Db_link,query Bulk_query)([]string,error){
+    var tags []string
+    if query.Q !=""{
+        hits,err := search_index_query(db_link,1,query.Q,-1)
+        for _,hit :=range(hits){
+            tags = append(tags,hit.Owner)
+        }
+        return tags,err
+    }
+    var rows *sql.Rows
+    var err error
+    if query.Label !=0{
+        rows,err = db_link.Query("select app_tag from label_link where lid=? and app=?",query.Label,label_app_note)
+    }else{
+        rows,err = db_link.Query("select tag from file_note where parent_tag='' order by nid desc")
+    }
+    if err !=nil{
+        return tags,err
+    }
+    defer rows.Close()
+    for rows.Next(){
+        var tag string
+        err = rows.Scan(&tag)
+        if err !=nil{
+            return tags,err
+        }
+        tags = append(tags,tag)
+    }
+    return tags,rows.Err()
+}
+
+// bulk_pick gives the notes to work on, it is called in the unit that changes
+// them so that they are not changed in between
+func bulk_pick(db_link Db_link,roots Roots,tags []string,query Bulk_query)([]Note_record,error){
+    var result []Note_record
+    var err error
+    seen := make(map[string]bool)
+    by_query := len(tags)==0
+    if by_query{
+        if query.empty(){
+            return result,errors.New("no note picked")
+        }
+        tags,err = bulk_query_tags(db_link,query)
+        if err !=nil{
+            return result,err
+        }
+    }
+    var labels map[string][]Label_record
+    if by_query && query.Label !=0{
+        labels,err = labels_map(db_link,label_app_note,tags)
+        if err !=nil{
+            return result,err
+        }
+    }
+    for _,tag :=range(tags){
+        record,err := get_note_by_tag(db_link,tag)
+        if err !=nil{
+            return result,errors.New("note "+tag+":"+err.Error())
+        }
+        if record.Parent_tag !=""{
+            record,err = get_note_by_tag(db_link,record.Parent_tag)
+            if err !=nil{
+                return result,errors.New("note "+tag+":"+err.Error())
+            }
+        }
+        if seen[record.Tag]{
+            continue
+        }
+        seen[record.Tag] = true
+        if !by_query{
+            result = append(result,record)
+            continue
+        }
+        if query.Color !=0 && record.Color !=query.Color{
+            continue
+        }
+        if query.Label !=0 && !label_has(labels[tag],query.Label){
+            continue
+        }
+        if query.Orphans{
+            path := roots.abs(record.File_dir+record.File_name)
+            if path==""{
+                continue // the root is not served, the file may well be there
+            }
+            ok,_ := file_exists(path)
+            if ok{
+                continue
+            }
+        }
+        result = append(result,record)
+    }
+    return result,nil
+}
+
+func bulk_color(u *Unit,notes []Note_record,color int)(Bulk_result,error){
+    result := Bulk_result{Action:"color",Notes:len(notes)}
+    for _,record :=range(notes){
+        if record.Color ==color{
+            continue
+        }
+        tab_note:=get_table("file_note")
+        tab_note.set("tag",record.Tag).set("color",strconv.Itoa(color))
+        _,err := do_update(u.tx,tab_note.pack_update([]string{"tag"}))
+        if err !=nil{
+            return result,err
+        }
+        result.Changed++
+    }
+    return result,nil
+}
+
+// bulk_labels puts the labels add on the notes and takes the labels del off
+func bulk_labels(u *Unit,notes []Note_record,add []int64,del []int64)(Bulk_result,error){
+    result := Bulk_result{Action:"labels",Notes:len(notes)}
+    var tags []string
+    for _,record :=range(notes){
+        tags = append(tags,record.Tag)
+    }
+    labels,err := labels_map(u.tx,label_app_note,tags)
+    if err !=nil{
+        return result,err
+    }
+    for _,tag :=range(tags){
+        var lids []int64
+        changed := false
+        for _,label :=range(labels[tag]){
+            if int64_in(del,label.Lid){
+                changed = true
+                continue
+            }
+            lids = append(lids,label.Lid)
+        }
+        for _,lid :=range(add){
+            if !int64_in(lids,lid){
+                lids = append(lids,lid)
+                changed = true
+            }
+        }
+        if !changed{
+            continue
+        }
+        err = label_set(u.tx,label_app_note,tag,lids)
+        if err !=nil{
+            return result,err
+        }
+        result.Changed++
+    }
+    return result,nil
+}
+
+func int64_in(list []int64,value int64)bool{
+    for _,item :=range(list){
+        if item ==value{
+            return true
+        }
+    }
+    return false
+}
+
+// bulk_move puts the notes on the files of the same names in folder, a note
+// whose file is not there is skipped
+func bulk_move(u *Unit,notes []Note_record,folder string,roots Roots)(Bulk_result,error){
+    result := Bulk_result{Action:"move",Notes:len(notes)}
+    folder = strings.Trim(str_db_delim(strings.TrimSpace(folder)),"/")
+    for _,part :=range(strings.Split(folder,"/")){
+        if part ==".."{
+            return result,errors.New("the folder has to be in the served folder")
+        }
+    }
+    folder = folder_key(folder)
+    if !roots.in_served(folder){
+        return result,errors.New("the root of the folder is not served")
+    }
+    for _,record :=range(notes){
+        if record.File_name ==""{
+            result.Skipped = append(result.Skipped,record.File_dir+": a folder note")
+            continue
+        }
+        if record.File_dir ==folder{
+            result.Skipped = append(result.Skipped,record.File_dir+record.File_name+": in the folder already")
+            continue
+        }
+        info,err := os.Stat(roots.abs(folder+record.File_name))
+        if err !=nil || info.IsDir(){
+            result.Skipped = append(result.Skipped,record.File_dir+record.File_name+": no "+folder+record.File_name)
+            continue
+        }
+        replies,err := note_replies(u.tx,record.Tag)
+        if err !=nil{
+            return result,err
+        }
+        for _,tag :=range(append(replies,record.Tag)){
+            tab_note:=get_table("file_note")
+            tab_note.set("tag",tag).set("file_dir",folder)
+            _,err = do_update(u.tx,tab_note.pack_update([]string{"tag"}))
+            if err !=nil{
+                return result,err
+            }
+        }
+        result.Changed++
+        result.Replies += len(replies)
+    }
+    return result,nil
+}
+
+func bulk_delete(u *Unit,notes []Note_record)(Bulk_result,error){
+    result := Bulk_result{Action:"delete",Notes:len(notes)}
+    for _,record :=range(notes){
+        replies,err := note_replies(u.tx,record.Tag)
+        if err !=nil{
+            return result,err
+        }
+        _,err = del_note_by_tag(u,record.Tag)
+        if err !=nil{
+            return result,err
+        }
+        result.Changed++
+        result.Replies += len(replies)
+    }
+    return result,nil
+}
+
+// ================ for fingerprints of the noted files ========================
+// The size and a sha256 of each noted file are kept by its path. A file moved
+// or renamed outside Filegai leaves its notes orphaned, the file of the same
+// fingerprint is where they belong. Big files are hashed on their first and
+// last fingerprint_sample bytes with the size: two of them with the same head
+// and tail are not told apart, so a match on a sample is never sure.
+
+const fingerprint_sample = 4<<20
+
+// fingerprint_sampled tells whether a file of the size is hashed on samples
+func fingerprint_sampled(size int64)bool{
+    return size > 2*fingerprint_sample
+}
+
+// fingerprint_minutes is the time between the scheduled refreshes
+const fingerprint_minutes = 30
+
+type File_fingerprint struct{
+    File_dir string
+    File_name string
+    Size int64
+    Mtime int64
+    Hash string
+}
+
+// file_hash gives the fingerprint of the file at path, the path fields are left empty
+func file_hash(path string)(File_fingerprint,error){
+    var result File_fingerprint
+    info,err := os.Stat(path)
+    if err !=nil{
+        return result,err
+    }
+    if info.IsDir(){
+        return result,errors.New("a folder")
+    }
+    result.Size = info.Size()
+    result.Mtime = info.ModTime().Unix()
+    f,err := os.Open(path)
+    if err !=nil{
+        return result,err
+    }
+    defer f.Close()
+    h := sha256.New()
+    if !fingerprint_sampled(result.Size){
+        _,err = io.Copy(h,f)
+    }else{
+        _,err = io.CopyN(h,f,fingerprint_sample)
+        if err ==nil{
+            _,err = f.Seek(-fingerprint_sample,io.SeekEnd)
+        }
+        if err ==nil{
+            _,err = io.CopyN(h,f,fingerprint_sample)
+        }
+        h.Write([]byte(strconv.FormatInt(result.Size,10)))
+    }
+    if err !=nil{
+        return result,err
+    }
+    result.Hash = hex.EncodeToString(h.Sum(nil))
+    return result,nil
+}
+
+func fingerprint_get(db_link Db_link,file_dir string,file_name string)(File_fingerprint,bool,error){
+    result := File_fingerprint{File_dir:file_dir,File_name:file_name}
+    tab := get_table("file_fingerprint")
+    tab.set("file_dir",file_dir).set("file_name",file_name)
+    rows,err := do_query(db_link,tab.pack_select("size,mtime,hash","fpid desc","1"))
+    if err !=nil{
+        return result,false,err
+    }
+    defer rows.Close()
+    if rows.Next(){
+        err = rows.Scan(&result.Size,&result.Mtime,&result.Hash)
+        return result,err ==nil,err
+    }
+    return result,false,rows.Err()
+}
+
+func fingerprint_put(db_link Db_link,fp File_fingerprint)error{
+    err := fingerprint_del(db_link,fp.File_dir,fp.File_name)
+    if err !=nil{
+        return err
+    }
+    tab := get_table("file_fingerprint")
+    tab.set("file_dir",fp.File_dir).set("file_name",fp.File_name).set("size",strconv.FormatInt(fp.Size,10))
+    tab.set("mtime",strconv.FormatInt(fp.Mtime,10)).set("hash",fp.Hash).set("fdate",get_now_string())
+    _,err = do_insert(db_link,tab.pack_insert())
+    return err
+}
+
+func fingerprint_del(db_link Db_link,file_dir string,file_name string)error{
+    tab := get_table("file_fingerprint")
+    tab.set("file_dir",file_dir).set("file_name",file_name)
+    _,err := do_delete(db_link,tab.pack_delete())
+    return err
+}
+
+// fingerprint_move follows a file or a folder (ending with "/") moved, the paths are from the root
+func fingerprint_move(db_link Db_link,old_path string,new_path string)error{
+    var err error
+    if strings.HasSuffix(old_path,"/"){
+        _,err = db_link.Exec(`update file_fingerprint set file_dir=?||substr(file_dir,?) where substr(file_dir,1,?)=?`,
+            new_path,len(old_path)+1,len(old_path),old_path)
+        return err
+    }
+    tab := get_table("file_fingerprint")
+    tab.set("file_dir",path_dir_name(new_path,"/")).set("file_name",path_file_name(new_path,"/"))
+    tab.where("file_dir","=",path_dir_name(old_path,"/")).where("file_name","=",path_file_name(old_path,"/"))
+    _,err = do_update(db_link,tab.pack_update(nil))
+    return err
+}
+
+// fingerprint_file keeps the fingerprint of the file up to date, it is hashed
+// again when its size or time changed. A file not there keeps its old one.
+func fingerprint_file(db_link Db_link,roots Roots,file_dir string,file_name string)error{
+    fp,err := fingerprint_hash(db_link,roots,file_dir,file_name)
+    if err !=nil || fp ==nil{
+        return err
+    }
+    return fingerprint_put(db_link,*fp)
+}
+
+// fingerprint_hash hashes the file when its fingerprint is not up to date, it
+// gives nil when there is nothing to put. It only reads the database, so the
+// hashing can be done before a unit begins.
+func fingerprint_hash(db_link Db_link,roots Roots,file_dir string,file_name string)(*File_fingerprint,error){
+    if file_name ==""{
+        return nil,nil
+    }
+    path := roots.abs(file_dir+file_name)
+    if path==""{
+        return nil,nil
+    }
+    info,err := os.Stat(path)
+    if err !=nil || info.IsDir(){
+        return nil,nil
+    }
+    old,found,err := fingerprint_get(db_link,file_dir,file_name)
+    if err !=nil{
+        return nil,err
+    }
+    if found && old.Size ==info.Size() && old.Mtime ==info.ModTime().Unix(){
+        return nil,nil
+    }
+    fp,err := file_hash(path)
+    if err !=nil{
+        return nil,err
+    }
+    fp.File_dir,fp.File_name = file_dir,file_name
+    return &fp,nil
+}
+
+// note_fingerprint hashes the file of device_id/ino for add_note, it is called
+// before the unit begins: a big file would hold the write lock for long.
+// It gives nil when there is nothing to put.
+func note_fingerprint(db_link Db_link,roots Roots,device_id string,ino string)*File_fingerprint{
+    file_dir,file_name,err := ino_note_path(db_link,roots,device_id,ino)
+    var fp *File_fingerprint
+    if err ==nil{
+        fp,err = fingerprint_hash(db_link,roots,file_dir,file_name)
+    }
+    if err !=nil{
+        fmt.Println("?? fingerprint of "+file_dir+file_name+":"+err.Error())
+        return nil
+    }
+    return fp
+}
+
+// fingerprint_refresh fingerprints the noted files and drops the fingerprints
+// of the paths having no note. It gives the number of files hashed again.
+func fingerprint_refresh(db_link Db_link,roots Roots)(int,error){
+    rows,err := db_link.Query("select distinct file_dir,file_name from file_note where file_name<>''")
+    if err !=nil{
+        return 0,err
+    }
+    var paths [][2]string
+    for rows.Next(){
+        var path [2]string
+        err = rows.Scan(&path[0],&path[1])
+        if err !=nil{
+            rows.Close()
+            return 0,err
+        }
+        paths = append(paths,path)
+    }
+    rows.Close()
+    cnt := 0
+    for _,path :=range(paths){
+        old,_,err := fingerprint_get(db_link,path[0],path[1])
+        if err !=nil{
+            return cnt,err
+        }
+        err = fingerprint_file(db_link,roots,path[0],path[1])
+        if err !=nil{
+            fmt.Printf("?? fingerprint of %s%s:%s\n",path[0],path[1],err.Error())
+            continue
+        }
+        now,_,_ := fingerprint_get(db_link,path[0],path[1])
+        if now.Hash !=old.Hash || now.Mtime !=old.Mtime{
+            cnt++
+        }
+    }
+    _,err = db_link.Exec(`delete from file_fingerprint where not exists (select 1 from file_note n
+        where n.file_dir=file_fingerprint.file_dir and n.file_name=file_fingerprint.file_name)`)
+    return cnt,err
+}
+
+// reattach_auto tells whether the sure matches are applied by the schedule
+func get_reattach_auto(db_link Db_link)int{
+    return get_setting_with_digit(db_link,"reattach_auto",0)
+}
+
+func set_reattach_auto(db_link Db_link,auto string)(bool,error){
+    return set_sys_setting(db_link,"reattach_auto",auto)
+}
+
+func fingerprint_schedule(st *Store){
+    for{
+        cnt,err := fingerprint_refresh(st.db,st.roots)
+        if err ==nil && cnt >0{
+            fmt.Printf("%d noted files fingerprinted\n",cnt)
+        }
+        if err ==nil && get_reattach_auto(st.db)==1{
+            var result Reattach_result
+            result,err = reattach_sure(st,st.roots)
+            if err ==nil && result.Files >0{
+                fmt.Println("orphan notes: "+result.String())
+            }
+        }
+        if err !=nil{
+            fmt.Println("?? refreshing the fingerprints failed:"+err.Error())
+        }
+        time.Sleep(fingerprint_minutes*time.Minute)
+    }
+}
+
+// Reattach_match is a file the orphan notes of File_dir+File_name may belong to
+type Reattach_match struct{
+    File_dir string
+    File_name string
+    New_path string // from the root, "/" as deliminator
+    Confidence int // in %, 100 is sure
+    Reason string
+    Notes int
+}
+
+func (m Reattach_match) Old_path()string{
+    return m.File_dir+m.File_name
+}
+
+// reattach_matches looks in the root for the files of the orphan notes, the
+// files of the same fingerprint first, then those of the same name
+func reattach_matches(db_link Db_link,roots Roots)([]Reattach_match,error){
+    var result []Reattach_match
+    rows,err := db_link.Query(`select file_dir,file_name,count(*) from file_note where parent_tag='' and file_name<>''
+        group by file_dir,file_name order by file_dir,file_name`)
+    if err !=nil{
+        return result,err
+    }
+    var orphans []Reattach_match
+    for rows.Next(){
+        var row Reattach_match
+        err = rows.Scan(&row.File_dir,&row.File_name,&row.Notes)
+        if err !=nil{
+            rows.Close()
+            return result,err
+        }
+        orphans = append(orphans,row)
+    }
+    rows.Close()
+    var missing []Reattach_match
+    for _,row :=range(orphans){
+        path := roots.abs(row.Old_path())
+        if path==""{
+            continue // the root is not served
+        }
+        if ok,_ := file_exists(path);!ok{
+            missing = append(missing,row)
+        }
+    }
+    if len(missing)==0{
+        return result,nil
+    }
+
+    // the files of the roots by size and by name, the hidden ones left out as in the listing,
+    // a file may have moved from one root to another
+    by_size := make(map[int64][]string)
+    by_name := make(map[string][]string)
+    walk := func(path string,info os.FileInfo,err error)error{
+        if err !=nil{
+            return nil // unreadable, passed over
+        }
+        if strings.HasPrefix(info.Name(),".") && !roots.is_root(path){
+            if info.IsDir(){
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        if info.IsDir() || !info.Mode().IsRegular(){
+            return nil
+        }
+        rel_path := str_db_delim(roots.rel(path))
+        by_size[info.Size()] = append(by_size[info.Size()],rel_path)
+        by_name[info.Name()] = append(by_name[info.Name()],rel_path)
+        return nil
+    }
+    for _,root :=range(roots.served()){
+        err = filepath.Walk(root.Dir,walk)
+        if err !=nil{
+            return result,err
+        }
+    }
+    hashes := make(map[string]string)
+    hash_of := func(rel_path string)string{
+        if hash,ok := hashes[rel_path];ok{
+            return hash
+        }
+        fp,err := file_hash(roots.abs(rel_path))
+        if err !=nil{
+            fp.Hash = ""
+        }
+        hashes[rel_path] = fp.Hash
+        return fp.Hash
+    }
+
+    for _,row :=range(missing){
+        fp,found,err := fingerprint_get(db_link,row.File_dir,row.File_name)
+        if err !=nil{
+            return result,err
+        }
+        var same []string
+        if found{
+            for _,path :=range(by_size[fp.Size]){
+                if hash_of(path)==fp.Hash{
+                    same = append(same,path)
+                }
+            }
+        }
+        // a big file is hashed on samples, the same sample is not the same content
+        content := "same content"
+        if fingerprint_sampled(fp.Size){
+            content = "same sample"
+        }
+        for _,path :=range(same){
+            match := row
+            match.New_path = path
+            same_name := path_file_name(path,"/")==row.File_name
+            switch{
+            case len(same)==1 && same_name && content=="same content":
+                match.Confidence,match.Reason = 100,"same content and name"
+            case len(same)==1 && same_name:
+                match.Confidence,match.Reason = 80,content+" and name"
+            case len(same)==1:
+                match.Confidence,match.Reason = 90,content+", renamed"
+            case same_name:
+                match.Confidence,match.Reason = 70,content+" and name, "+strconv.Itoa(len(same))+" copies"
+            default:
+                match.Confidence,match.Reason = 50,content+", "+strconv.Itoa(len(same))+" copies"
+            }
+            if content=="same sample" && match.Confidence>=80{
+                match.Confidence -= 10
+            }
+            result = append(result,match)
+        }
+        if len(same)>0{
+            continue
+        }
+        names := by_name[row.File_name]
+        for _,path :=range(names){
+            match := row
+            match.New_path = path
+            switch{
+            case !found && len(names)==1:
+                match.Confidence,match.Reason = 40,"same name, no fingerprint"
+            case !found:
+                match.Confidence,match.Reason = 20,"same name, no fingerprint, "+strconv.Itoa(len(names))+" files"
+            default:
+                match.Confidence,match.Reason = 30,"same name, the content changed"
+            }
+            result = append(result,match)
+        }
+    }
+    sort.SliceStable(result,func(i,j int)bool{
+        if result[i].Old_path() !=result[j].Old_path(){
+            return result[i].Old_path() < result[j].Old_path()
+        }
+        return result[i].Confidence > result[j].Confidence
+    })
+    return result,nil
+}
+
+type Reattach_result struct{
+    Files int
+    Notes int
+    Skipped []string
+}
+
+func (r Reattach_result) String()string{
+    s := fmt.Sprintf("the notes of %d files (%d notes) re-attached",r.Files,r.Notes)
+    if len(r.Skipped)>0{
+        s += fmt.Sprintf(", %d skipped\n",len(r.Skipped))+strings.Join(r.Skipped,"\n")
+    }
+    return s
+}
+
+// reattach moves all the notes of old_path to new_path, the paths are from the root with "/"
+func reattach(u *Unit,roots Roots,old_path string,new_path string,result *Reattach_result)error{
+    old_dir,old_name := path_dir_name(old_path,"/"),path_file_name(old_path,"/")
+    new_dir,new_name := path_dir_name(new_path,"/"),path_file_name(new_path,"/")
+    if old_name =="" || new_name =="" || strings.Contains("/"+new_path+"/","/../"){
+        result.Skipped = append(result.Skipped,old_path+": not a file")
+        return nil
+    }
+    if !roots.in_served(old_path) || !roots.in_served(new_path){
+        result.Skipped = append(result.Skipped,old_path+": the root is not served")
+        return nil
+    }
+    if ok,_ := file_exists(roots.abs(old_path));ok{
+        result.Skipped = append(result.Skipped,old_path+": the file is there")
+        return nil
+    }
+    info,err := os.Stat(roots.abs(new_path))
+    if err !=nil || info.IsDir(){
+        result.Skipped = append(result.Skipped,old_path+": no "+new_path)
+        return nil
+    }
+    tab_note := get_table("file_note")
+    tab_note.set("file_dir",old_dir).set("file_name",old_name).where("parent_tag","=","")
+    cnt,err := do_count(u.tx,tab_note.pack_count("cnt"))
+    if err !=nil{
+        return err
+    }
+    if cnt ==0{
+        result.Skipped = append(result.Skipped,old_path+": no note, re-attached already?")
+        return nil
+    }
+    _,err = note_move_file(u.tx,old_dir,old_name,new_dir,new_name)
+    if err !=nil{
+        return err
+    }
+    // the fingerprint goes with the notes, the refresh hashes the file again
+    // if it is not the same, so no file is hashed in the unit
+    err = fingerprint_del(u.tx,new_dir,new_name)
+    if err ==nil{
+        err = fingerprint_move(u.tx,old_path,new_path)
+    }
+    if err !=nil{
+        return err
+    }
+    result.Files++
+    result.Notes += int(cnt)
+    return nil
+}
+
+// reattach_sure applies the matches of confidence 100
+func reattach_sure(st *Store,roots Roots)(Reattach_result,error){
+    var result Reattach_result
+    matches,err := reattach_matches(st.db,roots)
+    if err !=nil{
+        return result,err
+    }
+    u,err := st.begin()
+    if err !=nil{
+        return result,err
+    }
+    for _,match :=range(matches){
+        if match.Confidence <100{
+            continue
+        }
+        err = reattach(u,roots,match.Old_path(),match.New_path,&result)
+        if err !=nil{
+            break
+        }
+    }
+    err = u.finish(err)
+    if err !=nil{
+        return Reattach_result{},err
+    }
+    return result,nil
+}
+
+//=====================================================================
+// for the file system watcher
+// With -watch, the renames and moves done in the served folder by other
+// programs are followed as they happen: ino_tree is kept up to date and the
+// notes, labels, links, pins and fingerprints go with their files. The kernel
+// reports the changed folders (inotify, on linux), elsewhere or when it can
+// not, the folders are polled for a changed time. A changed folder is synced
+// like a listing does, except that an inode known at another place is a move.
+
+// watch_settle_ms is the time the changes are gathered before they are applied,
+// the two folders of a move come together
+const watch_settle_ms = 500
+
+// watch_poll_seconds is the time between two looks at the folders when polling
+const watch_poll_seconds = 15
+
+type Fs_watch struct{
+    st *Store
+    roots Roots // the served ones
+    lock sync.Mutex // held while ino_tree and the notes are changed
+    dirty_lock sync.Mutex
+    dirty map[string]bool // the folders to sync, native paths ending with the deliminator
+    wake chan bool
+}
+
+// fs_watch is the running watcher, nil without -watch
+var fs_watch *Fs_watch
+
+func watch_start(st *Store)*Fs_watch{
+    w := &Fs_watch{st:st,roots:st.roots.served(),dirty:make(map[string]bool),wake:make(chan bool,1)}
+    err := watch_inotify(w)
+    if err !=nil{
+        fmt.Printf("?? watch: %s, the folders are polled every %d seconds\n",err.Error(),watch_poll_seconds)
+        go w.poll()
+    }else{
+        for _,root :=range(w.roots){
+            fmt.Println("watch: following the changes of "+root.Dir)
+        }
+    }
+    go w.run()
+    return w
+}
+
+// touch marks a folder to sync
+func (w *Fs_watch) touch(folder string){
+    ensure_folder(&folder,sys_delim())
+    w.dirty_lock.Lock()
+    w.dirty[folder]=true
+    w.dirty_lock.Unlock()
+    select{
+    case w.wake <- true:
+    default:
+    }
+}
+
+func (w *Fs_watch) run(){
+    for range(w.wake){
+        time.Sleep(watch_settle_ms*time.Millisecond)
+        w.dirty_lock.Lock()
+        folders := make([]string,0,len(w.dirty))
+        for folder,_ :=range(w.dirty){
+            folders = append(folders,folder)
+        }
+        w.dirty = make(map[string]bool)
+        w.dirty_lock.Unlock()
+        w.apply(folders)
+    }
+}
+
+// poll looks at the times of the folders, a folder whose entries changed has a new one
+func (w *Fs_watch) poll(){
+    delim := sys_delim()
+    var seen map[string]int64
+    for{
+        now := make(map[string]int64)
+        for _,root :=range(w.roots){
+            filepath.Walk(root.Dir,func(path string,info os.FileInfo,err error)error{
+                if err !=nil || !info.IsDir(){
+                    return nil
+                }
+                if strings.HasPrefix(info.Name(),".") && !w.roots.is_root(path){
+                    return filepath.SkipDir
+                }
+                ensure_folder(&path,delim)
+                now[path] = info.ModTime().UnixNano()
+                if seen !=nil{
+                    if mtime,ok := seen[path];!ok || mtime !=now[path]{
+                        w.touch(path)
+                    }
+                }
+                return nil
+            })
+        }
+        seen = now
+        time.Sleep(watch_poll_seconds*time.Second)
+    }
+}
+
+// watch_hidden tells whether the folder is out of the roots or in a hidden one
+func (w *Fs_watch) watch_hidden(folder string)bool{
+    root := w.roots.of(folder)
+    if root==nil{
+        return true
+    }
+    for _,name :=range(strings.Split(relative_path_of(folder,root.Dir),sys_delim())){
+        if strings.HasPrefix(name,"."){
+            return true
+        }
+    }
+    return false
+}
+
+// rel_path gives the path of the database for the log, a root as it is
+func (w *Fs_watch) rel_path(url string)string{
+    if w.roots.is_root(url){
+        return url
+    }
+    return str_db_delim(w.roots.rel(url))
+}
+
+// apply syncs the changed folders, the parents first. The removals are left to
+// the end, an inode gone from one folder may be in another one.
+func (w *Fs_watch) apply(folders []string){
+    delim := sys_delim()
+    sort.Slice(folders,func(i,j int)bool{
+        di,dj := strings.Count(folders[i],delim),strings.Count(folders[j],delim)
+        if di !=dj{
+            return di < dj
+        }
+        return folders[i] < folders[j]
+    })
+    w.lock.Lock()
+    defer w.lock.Unlock()
+    db := w.st.db
+    for _,folder :=range(folders){
+        if w.watch_hidden(folder){
+            continue
+        }
+        for _,path :=range(folder_split(folder,w.roots.of(folder).Dir,delim)){
+            node,err := get_Fnode(path,w.roots.is_root(path))
+            if err ==nil{
+                w.sync_entry(db,node,path,true)
+            }
+        }
+        w.sync_folder(db,folder,true)
+    }
+    for _,folder :=range(folders){
+        if !w.watch_hidden(folder){
+            w.prune(db,folder)
+        }
+    }
+}
+
+// sync_folder registers the entries of a folder and follows the moved ones, it
+// does not remove anything. The new entries are told when tell_new.
+func (w *Fs_watch) sync_folder(db_link Db_link,folder string,tell_new bool){
+    delim := sys_delim()
+    ensure_folder(&folder,delim)
+    this_fnode,err := get_Fnode(folder,w.roots.is_root(folder))
+    if err !=nil || !this_fnode.IsDir{
+        return // gone since
+    }
+    if w.roots.is_root(folder){
+        w.sync_entry(db_link,this_fnode,folder,tell_new)
+    }
+    for _,node :=range(folder_entries(folder)){
+        path := folder+node.Name
+        if node.IsDir{
+            path += delim
+        }
+        w.sync_entry(db_link,node,path,tell_new)
+    }
+}
+
+// sync_entry puts the node found at path in ino_tree. When its inode is known at
+// another place which is gone, the file or folder was moved and everything kept
+// on the old path goes to the new one.
+func (w *Fs_watch) sync_entry(db_link Db_link,node *Fnode,path string,tell_new bool){
+    delim := sys_delim()
+    old,err := query_fnode(db_link,node.Dev,node.Ino)
+    if err ==nil && old.Parent_ino ==node.Parent_ino && old.Name ==node.Name && old.IsDir ==node.IsDir{
+        return
+    }
+    old_url := ""
+    if err ==nil && old.IsDir ==node.IsDir{
+        old_url,_ = file_url(db_link,node.Dev,node.Ino,100,delim)
+    }
+    if old_url ==""{
+        _,err = register_ino(db_link,node)
+        if err !=nil{
+            fmt.Printf("?? watch: registering %s:%s\n",w.rel_path(path),err.Error())
+            return
+        }
+        if tell_new{
+            fmt.Println("watch: new "+w.rel_path(path))
+        }
+        return
+    }
+    if cur,err := get_Fnode(old_url,false);err ==nil && cur.Ino ==node.Ino{
+        // one more link to the same file, the old one stays
+        return
+    }
+    // the notes go first and the inode is put at its new place in the same
+    // unit: when the move fails, ino_tree keeps the old place to try again
+    u,err := w.st.begin()
+    if err ==nil{
+        err = w.follow(u.tx,old_url,path,node.IsDir)
+        if err ==nil{
+            _,err = update_ino(u.tx,node)
+        }
+        err = u.finish(err)
+    }
+    if err !=nil{
+        fmt.Printf("?? watch: moving %s to %s:%s\n",w.rel_path(old_url),w.rel_path(path),err.Error())
+        return
+    }
+    fmt.Printf("watch: %s moved to %s\n",w.rel_path(old_url),w.rel_path(path))
+}
+
+// follow moves what is kept on old_url to new_url, both native paths
+func (w *Fs_watch) follow(db_link Db_link,old_url string,new_url string,is_dir bool)error{
+    delim := sys_delim()
+    old_rel,new_rel := str_db_delim(w.roots.rel(old_url)),str_db_delim(w.roots.rel(new_url))
+    old_dir,new_dir := path_dir_name(strings.TrimSuffix(old_rel,"/"),"/"),path_dir_name(strings.TrimSuffix(new_rel,"/"),"/")
+    new_name := path_file_name(strings.TrimSuffix(new_url,delim),delim)
+    var err error
+    switch{
+    case is_dir && old_dir ==new_dir:
+        _,err = note_update_dirs(db_link,old_url,new_name,w.roots,delim,false)
+        if err ==nil{
+            _,err = shortcut_rename_folder(db_link,old_url,new_name,w.roots,false)
+        }
+    case is_dir:
+        _,err = note_change_path(db_link,old_rel,new_rel)
+        if err ==nil{
+            _,err = shortcut_change_path(db_link,old_rel,new_rel)
+        }
+    case old_dir ==new_dir:
+        _,err = note_update_name(db_link,old_dir,path_file_name(old_rel,"/"),new_name)
+        if err ==nil || err.Error()=="no record"{
+            _,err = shortcut_rename_file(db_link,old_url,new_name,w.roots)
+        }
+    default:
+        _,err = note_move_file(db_link,old_dir,path_file_name(old_rel,"/"),new_dir,new_name)
+        if err ==nil || err.Error()=="no record"{
+            _,err = shortcut_move_file(db_link,old_dir,path_file_name(old_rel,"/"),new_dir,new_name)
+        }
+    }
+    if err !=nil{
+        return err
+    }
+    return fingerprint_move(db_link,old_rel,new_rel)
+}
+
+// prune takes out of ino_tree the entries gone from the folder, with what was in them
+func (w *Fs_watch) prune(db_link Db_link,folder string){
+    this_fnode,err := get_Fnode(folder,w.roots.is_root(folder))
+    if err !=nil || !this_fnode.IsDir{
+        return // gone too, its parent prunes it
+    }
+    on_disk := make(map[uint64]bool)
+    for _,node :=range(folder_entries(folder)){
+        on_disk[node.Ino]=true
+    }
+    for _,ino :=range(inos_in_parent(db_link,this_fnode.Dev,this_fnode.Ino)){
+        if on_disk[uint64(ino)] || uint64(ino)==this_fnode.Ino{
+            continue
+        }
+        url,_ := file_url(db_link,this_fnode.Dev,uint64(ino),100,sys_delim())
+        err = w.forget(db_link,this_fnode.Dev,uint64(ino),100)
+        if err !=nil{
+            fmt.Printf("?? watch: removing %s:%s\n",w.rel_path(url),err.Error())
+            continue
+        }
+        fmt.Println("watch: removed "+w.rel_path(url))
+    }
+}
+
+// forget deletes an inode of ino_tree and those under it, whose numbers may be
+// given to new files
+func (w *Fs_watch) forget(db_link Db_link,dev uint64,ino uint64,max_level int)error{
+    if max_level <0{
+        return errors.New("maxium iteration")
+    }
+    for _,child :=range(inos_in_parent(db_link,uint64(dev),ino)){
+        if uint64(child) !=ino{
+            err := w.forget(db_link,dev,uint64(child),max_level-1)
+            if err !=nil{
+                return err
+            }
+        }
+    }
+    _,err := delete_ino(db_link,&Fnode{Dev:dev,Ino:ino})
+    return err
+}
+
+//=====================================================================
+// for the index of the whole root
+// The index puts every folder and file of the root in ino_tree with its size
+// and time, so the search finds the files in the folders nobody opened. The
+// time of a folder changes when an entry is added, removed or renamed in it,
+// so a folder is read again only when its time is not the one it had when it
+// was read last (scan_mtime); a full index reads them all. It runs in the
+// background on index_workers folders at a time and can be canceled, its
+// progress is on /index.
+
+type Index_progress struct{
+    Running bool
+    Full bool
+    Workers int
+    Folders int // read
+    Unchanged int // not read again
+    Entries int // folders and files in the folders read
+    Queued int // folders waiting
+    Errors int
+    Last_error string
+    Started string
+    Finished string
+    Canceled bool
+}
+
+type Indexer struct{
+    st *Store
+    lock sync.Mutex
+    progress Index_progress
+    cancel context.CancelFunc
+    finished time.Time
+}
+
+// Index_step is what a worker did with a folder
+type Index_step struct{
+    Folder string
+    Children []string // its folders, native paths ending with the deliminator
+    Entries int
+    Read bool
+    Err error
+}
+
+func get_index_workers(db_link Db_link)int{
+    workers := get_setting_with_digit(db_link,"index_workers",4)
+    if workers <1{
+        return 1
+    }
+    if workers >32{
+        return 32
+    }
+    return workers
+}
+
+func set_index_workers(db_link Db_link,workers string)(bool,error){
+    return set_sys_setting(db_link,"index_workers",workers)
+}
+
+// index_hours is the time between two scheduled indexes, 0 for none
+func get_index_hours(db_link Db_link)int{
+    return get_setting_with_digit(db_link,"index_hours",0)
+}
+
+func set_index_hours(db_link Db_link,hours string)(bool,error){
+    return set_sys_setting(db_link,"index_hours",hours)
+}
+
+func index_scan_mtime(db_link Db_link,node *Fnode)(int64,error){
+    var scan_mtime int64
+    err := db_link.QueryRow("select scan_mtime from ino_tree where host_name=? and device_id=? and ino=? limit 1",
+        get_host_name(),node.device_id(),node.ino()).Scan(&scan_mtime)
+    if err ==sql.ErrNoRows{
+        return 0,nil
+    }
+    return scan_mtime,err
+}
+
+func index_set_scan_mtime(db_link Db_link,node *Fnode,scan_mtime int64)error{
+    tab := get_table("ino_tree")
+    tab.set("scan_mtime",strconv.FormatInt(scan_mtime,10))
+    tab.where("host_name","=",get_host_name()).where("device_id","=",node.device_id()).where("ino","=",node.ino())
+    _,err := do_update(db_link,tab.pack_update(nil))
+    return err
+}
+
+// folders_in_parent gives the names of the folders under a folder in ino_tree
+func folders_in_parent(db_link Db_link,node *Fnode)([]string,error){
+    var result []string
+    tab := get_table("ino_tree")
+    tab.set("host_name",get_host_name()).set("device_id",node.device_id()).set("parent_ino",node.ino()).set("type","d")
+    tab.where("ino","<>",node.ino())
+    rows,err := do_query(db_link,tab.pack_select("name","",""))
+    if err !=nil{
+        return result,err
+    }
+    defer rows.Close()
+    for rows.Next(){
+        var name string
+        err = rows.Scan(&name)
+        if err !=nil{
+            return result,err
+        }
+        result = append(result,name)
+    }
+    return result,rows.Err()
+}
+
+func (ix *Indexer) status()Index_progress{
+    ix.lock.Lock()
+    defer ix.lock.Unlock()
+    return ix.progress
+}
+
+// start runs an index in the background, an error when one is running
+func (ix *Indexer) start(full bool)error{
+    ix.lock.Lock()
+    defer ix.lock.Unlock()
+    if ix.progress.Running{
+        return errors.New("an index is running")
+    }
+    ctx,cancel := context.WithCancel(context.Background())
+    ix.cancel = cancel
+    ix.progress = Index_progress{Running:true,Full:full,Workers:get_index_workers(ix.st.db),Started:get_now_string()}
+    go ix.run(ctx,full,ix.progress.Workers)
+    return nil
+}
+
+func (ix *Indexer) stop()bool{
+    ix.lock.Lock()
+    defer ix.lock.Unlock()
+    if !ix.progress.Running{
+        return false
+    }
+    ix.cancel()
+    return true
+}
+
+// run gives the folders to the workers, the folders found in one are queued
+// when it is done, so a folder is always in ino_tree before its entries
+func (ix *Indexer) run(ctx context.Context,full bool,workers int){
+    jobs := make(chan string)
+    steps := make(chan Index_step)
+    for i:=0;i<workers;i++{
+        go func(){
+            for folder :=range(jobs){
+                steps <- ix.index_folder(folder,full)
+            }
+        }()
+    }
+    var queue []string
+    for _,root :=range(ix.st.roots.served()){
+        queue = append(queue,root.Dir)
+    }
+    busy := 0
+    done := ctx.Done()
+    canceled := false
+    for (len(queue)>0 && !canceled) || busy >0{
+        var send chan string
+        next := ""
+        if len(queue)>0 && !canceled{
+            // the last one first, the queue stays short
+            send,next = jobs,queue[len(queue)-1]
+        }
+        select{
+        case send <- next:
+            queue = queue[:len(queue)-1]
+            busy++
+        case step := <-steps:
+            busy--
+            queue = append(queue,step.Children...)
+            ix.lock.Lock()
+            if step.Err !=nil{
+                ix.progress.Errors++
+                ix.progress.Last_error = step.Folder+":"+step.Err.Error()
+            }else if step.Read{
+                ix.progress.Folders++
+                ix.progress.Entries += step.Entries
+            }else{
+                ix.progress.Unchanged++
+            }
+            ix.progress.Queued = len(queue)
+            ix.lock.Unlock()
+        case <-done:
+            canceled = true
+            done = nil
+        }
+    }
+    close(jobs)
+
+    ix.lock.Lock()
+    ix.progress.Running = false
+    ix.progress.Canceled = canceled
+    ix.progress.Queued = len(queue)
+    ix.progress.Finished = get_now_string()
+    ix.finished = time.Now()
+    p := ix.progress
+    ix.lock.Unlock()
+    state := "done"
+    if canceled{
+        state = "canceled"
+    }
+    fmt.Printf("index %s: %d folders read, %d unchanged, %d entries, %d errors\n",state,p.Folders,p.Unchanged,p.Entries,p.Errors)
+}
+
+// index_folder reads a folder into ino_tree unless it is unchanged, and gives the folders in it
+func (ix *Indexer) index_folder(folder string,full bool)Index_step{
+    step := Index_step{Folder:folder}
+    db := ix.st.db
+    delim := sys_delim()
+    is_root := ix.st.roots.is_root(folder)
+    this_fnode,err := get_Fnode(folder,is_root)
+    if err !=nil{
+        if !os.IsNotExist(err){
+            step.Err = err
+        }
+        return step
+    }
+    scan_mtime,err := index_scan_mtime(db,this_fnode)
+    if err !=nil{
+        step.Err = err
+        return step
+    }
+    if full || scan_mtime !=this_fnode.Mtime{
+        // the time before the read, a change while reading is seen the next time;
+        // the times are in seconds, a folder changed this second is read again
+        refresh_folder(db,folder,is_root)
+        mtime := this_fnode.Mtime
+        if mtime >= time.Now().Unix()-1{
+            mtime = 0
+        }
+        err = index_set_scan_mtime(db,this_fnode,mtime)
+        if err !=nil{
+            step.Err = err
+            return step
+        }
+        step.Read = true
+        step.Entries = len(inos_in_parent(db,this_fnode.Dev,this_fnode.Ino))
+        if is_root{
+            step.Entries-- // the root itself
+        }
+    }
+    names,err := folders_in_parent(db,this_fnode)
+    if err !=nil{
+        step.Err = err
+        return step
+    }
+    for _,name :=range(names){
+        step.Children = append(step.Children,folder+name+delim)
+    }
+    return step
+}
+
+// index_schedule runs an index when the last one is older than index_hours,
+// the first one when the server starts
+func index_schedule(ix *Indexer){
+    for{
+        hours := get_index_hours(ix.st.db)
+        ix.lock.Lock()
+        due := hours >0 && !ix.progress.Running && (ix.finished.IsZero() || time.Since(ix.finished) >= time.Duration(hours)*time.Hour)
+        ix.lock.Unlock()
+        if due{
+            err := ix.start(false)
+            if err !=nil{
+                fmt.Println("?? scheduled index failed:"+err.Error())
+            }
+        }
+        time.Sleep(10*time.Minute)
+    }
+}
+
+// ================ for database initialize ========================
+// the schema is built up by numbered migrations, new databases run all of them.
+// Filegai.db keeps its version in the settings table (db_version),
+// blob pages keep it in "PRAGMA user_version"
+type Db_migration struct{
+    Version int
+    Name string
+    Sql string
+    Run func(step *Migration_step) error // optional, runs after Sql
+}
+
+// Migration_step is the work of one migration. Its statements run in tx; like
+// a Unit, its blob page writes are undone when the step fails, and its blob
+// deletes wait until tx has committed.
+type Migration_step struct{
+    tx *sql.Tx
+    folder string
+    undo []func() error
+    after []func() error
+}
+
+func (step *Migration_step) undo_blobs(){
+    for i:=len(step.undo)-1;i>=0;i--{
+        err := step.undo[i]()
+        if err !=nil{
+            fmt.Println("?? error reverting a blob write:"+err.Error())
+        }
+    }
+    step.undo = nil
+    step.after = nil
+}
+
+func (step *Migration_step) run_after(){
+    for _,fn :=range(step.after){
+        err := fn()
+        if err !=nil{
+            fmt.Println("?? error deleting a blob:"+err.Error())
+        }
+    }
+    step.undo = nil
+    step.after = nil
+}
+
+var main_migrations = []Db_migration{
+    {Version:1, Name:"baseline tables of version 0.2", Sql:`
+CREATE TABLE IF NOT EXISTS "ino_tree"( "id" INTEGER PRIMARY KEY AUTOINCREMENT, "host_name" VARCHAR(100),"device_id" BIGINT UNSIGNED,
+    "ino" BIGINT UNSIGNED,"parent_ino" BIGINT UNSIGNED,"name" VARCHAR(250),"type" CHAR(1),"state" CHAR(1) );
+CREATE TABLE IF NOT EXISTS "file_note"( "nid" INTEGER PRIMARY KEY AUTOINCREMENT, "tag" CHAR(10),"file_dir" VARCHAR(250),
+    "file_name" VARCHAR(250),"note" TEXT,ndate DATETIME, color CHAR(1));
+create table IF NOT EXISTS tags(tag_id INTEGER PRIMARY KEY AUTOINCREMENT,tag_str CHAR(10));
+create table IF NOT EXISTS note_ino(tid INTEGER  PRIMARY KEY AUTOINCREMENT,tag CHAR(10),host_name VARCHAR(40),device_id VARCHAR(10), ino BIGINT UNSIGNED);
+create table IF NOT EXISTS resource(rsid INTEGER PRIMARY KEY AUTOINCREMENT, page SMALLINT UNSIGNED, tag CHAR(10), name VARCHAR(250),type TINYINT UNSIGNED,rs_date DATETIME,ref_count TINYINT);
+create table IF NOT EXISTS resource_link(rsl_id INTEGER PRIMARY KEY AUTOINCREMENT, tag CHAR(10), app TINYINT, app_tag CHAR(10));
+create table IF NOT EXISTS shortcut(scid INTEGER PRIMARY KEY AUTOINCREMENT,track_id INT,file_dir VARCHAR(250), file_name VARCHAR(250),type CHAR(1),order_id INTERGER);
+create table IF NOT EXISTS article(artid INTEGER PRIMARY KEY AUTOINCREMENT, tag CHAR(10), shelf_id INT UNSIGNED,title VARCHAR(250), adate DATETIME, color CHAR(1));
+create table IF NOT EXISTS article_page(pgid INTEGER PRIMARY KEY AUTOINCREMENT,pg_tag CHAR(10), tag CHAR(10),order_id SMALLINT UNSIGNED,pdate DATETIME);
+create table IF NOT EXISTS settings(id INTEGER PRIMARY KEY AUTOINCREMENT,key VARCHAR(100),value VARCHAR(250), note VARCHAR(250) );
+create index IF NOT EXISTS idx_dev_ino on ino_tree(host_name,device_id, ino);
+create index IF NOT EXISTS idx_dev_parent on ino_tree(host_name,device_id,parent_ino);
+create index IF NOT EXISTS idx_dev_ino_note on file_note(tag);
+create index IF NOT EXISTS idx_file_note_path on file_note(file_dir,file_name);
+create index IF NOT EXISTS idx_resource_tag on resource(tag);
+create index IF NOT EXISTS idx_resource_link_tag on resource_link(tag);
+create index IF NOT EXISTS idx_tags on tags(tag_str);
+create index IF NOT EXISTS idx_article_tag on article(tag);
+create index IF NOT EXISTS idx_article_title on article(title);
+create index  IF NOT EXISTS idx_article_page_pg_tag on article_page(pg_tag);
+`},
+    // the baseline script reused the name idx_article_page_pg_tag, so this one was never created
+    {Version:2, Name:"index article_page(tag)", Sql:`
+create index IF NOT EXISTS idx_article_page_tag on article_page(tag);
+`},
+    {Version:3, Name:"hash the resources and merge the duplicates", Sql:`
+ALTER TABLE resource ADD COLUMN hash CHAR(64);
+create index IF NOT EXISTS idx_resource_hash on resource(hash);
+`, Run:merge_duplicate_resources},
+    // the table depends on the build, see search_index_create
+    {Version:4, Name:"full text index of the notes and article pages", Run:fill_search_index},
+    {Version:5, Name:"revisions of the notes", Sql:`
+CREATE TABLE IF NOT EXISTS note_revision(rvid INTEGER PRIMARY KEY AUTOINCREMENT, tag CHAR(10), rev_tag CHAR(10),
+    host_name VARCHAR(100), rdate DATETIME);
+create index IF NOT EXISTS idx_note_revision_tag on note_revision(tag);
+`},
+    // the note of a file stays as it is, the first one of its file
+    {Version:6, Name:"several notes on a file and replies", Sql:`
+ALTER TABLE file_note ADD COLUMN parent_tag CHAR(10) NOT NULL DEFAULT '';
+create index IF NOT EXISTS idx_file_note_parent on file_note(parent_tag);
+`},
+    {Version:7, Name:"labels, with one for each color", Sql:`
+CREATE TABLE IF NOT EXISTS label(lid INTEGER PRIMARY KEY AUTOINCREMENT, name VARCHAR(100), color VARCHAR(20), ldate DATETIME);
+CREATE TABLE IF NOT EXISTS label_link(llid INTEGER PRIMARY KEY AUTOINCREMENT, lid INTEGER, app TINYINT, app_tag VARCHAR(250));
+create index IF NOT EXISTS idx_label_link_lid on label_link(lid);
+create index IF NOT EXISTS idx_label_link_app on label_link(app,app_tag);
+`, Run:color_labels},
+    {Version:8, Name:"markdown notes and article pages", Sql:`
+ALTER TABLE file_note ADD COLUMN format TINYINT NOT NULL DEFAULT 0;
+ALTER TABLE article_page ADD COLUMN format TINYINT NOT NULL DEFAULT 0;
+ALTER TABLE note_revision ADD COLUMN format TINYINT NOT NULL DEFAULT 0;
+`},
+    {Version:9, Name:"page anchors of the notes on pdf files", Sql:`
+CREATE TABLE IF NOT EXISTS note_anchor(naid INTEGER PRIMARY KEY AUTOINCREMENT, tag CHAR(10), page INTEGER, quote TEXT, rect VARCHAR(100));
+create index IF NOT EXISTS idx_note_anchor_tag on note_anchor(tag);
+`},
+    // the [[...]] links are new, the texts before have none to fill in
+    {Version:10, Name:"wiki links between notes, articles and files", Sql:`
+CREATE TABLE IF NOT EXISTS wiki_link(wlid INTEGER PRIMARY KEY AUTOINCREMENT, app TINYINT, app_tag CHAR(10), owner CHAR(10),
+    kind VARCHAR(10), target VARCHAR(250), host_name VARCHAR(100), device_id BIGINT UNSIGNED, ino BIGINT UNSIGNED);
+create index IF NOT EXISTS idx_wiki_link_app on wiki_link(app,app_tag);
+create index IF NOT EXISTS idx_wiki_link_target on wiki_link(kind,target);
+`},
+    {Version:11, Name:"note templates", Sql:`
+CREATE TABLE IF NOT EXISTS note_template(ntid INTEGER PRIMARY KEY AUTOINCREMENT, name VARCHAR(100), format TINYINT NOT NULL DEFAULT 0,
+    exts VARCHAR(250), folder VARCHAR(250), body TEXT, tdate DATETIME);
+`},
+    // the files noted before are fingerprinted by the first refresh
+    {Version:12, Name:"fingerprints of the noted files", Sql:`
+CREATE TABLE IF NOT EXISTS file_fingerprint(fpid INTEGER PRIMARY KEY AUTOINCREMENT, file_dir VARCHAR(250), file_name VARCHAR(250),
+    size BIGINT, mtime BIGINT, hash CHAR(64), fdate DATETIME);
+create index IF NOT EXISTS idx_file_fingerprint_path on file_fingerprint(file_dir,file_name);
+create index IF NOT EXISTS idx_file_fingerprint_size on file_fingerprint(size);
+`},
+    // the rows are filled in when their folders are listed or indexed
+    {Version:13, Name:"sizes and times in ino_tree", Sql:`
+ALTER TABLE ino_tree ADD COLUMN size BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE ino_tree ADD COLUMN mtime BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE ino_tree ADD COLUMN scan_mtime BIGINT NOT NULL DEFAULT 0;
+`},
+    // the devices were int32 from the mac stat, they are uint64 now (see File_identity):
+    // the negative ones are taken as the uint32 they were, note_ino kept them as text
+    {Version:14, Name:"device ids as uint64", Sql:`
+UPDATE ino_tree SET device_id=device_id+4294967296 WHERE device_id<0;
+CREATE TABLE note_ino_wide(tid INTEGER PRIMARY KEY AUTOINCREMENT,tag CHAR(10),host_name VARCHAR(40),device_id BIGINT UNSIGNED, ino BIGINT UNSIGNED);
+INSERT INTO note_ino_wide(tid,tag,host_name,device_id,ino) SELECT tid,tag,host_name,CAST(device_id AS INTEGER),ino FROM note_ino;
+UPDATE note_ino_wide SET device_id=device_id+4294967296 WHERE device_id<0;
+DROP TABLE note_ino;
+ALTER TABLE note_ino_wide RENAME TO note_ino;
+`},
+    // the root_dir setting of each host becomes its default root, whose key in the paths is ""
+    {Version:15, Name:"named roots", Sql:`
+CREATE TABLE IF NOT EXISTS root_folder(rid INTEGER PRIMARY KEY AUTOINCREMENT,host_name VARCHAR(100),name VARCHAR(40),dir VARCHAR(250));
+create index IF NOT EXISTS idx_root_folder_host on root_folder(host_name,name);
+INSERT INTO root_folder(host_name,name,dir) SELECT note,'default',value FROM settings WHERE key='root_dir' AND note IS NOT NULL AND value<>'';
+DELETE FROM settings WHERE key='root_dir';
+`},
+    {Version:16, Name:"images of the note revisions", Run:revision_images},
+    // the file links kept the int32 devices of the mac stat as uint64, a negative one
+    // is a REAL near 2^64 short of its last bits: the device is the one of the same
+    // ino in ino_tree (uint64 since [14]), a link without it is found by its path
+    {Version:17, Name:"wiki link devices as uint64", Sql:`
+UPDATE wiki_link SET device_id=(SELECT t.device_id FROM ino_tree t WHERE t.host_name=wiki_link.host_name AND t.ino=wiki_link.ino
+    AND abs((t.device_id-4294967296)-(wiki_link.device_id-18446744073709551616.0))<4096 ORDER BY t.id LIMIT 1)
+    WHERE typeof(device_id)='real';
+UPDATE wiki_link SET host_name=NULL,ino=NULL WHERE device_id IS NULL AND ino IS NOT NULL;
+`},
+}
+
+// revision_images links the images of the revisions kept so far, as
+// note_revision_add does for the new ones
+func revision_images(step *Migration_step)error{
+    tx := step.tx
+    pages := open_migration_pages(step.folder)
+    defer pages.close()
+    var rev_tags []string
+    rows,err := tx.Query("select rev_tag from note_revision order by rvid")
+    if err !=nil{
+        return err
+    }
+    for rows.Next(){
+        var rev_tag string
+        err = rows.Scan(&rev_tag)
+        if err !=nil{
+            rows.Close()
+            return err
+        }
+        rev_tags = append(rev_tags,rev_tag)
+    }
+    rows.Close()
+    for _,rev_tag :=range(rev_tags){
+        text,err := pages.text(tx,rev_tag)
+        if err !=nil{
+            return err
+        }
+        err = revision_images_add(tx,rev_tag,text)
+        if err !=nil{
+            return err
+        }
+    }
+    return nil
+}
+
+// color_labels makes a label of each color, the notes and articles of the
+// color are labeled with it. The colors stay as they are.
+func color_labels(step *Migration_step)error{
+    tx := step.tx
+    for code:=1;code<=len(label_colors);code++{
+        name := color_decode(code)
+        res,err := tx.Exec("insert into label(name,color,ldate) values(?,?,?)",
+            strings.ToUpper(name[:1])+name[1:],label_colors[name],get_now_string())
+        if err !=nil{
+            return err
+        }
+        lid,err := res.LastInsertId()
+        if err !=nil{
+            return err
+        }
+        _,err = tx.Exec("insert into label_link(lid,app,app_tag) select ?,?,tag from file_note where color=? order by nid",
+            lid,label_app_note,strconv.Itoa(code))
+        if err !=nil{
+            return err
+        }
+        _,err = tx.Exec("insert into label_link(lid,app,app_tag) select ?,?,tag from article where color=? order by artid",
+            lid,label_app_article,strconv.Itoa(code))
+        if err !=nil{
+            return err
+        }
+    }
+    return nil
+}
+
+var blob_migrations = []Db_migration{
+    {Version:1, Name:"blob_obj table", Sql:`
+CREATE TABLE IF NOT EXISTS blob_obj(id integer primary key autoincrement,type TINYINT UNSIGNED,tag CHAR(10),data blob);
+CREATE INDEX IF NOT EXISTS blob_idx ON blob_obj(tag);
+`},
+}
+
+// Migration_pages opens the blob pages for the migrations, which run before
+// the Store is there. A missing page gives a nil handle.
+type Migration_pages struct{
+    folder string
+    dbs map[int]*sql.DB
+}
+
+func open_migration_pages(db_folder string)*Migration_pages{
+    return &Migration_pages{folder:db_folder,dbs:map[int]*sql.DB{}}
+}
+
+func (pages *Migration_pages) open(page int)(*sql.DB,error){
+    if db,ok := pages.dbs[page];ok{
+        return db,nil
+    }
+    if ok,_:=file_exists(blob_file_of(pages.folder,page));!ok{
+        return nil,nil
+    }
+    db,err := get_db(blob_file_of(pages.folder,page))
+    if err !=nil{
+        return nil,err
+    }
+    pages.dbs[page] = db
+    return db,nil
+}
+
+// text reads the text resource of the tag, "" when it is lost
+func (pages *Migration_pages) text(tx *sql.Tx,tag string)(string,error){
+    var page int
+    err := tx.QueryRow("select page from resource where tag=?",tag).Scan(&page)
+    if err ==sql.ErrNoRows{
+        return "",nil
+    }
+    if err !=nil{
+        return "",err
+    }
+    blob_db,err := pages.open(page)
+    if err !=nil || blob_db ==nil{
+        return "",err
+    }
+    _,data,err := blob_read(blob_db,tag)
+    if err ==sql.ErrNoRows{
+        return "",nil
+    }
+    return string(data),err
+}
+
+func (pages *Migration_pages) close(){
+    for _,db :=range(pages.dbs){
+        db.Close()
+    }
+}
+
+// merge_duplicate_resources fills resource.hash and folds the resources with the
+// same bytes into the oldest one: the links move to it, the texts showing the
+// others are changed to show it, the others are deleted. The blob pages it
+// writes are copied to backup/merge_.../ first. The texts are changed once
+// the statements are done, and the copies are deleted after the commit.
+func merge_duplicate_resources(step *Migration_step)error{
+    tx,db_folder := step.tx,step.folder
+    pages := open_migration_pages(db_folder)
+    defer pages.close()
+
+    type res_row struct{
+        tag string
+        page int
+    }
+    var rows_all []res_row
+    rows,err := tx.Query("select tag,page from resource where type<>33 order by rsid asc")
+    if err !=nil{
+        return err
+    }
+    for rows.Next(){
+        var row res_row
+        err = rows.Scan(&row.tag,&row.page)
+        if err !=nil{
+            rows.Close()
+            return err
+        }
+        rows_all = append(rows_all,row)
+    }
+    rows.Close()
+
+    keep := map[string]string{} // hash -> oldest tag
+    tag_map := map[string]string{} // duplicate tag -> kept tag
+    dups := map[string]int{} // duplicate tag -> page
+    for _,row :=range(rows_all){
+        blob_db,err := pages.open(row.page)
+        if err !=nil{
+            return err
+        }
+        if blob_db ==nil{
+            continue // fsck reports it
+        }
+        _,data,err := blob_read(blob_db,row.tag)
+        if err ==sql.ErrNoRows{
+            continue
+        }
+        if err !=nil{
+            return err
+        }
+        hash := resource_hash(data)
+        _,err = tx.Exec("update resource set hash=? where tag=?",hash,row.tag)
+        if err !=nil{
+            return err
+        }
+        if kept,ok := keep[hash];ok{
+            tag_map[row.tag] = kept
+            dups[row.tag] = row.page
+            continue
+        }
+        keep[hash] = row.tag
+    }
+    if len(tag_map)==0{
+        return nil
+    }
+    fmt.Printf("merging %d duplicated resources\n",len(tag_map))
+
+    backup_dir := db_folder+"backup"+sys_delim()+"merge_"+strings.NewReplacer("-","",":",""," ","_").Replace(get_now_string())+sys_delim()
+    err = os.MkdirAll(backup_dir,0755)
+    if err !=nil{
+        return err
+    }
+    all_pages,err := blob_pages(db_folder)
+    if err !=nil{
+        return err
+    }
+    for _,page :=range(all_pages){
+        blob_db,err := pages.open(page)
+        if err !=nil{
+            return err
+        }
+        err = db_snapshot(blob_db,backup_dir+"blob"+strconv.Itoa(page)+".db")
+        if err !=nil{
+            return err
+        }
+    }
+
+    for dup,kept :=range(tag_map){
+        _,err = tx.Exec("update resource_link set tag=? where tag=?",kept,dup)
+        if err !=nil{
+            return err
+        }
+        _,err = tx.Exec("delete from resource where tag=?",dup)
+        if err !=nil{
+            return err
+        }
+        _,err = tx.Exec("delete from tags where tag_str=?",dup)
+        if err !=nil{
+            return err
+        }
+    }
+    // a text that showed two of the copies links the kept one twice now
+    _,err = tx.Exec(`delete from resource_link where rsl_id not in
+        (select min(rsl_id) from resource_link group by tag,app,app_tag)`)
+    if err !=nil{
+        return err
+    }
+    _,err = tx.Exec(`update resource set ref_count=(select count(*) from resource_link where resource_link.tag=resource.tag)
+        where type<>33`)
+    if err !=nil{
+        return err
+    }
+
+    var texts []res_row
+    rows,err = tx.Query("select tag,page from resource where type=33")
+    if err !=nil{
+        return err
+    }
+    for rows.Next(){
+        var row res_row
+        err = rows.Scan(&row.tag,&row.page)
+        if err !=nil{
+            rows.Close()
+            return err
+        }
+        texts = append(texts,row)
+    }
+    rows.Close()
+    for _,row :=range(texts){
+        blob_db,err := pages.open(row.page)
+        if err !=nil{
+            return err
+        }
+        if blob_db ==nil{
+            continue
+        }
+        rs_type,data,err := blob_read(blob_db,row.tag)
+        if err ==sql.ErrNoRows{
+            continue
+        }
+        if err !=nil{
+            return err
+        }
+        text := retag_image_refs(string(data),tag_map)
+        if text == string(data){
+            continue
+        }
+        _,err = blob_update(blob_db,row.tag,[]byte(text),rs_type)
+        if err !=nil{
+            return err
+        }
+        // the handles of pages are closed by then
+        blob_file,tag,old_data := blob_file_of(db_folder,row.page),row.tag,data
+        step.undo = append(step.undo,func() error{
+            blob_db,err := get_db(blob_file)
+            if err !=nil{
+                return err
+            }
+            defer blob_db.Close()
+            _,err = blob_update(blob_db,tag,old_data,rs_type)
+            return err
+        })
+    }
+    for dup,page :=range(dups){
+        blob_file,tag := blob_file_of(db_folder,page),dup
+        step.after = append(step.after,func() error{
+            blob_db,err := get_db(blob_file)
+            if err !=nil{
+                return err
+            }
+            defer blob_db.Close()
+            _,err = blob_delete(blob_db,tag)
+            return err
+        })
+    }
+    return nil
+}
+
+// fill_search_index indexes the notes and the article pages there are, in
+// the index table of this build
+func fill_search_index(step *Migration_step)error{
+    tx := step.tx
+    err := search_index_create(tx)
+    if err ==nil{
+        _,err = tx.Exec("delete from "+search_table())
+    }
+    if err !=nil{
+        return err
+    }
+    pages := open_migration_pages(step.folder)
+    defer pages.close()
+    type entry struct{
+        app int
+        tag string
+        owner string
+        text_tag string
+    }
+    var entries []entry
+    reg :=regexp.MustCompile(`#<0x_([\d\w]+)_>`)
+    rows,err := tx.Query("select tag,note from file_note")
+    if err !=nil{
+        return err
+    }
+    for rows.Next(){
+        var tag,note string
+        err = rows.Scan(&tag,&note)
+        if err !=nil{
+            rows.Close()
+            return err
+        }
+        mats := reg.FindStringSubmatch(note)
+        if len(mats)>1{
+            entries = append(entries,entry{1,tag,tag,mats[1]})
+        }
+    }
+    rows.Close()
+    rows,err = tx.Query("select pg_tag,tag from article_page")
+    if err !=nil{
+        return err
+    }
+    for rows.Next(){
+        var pg_tag,tag string
+        err = rows.Scan(&pg_tag,&tag)
+        if err !=nil{
+            rows.Close()
+            return err
+        }
+        entries = append(entries,entry{2,pg_tag,tag,pg_tag})
+    }
+    rows.Close()
+    for _,e :=range(entries){
+        text,err := pages.text(tx,e.text_tag)
+        if err !=nil{
+            return err
+        }
+        err = search_index_put(tx,e.app,e.tag,e.owner,text)
+        if err !=nil{
+            return err
+        }
+    }
+    return nil
+}
+
+// search_index_sync makes the index fit this build. A build without FTS5 can
+// not write the FTS5 table, it fills search_plain and keeps it up to date
+// instead; while search_plain is there the FTS5 table is behind, so a build
+// with FTS5 fills it again and drops search_plain.
+func search_index_sync(db_folder string)error{
+    db,err := sql.Open("sqlite3",db_folder+"Filegai.db"+db_dsn_options)
+    if err !=nil{
+        return err
+    }
+    defer db.Close()
+    has_plain,err := table_exists(db,"search_plain")
+    if err !=nil{
+        return err
+    }
+    has_fts,err := table_exists(db,"search_index")
+    if err !=nil{
+        return err
+    }
+    if search_fts() && has_fts && !has_plain{
+        return nil
+    }
+    if !search_fts() && has_plain{
+        return nil
+    }
+    fmt.Println("filling the search index of this build")
+    tx,err := db.Begin()
+    if err !=nil{
+        return err
+    }
+    err = fill_search_index(&Migration_step{tx:tx,folder:db_folder})
+    if err ==nil && search_fts(){
+        _,err = tx.Exec("DROP TABLE IF EXISTS search_plain")
+    }
+    if err !=nil{
+        tx.Rollback()
+        return err
+    }
+    return tx.Commit()
+}
+
+func table_exists(db_link Db_link,name string)(bool,error){
+    var cnt int64
+    err := db_link.QueryRow("select count(*) from sqlite_master where type='table' and name=?",name).Scan(&cnt)
+    if err !=nil{
+        return false,err
+    }
+    return cnt>0,nil
+}
+
+func get_db_version(db_link Db_link)(int,error){
+    ok,err := table_exists(db_link,"settings")
+    if err !=nil || !ok{
+        return 0,err
+    }
+    version,err := get_setting(db_link,"db_version","sys")
+    if err !=nil{
+        return 0,err
+    }
+    if version=="" || version=="0.2"{
+        // written by the builds before the migrations, the tables are the baseline
+        ok,err = table_exists(db_link,"file_note")
+        if err !=nil || !ok{
+            return 0,err
+        }
+        return 1,nil
+    }
+    return strconv.Atoi(version)
+}
+
+func get_blob_version(db_link Db_link)(int,error){
+    var version int
+    err := db_link.QueryRow("PRAGMA user_version").Scan(&version)
+    if err !=nil{
+        return 0,err
+    }
+    if version ==0{
+        // pages made before the migrations
+        ok,err := table_exists(db_link,"blob_obj")
+        if err !=nil{
+            return 0,err
+        }
+        if ok{
+            return 1,nil
+        }
+    }
+    return version,nil
+}
+
+func set_blob_version(db_link Db_link,version int)error{
+    _,err := db_link.Exec("PRAGMA user_version="+strconv.Itoa(version))
+    return err
+}
+
+func pending_migrations(list []Db_migration,version int)[]Db_migration{
+    var result []Db_migration
+    for _,m :=range list{
+        if m.Version>version{
+            result = append(result,m)
+        }
+    }
+    sort.Slice(result,func(i,j int)bool{return result[i].Version<result[j].Version})
+    return result
+}
+
+// blob_pages returns the page numbers of the blobN.db files in db_folder
+func blob_pages(db_folder string)([]int,error){
+    var result []int
+    fileInfos,err := ioutil.ReadDir(db_folder)
+    if err !=nil{
+        return result, err
+    }
+    reg := regexp.MustCompile(`^blob(\d+)\.db$`)
+    for _,info:= range(fileInfos){
+        m :=reg.FindStringSubmatch(info.Name())
+        if len(m)>0{
+            i,err:=strconv.Atoi(m[1])
+            if err!=nil{
+                return result,err
+            }
+            result = append(result,i)
+        }
+    }
+    sort.Ints(result)
+    return result,nil
+}
+
+func blob_file_of(db_folder string,page int)string{
+    return db_folder+"blob"+strconv.Itoa(page)+".db"
+}
+
+// db_snapshot writes a consistent copy of the opened database to target
+func db_snapshot(db_link Db_link,target string)error{
+    _,err := db_link.Exec("VACUUM INTO ?",target)
+    return err
 }
 
-func del_article_page(db_link *sql.DB,pg_tag string,db_folder string)(bool,error){
-    // pg_tag is the same as blob_tag
-    record,err:=get_page_by_pg_tag(db_link,pg_tag)
+// migrate_file brings one database file up to date, is_blob tells which list to use.
+// a copy goes to backup_dir before the first step, unless the file is new
+func migrate_file(db_file string,is_blob bool,db_folder string,backup_dir string,dry_run bool)(int,error){
+    db, err := sql.Open("sqlite3",db_file)
     if err !=nil{
-        return false,err
+        return 0,err
     }
-    _,old_note,err:=get_text(db_link, db_folder,pg_tag)
-    
-     // 解除app_tag(article_tag,即record.Tag) 与old_note 中所有资源的引用连接
-    resource_ref_dec_by_text(db_link,2,record.Tag,old_note)
-    resource_link_del(db_link,pg_tag,2,record.Tag) // text 资源的引用连接解除
-    resource_delete(db_link,pg_tag ,db_folder) //删除text资源
-    tab := get_table("article_page")
-    tab.set("pg_tag",pg_tag)
-    _,err= do_delete(db_link,tab.pack_delete()) //删除page表中记录
-    if err!=nil{
-        return false,err
+    defer db.Close()
+    list := main_migrations
+    var version int
+    if is_blob{
+        list = blob_migrations
+        version,err = get_blob_version(db)
+    }else{
+        version,err = get_db_version(db)
     }
-    return true,nil
-}
-
-
-func list_article_pages(db_link *sql.DB,tag string,db_folder string)([]Article_page_record,error){
-    var result []Article_page_record
-    tab := get_table("article_page")
-    tab.set("tag",tag)
-    rows,err :=db_link.Query(tab.pack_select("pgid,pg_tag,tag,order_id,pdate","order_id desc,pgid asc",""))
-    defer rows.Close()
     if err !=nil{
-        return result,err
+        return 0,err
     }
-    var record Article_page_record
-    for rows.Next(){
-        err=rows.Scan(&record.Pgid,&record.Pg_tag,&record.Tag,&record.Order_id,&record.Pdate)
+    pending := pending_migrations(list,version)
+    file_name := path_file_name(db_file,sys_delim())
+    if len(pending)==0{
+        return 0,nil
+    }
+    if version>0 || dry_run{
+        // new files are not worth a message
+        fmt.Printf("%s: version %d -> %d\n",file_name,version,pending[len(pending)-1].Version)
+        for _,m :=range pending{
+            fmt.Printf("    [%d] %s\n",m.Version,m.Name)
+        }
+    }
+    if dry_run{
+        return len(pending),nil
+    }
+    if version>0{
+        err = os.MkdirAll(backup_dir,0755)
         if err !=nil{
-            continue
+            return 0,err
+        }
+        err = db_snapshot(db,backup_dir+file_name)
+        if err !=nil{
+            fmt.Printf("?? backup of %s failed\n",file_name)
+            return 0,err
+        }
+    }
+    for _,m :=range pending{
+        tx,err := db.Begin()
+        if err !=nil{
+            return 0,err
+        }
+        step := &Migration_step{tx:tx,folder:db_folder}
+        _,err = tx.Exec(m.Sql)
+        if err ==nil && m.Run !=nil{
+            err = m.Run(step)
         }
-        _,note,err:=get_text(db_link,db_folder ,record.Pg_tag)
         if err ==nil{
-            record.Data=note
+            if is_blob{
+                err = set_blob_version(tx,m.Version)
+            }else{
+                _,err = set_db_version(tx,strconv.Itoa(m.Version))
+            }
         }
-
-        result=append(result,record)
+        if err !=nil{
+            tx.Rollback()
+            step.undo_blobs()
+            fmt.Printf("?? migration [%d] of %s failed:%s\n",m.Version,file_name,err.Error())
+            return 0,err
+        }
+        err = tx.Commit()
+        if err !=nil{
+            step.undo_blobs()
+            return 0,err
+        }
+        step.run_after()
     }
-    return result,err
+    return len(pending),nil
 }
 
-func get_page_by_pg_tag(db_link *sql.DB,pg_tag string)(Article_page_record,error){
-    tab := get_table("article_page")
-    tab.set("pg_tag",pg_tag)
-    rows,err :=db_link.Query(tab.pack_select("pgid,pg_tag,tag,order_id,pdate","",""))
-    defer rows.Close()
-    var record Article_page_record
-    if !rows.Next(){
-        return record,errors.New("no record")
+// migrate_all upgrades Filegai.db and every blob page in db_folder,
+// returns the number of steps done (or to do, for dry_run)
+func migrate_all(db_folder string,dry_run bool)(int,error){
+    backup_dir := db_folder+"backup"+sys_delim()+"migrate_"+strings.NewReplacer("-","",":",""," ","_").Replace(get_now_string())+sys_delim()
+    total,err := migrate_file(db_folder+"Filegai.db",false,db_folder,backup_dir,dry_run)
+    if err !=nil{
+        return total,err
     }
-    err=rows.Scan(&record.Pgid,&record.Pg_tag,&record.Tag,&record.Order_id,&record.Pdate)
-    if err!=nil{
-        return record,err
+    if !dry_run{
+        err = search_index_sync(db_folder)
+        if err !=nil{
+            return total,err
+        }
     }
-    return record,nil
-}
-
-func get_page_records_by_tag(db_link *sql.DB,tag string)([]Article_page_record,error){
-    var result []Article_page_record
-
-    tab := get_table("article_page")
-    tab.set("tag",tag)
-    rows,err :=db_link.Query(tab.pack_select("pgid,pg_tag,tag,order_id,pdate","",""))
-    defer rows.Close()
+    pages,err := blob_pages(db_folder)
     if err !=nil{
-        return result,err
+        return total,err
     }
-    var record Article_page_record
-    for rows.Next(){
-        err=rows.Scan(&record.Pgid,&record.Pg_tag,&record.Tag,&record.Order_id,&record.Pdate)
+    for _,page :=range pages{
+        n,err := migrate_file(blob_file_of(db_folder,page),true,db_folder,backup_dir,dry_run)
+        total += n
         if err !=nil{
-            continue
+            return total,err
         }
-        result = append(result,record)
     }
-    return result,nil
+    return total,nil
 }
 
-// ================ for database initialize ========================
 func install_db(db_file string) (bool,error){
-    db, err := sql.Open("sqlite3",db_file)
-    if err !=nil{
-        fmt.Println("error linking database driver")
-        return false,err
-    }
-    sql_tables :=`
-CREATE TABLE IF NOT EXISTS "ino_tree"( "id" INTEGER PRIMARY KEY AUTOINCREMENT, "host_name" VARCHAR(100),"device_id" BIGINT UNSIGNED,
-    "ino" BIGINT UNSIGNED,"parent_ino" BIGINT UNSIGNED,"name" VARCHAR(250),"type" CHAR(1),"state" CHAR(1) );
-CREATE TABLE IF NOT EXISTS "file_note"( "nid" INTEGER PRIMARY KEY AUTOINCREMENT, "tag" CHAR(10),"file_dir" VARCHAR(250),
-    "file_name" VARCHAR(250),"note" TEXT,ndate DATETIME, color CHAR(1));
-create table IF NOT EXISTS tags(tag_id INTEGER PRIMARY KEY AUTOINCREMENT,tag_str CHAR(10));
-create table IF NOT EXISTS note_ino(tid INTEGER  PRIMARY KEY AUTOINCREMENT,tag CHAR(10),host_name VARCHAR(40),device_id VARCHAR(10), ino BIGINT UNSIGNED);
-create table IF NOT EXISTS resource(rsid INTEGER PRIMARY KEY AUTOINCREMENT, page SMALLINT UNSIGNED, tag CHAR(10), name VARCHAR(250),type TINYINT UNSIGNED,rs_date DATETIME,ref_count TINYINT);
-create table IF NOT EXISTS resource_link(rsl_id INTEGER PRIMARY KEY AUTOINCREMENT, tag CHAR(10), app TINYINT, app_tag CHAR(10));
-create table IF NOT EXISTS shortcut(scid INTEGER PRIMARY KEY AUTOINCREMENT,track_id INT,file_dir VARCHAR(250), file_name VARCHAR(250),type CHAR(1),order_id INTERGER);
-create table IF NOT EXISTS article(artid INTEGER PRIMARY KEY AUTOINCREMENT, tag CHAR(10), shelf_id INT UNSIGNED,title VARCHAR(250), adate DATETIME, color CHAR(1));
-create table IF NOT EXISTS article_page(pgid INTEGER PRIMARY KEY AUTOINCREMENT,pg_tag CHAR(10), tag CHAR(10),order_id SMALLINT UNSIGNED,pdate DATETIME);
-create table IF NOT EXISTS settings(id INTEGER PRIMARY KEY AUTOINCREMENT,key VARCHAR(100),value VARCHAR(250), note VARCHAR(250) );
-create index IF NOT EXISTS idx_dev_ino on ino_tree(host_name,device_id, ino);
-create index IF NOT EXISTS idx_dev_parent on ino_tree(host_name,device_id,parent_ino);
-create index IF NOT EXISTS idx_dev_ino_note on file_note(tag);
-create index IF NOT EXISTS idx_file_note_path on file_note(file_dir,file_name);
-create index IF NOT EXISTS idx_resource_tag on resource(tag);
-create index IF NOT EXISTS idx_resource_link_tag on resource_link(tag);
-create index IF NOT EXISTS idx_tags on tags(tag_str);
-create index IF NOT EXISTS idx_article_tag on article(tag);
-create index IF NOT EXISTS idx_article_title on article(title);
-create index  IF NOT EXISTS idx_article_page_pg_tag on article_page(pg_tag);
-create index  IF NOT EXISTS idx_article_page_pg_tag on article_page(tag);
-`
-    _, err = db.Exec(sql_tables)
-    db.Close()
+    db_folder := path_dir_name(db_file,sys_delim())
+    _,err := migrate_file(db_file,false,db_folder,"",false)
     if err != nil {
         fmt.Printf("error:%q\n", err)
         return false,err
@@ -3861,23 +11463,53 @@ var db_path = flag.String("d", "./Filegai", "database folder path")
 var to_create_db = flag.Bool("n", false, "create the new database ")
 var app_port =flag.Int("p",8080,"serving port,default 8080")
 var expose_server =flag.Bool("e",false,"to expose the server to internet")
-const app_usage =`usage: Filegai [options] Folder
+var to_migrate =flag.Bool("migrate",false,"upgrade the databases in the database folder and quit")
+var dry_run =flag.Bool("dry-run",false,"print the pending database upgrades and quit")
+var to_repair =flag.Bool("repair",false,"let fsck fix what it can")
+var to_watch =flag.Bool("watch",false,"follow the renames and moves done in the served folder by other programs")
+const app_usage =`usage: Filegai [options] [name=]Folder ...
+       Filegai -migrate [-dry-run] [-d db_folder]
+       Filegai fsck [-repair] [-d db_folder]
+       Filegai compact [-d db_folder]
+       Filegai backup [-d db_folder]
+       Filegai restore [-d db_folder] snapshot_name
+       Filegai export [-d db_folder] file.zip
+       Filegai import [-d db_folder] file.zip
+Folder: the folders to serve, name=Folder for each one but the default root, as lit=/data/papers
 -n: to create a new database
 -d db_folder : the database folder, default ./Filegai
 -e: to expose the server to internet. Dangerous!!, don't use, default No. 
 -p number:the communication port
+-watch: follow the files renamed or moved by other programs while serving, their notes go with them
+-migrate: upgrade Filegai.db and the blob pages, a backup is made in db_folder/backup/ first
+-dry-run: only print the pending upgrades
+fsck: check the notes, resources and blob pages against each other and quit
+-repair: with fsck, fix the counts, delete dead tags and move stray blobs to db_folder/quarantine/
+compact: move the blobs out of the half empty blob pages, delete the emptied pages and vacuum the rest
+backup: make a snapshot of the database folder in db_folder/backup/ and quit
+restore: put a snapshot back in place, stop the server first
+export: write the notes, articles, images, shortcuts and settings to a zip
+import: merge an export into the database, taken tags get new ones
 `
 //-----------------------the MAIN FUNCTION---------------------------
 
 func main(){
     if len(os.Args)<2{
-        fmt.Println(app_usage)
+        fmt.Print(app_usage)
         os.Exit(1) 
     }
-    flag.Parse()
-    if flag.NArg() ==0{
+    // fsck, compact, backup, restore, export and import are commands, their options follow them
+    command := ""
+    switch os.Args[1]{
+    case "fsck","compact","backup","restore","export","import":
+        command = os.Args[1]
+        flag.CommandLine.Parse(os.Args[2:])
+    default:
+        flag.Parse()
+    }
+    if flag.NArg() ==0 && !*to_migrate && !*dry_run && (command=="" || command=="restore" || command=="export" || command=="import"){
         fmt.Println("please provide the folder to serve")
-        fmt.Println(app_usage)
+        fmt.Print(app_usage)
         os.Exit(1)
     }    
     db_folder := *db_path
@@ -3886,20 +11518,180 @@ func main(){
     db_file :=db_folder+"Filegai.db"
     host_name := get_host_name()
 
-    root_dir := get_abs_path(flag.Arg(0))
-    // root_dir := flag.Arg(0)
-    ensure_folder(&root_dir,system_delim)
+    if *to_migrate || *dry_run{
+        if ok,_:=file_exists(db_file);!ok{
+            fmt.Printf("database file [%s] does not exists\n",db_file)
+            os.Exit(1)
+        }
+        steps,err := migrate_all(db_folder,*dry_run)
+        if err !=nil{
+            fmt.Printf("?? upgrade failed:%s\n",err.Error())
+            os.Exit(1)
+        }
+        if steps==0{
+            fmt.Println("databases are up to date")
+        }else if *dry_run{
+            fmt.Printf("%d pending steps, run with -migrate to apply\n",steps)
+        }else{
+            fmt.Printf("%d steps done\n",steps)
+        }
+        os.Exit(0)
+    }
+
+    if command=="restore"{
+        replaced,err := restore_backup(db_folder,flag.Arg(0))
+        if err !=nil{
+            fmt.Printf("?? restore failed:%s\n",err.Error())
+            os.Exit(1)
+        }
+        fmt.Printf("%s restored, the replaced files are in %s\n",flag.Arg(0),backup_folder(db_folder)+replaced)
+        os.Exit(0)
+    }
+
+    if command=="backup"{
+        if ok,_:=file_exists(db_file);!ok{
+            fmt.Printf("database file [%s] does not exists\n",db_file)
+            os.Exit(1)
+        }
+        st,err := open_store(db_folder)
+        if err !=nil{
+            fmt.Println("?? error opening database file:",db_file)
+            os.Exit(1)
+        }
+        name,err := backup_now(st)
+        if err ==nil{
+            err = rotate_backups(db_folder,get_backup_keep(st.db))
+        }
+        st.close()
+        if err !=nil{
+            fmt.Printf("?? backup failed:%s\n",err.Error())
+            os.Exit(1)
+        }
+        fmt.Println("backup done:"+backup_folder(db_folder)+name)
+        os.Exit(0)
+    }
+
+    if command=="export" || command=="import"{
+        if ok,_:=file_exists(db_file);!ok{
+            fmt.Printf("database file [%s] does not exists\n",db_file)
+            os.Exit(1)
+        }
+        steps,err := migrate_all(db_folder,true)
+        if err !=nil{
+            fmt.Printf("?? error reading the database versions:%s\n",err.Error())
+            os.Exit(1)
+        }
+        if steps>0{
+            fmt.Println("the databases are from an older version, run with -migrate first")
+            os.Exit(1)
+        }
+        st,err := open_store(db_folder)
+        if err !=nil{
+            fmt.Println("?? error opening database file:",db_file)
+            os.Exit(1)
+        }
+        if command=="export"{
+            var file *os.File
+            var archive Export_archive
+            file,err = os.Create(flag.Arg(0))
+            if err ==nil{
+                archive,err = export_archive(st,file,nil)
+                file.Close()
+                if err !=nil{
+                    os.Remove(flag.Arg(0))
+                }
+            }
+            if err ==nil{
+                fmt.Printf("%d notes, %d articles, %d images exported to %s\n",len(archive.Notes),len(archive.Articles),len(archive.Resources),flag.Arg(0))
+            }
+        }else{
+            var result Import_result
+            result,err = import_archive(st,flag.Arg(0))
+            if err ==nil{
+                fmt.Println("imported: "+result.String())
+            }
+        }
+        st.close()
+        if err !=nil{
+            fmt.Printf("?? %s failed:%s\n",command,err.Error())
+            os.Exit(1)
+        }
+        os.Exit(0)
+    }
+
+    if command=="compact"{
+        if ok,_:=file_exists(db_file);!ok{
+            fmt.Printf("database file [%s] does not exists\n",db_file)
+            os.Exit(1)
+        }
+        steps,err := migrate_all(db_folder,true)
+        if err !=nil{
+            fmt.Printf("?? error reading the database versions:%s\n",err.Error())
+            os.Exit(1)
+        }
+        if steps>0{
+            fmt.Println("the databases are from an older version, run with -migrate first")
+            os.Exit(1)
+        }
+        st,err := open_store(db_folder)
+        if err !=nil{
+            fmt.Println("?? error opening database file:",db_file)
+            os.Exit(1)
+        }
+        report,err := compact_blobs(st,get_blob_page_limit(st.db))
+        st.close()
+        fmt.Print(report.String())
+        if err !=nil{
+            fmt.Printf("?? compact failed:%s\n",err.Error())
+            os.Exit(1)
+        }
+        os.Exit(0)
+    }
+
+    if command=="fsck"{
+        if ok,_:=file_exists(db_file);!ok{
+            fmt.Printf("database file [%s] does not exists\n",db_file)
+            os.Exit(1)
+        }
+        steps,err := migrate_all(db_folder,true)
+        if err !=nil{
+            fmt.Printf("?? error reading the database versions:%s\n",err.Error())
+            os.Exit(1)
+        }
+        if steps>0{
+            fmt.Println("the databases are from an older version, run with -migrate first")
+            os.Exit(1)
+        }
+        st,err := open_store(db_folder)
+        if err !=nil{
+            fmt.Println("?? error opening database file:",db_file)
+            os.Exit(1)
+        }
+        report,err := fsck(st,*to_repair)
+        st.close()
+        fmt.Print(report.String())
+        if err !=nil{
+            fmt.Printf("?? fsck failed:%s\n",err.Error())
+            os.Exit(1)
+        }
+        if len(report.Issues) > report.fixed_count(){
+            os.Exit(1)
+        }
+        os.Exit(0)
+    }
 
-    if ok,_ :=file_exists(root_dir);!ok{
-        fmt.Printf("Serving folder [%s] does not exists,error %q\n",root_dir)
-        fmt.Println(app_usage)
+    // the folders to serve, [name=]folder
+    served,err := parse_roots(flag.Args())
+    if err !=nil{
+        fmt.Println(err.Error())
+        fmt.Print(app_usage)
         os.Exit(1)
     }
 
     if *to_create_db{
         if ok,_:=file_exists(db_folder);ok{
             fmt.Println("folder already exists,please don't use -n option for existing database")
-            fmt.Println(app_usage)
+            fmt.Print(app_usage)
             os.Exit(1)
         }
         err := os.Mkdir(db_folder,0755)
@@ -3923,21 +11715,42 @@ func main(){
     }else{
         if ok,_:=file_exists(db_folder);!ok{
             fmt.Printf("folder [%s] does not exists\n",db_folder)
-            fmt.Println(app_usage)
+            fmt.Print(app_usage)
+            os.Exit(1)
+        }
+        // databases from older builds are upgraded before serving
+        _,err := migrate_all(db_folder,false)
+        if err !=nil{
+            fmt.Printf("?? upgrade of the databases failed:%s\n",err.Error())
             os.Exit(1)
         }
     }
 
-    // fmt.Println("Opening a database link")
-    db, err := get_db(db_file)
-    if err !=nil{
+    // one set of handles for the whole process, see Store
+    st, open_err := open_store(db_folder)
+    if open_err !=nil{
         fmt.Println("?? error opening database file:",db_file)
         return
     }
-    db.Close()
+    defer st.close()
+    st.roots,err = roots_load(st.db,served)
+    if err !=nil{
+        fmt.Println("?? error reading the roots:",err.Error())
+        return
+    }
+    roots := st.roots
+    go backup_schedule(st)
+    go fingerprint_schedule(st)
+    if *to_watch{
+        fs_watch = watch_start(st)
+    }
+    ix := &Indexer{st:st}
+    go index_schedule(ix)
     
     fmt.Println("*********************************************************")
-    fmt.Println("Serving:",root_dir)
+    for _,root :=range(roots.served()){
+        fmt.Printf("Serving %s: %s\n",root.Name,root.Dir)
+    }
     fmt.Println("Database folder:",db_folder)
     fmt.Println("Main Database file:",db_file)
     fmt.Println("*********************************************************")
@@ -3950,63 +11763,63 @@ func main(){
 
     r.SetFuncMap(template.FuncMap{
         "unescapeHtmlTag":unescapeHtmlTag,
+        "text_view":text_view,
     })
     // r.LoadHTMLFiles("templates/index.html", "templates/notes.html","templates/images.html",
     //                 "templates/show_code.html","templates/status.html")
 
     r.LoadHTMLGlob("templates/*")
     r.GET("/",func(c *gin.Context){  
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-        }
-        
-        root_dir_in_db,err :=get_host_root(db,get_host_name())
-        if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-        }
-        if root_dir_in_db ==""{
-            _,err :=set_host_root(db,get_host_name(),root_dir)
-            if err!=nil{
-                fmt.Println("?? setting has root error"+err.Error())
-            }
-        }else{
-            if root_dir_in_db != root_dir{
+        db := st.db
+
+        var served []gin.H
+        for _,root :=range(roots.served()){
+            if root.Kept !=""{
                 c.Redirect(http.StatusTemporaryRedirect,"/error/9")
+                return
+            }
+            refresh_folder(db,root.Dir,true)
+            this_fnode,err := get_Fnode(root.Dir,true)
+            if err !=nil{
+                c.Redirect(http.StatusTemporaryRedirect,"/error/1")
+                return
+            }
+            served = append(served,gin.H{"root":root,"this_fnode":this_fnode,"dev_ino":this_fnode.dev_ino()})
+        }
+        var others []*Root
+        for _,root :=range(roots){
+            if !root.Served{
+                others = append(others,root)
             }
         }
-
-        refresh_folder(db,root_dir,true)
-        this_fnode,_ := get_Fnode(root_dir,true)
         c.HTML(http.StatusOK,"status.html",gin.H{
-            "root_dir":root_dir,
-            "this_fnode":this_fnode,
+            "served":served,
+            "others":others,
             "db_folder":db_folder,
             "db_file":db_file,
-            "dev_ino":strconv.FormatUint(uint64(this_fnode.Dev),10)+"_"+strconv.FormatUint(this_fnode.Ino,10),
         })
-        // c.Redirect(http.StatusTemporaryRedirect,"/list/"+strconv.FormatUint(uint64(this_fnode.Dev),10)+"_"+strconv.FormatUint(this_fnode.Ino,10))
+        // c.Redirect(http.StatusTemporaryRedirect,"/list/"+strconv.FormatUint(this_fnode.Dev,10)+"_"+strconv.FormatUint(this_fnode.Ino,10))
     });
 
     r.GET("/list",func(c *gin.Context){ 
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-        }
+        db := st.db
 
-        refresh_folder(db,root_dir,true)
-        this_fnode,_ := get_Fnode(root_dir,true)
-        c.Redirect(http.StatusTemporaryRedirect,"/list/"+strconv.FormatUint(uint64(this_fnode.Dev),10)+"_"+strconv.FormatUint(this_fnode.Ino,10))
+        // ?root=name goes to another root, the switcher of the listing
+        root := roots.main()
+        if name :=c.Query("root");name !=""{
+            root = roots.by_name(name)
+            if root ==nil{
+                c.Redirect(http.StatusTemporaryRedirect,"/error/1")
+                return
+            }
+        }
+        refresh_folder(db,root.Dir,true)
+        this_fnode,_ := get_Fnode(root.Dir,true)
+        c.Redirect(http.StatusTemporaryRedirect,"/list/"+strconv.FormatUint(this_fnode.Dev,10)+"_"+strconv.FormatUint(this_fnode.Ino,10))
     });
 
     r.GET("/nav/:dev_ino",func(c *gin.Context){ 
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-        }
+        db := st.db
 
         device_id, ino,err:=dev_ino_uint64(c.Param("dev_ino"))
         if err !=nil{
@@ -4026,11 +11839,7 @@ func main(){
     });
 
     r.GET("/list/:ino", func(c *gin.Context) {
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-        }
+        db := st.db
 
         var pairs []string 
         if strings.Contains(c.Param("ino"),"&"){
@@ -4065,10 +11874,7 @@ func main(){
         }
         all_nodes :=folder_entries(url)
         sort.Sort(byAlpha(all_nodes))
-        is_root :=false
-        if url==root_dir{
-            is_root = true
-        }
+        is_root :=roots.is_root(url)
         refresh_folder(db,url,is_root)
         this_node,err:=query_fnode(db,device_id, ino)
         if err !=nil{
@@ -4084,19 +11890,48 @@ func main(){
         var stash_value string
         var stash_class string
 
-        notes_map,err:=get_note_map(db,device_id,ino,root_dir,db_folder)
-        shortcut_map,err:=get_shortcut_map(db,url,root_dir)
+        notes_map,err:=get_note_map(db,device_id,ino,roots,st)
+        // the labels of the files and of their notes, ?label= keeps the files having it
+        label_lid,_ := strconv.ParseInt(c.Query("label"),10,64)
+        rel_dir := roots.rel(url)
+        if sys_delim()=="\\"{
+            rel_dir = strings.ReplaceAll(rel_dir,"\\","/")
+        }
+        var file_paths,note_tags []string
+        for _,tmp_node :=range(all_nodes){
+            if !tmp_node.IsDir{
+                file_paths = append(file_paths,rel_dir+tmp_node.Name)
+            }
+        }
+        for _,records :=range(notes_map){
+            for _,record :=range(records){
+                note_tags = append(note_tags,record.Tag)
+            }
+        }
+        folder_notes,err:=folder_notes_map(db,st,rel_dir)
+        if err !=nil{
+            fmt.Printf("error:getting folder notes %q\n",err)
+        }
+        file_labels,err:=labels_map(db,label_app_file,file_paths)
+        if err !=nil{
+            fmt.Printf("error:getting file labels %q\n",err)
+        }
+        note_labels,err:=labels_map(db,label_app_note,note_tags)
+        if err !=nil{
+            fmt.Printf("error:getting note labels %q\n",err)
+        }
+        shortcut_map,err:=get_shortcut_map(db,url,roots)
         if err!=nil{
             fmt.Printf("error:getting shortcut map %q\n",err)
             c.Redirect(http.StatusTemporaryRedirect,"/error/1")
         }
-        shortcut_map_folder,err:=get_shortcut_map_folder(db,url,root_dir)
+        shortcut_map_folder,err:=get_shortcut_map_folder(db,url,roots)
         if err!=nil{
             fmt.Printf("error:getting shortcut map folder %q\n",err)
             c.Redirect(http.StatusTemporaryRedirect,"/error/1")
         }
 
-        // this_folder :=path_file_name(relative_path_of(url,root_dir))
+        // this_folder :=path_file_name(roots.rel(url))
         sc_type,ok :=shortcut_map["000root000"]
         if ok{
             if strings.Contains(sc_type,"d"){
@@ -4141,22 +11976,44 @@ func main(){
                     fnv.Pin_class="unpinned_folder"
                     fnv.Stash_class="unstashed_folder"
                 }
+                if record,ok :=folder_notes[tmp_node.Name];ok{
+                    fnv.Tag=record.Tag
+                    fnv.Color=record.Color_str
+                    fnv.Note_tip=str_shrink_rune(html_text(record.Note),300)
+                }
                 folder_nodes=append(folder_nodes,fnv)
             }else{
                 
-                record,ok := notes_map[tmp_node.Name]
-                if ok{
+                fnv.Labels = file_labels[rel_dir+tmp_node.Name]
+                for _,record :=range(notes_map[tmp_node.Name]){
+                    fnv.Note_labels = label_merge_into(fnv.Note_labels,note_labels[record.Tag])
+                }
+                if len(fnv.Note_labels)>0{
+                    // drop those already shown on the file
+                    own := fnv.Labels
+                    fnv.Note_labels = label_merge_into(own[:len(own):len(own)],fnv.Note_labels)[len(own):]
+                }
+                if label_lid !=0 && !label_has(fnv.Labels,label_lid) && !label_has(fnv.Note_labels,label_lid){
+                    continue
+                }
+                threads := note_threads(notes_map[tmp_node.Name])
+                if len(threads)>0{
+                    // the latest note is shown, the others are on the thread page
+                    record := threads[len(threads)-1].Note
                     fnv.Note =record.Note
+                    fnv.Note_format =record.Format
                     fnv.Tag=record.Tag
                     fnv.Color=color_decode(record.Color)
                     fnv.Note_visible="note_visible"
+                    fnv.Note_count=len(threads)
+                    fnv.Reply_count=len(notes_map[tmp_node.Name])-len(threads)
                 }else{
                     fnv.Note =""
                     fnv.Tag=""
                     fnv.Color=color_decode(0)
                     fnv.Note_visible=""
                 }
-                if uint64(fnv.Dev)==active_device_id && fnv.Ino == active_ino{
+                if fnv.Dev==active_device_id && fnv.Ino == active_ino{
                     fnv.Active_css_class="active"
                 }else{
                     fnv.Active_css_class=""
@@ -4188,16 +12045,28 @@ func main(){
             }
         }        
     
-        workspace_folders,err:=shortcut_entry(db,"d",root_dir)
+        workspace_folders,err:=shortcut_entry(db,"d",roots)
         if err !=nil{
             fmt.Printf("error:getting shortcut folder entries %q\n",err)
             workspace_folders=""
         }
-        workspace_files,err:=shortcut_entry(db,"f",root_dir)
+        workspace_files,err:=shortcut_entry(db,"f",roots)
         if err !=nil{
             fmt.Printf("error:getting shortcut file entries %q\n",err)
             workspace_files=""
         }
+        all_labels,err:=list_labels(db)
+        if err !=nil{
+            fmt.Printf("error:listing labels %q\n",err)
+        }
+        // the note on this folder is kept under the empty file name
+        var folder_note Note_record
+        folder_note.Color_str=color_decode(0)
+        folder_threads := note_threads(notes_map[""])
+        if len(folder_threads)>0{
+            folder_note = folder_threads[len(folder_threads)-1].Note
+            folder_note.Color_str=color_decode(folder_note.Color)
+        }
         var folder_name_maxlen=30
         var file_name_maxlen=120
         for i:=0;i<len(folder_nodes);i++{
@@ -4226,30 +12095,50 @@ func main(){
             "workspace_folders":workspace_folders,
             "workspace_files":workspace_files,
             "wrap_class":get_page_wrap_class(db,get_host_name()),
+            "all_labels":all_labels,
+            "label":c.Query("label"),
+            "folder_note":folder_note,
+            "folder_note_count":len(folder_threads),
+            "folder_reply_count":len(notes_map[""])-len(folder_threads),
+            "roots":roots.served(),
+            "root":roots.of(url),
         })
     });
 
     // ============= RESOURCE HANDLE =====================
     r.POST("/image_upload",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-        }
-        
-        file, _ := c.FormFile("file")
+        file, err := c.FormFile("file")
         // detail of the file
         // &multipart.FileHeader{
         // Filename:"aaa.png", 
         // Header:textproto.MIMEHeader{
         //   "Content-Disposition":[]string{"form-data; name=\"file\"; filename=\"aaa.png\""}, 
         //   "Content-Type":[]string{"image/png"}}, Size:9944, content
-     
-        content_type :=file.Header["Content-Type"][0]
-        c.SaveUploadedFile(file, db_folder+"upload_temp")
-        rs_type := mime_encode(content_type)
+        var data []byte
+        if err ==nil{
+            // each upload is read from its own part, two at once do not mix
+            handler,open_err := file.Open()
+            err = open_err
+            if err ==nil{
+                data,err = ioutil.ReadAll(handler)
+                handler.Close()
+            }
+        }
+        if err !=nil{
+            fmt.Println("?? image upload:"+err.Error())
+            c.JSON(http.StatusOK, gin.H{
+                "location":"/get_image/xxx",
+            })
+            return
+        }
+        rs_type := mime_encode(file.Header.Get("Content-Type"))
         img_suffix:=mime_decode_suffix(rs_type)
-        tag,err:=resource_deposite_file(db,file.Filename,rs_type,db_folder+"upload_temp" ,db_folder)
+        u,err:=st.begin()
+        var tag string
+        if err ==nil{
+            tag,err=resource_deposite(u,file.Filename,rs_type,data)
+            err=u.finish(err)
+        }
         if err !=nil{
             c.JSON(http.StatusOK, gin.H{
                 "location":"/get_image/xxx",
@@ -4262,42 +12151,59 @@ func main(){
     });
 
     r.POST("/image_update",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
+        file, err := c.FormFile("file")
         if err !=nil{
-            c.String(http.StatusOK,"?? error opening the db") 
+            c.String(http.StatusOK,"??no file")
+            return
         }
-        file, _ := c.FormFile("file")
         tag :=img_name_tag(c.PostForm("tag"))   
-        content_type :=file.Header["Content-Type"][0]
-        c.SaveUploadedFile(file, db_folder+"upload_temp")
-        handler, err := os.Open( db_folder+"upload_temp")
-        defer  handler.Close()
+        content_type :=file.Header.Get("Content-Type")
+        handler, err := file.Open()
         if err!=nil{
             c.String(http.StatusOK,"??open file faild")
+            return
         }
+        defer  handler.Close()
         data,err:=ioutil.ReadAll(handler)
         if err !=nil{
             c.String(http.StatusOK,"??read file faild")
+            return
         }
         rs_type := mime_encode(content_type)
+        // owner is app_apptag of the note or the article the image is changed for
+        app := 0
+        app_tag := ""
+        if pairs := strings.SplitN(c.PostForm("owner"),"_",2);len(pairs)==2{
+            app,_ = strconv.Atoi(pairs[0])
+            app_tag = pairs[1]
+        }
        
-        _,err=resource_update(db,tag,rs_type,data,db_folder)
+        u,err:=st.begin()
+        if err ==nil{
+            tag,err=resource_update_owned(u,tag,app,app_tag,rs_type,data)
+            err=u.finish(err)
+        }
         if err!=nil{
-            c.String(http.StatusOK,"??update faild")
+            c.String(http.StatusOK,"??update faild:"+err.Error())
+            return
         }
         
         c.String(http.StatusOK,"!!"+tag)       
     });
 
-    r.GET("/get_image/:tag",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
+    r.GET("/image_owners/:tag",func(c *gin.Context){
+        owners,err := resource_owners(st.db,img_name_tag(c.Param("tag")))
         if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/public/css/sorry.png")
+            c.String(http.StatusOK,"??"+err.Error())
+            return
         }
+        c.JSON(http.StatusOK,owners)
+    });
+
+    r.GET("/get_image/:tag",func(c *gin.Context){
+        db := st.db
         tag:=img_name_tag(c.Param("tag"))
-        _,data,err:=get_image(db, db_folder,tag)
+        _,data,err:=get_image(db, st,tag)
         if err!=nil{
             c.Redirect(http.StatusTemporaryRedirect,"/public/css/sorry.png")
         }else{
@@ -4309,13 +12215,9 @@ func main(){
     r.GET("/get_image_r/:tag",func(c *gin.Context){
         // for change image, after changing the image,
         // if src does not change, the image do not get updated
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/public/css/sorry.png")
-        }
+        db := st.db
         tag:=img_name_tag(c.Param("tag"))
-        _,data,err:=get_image(db, db_folder,tag)
+        _,data,err:=get_image(db, st,tag)
         if err!=nil{
             c.Redirect(http.StatusTemporaryRedirect,"/public/css/sorry.png")
         }else{
@@ -4325,11 +12227,7 @@ func main(){
     });
 
     r.GET("/list_image/:page",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-        }
+        db := st.db
 
         page,_ :=strconv.Atoi(c.Param("page"))
         page_len := get_img_page_len(db)
@@ -4353,11 +12251,7 @@ func main(){
     });
 
     r.POST("/search_images",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-        }
+        db := st.db
 
         target:=c.PostForm("target")
         images,err :=search_images(db,target)
@@ -4373,11 +12267,7 @@ func main(){
     })
 
     r.GET("/orphan_images",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-        }
+        db := st.db
 
         images :=orphan_images(db)
 
@@ -4388,14 +12278,10 @@ func main(){
     });
 
     r.GET("/retrace_image/:tag",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-        }
+        db := st.db
         var found=false;
         search_tag:=img_name_tag(c.Param("tag"))
-        n_records,err:=search_notes(db,db_folder,search_tag )
+        n_records,err:=search_notes_raw(db,st,search_tag )
         
         if err ==nil{
             for _,record:=range(n_records){
@@ -4418,11 +12304,7 @@ func main(){
     })
 
     r.POST("/image_cname",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.String(http.StatusOK,"?? error open db")
-        }
+        db := st.db
         
         tag :=img_name_tag(c.PostForm("tag"))
         name :=c.PostForm("new_name")
@@ -4439,11 +12321,7 @@ func main(){
     });
 
     r.GET("/track/:tag",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-        }
+        db := st.db
         
         tag :=img_name_tag(c.Param("tag"))
         app,app_tag,err := resource_link_read(db,tag)
@@ -4455,35 +12333,36 @@ func main(){
             if err !=nil{
                 c.Redirect(http.StatusTemporaryRedirect,"/error/1")
             }
-            record_rel_path:=""
-            if sys_delim()=="\\"{
-                record_rel_path =strings.ReplaceAll(record.File_dir+record.File_name,"/","\\")
-            }else{
-                record_rel_path=record.File_dir+record.File_name
-            }
-            fnode,err:=get_Fnode(root_dir+record_rel_path,false)
+            link,err:=note_list_link(roots,record.File_dir,record.File_name)
             if err !=nil{
                 c.Redirect(http.StatusTemporaryRedirect,"/error/2")
             }
-            active_ino :=strconv.FormatUint(uint64(fnode.Dev),10)+"_"+strconv.FormatUint(fnode.Ino,10)
-            parent_ino :=strconv.FormatUint(uint64(fnode.Dev),10)+"_"+strconv.FormatUint(fnode.Parent_ino,10)
-            c.Redirect(http.StatusTemporaryRedirect,"/list/"+parent_ino+"&"+active_ino)
+            c.Redirect(http.StatusTemporaryRedirect,link)
         }else if app==2{
             c.Redirect(http.StatusTemporaryRedirect,"/show_article/"+app_tag)
+        }else if app==3{
+            // only the history of a note shows it
+            var note_tag string
+            err = db.QueryRow("select tag from note_revision where rev_tag=?",app_tag).Scan(&note_tag)
+            if err !=nil{
+                c.Redirect(http.StatusTemporaryRedirect,"/error/2")
+                return
+            }
+            c.Redirect(http.StatusTemporaryRedirect,"/note_history/"+note_tag)
         }else{
             c.Redirect(http.StatusTemporaryRedirect,"/error/2")
         }
     });
 
     r.GET("/clear/:tag",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
+        tag :=img_name_tag(c.Param("tag"))
+        u,err:=st.begin()
         if err !=nil{
-            c.String(http.StatusOK,"?? error open db"+err.Error())
+            c.String(http.StatusOK,"?? Data base error:"+err.Error())
+            return
         }
-
-        tag :=img_name_tag(c.Param("tag"))
-        ok,err:=resource_delete(db,tag,db_folder)
+        ok,err:=resource_delete(u,tag)
+        err=u.finish(err)
         if err !=nil{
             c.String(http.StatusOK,"?? Data base error:"+err.Error())
             return
@@ -4498,13 +12377,6 @@ func main(){
     //====================== NOTES HANDLE ======================
     r.POST("/add_note/:ino",func(c *gin.Context){
         // posting: 'ino_id' : ino_id,'tag': item_value, 'note':tinyMCE.get('note_content').getContent(),'color': color_code}
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.String(http.StatusOK,"?? error open db")
-            return
-        }
-
         ok,err:=regexp.MatchString(`\d+_\d+`,c.PostForm("ino_id"))
 
         if err!=nil{
@@ -4518,9 +12390,17 @@ func main(){
         pairs:=strings.Split(c.PostForm("ino_id"),"_")
         note:=c.PostForm("note")
         color:=c.PostForm("color")
+        format,_:=strconv.Atoi(c.PostForm("format"))
         device_id := pairs[0]
         ino:=pairs[1]
-        tag,err :=add_note(db,"virtual",device_id,ino,note,color,root_dir,db_folder)
+        fp := note_fingerprint(st.db,roots,device_id,ino)
+        u,err :=st.begin()
+        if err !=nil{
+            c.String(http.StatusOK,"??error adding note-code")
+            return
+        }
+        tag,err :=add_note(u,"virtual",device_id,ino,note,format,color,roots,fp)
+        err =u.finish(err)
         
         if err !=nil{
             c.String(http.StatusOK,"??error adding note-code")
@@ -4532,13 +12412,38 @@ func main(){
 
     });
 
-    r.GET("/del_note/:ino",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
+    // the text a new note on the file starts with, from the template of the file
+    r.GET("/add_note/:ino",func(c *gin.Context){
+        db := st.db
+        device_id,ino,err:=dev_ino_uint64(c.Param("ino"))
+        if err !=nil{
+            c.String(http.StatusOK,"??query error")
+            return
+        }
+        url,err := file_url(db,device_id,ino,100,sys_delim())
         if err !=nil{
-            c.String(http.StatusOK,"?? error open db")
+            c.String(http.StatusOK,"??error, getting file_url failed")
+            return
+        }
+        rel_path := strings.ReplaceAll(roots.rel(url),sys_delim(),"/")
+        record,found,err := note_template_for(db,rel_path)
+        if err !=nil{
+            c.String(http.StatusOK,"??Data base error:"+err.Error())
             return
         }
+        if !found{
+            c.JSON(http.StatusOK,gin.H{"name":""})
+            return
+        }
+        c.JSON(http.StatusOK,gin.H{
+            "name":record.Name,
+            "format":record.Format,
+            "note":note_template_fill(record,rel_path,host_name),
+        })
+    });
+
+    r.GET("/del_note/:ino",func(c *gin.Context){
+        db := st.db
         
         if strings.Contains(c.Param("ino"),"_"){
             pair:=strings.Split(c.Param("ino"),"_")
@@ -4548,11 +12453,15 @@ func main(){
             if err !=nil{
                 c.String(http.StatusOK,"??unable to find file")
             }
-            rel_url := relative_path_of(url,root_dir)
+            rel_url := roots.rel(url)
             file_dir := path_dir_name(rel_url,"/")
             file_name := path_file_name(rel_url,"/")
 
-            _,err = del_note(db, file_dir,file_name,db_folder)
+            u,err :=st.begin()
+            if err ==nil{
+                _,err = del_note(u, file_dir,file_name)
+                err = u.finish(err)
+            }
             if err!=nil{
                 c.String(http.StatusOK,"??del note failed")
             }else{
@@ -4560,7 +12469,11 @@ func main(){
             }
         }else{
             tag :=c.Param("ino")
-            _,err :=del_note_by_tag(db,tag,db_folder)
+            u,err :=st.begin()
+            if err ==nil{
+                _,err =del_note_by_tag(u,tag)
+                err = u.finish(err)
+            }
             if err!=nil{
                 c.String(http.StatusOK,"??del note failed")
             }else{
@@ -4571,19 +12484,19 @@ func main(){
 
     r.POST("/edit_note/:tag",func(c *gin.Context){
        // posting {'ino_id' : ino_id,'tag': item_value, 'note':tinyMCE.get('note_content').getContent(),'color': color_code}
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.String(http.StatusOK,"?? error open db")
-            return
-        }
-        
         tag :=c.PostForm("tag")
         note :=c.PostForm("note")
         color :=c.PostForm("color")
-        ok,err:=edit_note(db,tag,note,color,db_folder)
+        u,err :=st.begin()
+        if err !=nil{
+            c.String(http.StatusOK,"??update note error")
+            return
+        }
+        ok,err:=edit_note(u,tag,note,color)
+        err =u.finish(err)
         if err !=nil{
             c.String(http.StatusOK,"??update note error")
+            return
         }
         if !ok{
             c.String(http.StatusOK,"??update note failed")
@@ -4591,14 +12504,162 @@ func main(){
         c.String(http.StatusOK,"!!"+tag)
     });
 
-    // handling rename
-    r.POST("/rename/:ino",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
+    // the saved texts of a note, a and b are the rvid to compare, 0 is the current text
+    r.GET("/note_history/:tag",func(c *gin.Context){
+        db := st.db
+        tag := c.Param("tag")
+        record,err := get_note_by_tag(db,tag)
+        if err !=nil{
+            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
+            return
+        }
+        revisions,err := note_revisions(db,tag)
+        if err !=nil{
+            c.String(http.StatusOK,"??Data base error:"+err.Error())
+            return
+        }
+        var a,b int64
+        if len(revisions)>0{
+            a = revisions[0].Rvid
+        }
+        if c.Query("a") !=""{
+            a,_ = strconv.ParseInt(c.Query("a"),10,64)
+        }
+        if c.Query("b") !=""{
+            b,_ = strconv.ParseInt(c.Query("b"),10,64)
+        }
+        diff := ""
+        if len(revisions)>0{
+            old_text,err := note_version_text(db,st,tag,a)
+            if err !=nil{
+                c.String(http.StatusOK,"??revision "+strconv.FormatInt(a,10)+":"+err.Error())
+                return
+            }
+            new_text,err := note_version_text(db,st,tag,b)
+            if err !=nil{
+                c.String(http.StatusOK,"??revision "+strconv.FormatInt(b,10)+":"+err.Error())
+                return
+            }
+            diff = html_diff(old_text,new_text)
+        }
+        link,err := note_list_link(roots,record.File_dir,record.File_name)
+        if err !=nil{
+            link = ""
+        }
+        c.HTML(http.StatusOK,"note_history.html",gin.H{
+            "wrap_class":get_page_wrap_class(db,get_host_name()),
+            "tag":tag,
+            "path":record.File_dir+record.File_name,
+            "link":link,
+            "versions":note_versions(revisions),
+            "a":a,
+            "b":b,
+            "diff":diff,
+            "history":len(revisions)>0,
+        })
+    });
+
+    r.POST("/note_restore",func(c *gin.Context){
+        rvid,err := strconv.ParseInt(c.PostForm("rvid"),10,64)
+        if err !=nil{
+            c.String(http.StatusOK,"??bad revision")
+            return
+        }
+        u,err :=st.begin()
+        if err !=nil{
+            c.String(http.StatusOK,"??Data base error:"+err.Error())
+            return
+        }
+        tag,missing,err := restore_note_revision(u,rvid)
+        err =u.finish(err)
+        if err !=nil{
+            c.String(http.StatusOK,"??restore failed:"+err.Error())
+            return
+        }
+        // the images that could not come back follow the tag
+        c.String(http.StatusOK,"!!"+tag+"|"+strings.Join(missing,","))
+    });
+
+    // all the notes on the file of the note, with the replies
+    r.GET("/note_thread/:tag",func(c *gin.Context){
+        db := st.db
+        record,err := get_note_by_tag(db,c.Param("tag"))
+        if err !=nil{
+            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
+            return
+        }
+        records,err := file_notes(db,st,record.File_dir,record.File_name)
+        if err ==nil{
+            err = note_anchors(db,records)
+        }
+        if err !=nil{
+            c.String(http.StatusOK,"??Data base error:"+err.Error())
+            return
+        }
+        link,err := note_list_link(roots,record.File_dir,record.File_name)
+        if err !=nil{
+            link = ""
+        }
+        backlinks,err := file_backlinks(db,roots,record.File_dir,record.File_name)
+        if err !=nil{
+            c.String(http.StatusOK,"??Data base error:"+err.Error())
+            return
+        }
+        c.HTML(http.StatusOK,"note_thread.html",gin.H{
+            "backlinks":backlinks,
+            "wrap_class":get_page_wrap_class(db,get_host_name()),
+            "tag":record.Tag,
+            "path":record.File_dir+record.File_name,
+            "link":link,
+            "threads":note_threads(records),
+        })
+    });
+
+    // a new note on the file of the note `tag`, a reply when parent is given
+    r.POST("/thread_note",func(c *gin.Context){
+        u,err :=st.begin()
+        if err !=nil{
+            c.String(http.StatusOK,"??Data base error:"+err.Error())
+            return
+        }
+        format,_ := strconv.Atoi(c.PostForm("format"))
+        tag,err := add_thread_note(u,c.PostForm("tag"),c.PostForm("parent"),c.PostForm("note"),format,c.PostForm("color"))
+        err =u.finish(err)
+        if err !=nil{
+            c.String(http.StatusOK,"??adding note failed:"+err.Error())
+            return
+        }
+        c.String(http.StatusOK,"!!"+tag)
+    });
+
+    // posting {tag, format: 0 html, 1 markdown}
+    r.POST("/note_format",func(c *gin.Context){
+        tag := c.PostForm("tag")
+        format,_ := strconv.Atoi(c.PostForm("format"))
+        if format !=text_format_html && format !=text_format_markdown{
+            c.String(http.StatusOK,"??bad format")
+            return
+        }
+        u,err :=st.begin()
+        if err ==nil{
+            err = note_convert(u,tag,format)
+            err = u.finish(err)
+        }
         if err !=nil{
-            c.String(http.StatusOK,"?? error open db")
+            c.String(http.StatusOK,"??converting failed:"+err.Error())
             return
         }
+        c.String(http.StatusOK,"!!"+tag)
+    });
+
+    // posting {text}, the preview of a markdown note, in the same html as the saved one
+    r.POST("/markdown_html",func(c *gin.Context){
+        c.String(http.StatusOK,markdown_html(c.PostForm("text")))
+    });
+
+    // handling rename
+    r.POST("/rename/:ino",func(c *gin.Context){
+        db := st.db
          
         dev_ino:=c.PostForm("ino_id")
         // filter out illegal signs in the new file name
@@ -4618,12 +12679,12 @@ func main(){
             return
         }
 
-        _,err=file_rename(db,old_url,new_name,root_dir)
+        _,err=file_rename(db,old_url,new_name,roots)
         if err !=nil{
             c.String(http.StatusOK,"??rename_error:"+err.Error())
             return 
         }
-        _,err = shortcut_rename_file(db,old_url,new_name,root_dir )
+        _,err = shortcut_rename_file(db,old_url,new_name,roots )
         if err !=nil{
             c.String(http.StatusOK,"??shortcut_rename_error:"+err.Error())
             return
@@ -4633,12 +12694,7 @@ func main(){
 
     // handling rename_folder
     r.POST("/rename_folder",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.String(http.StatusOK,"??error opening database file")
-            return
-        }
+        db := st.db
          
         dev_ino:=c.PostForm("ino_id")
         reg := regexp.MustCompile(`[\*\.\?<>:"]`)
@@ -4655,25 +12711,44 @@ func main(){
             c.String(http.StatusOK,"??getting file_url error")
             return 
         }
-        new_url,err:=folder_rename(db,old_url,new_name ,root_dir)
+        new_url,err:=folder_rename(db,old_url,new_name ,roots)
         if err !=nil{
             fmt.Printf("error:%q\n",err)
             c.String(http.StatusOK,"??parsing error")
             return
         }
-        // db_link *sql.DB,old_url string, new_name string,root_dir string
-        shortcut_rename_folder(db,old_url,new_name ,root_dir,false)
+        // db_link Db_link,old_url string, new_name string,root_dir string
+        shortcut_rename_folder(db,old_url,new_name ,roots,false)
         c.String(http.StatusOK,"!!"+new_url)        
 
     })
 
     r.GET("/file_notes/:page",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-        }
+        db := st.db
                 
+        all_labels,_ := list_labels(db)
+        if c.Query("label") !=""{
+            // the notes of a label are on one page
+            lid,_ := strconv.ParseInt(c.Query("label"),10,64)
+            notes,err := label_notes(db,st,lid)
+            if err ==nil{
+                err = fill_note_labels(db,notes)
+            }
+            if err !=nil{
+                c.HTML(http.StatusOK,"error.html",gin.H{
+                    "error_msg":err.Error(),
+                })
+                return
+            }
+            c.HTML(http.StatusOK,"notes.html",gin.H{
+                "notes":notes,
+                "page_bar":"",
+                "wrap_class":get_page_wrap_class(db,host_name),
+                "all_labels":all_labels,
+                "label":c.Query("label"),
+            })
+            return
+        }
         page,_ :=strconv.Atoi(c.Param("page"))
         page_len := get_notes_page_len(db)
         cnt,err := notes_count(db)
@@ -4685,10 +12760,12 @@ func main(){
             err_msg="count note error"
            
         }else{
-            all_notes,err =list_notes(db, page_len,page,db_folder)
+            all_notes,err =list_notes(db, page_len,page,st)
             if err !=nil{
                 has_err =true
                 err_msg +=" can't find note"
+            }else{
+                fill_note_labels(db,all_notes)
             }
         }
 
@@ -4707,46 +12784,121 @@ func main(){
                 "notes":all_notes,
                 "page_bar":draw_page_bar(page_count,page,"background-color:#1E9FFF","/file_notes/"),
                 "wrap_class":get_page_wrap_class(db,host_name),
+                "all_labels":all_labels,
             })
         }
     });
 
     r.GET("/orphan_notes",func(c *gin.Context){
-        // func (db_link *sql.DB,db_folder string,root_dir string)([]Note_record,error){
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-        }
+        // func (db_link Db_link,db_folder string,root_dir string)([]Note_record,error){
+        db := st.db
 
-        notes,err := orphan_notes(db,db_folder,root_dir)
+        notes,err := orphan_notes(db,st,roots)
         if err !=nil{
             c.Redirect(http.StatusTemporaryRedirect,"/error/1")
         }
+        all_labels,_ := list_labels(db)
 
         c.HTML(http.StatusOK,"note_orphans.html",gin.H{
             "notes":notes,
             "page_bar":"",
             "wrap_class":get_page_wrap_class(db,host_name),
+            "all_labels":all_labels,
         })    
     });
 
-    r.POST("/search_note",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
+    // the files the orphan notes may belong to, for a review
+    r.GET("/reattach",func(c *gin.Context){
+        db := st.db
+        matches,err := reattach_matches(db,roots)
         if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
+            c.HTML(http.StatusOK,"error.html",gin.H{
+                "error_msg":err.Error(),
+            })
+            return
+        }
+        c.HTML(http.StatusOK,"note_reattach.html",gin.H{
+            "matches":matches,
+            "reattach_auto":get_reattach_auto(db),
+            "wrap_class":get_page_wrap_class(db,host_name),
+        })
+    });
+
+    // posting {pairs: [[old path, new path],...] in json}, or {sure: 1} for the matches of confidence 100
+    r.POST("/reattach",func(c *gin.Context){
+        var result Reattach_result
+        var err error
+        if c.PostForm("sure")=="1"{
+            result,err = reattach_sure(st,roots)
+        }else{
+            var pairs [][2]string
+            err = json.Unmarshal([]byte(c.PostForm("pairs")),&pairs)
+            if err !=nil{
+                c.String(http.StatusOK,"??bad pairs:"+err.Error())
+                return
+            }
+            var u *Unit
+            u,err = st.begin()
+            if err ==nil{
+                for _,pair :=range(pairs){
+                    err = reattach(u,roots,pair[0],pair[1],&result)
+                    if err !=nil{
+                        break
+                    }
+                }
+                err = u.finish(err)
+            }
+        }
+        if err !=nil{
+            c.String(http.StatusOK,"??nothing changed, "+err.Error())
+            return
+        }
+        c.String(http.StatusOK,"!!"+result.String())
+    });
+
+    r.GET("/search",func(c *gin.Context){
+        db := st.db
+        target := c.Query("q")
+        filter := Search_filter{From:c.Query("from"),To:c.Query("to"),Folder:c.Query("folder"),Ext:c.Query("ext")}
+        if kind := c.Query("kind");kind !=""{
+            filter.Kinds = []string{kind}
+        }
+        filter.Color,_ = strconv.Atoi(c.Query("color"))
+        results,err := unified_search(db,st,host_name,roots,target,filter)
+        if err !=nil{
+            c.HTML(http.StatusOK,"error.html",gin.H{
+                "error_msg":err.Error(),
+            })
             return
         }
+        c.HTML(http.StatusOK,"search.html",gin.H{
+            "results":results,
+            "q":target,
+            "kind":c.Query("kind"),
+            "color":c.Query("color"),
+            "from":filter.From,
+            "to":filter.To,
+            "folder":filter.Folder,
+            "ext":filter.Ext,
+            "wrap_class":get_page_wrap_class(db,host_name),
+        })
+    });
+
+    r.POST("/search_note",func(c *gin.Context){
+        db := st.db
         
         target := c.PostForm("target")
-        all_notes,err :=search_notes(db,db_folder,target)
+        all_notes,err :=search_notes(db,st,target)
+        all_labels,_ := list_labels(db)
+        fill_note_labels(db,all_notes)
         if err !=nil{
             if err.Error()=="no record"{
                 c.HTML(http.StatusOK,"notes.html",gin.H{
                     "notes":all_notes,
                     "page_bar":"",
                     "wrap_class":get_page_wrap_class(db,host_name),
+                    "all_labels":all_labels,
+                    "q":target,
                 })
             }else{
                 c.HTML(http.StatusOK,"error.html",gin.H{
@@ -4758,17 +12910,14 @@ func main(){
                 "notes":all_notes,
                 "page_bar":"",
                 "wrap_class":get_page_wrap_class(db,host_name),
+                "all_labels":all_labels,
+                "q":target,
             })
         }
     });
 
     r.POST("/retrace_note",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.String(http.StatusOK,"?? open db failed")
-            return
-        }
+        db := st.db
 
         file_name:=c.PostForm("file_name")
         fnodes,err := search_fnodes(db,host_name,file_name)
@@ -4779,22 +12928,17 @@ func main(){
         result:=""
         for _,fnode:=range(fnodes){
             result = result+"<p><input type='radio'  name='dev_ino' value='"
-            result = result+strconv.FormatUint(uint64(fnode.Dev),10)+"_"+strconv.FormatUint(fnode.Ino,10)+"' />"+fnode.Name+"</p>\n"
+            result = result+strconv.FormatUint(fnode.Dev,10)+"_"+strconv.FormatUint(fnode.Ino,10)+"' />"+fnode.Name+"</p>\n"
         }
         c.String(http.StatusOK,"!!"+result)
     })
 
     r.POST("/assign_note",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.String(http.StatusOK,"?? open db failed")
-            return
-        }
+        db := st.db
 
         note_tag:=c.PostForm("note_tag")
         dev_ino :=c.PostForm("dev_ino")
-        _,err:=assign_note(db,note_tag,dev_ino,root_dir)
+        _,err:=assign_note(db,note_tag,dev_ino,roots)
         if err!=nil{
             c.String(http.StatusOK,"?? error operating database")
             return
@@ -4803,14 +12947,77 @@ func main(){
         c.String(http.StatusOK,"!!Done")
     })
 
-    // ============== handle article =======================
-    r.POST("/new_article",func(c *gin.Context){  
-        db, err := get_db(db_file)
-        defer db.Close()
+    // posting {action: color, labels, move, export or delete; tags: "tag1,tag2", or the query
+    // of the list: all, orphans, q, label, color; set_color; add_lids, del_lids: "1,3"; folder}
+    r.POST("/bulk_notes",func(c *gin.Context){
+        db := st.db
+        var tags []string
+        for _,tag :=range(strings.Split(c.PostForm("tags"),",")){
+            if strings.TrimSpace(tag) !=""{
+                tags = append(tags,strings.TrimSpace(tag))
+            }
+        }
+        query := Bulk_query{All:c.PostForm("all")=="1",Orphans:c.PostForm("orphans")=="1",Q:strings.TrimSpace(c.PostForm("q"))}
+        query.Label,_ = strconv.ParseInt(c.PostForm("label"),10,64)
+        query.Color,_ = strconv.Atoi(c.PostForm("color"))
+        action := c.PostForm("action")
+        if action =="export"{
+            notes,err := bulk_pick(db,roots,tags,query)
+            if err !=nil{
+                c.String(http.StatusOK,"??"+err.Error())
+                return
+            }
+            var note_tags = []string{}
+            for _,record :=range(notes){
+                note_tags = append(note_tags,record.Tag)
+            }
+            name := "filegai_notes_"+strings.NewReplacer("-","",":",""," ","_").Replace(get_now_string())+".zip"
+            c.Header("Content-Type","application/zip")
+            c.Header("Content-Disposition","attachment; filename="+name)
+            _,err = export_archive(st,c.Writer,note_tags)
+            if err !=nil{
+                fmt.Println("?? export failed:"+err.Error())
+            }
+            return
+        }
+        var result Bulk_result
+        var notes []Note_record
+        u,err :=st.begin()
+        if err ==nil{
+            notes,err = bulk_pick(u.tx,roots,tags,query)
+        }
+        if err ==nil{
+            switch action{
+            case "color":
+                set_color,_ := strconv.Atoi(c.PostForm("set_color"))
+                if set_color <1 || set_color >7{
+                    err = errors.New("bad color")
+                }else{
+                    result,err = bulk_color(u,notes,set_color)
+                }
+            case "labels":
+                result,err = bulk_labels(u,notes,lids_parse(c.PostForm("add_lids")),lids_parse(c.PostForm("del_lids")))
+            case "move":
+                result,err = bulk_move(u,notes,c.PostForm("folder"),roots)
+            case "delete":
+                result,err = bulk_delete(u,notes)
+            default:
+                err = errors.New("bad action")
+            }
+        }
+        if u !=nil{
+            err = u.finish(err)
+        }
         if err !=nil{
-            c.String(http.StatusOK,"?? open db failed:"+err.Error())
+            c.String(http.StatusOK,"??nothing changed, "+err.Error())
             return
         }
+        c.String(http.StatusOK,"!!"+result.String())
+    })
+
+    // ============== handle article =======================
+    r.POST("/new_article",func(c *gin.Context){  
+        db := st.db
         title := c.PostForm("title")
         color := c.PostForm("color")
         shelf_id := c.PostForm("shelf_id")
@@ -4824,17 +13031,12 @@ func main(){
     });
 
     r.POST("/edit_article",func(c *gin.Context){  
-        db, err := get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.String(http.StatusOK,"?? open db failed:"+err.Error())
-            return
-        }
+        db := st.db
         tag :=  c.PostForm("tag")
         title := c.PostForm("title")
         color := c.PostForm("color")
         shelf_id := c.PostForm("shelf_id")
-        _,err=update_article(db,tag,title,color,shelf_id)
+        _,err:=update_article(db,tag,title,color,shelf_id)
         if err !=nil{
             c.String(http.StatusOK,"?? error"+err.Error())
             return
@@ -4844,14 +13046,11 @@ func main(){
 
     r.POST("/del_article",func(c *gin.Context){ 
         tag := c.PostForm("tag")
-        db, err := get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.String(http.StatusOK,"?? open db failed:"+err.Error())
-            return
+        u,err:=st.begin()
+        if err ==nil{
+            _,err=del_article(u,tag)
+            err=u.finish(err)
         }
-
-        _,err=del_article(db,tag,db_folder)
         if err!=nil{
             fmt.Println("?? error deleting article:"+err.Error())
             c.String(http.StatusOK,"?? error deleting article:"+err.Error())
@@ -4860,38 +13059,44 @@ func main(){
     });
 
     r.GET("/articles/:page",func(c *gin.Context){ 
-        db, err := get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-        }
+        db := st.db
 
         page,err :=strconv.Atoi(c.Param("page"))
         if err!=nil{
             page =1
         }
         page_len := get_article_list_len(db)
-        articles,err:=list_articles(db,page,page_len)
+        var articles []Article_record
+        page_bar := ""
+        if c.Query("label") !=""{
+            // the articles of a label are on one page
+            lid,_ := strconv.ParseInt(c.Query("label"),10,64)
+            articles,err=label_articles(db,lid)
+        }else{
+            articles,err=list_articles(db,page,page_len)
+            cnt,_ :=count_articles(db)
+            page_bar = draw_page_bar(calc_pages(cnt, page_len),page,"background-color:#1E9FFF","/list_image/")
+        }
+        if err ==nil{
+            err = fill_article_labels(db,articles)
+        }
         if err !=nil{
             c.Redirect(http.StatusTemporaryRedirect,"/error/1")
             return
         }
-        cnt,_ :=count_articles(db)
-        page_count := calc_pages(cnt, page_len)
+        all_labels,_ := list_labels(db)
         c.HTML(http.StatusOK,"articles.html",gin.H{
             "articles":articles,
-            "page_bar":draw_page_bar(page_count,page,"background-color:#1E9FFF","/list_image/"),
+            "page_bar":page_bar,
             "wrap_class":get_page_wrap_class(db,host_name),
+            "all_labels":all_labels,
+            "label":c.Query("label"),
         });
     })
 
     r.GET("/show_article/:tag",func(c *gin.Context){ 
         tag := c.Param("tag")
-        db, err := get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-        }
+        db := st.db
         
         article,err :=get_article_record(db,tag)
         if err !=nil{
@@ -4903,7 +13108,7 @@ func main(){
             return
         }
 
-        pages,err := list_article_pages(db,tag,db_folder)
+        pages,err := list_article_pages(db,tag,st)
         if err !=nil{
             if  err.Error()=="no record"{
                 c.Redirect(http.StatusTemporaryRedirect,"/error/2")
@@ -4913,10 +13118,16 @@ func main(){
             return
         }
         
+        backlinks,err := article_backlinks(db,tag)
+        if err !=nil{
+            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
+            return
+        }
         c.HTML(http.StatusOK,"show_article.html",gin.H{
             "article":article,
             "article_tag":article.Tag,
             "pages":pages,
+            "backlinks":backlinks,
             "wrap_class":get_page_wrap_class(db,host_name),
         });
 
@@ -4924,11 +13135,7 @@ func main(){
 
     r.GET("/show_article_sort/:tag",func(c *gin.Context){ 
         tag := c.Param("tag")
-        db, err := get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-        }
+        db := st.db
         
         article,err :=get_article_record(db,tag)
         if err !=nil{
@@ -4940,7 +13147,7 @@ func main(){
             return
         }
 
-        pages,err := list_article_pages(db,tag,db_folder)
+        pages,err := list_article_pages(db,tag,st)
         if err !=nil{
             if  err.Error()=="no record"{
                 c.Redirect(http.StatusTemporaryRedirect,"/error/2")
@@ -4951,7 +13158,8 @@ func main(){
         }
         max_len := 200
         for i:=0;i<len(pages);i++{
-            pages[i].Data=html_shrink(pages[i].Data,max_len)
+            pages[i].Data=html_shrink(text_html(pages[i].Data,pages[i].Format),max_len)
+            pages[i].Format=text_format_html
         }
         
         c.HTML(http.StatusOK,"article_page_sort.html",gin.H{
@@ -4963,11 +13171,8 @@ func main(){
     });
 
     r.POST("/article_page_sort",func(c *gin.Context){ 
-        db, err := get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.String(http.StatusOK,"?? open db failed")
-        }
+        db := st.db
+        var err error
         order_arr :=strings.Split(c.PostForm("order_str"),";")
         for _,str:=range(order_arr){
             if !strings.Contains(str,":"){
@@ -4984,11 +13189,7 @@ func main(){
     })
 
     r.POST("/search_article",func(c *gin.Context){ 
-        db, err := get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-        }
+        db := st.db
 
         target:=c.PostForm("target")
         articles,err :=search_article(db,target)
@@ -4996,54 +13197,55 @@ func main(){
             fmt.Println("?? error searching article:",err.Error())
             c.Redirect(http.StatusTemporaryRedirect,"/error/1")
         }
+        fill_article_labels(db,articles)
+        all_labels,_ := list_labels(db)
         c.HTML(http.StatusOK,"articles.html",gin.H{
             "articles":articles,
             "page_bar":"",
             "wrap_class":get_page_wrap_class(db,host_name),
+            "all_labels":all_labels,
         });
     })
 
     // handle article pages
     r.GET("/article_page/:tags",func(c *gin.Context){ 
-        db, err := get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-        }
+        db := st.db
 
         tags :=strings.Split(c.Param("tags"),"_")
         tag :=tags[0]
         pg_tag :=tags[1]
         content :=""
+        // a new page is in markdown with ?format=1
+        format,_ :=strconv.Atoi(c.Query("format"))
         if pg_tag !=""{
-            if err !=nil{
-               fmt.Println("?? error getting article page")
-            }
-            _,old_note,err:=get_text(db, db_folder ,pg_tag )
+            _,old_note,err:=get_text(db, st ,pg_tag )
             if err==nil{
                 content=old_note
             }
+            record,err:=get_page_by_pg_tag(db,pg_tag)
+            if err==nil{
+                format=record.Format
+            }
         }
-        article,err :=get_article_record(db,tag)
+        article,_ :=get_article_record(db,tag)
         c.HTML(http.StatusOK,"article_page.html",gin.H{
             "tag":tag,
             "pg_tag":pg_tag,
             "title":article.Title,
             "content":content,
+            "format":format,
             "wrap_class":get_page_wrap_class(db,host_name),
         });
 
     });
     
     r.POST("/del_article_page",func(c *gin.Context){
-        db, err := get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.String(http.StatusOK,"?? open db failed")
-        }
-
         pg_tag :=c.PostForm("pg_tag")
-        _,err=del_article_page(db,pg_tag,db_folder)
+        u,err:=st.begin()
+        if err ==nil{
+            _,err=del_article_page(u,pg_tag)
+            err=u.finish(err)
+        }
         if err!=nil{
             c.String(http.StatusOK,"?? error msg:"+err.Error())
             return
@@ -5053,16 +13255,15 @@ func main(){
     });
 
     r.POST("/article_page_add",func(c *gin.Context){
-        db, err := get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.String(http.StatusOK,"?? error open the database file")
-            return
-        }
-
         tag:=c.PostForm("tag")
         content :=c.PostForm("content") 
-        pg_tag,err:=add_article_page(db,tag,content,db_folder)
+        format,_ :=strconv.Atoi(c.PostForm("format"))
+        u,err:=st.begin()
+        var pg_tag string
+        if err ==nil{
+            pg_tag,err=add_article_page(u,tag,content,format)
+            err=u.finish(err)
+        }
         if err !=nil{
             fmt.Println("?? error adding page:",err.Error())
             c.String(http.StatusOK,"?? error:"+err.Error())
@@ -5073,16 +13274,13 @@ func main(){
     })
 
     r.POST("/article_page_update",func(c *gin.Context){
-        db, err := get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.String(http.StatusOK,"?? error open the database file")
-            return
-        }
-
         pg_tag:=c.PostForm("pg_tag")
         content :=c.PostForm("content")
-        _,err =edit_article_page(db,pg_tag,content,db_folder)
+        u,err :=st.begin()
+        if err ==nil{
+            _,err =edit_article_page(u,pg_tag,content)
+            err =u.finish(err)
+        }
         if err !=nil{
             fmt.Println("?? error updating page:",err.Error())
             c.String(http.StatusOK,"?? error updating page:"+err.Error())
@@ -5092,16 +13290,33 @@ func main(){
 
     });
 
-    // ================= FILE OPEN =========================
-    r.GET("/show/:dev_ino",func(c *gin.Context){  
-        db, err := get_db(db_file)
-        defer db.Close()
+    // posting {pg_tag, format: 0 html, 1 markdown}
+    r.POST("/article_page_format",func(c *gin.Context){
+        pg_tag :=c.PostForm("pg_tag")
+        format,_ :=strconv.Atoi(c.PostForm("format"))
+        if format !=text_format_html && format !=text_format_markdown{
+            c.String(http.StatusOK,"??bad format")
+            return
+        }
+        u,err :=st.begin()
+        if err ==nil{
+            err =article_page_convert(u,pg_tag,format)
+            err =u.finish(err)
+        }
         if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
+            c.String(http.StatusOK,"?? error converting page:"+err.Error())
+            return
         }
+        c.String(http.StatusOK,"!!"+pg_tag)
+    });
+
+    // ================= FILE OPEN =========================
+    r.GET("/show/:dev_ino",func(c *gin.Context){  
+        db := st.db
         var device_id uint64
         var ino uint64
         var url string
+        anno_tag := "" // the note the file is opened from
 
         if strings.Contains(c.Param("dev_ino"),"_"){
             device_id,ino,err:=dev_ino_uint64(c.Param("dev_ino"))
@@ -5127,18 +13342,44 @@ func main(){
                 c.String(http.StatusOK,"??error,getting note failed")
                 return
             }
-            url= root_dir+note.File_dir+note.File_name
+            url= roots.abs(note.File_dir+note.File_name)
+            anno_tag = tag
         }
         fnode,err :=get_Fnode(url,false)
         if err !=nil{
             c.String(http.StatusOK,"??error,getting note url failed:"+err.Error())
             return
         }
-        device_id =uint64(fnode.Dev)
+        device_id =fnode.Dev
         ino = fnode.Ino
+        if fnode.IsDir{
+            // the note is on the folder
+            c.Redirect(http.StatusTemporaryRedirect,"/list/"+strconv.FormatUint(device_id,10)+"_"+strconv.FormatUint(ino,10))
+            return
+        }
 
         file_ext :=file_suffix(url)
         file_name :=path_file_name(url,sys_delim())
+        // a pdf opens in the viewer unless an opener is set for pdf on this PC,
+        // an annotation or a page always does
+        if file_ext =="pdf"{
+            anchors,err := anchors_map(db,[]string{anno_tag})
+            if err !=nil{
+                c.String(http.StatusOK,"??Data base error:"+err.Error())
+                return
+            }
+            page,_ := strconv.Atoi(c.Query("page"))
+            if anchors[anno_tag].Page >0 || page >0 || get_host_setting(db,host_name,"pdf_opener","")==""{
+                view := "/pdf_view/"+strconv.FormatUint(device_id,10)+"_"+strconv.FormatUint(ino,10)
+                if anchors[anno_tag].Page >0{
+                    view += "?anno="+anno_tag
+                }else if page >0{
+                    view += "?page="+strconv.Itoa(page)
+                }
+                c.Redirect(http.StatusTemporaryRedirect,view)
+                return
+            }
+        }
         opener :=get_host_opener(db,file_ext)
         if opener=="browser"{
             file_handler,err :=os.Open(url)
@@ -5169,62 +13410,253 @@ func main(){
             return
         }
 
-        switch file_ext{
-            
-        case "rb","py","go","c","cpp","h","php","html","pl","cs","asp","erb":
-            file_handler,err :=os.Open(url)
-            defer file_handler.Close()
-            if err!=nil{
-                c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-            }
-            data,err := ioutil.ReadAll(file_handler)
-            if err!=nil{
-                c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-            }
-
-            c.HTML(http.StatusOK,"show_code.html",gin.H{
-                "code_type":file_ext,
-                "code_content":string(data),
-                "file_name":file_name,
-                "wrap_class":get_page_wrap_class(db,host_name),
-            })
-        case "png","jpeg","jpg","bmp","tif","svg","mp3","webp":
-            file_handler,err :=os.Open(url)
-            defer file_handler.Close()
-            if err!=nil{
-                c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-            }
-            data,err := ioutil.ReadAll(file_handler)
-            if err!=nil{
-                c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-            }
-            c.Data(http.StatusOK,ext_to_mime(file_ext),data)
-        default:        
-            file_handler,err :=os.Open(url)
-            defer file_handler.Close()
-            if err!=nil{
-                c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-            }
-            data,err := ioutil.ReadAll(file_handler)
-            if err!=nil{
-                c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-            }
-            c.Header("Content-Type", ext_to_mime(file_ext))
-            c.Header("Content-Disposition","filename="+path_file_name(url,"/"))
-            c.Data(http.StatusOK,ext_to_mime(file_ext),data)                     
+        switch file_ext{
+            
+        case "rb","py","go","c","cpp","h","php","html","pl","cs","asp","erb":
+            file_handler,err :=os.Open(url)
+            defer file_handler.Close()
+            if err!=nil{
+                c.Redirect(http.StatusTemporaryRedirect,"/error/1")
+            }
+            data,err := ioutil.ReadAll(file_handler)
+            if err!=nil{
+                c.Redirect(http.StatusTemporaryRedirect,"/error/1")
+            }
+
+            c.HTML(http.StatusOK,"show_code.html",gin.H{
+                "code_type":file_ext,
+                "code_content":string(data),
+                "file_name":file_name,
+                "wrap_class":get_page_wrap_class(db,host_name),
+            })
+        case "png","jpeg","jpg","bmp","tif","svg","mp3","webp":
+            file_handler,err :=os.Open(url)
+            defer file_handler.Close()
+            if err!=nil{
+                c.Redirect(http.StatusTemporaryRedirect,"/error/1")
+            }
+            data,err := ioutil.ReadAll(file_handler)
+            if err!=nil{
+                c.Redirect(http.StatusTemporaryRedirect,"/error/1")
+            }
+            c.Data(http.StatusOK,ext_to_mime(file_ext),data)
+        default:        
+            file_handler,err :=os.Open(url)
+            defer file_handler.Close()
+            if err!=nil{
+                c.Redirect(http.StatusTemporaryRedirect,"/error/1")
+            }
+            data,err := ioutil.ReadAll(file_handler)
+            if err!=nil{
+                c.Redirect(http.StatusTemporaryRedirect,"/error/1")
+            }
+            c.Header("Content-Type", ext_to_mime(file_ext))
+            c.Header("Content-Disposition","filename="+path_file_name(url,"/"))
+            c.Data(http.StatusOK,ext_to_mime(file_ext),data)                     
+        }
+
+    });
+
+    // ================= pdf annotations =======================
+    // the viewer of a pdf file with its annotations, ?page= or ?anno= (a note tag) to start at
+    r.GET("/pdf_view/:dev_ino",func(c *gin.Context){
+        db := st.db
+        device_id,ino,err:=dev_ino_uint64(c.Param("dev_ino"))
+        if err !=nil{
+            c.String(http.StatusOK,"??query error")
+            return
+        }
+        url,err := file_url(db,device_id,ino,100,sys_delim())
+        if err !=nil{
+            c.String(http.StatusOK,"??error, getting file_url failed")
+            return
+        }
+        rel_path := strings.ReplaceAll(roots.rel(url),sys_delim(),"/")
+        file_dir := path_dir_name(rel_path,"/")
+        file_name := path_file_name(rel_path,"/")
+        annotations,err := file_annotations(db,st,file_dir,file_name)
+        if err !=nil{
+            c.String(http.StatusOK,"??Data base error:"+err.Error())
+            return
+        }
+        page,_ := strconv.Atoi(c.Query("page"))
+        if page <1{
+            page = 1
+        }
+        quote := ""
+        for _,note :=range(annotations){
+            if note.Tag ==c.Query("anno"){
+                page,quote = note.Anchor.Page,note.Anchor.Quote
+            }
+        }
+        link,err := note_list_link(roots,file_dir,file_name)
+        if err !=nil{
+            link = ""
+        }
+        backlinks,err := file_backlinks(db,roots,file_dir,file_name)
+        if err !=nil{
+            c.String(http.StatusOK,"??Data base error:"+err.Error())
+            return
+        }
+        c.HTML(http.StatusOK,"pdf_view.html",gin.H{
+            "backlinks":backlinks,
+            "dev_ino":c.Param("dev_ino"),
+            "file_name":file_name,
+            "path":rel_path,
+            "link":link,
+            "page":page,
+            "anno":c.Query("anno"),
+            "quote":quote,
+            "annotations":annotations,
+        })
+    });
+
+    // the pdf file itself, for the viewer of the browser
+    r.GET("/pdf_file/:dev_ino",func(c *gin.Context){
+        device_id,ino,err:=dev_ino_uint64(c.Param("dev_ino"))
+        if err !=nil{
+            c.String(http.StatusOK,"??query error")
+            return
+        }
+        url,err := file_url(st.db,device_id,ino,100,sys_delim())
+        if err !=nil || file_suffix(url) !="pdf"{
+            c.String(http.StatusOK,"??error, not a pdf file")
+            return
+        }
+        c.File(url)
+    });
+
+    // posting {ino_id, note, format, color, page, quote, rect}, a new annotation of the file
+    r.POST("/annotate",func(c *gin.Context){
+        page,err := strconv.Atoi(c.PostForm("page"))
+        if err !=nil || page <1{
+            c.String(http.StatusOK,"??bad page number")
+            return
+        }
+        rect,err := rect_parse(c.PostForm("rect"))
+        if err !=nil{
+            c.String(http.StatusOK,"??"+err.Error())
+            return
+        }
+        dev_ino := strings.Split(c.PostForm("ino_id"),"_")
+        if len(dev_ino) !=2{
+            c.String(http.StatusOK,"??query format problem")
+            return
+        }
+        format,_ := strconv.Atoi(c.PostForm("format"))
+        fp := note_fingerprint(st.db,roots,dev_ino[0],dev_ino[1])
+        u,err :=st.begin()
+        if err !=nil{
+            c.String(http.StatusOK,"??Data base error:"+err.Error())
+            return
+        }
+        tag,err := add_note(u,host_name,dev_ino[0],dev_ino[1],c.PostForm("note"),format,c.PostForm("color"),roots,fp)
+        if err ==nil{
+            err = anchor_set(u.tx,Note_anchor{Tag:tag,Page:page,Quote:strings.TrimSpace(c.PostForm("quote")),Rect:rect})
+        }
+        err =u.finish(err)
+        if err !=nil{
+            c.String(http.StatusOK,"??adding annotation failed:"+err.Error())
+            return
+        }
+        c.String(http.StatusOK,"!!"+tag)
+    });
+
+    // ================= wiki links =======================
+    // where a [[kind:target]] link goes, the file of a file link is looked for by its ino first
+    r.GET("/wiki/:kind",func(c *gin.Context){
+        db := st.db
+        link := Wiki_link{Kind:c.Param("kind"),Target:c.Query("target")}
+        if link.Kind =="file"{
+            known,err := wiki_links_query(db,"kind='file' and target=? and host_name=? and ino>0",link.Target,host_name)
+            if err ==nil && len(known)>0{
+                link = known[0]
+            }
+        }
+        to,err := wiki_target_link(db,roots,link)
+        if err !=nil{
+            c.String(http.StatusOK,"??broken link [["+link.Kind+":"+link.Target+"]]: "+err.Error())
+            return
+        }
+        c.Redirect(http.StatusTemporaryRedirect,to)
+    });
+
+    // what links to the file or its notes
+    r.GET("/backlinks/:dev_ino",func(c *gin.Context){
+        db := st.db
+        device_id,ino,err:=dev_ino_uint64(c.Param("dev_ino"))
+        if err !=nil{
+            c.String(http.StatusOK,"??query error")
+            return
+        }
+        url,err := file_url(db,device_id,ino,100,sys_delim())
+        if err !=nil{
+            c.String(http.StatusOK,"??error, getting file_url failed")
+            return
+        }
+        rel_path := strings.ReplaceAll(roots.rel(url),sys_delim(),"/")
+        backlinks,err := file_backlinks(db,roots,path_dir_name(rel_path,"/"),path_file_name(rel_path,"/"))
+        if err !=nil{
+            c.String(http.StatusOK,"??Data base error:"+err.Error())
+            return
+        }
+        c.HTML(http.StatusOK,"wiki_links.html",gin.H{
+            "wrap_class":get_page_wrap_class(db,host_name),
+            "title":"Referenced by "+rel_path,
+            "backlinks":backlinks,
+        })
+    });
+
+    r.GET("/wiki_broken",func(c *gin.Context){
+        db := st.db
+        broken,err := wiki_broken(db,roots)
+        if err !=nil{
+            c.String(http.StatusOK,"??Data base error:"+err.Error())
+            return
         }
+        c.HTML(http.StatusOK,"wiki_links.html",gin.H{
+            "wrap_class":get_page_wrap_class(db,host_name),
+            "title":"Broken links",
+            "broken":true,
+            "backlinks":broken,
+        })
+    });
 
+    // posting {tag, page, quote, rect}, moves the note to the anchor; page 0 takes the anchor off
+    r.POST("/anchor_set",func(c *gin.Context){
+        tag := c.PostForm("tag")
+        page,err := strconv.Atoi(c.PostForm("page"))
+        if err !=nil || page <0{
+            c.String(http.StatusOK,"??bad page number")
+            return
+        }
+        rect,err := rect_parse(c.PostForm("rect"))
+        if err !=nil{
+            c.String(http.StatusOK,"??"+err.Error())
+            return
+        }
+        u,err :=st.begin()
+        if err !=nil{
+            c.String(http.StatusOK,"??Data base error:"+err.Error())
+            return
+        }
+        _,err = get_note_by_tag(u.tx,tag)
+        if err ==nil{
+            err = anchor_set(u.tx,Note_anchor{Tag:tag,Page:page,Quote:strings.TrimSpace(c.PostForm("quote")),Rect:rect})
+        }
+        err =u.finish(err)
+        if err !=nil{
+            c.String(http.StatusOK,"??setting the anchor failed:"+err.Error())
+            return
+        }
+        c.String(http.StatusOK,"!!"+tag)
     });
 
     
    
     // ================= shortcut =======================
     r.GET("/add_shortcut/:ino",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.String(http.StatusOK,"?? open db error")
-        }
+        db := st.db
         delim:=sys_delim()
         device_id,ino,err:=dev_ino_uint64(c.Param("ino"))
         if err!=nil{
@@ -5235,7 +13667,7 @@ func main(){
                 c.String(http.StatusOK,"??db error")
             }
             
-            rel_url := relative_path_of(url,root_dir)
+            rel_url := roots.rel(url)
             file_name:= path_file_name(rel_url,delim)
             file_dir:= path_dir_name(rel_url,delim)
             sc_type :="f"
@@ -5257,12 +13689,7 @@ func main(){
 
     r.GET("/del_shortcut/:ino",func(c *gin.Context){
         delim := sys_delim()
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.String(http.StatusOK,"?? open db error")
-            return
-        }
+        db := st.db
         
         device_id,ino,err:=dev_ino_uint64(c.Param("ino"))
         if err!=nil{
@@ -5272,7 +13699,7 @@ func main(){
             if err!=nil{
                 c.String(http.StatusOK,"??db error")
             }
-            rel_url := relative_path_of(url,root_dir)
+            rel_url := roots.rel(url)
             file_name:= path_file_name(rel_url,delim)
             file_dir:= path_dir_name(rel_url,delim)
             sc_type  := "f"
@@ -5293,12 +13720,7 @@ func main(){
     });
 
     r.GET("/del_shortcut_id/:scid",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.String(http.StatusOK,"?? open db error")
-            return
-        }
+        db := st.db
 
         _,err:=del_shortcut_id(db,c.Param("scid"))
         if err !=nil{
@@ -5309,13 +13731,8 @@ func main(){
     })
 
     r.GET("/stash/:ino",func(c *gin.Context){
-        db, err = get_db(db_file)
+        db := st.db
         delim:=sys_delim()
-        defer db.Close()
-        if err !=nil{
-            c.String(http.StatusOK,"?? open db error")
-            return
-        }
  
         device_id,ino,err:=dev_ino_uint64(c.Param("ino"))
         if err!=nil{
@@ -5328,11 +13745,11 @@ func main(){
             c.String(http.StatusOK,"??db error")
             return
         }
-        if url == root_dir{
+        if roots.is_root(url){
             c.String(http.StatusOK,"??root_dir stash is not allowed")
             return
         }
-        rel_url := relative_path_of(url,root_dir)
+        rel_url := roots.rel(url)
         file_name:= path_file_name(rel_url, delim)
         file_dir:= path_dir_name(rel_url, delim)
         sc_type :="s"  // file stash
@@ -5356,13 +13773,7 @@ func main(){
 
     r.GET("/unstash/:ino",func(c *gin.Context){
         delim := sys_delim()
-        db, err = get_db(db_file)
-        defer db.Close()
-
-        if err !=nil{
-            c.String(http.StatusOK,"?? open db error")
-            return
-        }
+        db := st.db
 
         device_id,ino,err:=dev_ino_uint64(c.Param("ino"))
         if err!=nil{
@@ -5372,7 +13783,7 @@ func main(){
             if err!=nil{
                 c.String(http.StatusOK,"??db error")
             }
-            rel_url := relative_path_of(url,root_dir)
+            rel_url := roots.rel(url)
             file_name:= path_file_name(rel_url,delim)
             file_dir:= path_dir_name(rel_url,delim)
             sc_type  := "s"
@@ -5393,11 +13804,7 @@ func main(){
     });
 
     r.GET("/manange_shortcut",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err!=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-        }
+        db := st.db
         pin_files,err := shortcut_list(db,"f")
         if err !=nil && err.Error() !="no record"{
             fmt.Printf("error:%q\n",err)
@@ -5435,11 +13842,7 @@ func main(){
 
     r.GET("/put/:ino",func(c *gin.Context){
         // delim := sys_delim()
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
-        }
+        db := st.db
 
         device_id,ino ,err := dev_ino_uint64(c.Param("ino"))
         if err!=nil{
@@ -5456,8 +13859,11 @@ func main(){
             c.Redirect(http.StatusTemporaryRedirect,"/error/1")
             return 
         }
+        // the native folders, those of a root not served stay as they are kept
         for i:=0;i<len(list_file);i++{
-            list_file[i].File_dir=str_native_delim(root_dir+list_file[i].File_dir)
+            if dir :=roots.abs(list_file[i].File_dir);dir !=""{
+                list_file[i].File_dir=dir
+            }
         }
 
         list_folder,err :=shortcut_list(db,"t")
@@ -5466,13 +13872,14 @@ func main(){
             return 
         }
         for i:=0;i<len(list_folder);i++{
-            list_folder[i].File_dir=str_native_delim(root_dir+list_folder[i].File_dir)
+            if dir :=roots.abs(list_folder[i].File_dir);dir !=""{
+                list_folder[i].File_dir=dir
+            }
         }
 
         c.HTML(http.StatusOK,"put.html",gin.H{
             "list_file":list_file,
             "list_folder":list_folder,
-            "root_dir":root_dir,
             "url":url,
             "dev_ino":c.Param("ino"),
             "wrap_class":get_page_wrap_class(db,host_name),
@@ -5480,16 +13887,11 @@ func main(){
 
     });
     r.POST("/putdown",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.String(http.StatusOK,"?? open db error")
-            return
-        }
+        db := st.db
 
         dev_ino:=c.PostForm("dev_ino")
         scid := c.PostForm("scid")
-        _,err:=stash_putdown(db,scid, dev_ino,root_dir)
+        _,err:=stash_putdown(db,scid, dev_ino,roots)
         if err !=nil{
             fmt.Println("??error:"+err.Error())
             c.String(http.StatusOK,"?? error"+err.Error())
@@ -5499,17 +13901,18 @@ func main(){
     });
 
     r.GET("/rebuild",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
-        if err !=nil{
-            c.String(http.StatusOK,"?? open db error")
-            return
-        }
+        db := st.db
         
-        if _,err:=clear_ino(db,root_dir);err !=nil{
+        var err error
+        for _,root :=range(roots.served()){
+            if _,err=clear_ino(db,root.Dir);err !=nil{
+                break
+            }
+        }
+        if err !=nil{
             c.String(http.StatusOK,"??rebuild error")
         }else{
-            if _, err:=rebuild(db, root_dir); err !=nil{
+            if _, err:=rebuild(db, roots); err !=nil{
                 c.String(http.StatusOK,"??rebuild error")
             }else{
                 c.String(http.StatusOK,"!!Done")
@@ -5517,44 +13920,279 @@ func main(){
         }
     });
 
-    r.GET("/settings",func(c *gin.Context){
-        // c.Redirect(http.StatusTemporaryRedirect,"/error/101")
-        db, err = get_db(db_file)
-        host_name := get_host_name()
-        defer db.Close()
+    // the progress of the index
+    r.GET("/index",func(c *gin.Context){
+        c.JSON(http.StatusOK,ix.status())
+    })
+
+    // posting {full: "1" to read the unchanged folders too}
+    r.POST("/index",func(c *gin.Context){
+        err := ix.start(c.PostForm("full")=="1")
+        if err !=nil{
+            c.String(http.StatusOK,"??"+err.Error())
+            return
+        }
+        c.String(http.StatusOK,"!!started")
+    })
+
+    r.POST("/index_cancel",func(c *gin.Context){
+        if !ix.stop(){
+            c.String(http.StatusOK,"??no index is running")
+            return
+        }
+        c.String(http.StatusOK,"!!canceled")
+    })
+
+    r.GET("/fsck",func(c *gin.Context){
+        report,err := fsck(st,false)
+        if err !=nil{
+            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
+            return
+        }
+        fixable := false
+        for _,issue :=range(report.Issues){
+            if issue.repairable(){
+                fixable = true
+            }
+        }
+        c.HTML(http.StatusOK,"fsck.html",gin.H{
+            "issues":report.Issues,
+            "fixable":fixable,
+        })
+    });
+
+    r.POST("/fsck",func(c *gin.Context){
+        report,err := fsck(st,true)
+        if err !=nil{
+            c.String(http.StatusOK,"?? fsck failed:"+err.Error())
+            return
+        }
+        c.String(http.StatusOK,"!!"+strconv.Itoa(report.fixed_count()))
+    });
+
+    r.POST("/compact",func(c *gin.Context){
+        report,err := compact_blobs(st,get_blob_page_limit(st.db))
+        if err !=nil{
+            c.String(http.StatusOK,"?? compact failed:"+err.Error())
+            return
+        }
+        c.String(http.StatusOK,"!!"+report.String())
+    });
+
+    r.GET("/backup",func(c *gin.Context){
+        records,err := list_backups(db_folder)
+        if err !=nil{
+            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
+            return
+        }
+        c.HTML(http.StatusOK,"backup.html",gin.H{
+            "backups":records,
+            "backup_folder":backup_folder(db_folder),
+            "backup_hours":get_backup_hours(st.db),
+            "backup_keep":get_backup_keep(st.db),
+        })
+    });
+
+    r.POST("/backup",func(c *gin.Context){
+        name,err := backup_now(st)
+        if err ==nil{
+            err = rotate_backups(db_folder,get_backup_keep(st.db))
+        }
+        if err !=nil{
+            c.String(http.StatusOK,"?? backup failed:"+err.Error())
+            return
+        }
+        c.String(http.StatusOK,"!!"+name)
+    });
+
+    r.GET("/export",func(c *gin.Context){
+        name := "filegai_"+strings.NewReplacer("-","",":",""," ","_").Replace(get_now_string())+".zip"
+        c.Header("Content-Type","application/zip")
+        c.Header("Content-Disposition","attachment; filename="+name)
+        _,err := export_archive(st,c.Writer,nil)
+        if err !=nil{
+            // the headers are gone already, the broken zip tells the rest
+            fmt.Println("?? export failed:"+err.Error())
+        }
+    });
+
+    r.POST("/import",func(c *gin.Context){
+        file,err := c.FormFile("file")
+        if err !=nil{
+            c.String(http.StatusOK,"?? no file")
+            return
+        }
+        // each upload has its own file, two imports at once do not mix
+        temp_file,err := ioutil.TempFile(db_folder,"import_*.zip")
+        if err !=nil{
+            c.String(http.StatusOK,"?? upload failed:"+err.Error())
+            return
+        }
+        temp := temp_file.Name()
+        temp_file.Close()
+        err = c.SaveUploadedFile(file,temp)
+        if err !=nil{
+            os.Remove(temp)
+            c.String(http.StatusOK,"?? upload failed:"+err.Error())
+            return
+        }
+        defer os.Remove(temp)
+        result,err := import_archive(st,temp)
+        if err !=nil{
+            c.String(http.StatusOK,"?? import failed:"+err.Error())
+            return
+        }
+        c.String(http.StatusOK,"!!"+result.String())
+    });
+
+    //====================== LABELS ======================
+    r.GET("/labels",func(c *gin.Context){
+        db := st.db
+        labels,err := list_labels(db)
+        if err !=nil{
+            c.String(http.StatusOK,"??Data base error:"+err.Error())
+            return
+        }
+        c.HTML(http.StatusOK,"labels.html",gin.H{
+            "labels":labels,
+            "wrap_class":get_page_wrap_class(db,get_host_name()),
+        })
+    });
+
+    r.POST("/label_add",func(c *gin.Context){
+        lid,err := label_add(st.db,c.PostForm("name"),c.PostForm("color"))
+        if err !=nil{
+            c.String(http.StatusOK,"??"+err.Error())
+            return
+        }
+        c.String(http.StatusOK,"!!"+strconv.FormatInt(lid,10))
+    });
+
+    r.POST("/label_edit",func(c *gin.Context){
+        lid,_ := strconv.ParseInt(c.PostForm("lid"),10,64)
+        err := label_update(st.db,lid,c.PostForm("name"),c.PostForm("color"))
+        if err !=nil{
+            c.String(http.StatusOK,"??"+err.Error())
+            return
+        }
+        c.String(http.StatusOK,"!!"+c.PostForm("lid"))
+    });
+
+    r.POST("/label_merge",func(c *gin.Context){
+        from,_ := strconv.ParseInt(c.PostForm("lid"),10,64)
+        into,_ := strconv.ParseInt(c.PostForm("into"),10,64)
+        u,err :=st.begin()
+        if err ==nil{
+            err = label_merge(u.tx,from,into)
+            err = u.finish(err)
+        }
+        if err !=nil{
+            c.String(http.StatusOK,"??"+err.Error())
+            return
+        }
+        c.String(http.StatusOK,"!!"+c.PostForm("into"))
+    });
+
+    r.POST("/label_del",func(c *gin.Context){
+        lid,_ := strconv.ParseInt(c.PostForm("lid"),10,64)
+        u,err :=st.begin()
+        if err ==nil{
+            err = label_delete(u.tx,lid)
+            err = u.finish(err)
+        }
+        if err !=nil{
+            c.String(http.StatusOK,"??"+err.Error())
+            return
+        }
+        c.String(http.StatusOK,"!!"+c.PostForm("lid"))
+    });
+
+    // posting {app: 1 note, 2 article, 3 file; target: the tag, or dev_ino of the file; lids: "1,3"}
+    r.POST("/label_set",func(c *gin.Context){
+        db := st.db
+        app,_ := strconv.Atoi(c.PostForm("app"))
+        target := c.PostForm("target")
+        switch app{
+        case label_app_note,label_app_article:
+        case label_app_file:
+            device_id,ino,err := dev_ino_uint64(target)
+            if err !=nil{
+                c.String(http.StatusOK,"??bad file:"+target)
+                return
+            }
+            url,err := file_url(db,device_id,ino,100,sys_delim())
+            if err !=nil{
+                c.String(http.StatusOK,"??unable to find file")
+                return
+            }
+            target = roots.rel(url)
+            if sys_delim()=="\\"{
+                target = strings.ReplaceAll(target,"\\","/")
+            }
+        default:
+            c.String(http.StatusOK,"??bad app")
+            return
+        }
+        lids := lids_parse(c.PostForm("lids"))
+        u,err :=st.begin()
+        if err ==nil{
+            err = label_set(u.tx,app,target,lids)
+            err = u.finish(err)
+        }
         if err !=nil{
-            c.String(http.StatusOK,"?? open db error")
+            c.String(http.StatusOK,"??"+err.Error())
             return
         }
+        c.String(http.StatusOK,"!!"+target)
+    });
+
+    r.GET("/settings",func(c *gin.Context){
+        // c.Redirect(http.StatusTemporaryRedirect,"/error/101")
+        db := st.db
+        host_name := get_host_name()
 
         openers,err := enum_host_openers(db,host_name)
         if err!=nil{
             openers=""
         }
+        templates,err := list_note_templates(db)
+        if err !=nil{
+            fmt.Println("?? error listing the note templates:",err.Error())
+        }
 
         c.HTML(http.StatusOK,"settings.html",gin.H{            
             "openers":openers,
+            "templates":templates,
             "wrap_class":get_page_wrap_class(db,host_name),
             "img_page_len":strconv.Itoa(get_img_page_len(db)),
             "notes_page_len":strconv.Itoa(get_notes_page_len(db)),
             "article_list_len":strconv.Itoa(get_article_list_len(db)),
+            "backup_hours":strconv.Itoa(get_backup_hours(db)),
+            "backup_keep":strconv.Itoa(get_backup_keep(db)),
+            "blob_page_mb":strconv.FormatInt(get_blob_page_limit(db)/1000000,10),
+            "note_revision_keep":strconv.Itoa(get_note_revision_keep(db)),
+            "reattach_auto":strconv.Itoa(get_reattach_auto(db)),
+            "index_workers":strconv.Itoa(get_index_workers(db)),
+            "index_hours":strconv.Itoa(get_index_hours(db)),
         });
 
     });
     r.POST("/settings",func(c *gin.Context){
         // c.Redirect(http.StatusTemporaryRedirect,"/error/101")
-        db, err = get_db(db_file)
+        db := st.db
         host_name := get_host_name()
-        defer db.Close()
-        if err !=nil{
-            c.String(http.StatusOK,"?? open db error")
-            return
-        }
 
         set_page_wrap_class(db,host_name,c.PostForm("wrap_class"))
         set_img_page_len(db,c.PostForm("img_page_len"))
         set_notes_page_len(db,c.PostForm("notes_page_len"))
         set_article_list_len(db,c.PostForm("article_list_len"))
+        set_backup_hours(db,c.PostForm("backup_hours"))
+        set_backup_keep(db,c.PostForm("backup_keep"))
+        set_blob_page_mb(db,c.PostForm("blob_page_mb"))
+        set_note_revision_keep(db,c.PostForm("note_revision_keep"))
+        set_reattach_auto(db,c.PostForm("reattach_auto"))
+        set_index_workers(db,c.PostForm("index_workers"))
+        set_index_hours(db,c.PostForm("index_hours"))
         // LIST TO UPDATE
         reg:=regexp.MustCompile(`\s*([\w\d]+)\s*=\s*(\S.*)\s*[\r\n]`)
         opener_list := reg.FindAllStringSubmatch(c.PostForm("openers"),-1)
@@ -5572,12 +14210,33 @@ func main(){
     });
 
 
-    r.GET("/gallery/:ino",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
+    // posting {ntid ("" for a new one), name, format, exts, folder, body}
+    r.POST("/note_template_save",func(c *gin.Context){
+        ntid,_ := strconv.ParseInt(c.PostForm("ntid"),10,64)
+        format,_ := strconv.Atoi(c.PostForm("format"))
+        ntid,err := note_template_save(st.db,Note_template{Ntid:ntid,Name:c.PostForm("name"),Format:format,
+            Exts:c.PostForm("exts"),Folder:c.PostForm("folder"),Body:c.PostForm("body")})
         if err !=nil{
-            c.Redirect(http.StatusTemporaryRedirect,"/error/1")
+            c.String(http.StatusOK,"??saving the template failed:"+err.Error())
+            return
+        }
+        c.String(http.StatusOK,"!!"+strconv.FormatInt(ntid,10))
+    });
+
+    r.POST("/note_template_del",func(c *gin.Context){
+        ntid,err := strconv.ParseInt(c.PostForm("ntid"),10,64)
+        if err ==nil{
+            err = note_template_del(st.db,ntid)
+        }
+        if err !=nil{
+            c.String(http.StatusOK,"??deleting the template failed")
+            return
         }
+        c.String(http.StatusOK,"!!Done")
+    });
+
+    r.GET("/gallery/:ino",func(c *gin.Context){
+        db := st.db
 
         device_id,ino,err:=dev_ino_uint64(c.Param("ino"))
         url,err :=file_url(db,device_id,ino,100,"/")
@@ -5611,15 +14270,6 @@ func main(){
 
 
     r.GET("/error/:no",func(c *gin.Context){
-        db, err = get_db(db_file)
-        defer db.Close()
-
-        if err !=nil{
-            c.HTML(http.StatusOK,"error.html",gin.H{
-                "error_msg":"fatal error failed to open db",
-            })
-            return
-        }
         error_no:=c.Param("no")
         switch error_no{
         case "1":
@@ -5632,7 +14282,7 @@ func main(){
             })
         case "9":
             c.HTML(http.StatusOK,"error.html",gin.H{
-                "error_msg":"the root_dir did not match the one in the database, please check and restart, or you can try <a href='/rebuild'>rebuild the cache</a>",
+                "error_msg":"the folder of a root did not match the one kept in the database for its name, please check the name=folder of the command line and restart, or you can try <a href='/rebuild'>rebuild the cache</a>",
             })
         case "101":
             c.HTML(http.StatusOK,"error.html",gin.H{
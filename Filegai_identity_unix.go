@@ -0,0 +1,31 @@
+// +build !windows
+
+package main
+
+import(
+    "errors"
+    "os"
+    "syscall"
+)
+
+// stat_identity reads the device and the inode from the stat of the file
+type stat_identity struct{}
+
+var file_identity File_identity = stat_identity{}
+
+func (stat_identity) identify(path string,info os.FileInfo)(uint64,uint64,error){
+    stat, ok := info.Sys().(*syscall.Stat_t)
+    if !ok {
+        return 0,0,errors.New("error in geting stat")
+    }
+    return stat_dev(int64(stat.Dev)),uint64(stat.Ino),nil
+}
+
+// stat_dev gives the device of a stat as uint64: it is an int32 on mac and a
+// uint64 on linux, a negative one is taken as the uint32 it was
+func stat_dev(dev int64)uint64{
+    if dev <0{
+        return uint64(uint32(dev))
+    }
+    return uint64(dev)
+}
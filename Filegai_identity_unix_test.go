@@ -0,0 +1,118 @@
+// +build !windows
+
+package main
+
+import(
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "syscall"
+    "testing"
+)
+
+func TestStatDev(t *testing.T){
+    cases := []struct{
+        dev int64
+        want uint64
+    }{
+        {0,0},
+        {16777220,16777220},
+        // a mac device whose int32 went negative
+        {-16777220,4278190076},
+        {-1,4294967295},
+        {int64(int32(-2147483648)),2147483648},
+        // a linux device is a uint64 already
+        {66306,66306},
+    }
+    for _,c :=range(cases){
+        got := stat_dev(c.dev)
+        if got !=c.want{
+            t.Errorf("stat_dev(%d) = %d, want %d",c.dev,got,c.want)
+        }
+    }
+}
+
+func TestStatIdentity(t *testing.T){
+    dir := t.TempDir()
+    path := filepath.Join(dir,"a.txt")
+    if err := ioutil.WriteFile(path,[]byte("a"),0644);err !=nil{
+        t.Fatal(err)
+    }
+    info,err := os.Stat(path)
+    if err !=nil{
+        t.Fatal(err)
+    }
+    dev,ino,err := stat_identity{}.identify(path,info)
+    if err !=nil{
+        t.Fatal(err)
+    }
+    stat := info.Sys().(*syscall.Stat_t)
+    if dev !=stat_dev(int64(stat.Dev)) || ino !=uint64(stat.Ino){
+        t.Errorf("identify gives %d_%d, the stat is %d_%d",dev,ino,stat.Dev,stat.Ino)
+    }
+    // the file is known by the same numbers after a rename
+    moved := filepath.Join(dir,"b.txt")
+    if err = os.Rename(path,moved);err !=nil{
+        t.Fatal(err)
+    }
+    info,err = os.Stat(moved)
+    if err !=nil{
+        t.Fatal(err)
+    }
+    dev2,ino2,err := stat_identity{}.identify(moved,info)
+    if err !=nil || dev2 !=dev || ino2 !=ino{
+        t.Errorf("after the rename identify gives %d_%d (%v), want %d_%d",dev2,ino2,err,dev,ino)
+    }
+}
+
+func TestGetFnode(t *testing.T){
+    dir := t.TempDir()+string(os.PathSeparator)
+    if err := os.Mkdir(dir+"sub",0755);err !=nil{
+        t.Fatal(err)
+    }
+    for _,name :=range([]string{"a.txt",".hidden","sub"+string(os.PathSeparator)+"b.txt"}){
+        if err := ioutil.WriteFile(dir+name,[]byte(name),0644);err !=nil{
+            t.Fatal(err)
+        }
+    }
+    root,err := get_Fnode(dir,true)
+    if err !=nil{
+        t.Fatal(err)
+    }
+    if !root.IsDir || root.Parent_dev !=root.Dev || root.Parent_ino !=root.Ino{
+        t.Errorf("the root is not its own parent folder: %+v",root)
+    }
+    file,err := get_Fnode(dir+"a.txt",false)
+    if err !=nil{
+        t.Fatal(err)
+    }
+    if file.IsDir || file.Name !="a.txt" || file.Size !=5 || file.Parent_ino !=root.Ino || file.Parent_dev !=root.Dev{
+        t.Errorf("get_Fnode of a.txt: %+v",file)
+    }
+    if _,err = get_Fnode(dir+"none",false);err ==nil{
+        t.Errorf("get_Fnode of a missing file gives no error")
+    }
+
+    entries := folder_entries(dir)
+    found := map[string]*Fnode{}
+    for _,node :=range(entries){
+        found[node.Name] = node
+    }
+    if len(entries) !=2 || found["a.txt"] ==nil || found["sub"] ==nil{
+        t.Fatalf("folder_entries gives %d entries, want a.txt and sub without the hidden one",len(entries))
+    }
+    if found["a.txt"].Ino !=file.Ino || found["a.txt"].Dev !=file.Dev || found["a.txt"].Size !=file.Size{
+        t.Errorf("folder_entries and get_Fnode differ on a.txt: %+v %+v",found["a.txt"],file)
+    }
+    sub := found["sub"]
+    if !sub.IsDir || sub.Parent_ino !=root.Ino{
+        t.Errorf("folder_entries of sub: %+v",sub)
+    }
+    inner := folder_entries(dir+"sub")
+    if len(inner) !=1 || inner[0].Name !="b.txt" || inner[0].Parent_ino !=sub.Ino{
+        t.Errorf("folder_entries of sub gives %d entries",len(inner))
+    }
+    if len(folder_entries(dir+"none")) !=0{
+        t.Errorf("folder_entries of a missing folder is not empty")
+    }
+}
@@ -0,0 +1,31 @@
+// +build windows
+
+package main
+
+import(
+    "os"
+    "syscall"
+)
+
+// handle_identity reads the volume serial number and the file index from the
+// file information of a handle, folders are opened with backup semantics
+type handle_identity struct{}
+
+var file_identity File_identity = handle_identity{}
+
+func (handle_identity) identify(path string,info os.FileInfo)(uint64,uint64,error){
+    name, err := syscall.UTF16PtrFromString(path)
+    if err != nil {
+        return 0, 0, err
+    }
+    handle, err := syscall.CreateFile(name,0,syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,nil,syscall.OPEN_EXISTING,syscall.FILE_FLAG_BACKUP_SEMANTICS,0)
+    if err != nil {
+        return 0, 0, err
+    }
+    defer syscall.CloseHandle(handle)
+    var data syscall.ByHandleFileInformation
+    if err = syscall.GetFileInformationByHandle(handle, &data); err != nil {
+        return 0, 0, err
+    }
+    return uint64(data.VolumeSerialNumber), (uint64(data.FileIndexHigh) << 32) | uint64(data.FileIndexLow), nil
+}
@@ -0,0 +1,57 @@
+// +build windows
+
+package main
+
+import(
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestHandleIdentity(t *testing.T){
+    dir := t.TempDir()
+    path := filepath.Join(dir,"a.txt")
+    if err := ioutil.WriteFile(path,[]byte("a"),0644);err !=nil{
+        t.Fatal(err)
+    }
+    info,err := os.Stat(path)
+    if err !=nil{
+        t.Fatal(err)
+    }
+    dev,ino,err := handle_identity{}.identify(path,info)
+    if err !=nil{
+        t.Fatal(err)
+    }
+    if dev ==0 || ino ==0{
+        t.Errorf("identify gives %d_%d",dev,ino)
+    }
+    // a folder is opened too, with backup semantics
+    dir_info,err := os.Stat(dir)
+    if err !=nil{
+        t.Fatal(err)
+    }
+    dir_dev,dir_ino,err := handle_identity{}.identify(dir,dir_info)
+    if err !=nil{
+        t.Fatal(err)
+    }
+    if dir_dev !=dev || dir_ino ==ino{
+        t.Errorf("the folder is %d_%d, its file %d_%d",dir_dev,dir_ino,dev,ino)
+    }
+    // the file is known by the same numbers after a rename
+    moved := filepath.Join(dir,"b.txt")
+    if err = os.Rename(path,moved);err !=nil{
+        t.Fatal(err)
+    }
+    info,err = os.Stat(moved)
+    if err !=nil{
+        t.Fatal(err)
+    }
+    dev2,ino2,err := handle_identity{}.identify(moved,info)
+    if err !=nil || dev2 !=dev || ino2 !=ino{
+        t.Errorf("after the rename identify gives %d_%d (%v), want %d_%d",dev2,ino2,err,dev,ino)
+    }
+    if _,_,err = (handle_identity{}).identify(filepath.Join(dir,"none"),info);err ==nil{
+        t.Errorf("identify of a missing file gives no error")
+    }
+}
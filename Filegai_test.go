@@ -0,0 +1,821 @@
+package main
+
+import(
+    "database/sql"
+    "errors"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+func TestMdUrl(t *testing.T){
+    cases := []struct{
+        dest string
+        want string
+    }{
+        {"https://example.com/a?b=1&c=2","https://example.com/a?b=1&amp;c=2"},
+        {"http://example.com","http://example.com"},
+        {"mailto:someone@example.com","mailto:someone@example.com"},
+        {"/get_image/abcdefghij.png","/get_image/abcdefghij.png"},
+        {"../list/1_2#top","../list/1_2#top"},
+        {"<https://example.com>","https://example.com"},
+        {"  https://example.com  ","https://example.com"},
+        {"javascript:alert(1)","#"},
+        {"JavaScript:alert(1)","#"},
+        {"java\rscript:alert(1)","#"},
+        {"java\nscript:alert(1)","#"},
+        {"java\tscript:alert(1)","#"},
+        {"\x01javascript:alert(1)","#"},
+        {"javascript\x00:alert(1)","#"},
+        {"java script:alert(1)","#"},
+        {"data:text/html,<script>alert(1)</script>","#"},
+        {"vbscript:msgbox(1)","#"},
+        {"file:///etc/passwd","#"},
+    }
+    for _,c :=range(cases){
+        got := md_url(c.dest)
+        if got !=c.want{
+            t.Errorf("md_url(%q) = %q, want %q",c.dest,got,c.want)
+        }
+    }
+}
+
+func TestMarkdownHtmlLinks(t *testing.T){
+    bad := []string{
+        "[x](java\rscript:alert(1))",
+        "[x](\x01javascript:alert(1))",
+        "[x](javascript:alert(1))",
+        "![x](java\rscript:alert(1))",
+        "<javascript:alert(1)>",
+    }
+    for _,src :=range(bad){
+        out := markdown_html(src)
+        lower := strings.ToLower(out)
+        if strings.Contains(lower,`href="java`) || strings.Contains(lower,`src="java`) || strings.Contains(lower,`href="\x01`){
+            t.Errorf("markdown_html(%q) keeps the script link: %s",src,out)
+        }
+    }
+    out := markdown_html("[site](https://example.com)")
+    if !strings.Contains(out,`href="https://example.com"`){
+        t.Errorf("markdown_html drops a web link: %s",out)
+    }
+}
+
+// migrate_to upgrades the Filegai.db of folder up to the version
+func migrate_to(t *testing.T,folder string,version int){
+    all := main_migrations
+    defer func(){ main_migrations = all }()
+    var list []Db_migration
+    for _,m :=range(all){
+        if m.Version <=version{
+            list = append(list,m)
+        }
+    }
+    main_migrations = list
+    if _,err := migrate_file(folder+"Filegai.db",false,folder,folder+"backup_"+strconv.Itoa(version)+string(os.PathSeparator),false);err !=nil{
+        t.Fatalf("migrating to %d: %s",version,err.Error())
+    }
+}
+
+func TestMigrationDeviceIds(t *testing.T){
+    folder := t.TempDir()+string(os.PathSeparator)
+    migrate_to(t,folder,13)
+    db,err := sql.Open("sqlite3",folder+"Filegai.db")
+    if err !=nil{
+        t.Fatal(err)
+    }
+    defer db.Close()
+    // the mac stat gave the devices as int32, note_ino kept them as text
+    _,err = db.Exec(`
+INSERT INTO ino_tree(host_name,device_id,ino,parent_ino,name,type,state) VALUES('mac',-16777220,11,2,'a.pdf','f','a');
+INSERT INTO ino_tree(host_name,device_id,ino,parent_ino,name,type,state) VALUES('mac',16777220,12,2,'b.pdf','f','a');
+INSERT INTO ino_tree(host_name,device_id,ino,parent_ino,name,type,state) VALUES('mac',-1,13,2,'c.pdf','f','a');
+INSERT INTO note_ino(tag,host_name,device_id,ino) VALUES('tag_a','mac','-16777220',11);
+INSERT INTO note_ino(tag,host_name,device_id,ino) VALUES('tag_b','mac','16777220',12);
+INSERT INTO wiki_link(app,app_tag,owner,kind,target,host_name,device_id,ino) VALUES(1,'tag_w','tag_w','file','a.pdf','mac','18446744073692774396',11);
+INSERT INTO wiki_link(app,app_tag,owner,kind,target,host_name,device_id,ino) VALUES(1,'tag_w','tag_w','file','b.pdf','mac','16777220',12);
+INSERT INTO wiki_link(app,app_tag,owner,kind,target,host_name,device_id,ino) VALUES(1,'tag_w','tag_w','file','gone.pdf','mac','18446744073692774396',99);
+`)
+    if err !=nil{
+        t.Fatal(err)
+    }
+    migrate_to(t,folder,14)
+    version,err := get_db_version(db)
+    if err !=nil || version !=14{
+        t.Fatalf("the version is %d (%v), want 14",version,err)
+    }
+    for ino,want :=range(map[int]uint64{11:4278190076,12:16777220,13:4294967295}){
+        var dev uint64
+        var kind string
+        err = db.QueryRow("select device_id,typeof(device_id) from ino_tree where ino=?",ino).Scan(&dev,&kind)
+        if err !=nil{
+            t.Fatal(err)
+        }
+        if dev !=want || kind !="integer"{
+            t.Errorf("ino_tree device of %d is %d (%s), want %d",ino,dev,kind,want)
+        }
+    }
+    for tag,want :=range(map[string]uint64{"tag_a":4278190076,"tag_b":16777220}){
+        var dev uint64
+        var kind string
+        err = db.QueryRow("select device_id,typeof(device_id) from note_ino where tag=?",tag).Scan(&dev,&kind)
+        if err !=nil{
+            t.Fatal(err)
+        }
+        if dev !=want || kind !="integer"{
+            t.Errorf("note_ino device of %s is %d (%s), want %d",tag,dev,kind,want)
+        }
+    }
+    // the note finds its file by the device get_Fnode gives now
+    device_id,ino,err := dev_ino_uint64("4278190076_11")
+    if err !=nil{
+        t.Fatal(err)
+    }
+    var tag string
+    err = db.QueryRow("select tag from note_ino where device_id=? and ino=?",device_id,ino).Scan(&tag)
+    if err !=nil || tag !="tag_a"{
+        t.Errorf("note_ino by the uint64 device gives %q (%v)",tag,err)
+    }
+    // the rest of the migrations run on it, the file links took the uint64 of
+    // the negative int32 which is a REAL now
+    migrate_to(t,folder,main_migrations[len(main_migrations)-1].Version)
+    links,err := wiki_links_query(db,"1=1")
+    if err !=nil{
+        t.Fatalf("wiki_links_query after the migrations: %s",err.Error())
+    }
+    want := map[string][3]interface{}{
+        "a.pdf":{"mac",uint64(4278190076),uint64(11)},
+        "b.pdf":{"mac",uint64(16777220),uint64(12)},
+        // no ino_tree row to take the device from, the link goes by its path
+        "gone.pdf":{"",uint64(0),uint64(0)},
+    }
+    if len(links) !=len(want){
+        t.Fatalf("%d wiki links, want %d",len(links),len(want))
+    }
+    for _,link :=range(links){
+        w := want[link.Target]
+        if link.Host_name !=w[0] || link.Device_id !=w[1] || link.Ino !=w[2]{
+            t.Errorf("wiki link to %s is %s %d_%d, want %v",link.Target,link.Host_name,link.Device_id,link.Ino,w)
+        }
+    }
+    var kind string
+    err = db.QueryRow("select typeof(device_id) from wiki_link where target='a.pdf'").Scan(&kind)
+    if err !=nil || kind !="integer"{
+        t.Errorf("the wiki link device is %s (%v), want integer",kind,err)
+    }
+}
+
+// test_store gives a store on a new database in a temp folder
+func test_store(t *testing.T)*Store{
+    folder := t.TempDir()+string(os.PathSeparator)
+    if _,err := install_db(folder+"Filegai.db");err !=nil{
+        t.Fatal(err)
+    }
+    st,err := open_store(folder)
+    if err !=nil{
+        t.Fatal(err)
+    }
+    t.Cleanup(st.close)
+    return st
+}
+
+func TestDropBlobRetires(t *testing.T){
+    st := test_store(t)
+    if _,err := st.blob("2");err !=nil{
+        t.Fatal(err)
+    }
+    if err := st.drop_blob("2");err !=nil{
+        t.Fatal(err)
+    }
+    if _,err := st.blob("2");err ==nil{
+        t.Errorf("blob gives a handle of a dropped page")
+    }
+    if ok,_ := file_exists(st.blob_file("2"));ok{
+        t.Errorf("the dropped page is made again")
+    }
+    if _,err := st.blob("1");err !=nil{
+        t.Errorf("the other pages are not opened: %s",err.Error())
+    }
+}
+
+func TestMergeDuplicateResources(t *testing.T){
+    folder := t.TempDir()+string(os.PathSeparator)
+    migrate_to(t,folder,2)
+    if _,err := blob_create_file(blob_file_of(folder,1));err !=nil{
+        t.Fatal(err)
+    }
+    blob,err := get_db(blob_file_of(folder,1))
+    if err !=nil{
+        t.Fatal(err)
+    }
+    // imga and imgb are the same bytes, t1 shows both of them
+    blobs := []struct{
+        tag string
+        rs_type int
+        data string
+    }{
+        {"imga",1,"same bytes"},
+        {"imgb",1,"same bytes"},
+        {"imgc",1,"other bytes"},
+        {"t1",33,`<img src="get_image/imga"><img src="get_image/imgb">`},
+        {"t2",33,`<img src="get_image/imgb">`},
+        {"t3",33,`<img src="get_image/imgc">`},
+    }
+    for _,b :=range(blobs){
+        if _,err = blob_save(blob,b.tag,[]byte(b.data),b.rs_type);err !=nil{
+            t.Fatal(err)
+        }
+    }
+    blob.Close()
+    db,err := sql.Open("sqlite3",folder+"Filegai.db")
+    if err !=nil{
+        t.Fatal(err)
+    }
+    defer db.Close()
+    _,err = db.Exec(`
+INSERT INTO resource(page,tag,name,type,rs_date,ref_count) VALUES(1,'imga','a.png',1,'2020-01-01',1);
+INSERT INTO resource(page,tag,name,type,rs_date,ref_count) VALUES(1,'imgb','b.png',1,'2020-01-02',2);
+INSERT INTO resource(page,tag,name,type,rs_date,ref_count) VALUES(1,'imgc','c.png',1,'2020-01-03',1);
+INSERT INTO resource(page,tag,name,type,rs_date,ref_count) VALUES(1,'t1','',33,'2020-01-01',1);
+INSERT INTO resource(page,tag,name,type,rs_date,ref_count) VALUES(1,'t2','',33,'2020-01-01',1);
+INSERT INTO resource(page,tag,name,type,rs_date,ref_count) VALUES(1,'t3','',33,'2020-01-01',1);
+INSERT INTO tags(tag_str) VALUES('imga'),('imgb'),('imgc'),('t1'),('t2'),('t3'),('n1'),('n2'),('n3');
+INSERT INTO file_note(tag,file_dir,file_name,note,ndate,color) VALUES('n1','/d','1.txt','#<0x_t1_>','2020-01-01',0);
+INSERT INTO file_note(tag,file_dir,file_name,note,ndate,color) VALUES('n2','/d','2.txt','#<0x_t2_>','2020-01-01',0);
+INSERT INTO file_note(tag,file_dir,file_name,note,ndate,color) VALUES('n3','/d','3.txt','#<0x_t3_>','2020-01-01',0);
+INSERT INTO resource_link(tag,app,app_tag) VALUES('imga',1,'n1'),('imgb',1,'n1'),('imgb',1,'n2'),('imgc',1,'n3');
+`)
+    if err !=nil{
+        t.Fatal(err)
+    }
+    migrate_to(t,folder,3)
+
+    var count int
+    db.QueryRow("select count(*) from resource where tag='imgb'").Scan(&count)
+    if count !=0{
+        t.Errorf("the duplicate imgb is still a resource")
+    }
+    db.QueryRow("select count(*) from tags where tag_str='imgb'").Scan(&count)
+    if count !=0{
+        t.Errorf("the duplicate imgb is still a tag")
+    }
+    db.QueryRow("select count(*) from resource where type<>33 and hash is null").Scan(&count)
+    if count !=0{
+        t.Errorf("%d resources are not hashed",count)
+    }
+    links := map[string]int{}
+    rows,err := db.Query("select tag,app_tag from resource_link where app=1")
+    if err !=nil{
+        t.Fatal(err)
+    }
+    for rows.Next(){
+        var tag,app_tag string
+        rows.Scan(&tag,&app_tag)
+        links[tag+" "+app_tag]++
+    }
+    rows.Close()
+    want_links := map[string]int{"imga n1":1,"imga n2":1,"imgc n3":1}
+    if len(links) !=len(want_links){
+        t.Errorf("the links are %v, want %v",links,want_links)
+    }
+    for link,n :=range(want_links){
+        if links[link] !=n{
+            t.Errorf("the link %s is there %d times, want %d",link,links[link],n)
+        }
+    }
+    for tag,want :=range(map[string]int{"imga":2,"imgc":1}){
+        var ref_count int
+        db.QueryRow("select ref_count from resource where tag=?",tag).Scan(&ref_count)
+        if ref_count !=want{
+            t.Errorf("ref_count of %s is %d, want %d",tag,ref_count,want)
+        }
+    }
+
+    blob,err = get_db(blob_file_of(folder,1))
+    if err !=nil{
+        t.Fatal(err)
+    }
+    defer blob.Close()
+    texts := map[string]string{
+        "t1":`<img src="get_image/imga"><img src="get_image/imga">`,
+        "t2":`<img src="get_image/imga">`,
+        "t3":`<img src="get_image/imgc">`,
+    }
+    for tag,want :=range(texts){
+        _,data,err := blob_read(blob,tag)
+        if err !=nil || string(data) !=want{
+            t.Errorf("the text %s is %q (%v), want %q",tag,data,err,want)
+        }
+    }
+    if _,_,err = blob_read(blob,"imgb");err !=sql.ErrNoRows{
+        t.Errorf("the bytes of imgb are kept: %v",err)
+    }
+    migrate_to(t,folder,main_migrations[len(main_migrations)-1].Version)
+}
+
+// test_note adds a note on a file whose text shows the html
+func test_note(t *testing.T,u *Unit,tag string,html string){
+    text_tag,err := resource_deposite(u,"",33,[]byte(html))
+    if err !=nil{
+        t.Fatal(err)
+    }
+    _,err = u.tx.Exec("insert into tags(tag_str) values(?)",tag)
+    if err ==nil{
+        _,err = u.tx.Exec("insert into file_note(tag,file_dir,file_name,note,ndate,color) values(?,'/d',?,?,'2020-01-01',0)",
+            tag,tag+".txt","#<0x_"+text_tag+"_>")
+    }
+    if err !=nil{
+        t.Fatal(err)
+    }
+}
+
+func TestResourceUpdateToKnownBytes(t *testing.T){
+    st := test_store(t)
+    u,err := st.begin()
+    if err !=nil{
+        t.Fatal(err)
+    }
+    defer u.rollback()
+    tag_a,err := resource_deposite(u,"a.png",1,[]byte("bytes a"))
+    if err !=nil{
+        t.Fatal(err)
+    }
+    tag_b,err := resource_deposite(u,"b.png",1,[]byte("bytes b"))
+    if err !=nil{
+        t.Fatal(err)
+    }
+    test_note(t,u,"n1",`<img src="get_image/`+tag_a+`">`)
+    test_note(t,u,"n2",`<img src="get_image/`+tag_b+`">`)
+    if err = resource_ref_add(u.tx,tag_a,1,"n1");err ==nil{
+        err = resource_ref_add(u.tx,tag_b,1,"n2")
+    }
+    if err !=nil{
+        t.Fatal(err)
+    }
+
+    // n2 alone shows b, it is changed in place to the bytes of a
+    got,err := resource_update_owned(u,tag_b,1,"n2",1,[]byte("bytes a"))
+    if err !=nil{
+        t.Fatal(err)
+    }
+    if got !=tag_a{
+        t.Errorf("the update gives %s, want the image %s with the same bytes",got,tag_a)
+    }
+    var count int
+    u.tx.QueryRow("select count(*) from resource where hash=?",resource_hash([]byte("bytes a"))).Scan(&count)
+    if count !=1{
+        t.Errorf("%d resources hold the same bytes",count)
+    }
+    u.tx.QueryRow("select count(*) from resource_link where tag=? and app=1 and app_tag='n2'",tag_a).Scan(&count)
+    if count !=1{
+        t.Errorf("n2 links %s %d times",tag_a,count)
+    }
+    var ref_a,ref_b int
+    u.tx.QueryRow("select ref_count from resource where tag=?",tag_a).Scan(&ref_a)
+    u.tx.QueryRow("select ref_count from resource where tag=?",tag_b).Scan(&ref_b)
+    if ref_a !=2 || ref_b !=0{
+        t.Errorf("ref_count of a is %d and of b %d, want 2 and 0",ref_a,ref_b)
+    }
+    record,err := get_note_by_tag(u.tx,"n2")
+    if err !=nil{
+        t.Fatal(err)
+    }
+    _,text,err := get_text(u.tx,st,strings.TrimSuffix(strings.TrimPrefix(record.Note,"#<0x_"),"_>"))
+    if err !=nil || !strings.Contains(text,"get_image/"+tag_a){
+        t.Errorf("the text of n2 is %q (%v)",text,err)
+    }
+    // other bytes are still changed in place
+    got,err = resource_update_owned(u,tag_a,0,"",1,[]byte("bytes c"))
+    if err ==nil{
+        t.Errorf("an image shown by two notes is changed without an owner")
+    }
+    got,err = resource_update_owned(u,tag_b,0,"",1,[]byte("bytes c"))
+    if err !=nil || got !=tag_b{
+        t.Errorf("the unshown b is not changed in place: %s %v",got,err)
+    }
+}
+
+func TestMigrationRoots(t *testing.T){
+    folder := t.TempDir()+string(os.PathSeparator)
+    root := t.TempDir()+string(os.PathSeparator)
+    if err := os.MkdirAll(root+"sub",0755);err !=nil{
+        t.Fatal(err)
+    }
+    if err := ioutil.WriteFile(root+"sub"+string(os.PathSeparator)+"a.txt",[]byte("a"),0644);err !=nil{
+        t.Fatal(err)
+    }
+    migrate_to(t,folder,14)
+    db,err := sql.Open("sqlite3",folder+"Filegai.db")
+    if err !=nil{
+        t.Fatal(err)
+    }
+    defer db.Close()
+    // the paths were kept in the root_dir setting of the host
+    _,err = db.Exec(`
+INSERT INTO settings(key,value,note) VALUES('root_dir',?,?);
+INSERT INTO settings(key,value,note) VALUES('root_dir','/home/other/','other_host');
+INSERT INTO file_note(tag,file_dir,file_name,note,ndate,color) VALUES('n1','sub/','a.txt','','2020-01-01',0);
+INSERT INTO wiki_link(app,app_tag,owner,kind,target) VALUES(1,'n2','n2','file','sub/a.txt');
+`,root,get_host_name())
+    if err !=nil{
+        t.Fatal(err)
+    }
+    migrate_to(t,folder,main_migrations[len(main_migrations)-1].Version)
+
+    var count int
+    db.QueryRow("select count(*) from settings where key='root_dir'").Scan(&count)
+    if count !=0{
+        t.Errorf("the root_dir settings are kept")
+    }
+    db.QueryRow("select count(*) from root_folder where host_name='other_host' and name='default' and dir='/home/other/'").Scan(&count)
+    if count !=1{
+        t.Errorf("the root of the other host is not kept")
+    }
+    served,err := parse_roots([]string{root})
+    if err !=nil{
+        t.Fatal(err)
+    }
+    roots,err := roots_load(db,served)
+    if err !=nil{
+        t.Fatal(err)
+    }
+    if main := roots.main();main ==nil || main.Key !="" || main.Kept !=""{
+        t.Errorf("the root_dir is not the default root: %+v",main)
+    }
+    db.QueryRow("select count(*) from root_folder where host_name=?",get_host_name()).Scan(&count)
+    if count !=1{
+        t.Errorf("%d roots for this host, want the one of root_dir",count)
+    }
+
+    want := root+"sub"+string(os.PathSeparator)+"a.txt"
+    note,err := get_note_by_tag(db,"n1")
+    if err !=nil{
+        t.Fatal(err)
+    }
+    if got := roots.abs(note.File_dir+note.File_name);got !=want{
+        t.Errorf("the note is on %s, want %s",got,want)
+    }
+    if _,err = note_list_link(roots,note.File_dir,note.File_name);err !=nil{
+        t.Errorf("the note has no link to its file: %s",err.Error())
+    }
+    links,err := wiki_links_query(db,"1=1")
+    if err !=nil || len(links) !=1{
+        t.Fatalf("wiki_links_query gives %d links (%v)",len(links),err)
+    }
+    path,err := wiki_file_path(db,roots,links[0])
+    if err !=nil || roots.abs(path) !=want{
+        t.Errorf("the wiki link goes to %s (%v), want %s",roots.abs(path),err,want)
+    }
+}
+
+// test_watch gives a watcher of a new root on the store, with its files in ino_tree
+func test_watch(t *testing.T,st *Store,files ...string)(*Fs_watch,string){
+    delim := string(os.PathSeparator)
+    root := t.TempDir()+delim
+    for _,name :=range(files){
+        path := root+str_native_delim(name)
+        if err := os.MkdirAll(path_dir_name(path,delim),0755);err !=nil{
+            t.Fatal(err)
+        }
+        if err := ioutil.WriteFile(path,[]byte(name),0644);err !=nil{
+            t.Fatal(err)
+        }
+    }
+    roots,err := parse_roots([]string{root})
+    if err !=nil{
+        t.Fatal(err)
+    }
+    w := &Fs_watch{st:st,roots:roots,dirty:make(map[string]bool),wake:make(chan bool,1)}
+    filepath.Walk(root,func(path string,info os.FileInfo,err error)error{
+        if err ==nil && info.IsDir(){
+            w.apply([]string{path})
+        }
+        return nil
+    })
+    return w,root
+}
+
+func TestWatchFollowsMove(t *testing.T){
+    st := test_store(t)
+    w,root := test_watch(t,st,"docs/a.txt","other/keep.txt")
+    db := st.db
+    _,err := db.Exec(`
+INSERT INTO file_note(tag,file_dir,file_name,note,ndate,color) VALUES('n1','docs/','a.txt','','2020-01-01',0);
+INSERT INTO shortcut(track_id,file_dir,file_name,type,order_id) VALUES(0,'docs/','a.txt','f',1);
+INSERT INTO label(name,color,ldate) VALUES('read','#d9534f','2020-01-01');
+INSERT INTO label_link(lid,app,app_tag) SELECT lid,?,'docs/a.txt' FROM label WHERE name='read';
+INSERT INTO wiki_link(app,app_tag,owner,kind,target) VALUES(1,'n2','n2','file','docs/a.txt');
+`,label_app_file)
+    if err !=nil{
+        t.Fatal(err)
+    }
+    delim := string(os.PathSeparator)
+    before,err := get_Fnode(root+"docs"+delim+"a.txt",false)
+    if err !=nil{
+        t.Fatal(err)
+    }
+    if err = os.Rename(root+"docs"+delim+"a.txt",root+"other"+delim+"b.txt");err !=nil{
+        t.Fatal(err)
+    }
+    w.apply([]string{root+"docs"+delim,root+"other"+delim})
+
+    node,err := query_fnode(db,before.Dev,before.Ino)
+    if err !=nil || node.Name !="b.txt"{
+        t.Errorf("ino_tree has %+v (%v), want b.txt",node,err)
+    }
+    url,err := file_url(db,before.Dev,before.Ino,100,delim)
+    if err !=nil || url !=root+"other"+delim+"b.txt"{
+        t.Errorf("the file is at %s in ino_tree (%v)",url,err)
+    }
+    checks := []struct{
+        what string
+        sql string
+    }{
+        {"note","select count(*) from file_note where tag='n1' and file_dir='other/' and file_name='b.txt'"},
+        {"shortcut","select count(*) from shortcut where file_dir='other/' and file_name='b.txt'"},
+        {"label","select count(*) from label_link where app_tag='other/b.txt'"},
+        {"wiki link","select count(*) from wiki_link where kind='file' and target='other/b.txt'"},
+    }
+    for _,c :=range(checks){
+        var count int
+        if err = db.QueryRow(c.sql).Scan(&count);err !=nil || count !=1{
+            t.Errorf("the %s did not follow the move (%d, %v)",c.what,count,err)
+        }
+    }
+}
+
+func TestWatchMoveIsOneUnit(t *testing.T){
+    st := test_store(t)
+    w,root := test_watch(t,st,"docs/a.txt","other/keep.txt")
+    db := st.db
+    _,err := db.Exec(`INSERT INTO file_note(tag,file_dir,file_name,note,ndate,color) VALUES('n1','docs/','a.txt','','2020-01-01',0);
+INSERT INTO wiki_link(app,app_tag,owner,kind,target) VALUES(1,'n2','n2','file','docs/a.txt');`)
+    if err !=nil{
+        t.Fatal(err)
+    }
+    delim := string(os.PathSeparator)
+    before,err := get_Fnode(root+"docs"+delim+"a.txt",false)
+    if err !=nil{
+        t.Fatal(err)
+    }
+    // the shortcuts are moved after the notes, without them the move fails
+    if _,err = db.Exec("DROP TABLE shortcut");err !=nil{
+        t.Fatal(err)
+    }
+    if err = os.Rename(root+"docs"+delim+"a.txt",root+"other"+delim+"b.txt");err !=nil{
+        t.Fatal(err)
+    }
+    w.sync_folder(db,root+"other"+delim,false)
+
+    node,err := query_fnode(db,before.Dev,before.Ino)
+    if err !=nil || node.Name !="a.txt" || node.Parent_ino !=before.Parent_ino{
+        t.Errorf("ino_tree has %+v (%v), want the old place to try again",node,err)
+    }
+    var count int
+    db.QueryRow("select count(*) from file_note where file_dir='docs/' and file_name='a.txt'").Scan(&count)
+    if count !=1{
+        t.Errorf("the note moved without its file")
+    }
+    db.QueryRow("select count(*) from wiki_link where target='docs/a.txt'").Scan(&count)
+    if count !=1{
+        t.Errorf("the wiki link moved without its file")
+    }
+}
+
+// test_bulk runs a bulk operation as /bulk_notes does, the notes are picked in its unit
+func test_bulk(st *Store,roots Roots,tags []string,query Bulk_query,do func(u *Unit,notes []Note_record)(Bulk_result,error))(Bulk_result,error){
+    var result Bulk_result
+    u,err := st.begin()
+    if err !=nil{
+        return result,err
+    }
+    notes,err := bulk_pick(u.tx,roots,tags,query)
+    if err ==nil{
+        result,err = do(u,notes)
+    }
+    return result,u.finish(err)
+}
+
+func TestBulkRoundTrip(t *testing.T){
+    st := test_store(t)
+    delim := string(os.PathSeparator)
+    root := t.TempDir()+delim
+    for _,name :=range([]string{"a"+delim+"x.txt","a"+delim+"y.txt","b"+delim+"x.txt"}){
+        os.MkdirAll(path_dir_name(root+name,delim),0755)
+        if err := ioutil.WriteFile(root+name,[]byte(name),0644);err !=nil{
+            t.Fatal(err)
+        }
+    }
+    roots,err := parse_roots([]string{root})
+    if err !=nil{
+        t.Fatal(err)
+    }
+    // more matches than a page of the search shows, n0 has a reply
+    const matches = 230
+    for i :=0;i<matches+5;i++{
+        tag := "n"+strconv.Itoa(i)
+        name := "x.txt"
+        if i%2 ==1{
+            name = "y.txt"
+        }
+        text := "alpha "+tag
+        if i >=matches{
+            text = "beta "+tag
+        }
+        _,err = st.db.Exec("insert into file_note(tag,file_dir,file_name,note,ndate,color) values(?,'a/',?,'','2020-01-01',1)",tag,name)
+        if err ==nil{
+            err = search_index_put(st.db,1,tag,tag,text)
+        }
+        if err !=nil{
+            t.Fatal(err)
+        }
+    }
+    _,err = st.db.Exec("insert into file_note(tag,file_dir,file_name,note,ndate,color,parent_tag) values('r0','a/','x.txt','','2020-01-01',1,'n0')")
+    if err ==nil{
+        err = search_index_put(st.db,1,"r0","r0","alpha reply")
+    }
+    if err !=nil{
+        t.Fatal(err)
+    }
+    count := func(sql_str string,args ...interface{})int{
+        var n int
+        if err := st.db.QueryRow(sql_str,args...).Scan(&n);err !=nil{
+            t.Fatal(err)
+        }
+        return n
+    }
+    alpha := Bulk_query{Q:"alpha"}
+
+    // the colors there and back
+    result,err := test_bulk(st,roots,nil,alpha,func(u *Unit,notes []Note_record)(Bulk_result,error){
+        return bulk_color(u,notes,3)
+    })
+    if err !=nil || result.Notes !=matches || result.Changed !=matches{
+        t.Fatalf("color: %s (%v)",result.String(),err)
+    }
+    if n := count("select count(*) from file_note where color=3");n !=matches{
+        t.Errorf("%d notes are colored, want %d",n,matches)
+    }
+    result,err = test_bulk(st,roots,nil,Bulk_query{Color:3},func(u *Unit,notes []Note_record)(Bulk_result,error){
+        return bulk_color(u,notes,1)
+    })
+    if err !=nil || result.Changed !=matches || count("select count(*) from file_note where color<>1") !=0{
+        t.Errorf("color back: %s (%v)",result.String(),err)
+    }
+
+    // a failure leaves every note as it was
+    _,err = test_bulk(st,roots,nil,alpha,func(u *Unit,notes []Note_record)(Bulk_result,error){
+        result,err := bulk_color(u,notes,5)
+        if err ==nil{
+            err = errors.New("stop")
+        }
+        return result,err
+    })
+    if err ==nil || count("select count(*) from file_note where color=5") !=0{
+        t.Errorf("a failed operation changed the notes (%v)",err)
+    }
+
+    // the labels on and off
+    lid,err := label_add(st.db,"bulk","#d9534f")
+    if err !=nil{
+        t.Fatal(err)
+    }
+    result,err = test_bulk(st,roots,nil,alpha,func(u *Unit,notes []Note_record)(Bulk_result,error){
+        return bulk_labels(u,notes,[]int64{lid},nil)
+    })
+    if err !=nil || result.Changed !=matches{
+        t.Errorf("labels on: %s (%v)",result.String(),err)
+    }
+    result,err = test_bulk(st,roots,nil,Bulk_query{Label:lid},func(u *Unit,notes []Note_record)(Bulk_result,error){
+        return bulk_labels(u,notes,nil,[]int64{lid})
+    })
+    if err !=nil || result.Notes !=matches || result.Changed !=matches{
+        t.Errorf("labels off: %s (%v)",result.String(),err)
+    }
+    if n := count("select count(*) from label_link where lid=?",lid);n !=0{
+        t.Errorf("%d notes keep the label",n)
+    }
+
+    // to b and back, n1 has no file there
+    result,err = test_bulk(st,roots,[]string{"n0","n1"},Bulk_query{},func(u *Unit,notes []Note_record)(Bulk_result,error){
+        return bulk_move(u,notes,"b",roots)
+    })
+    if err !=nil || result.Changed !=1 || result.Replies !=1 || len(result.Skipped) !=1{
+        t.Errorf("move: %s (%v)",result.String(),err)
+    }
+    if n := count("select count(*) from file_note where file_dir='b/' and file_name='x.txt'");n !=2{
+        t.Errorf("%d notes in b, want n0 and its reply",n)
+    }
+    result,err = test_bulk(st,roots,[]string{"r0"},Bulk_query{},func(u *Unit,notes []Note_record)(Bulk_result,error){
+        return bulk_move(u,notes,"a",roots)
+    })
+    if err !=nil || result.Changed !=1 || count("select count(*) from file_note where file_dir<>'a/'") !=0{
+        t.Errorf("move back: %s (%v)",result.String(),err)
+    }
+
+    // the replies go with their notes
+    result,err = test_bulk(st,roots,[]string{"n0"},Bulk_query{},func(u *Unit,notes []Note_record)(Bulk_result,error){
+        return bulk_delete(u,notes)
+    })
+    if err !=nil || result.Changed !=1 || result.Replies !=1{
+        t.Errorf("delete: %s (%v)",result.String(),err)
+    }
+    if n := count("select count(*) from file_note where tag in ('n0','r0')");n !=0{
+        t.Errorf("%d of n0 and its reply are left",n)
+    }
+    if n := count("select count(*) from file_note");n !=matches+4{
+        t.Errorf("%d notes are left, want %d",n,matches+4)
+    }
+}
+
+// test_image gives the bytes of the image as the store has them
+func test_image(st *Store,tag string)([]byte,error){
+    record,err := get_resource_record(st.db,tag)
+    if err !=nil{
+        return nil,err
+    }
+    blob_db,err := st.blob(strconv.Itoa(record.Page))
+    if err !=nil{
+        return nil,err
+    }
+    _,data,err := blob_read(blob_db,tag)
+    return data,err
+}
+
+func TestBackupRestore(t *testing.T){
+    st := test_store(t)
+    folder := st.folder
+    deposite := func(name string,data string)string{
+        u,err := st.begin()
+        if err !=nil{
+            t.Fatal(err)
+        }
+        tag,err := resource_deposite(u,name,1,[]byte(data))
+        if err ==nil{
+            _,err = u.tx.Exec("insert into file_note(tag,file_dir,file_name,note,ndate,color) values(?,'a/',?,'','2020-01-01',1)",
+                "n_"+name,name)
+        }
+        if err = u.finish(err);err !=nil{
+            t.Fatal(err)
+        }
+        return tag
+    }
+    kept := deposite("kept.png","kept bytes")
+    name,err := backup_now(st)
+    if err !=nil{
+        t.Fatal(err)
+    }
+    records,err := list_backups(folder)
+    if err !=nil || len(records) !=1 || records[0].Name !=name || records[0].Files <2{
+        t.Fatalf("list_backups gives %+v (%v)",records,err)
+    }
+    later := deposite("later.png","later bytes")
+    if _,err = st.db.Exec("update file_note set color=4 where tag='n_kept.png'");err !=nil{
+        t.Fatal(err)
+    }
+
+    if _,err = restore_backup(folder,name);err ==nil{
+        t.Fatalf("a restore runs while the store is open")
+    }
+    if _,err = restore_backup(folder,"snapshot_none");err ==nil{
+        t.Errorf("a restore of a missing snapshot gives no error")
+    }
+    st.close()
+    replaced,err := restore_backup(folder,name)
+    if err !=nil{
+        t.Fatal(err)
+    }
+    if ok,_ := file_exists(backup_folder(folder)+replaced+string(os.PathSeparator)+"Filegai.db");!ok{
+        t.Errorf("the replaced database is not kept in %s",replaced)
+    }
+    infos,_ := ioutil.ReadDir(backup_folder(folder))
+    for _,info :=range(infos){
+        if strings.HasPrefix(info.Name(),"restoring_"){
+            t.Errorf("the staging folder %s is left",info.Name())
+        }
+    }
+
+    st,err = open_store(folder)
+    if err !=nil{
+        t.Fatal(err)
+    }
+    defer st.close()
+    var color int
+    if err = st.db.QueryRow("select color from file_note where tag='n_kept.png'").Scan(&color);err !=nil || color !=1{
+        t.Errorf("the note is %d (%v) after the restore, want 1",color,err)
+    }
+    var count int
+    st.db.QueryRow("select count(*) from file_note where tag='n_later.png'").Scan(&count)
+    if count !=0{
+        t.Errorf("the note made after the snapshot is still there")
+    }
+    if data,err := test_image(st,kept);err !=nil || string(data) !="kept bytes"{
+        t.Errorf("the image is %q (%v) after the restore",data,err)
+    }
+    if _,err = get_resource_record(st.db,later);err ==nil{
+        t.Errorf("the image added after the snapshot is still a resource")
+    }
+}
@@ -0,0 +1,137 @@
+// +build linux
+
+package main
+
+import(
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "syscall"
+    "unsafe"
+)
+
+const inotify_mask = syscall.IN_CREATE|syscall.IN_DELETE|syscall.IN_MOVED_FROM|syscall.IN_MOVED_TO|syscall.IN_DELETE_SELF|syscall.IN_ONLYDIR
+
+// watch_inotify has the kernel tell which folders of the roots changed. The
+// watches are on every folder but the hidden ones; the error is for a kernel
+// without inotify or roots with more folders than fs.inotify.max_user_watches.
+func watch_inotify(w *Fs_watch)error{
+    fd,err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+    if err !=nil{
+        return fmt.Errorf("no inotify:%s",err.Error())
+    }
+    folders := make(map[int32]string) // watch -> folder, native paths ending with the deliminator
+    for _,root :=range(w.roots){
+        _,err = inotify_add(fd,folders,root.Dir,nil)
+        if err !=nil{
+            syscall.Close(fd)
+            return err
+        }
+    }
+    go inotify_read(w,fd,folders)
+    return nil
+}
+
+// inotify_add watches the folder and the folders under it, found ones are given to found
+func inotify_add(fd int,folders map[int32]string,folder string,found func(string))(int,error){
+    delim := sys_delim()
+    cnt := 0
+    err := filepath.Walk(folder,func(path string,info os.FileInfo,err error)error{
+        if err !=nil || !info.IsDir(){
+            return nil
+        }
+        if strings.HasPrefix(info.Name(),".") && path !=filepath.Clean(folder){
+            return filepath.SkipDir
+        }
+        wd,err := syscall.InotifyAddWatch(fd,path,inotify_mask)
+        if err ==syscall.ENOSPC{
+            return fmt.Errorf("too many folders for inotify, see fs.inotify.max_user_watches")
+        }
+        if err !=nil{
+            return nil // gone or unreadable, passed over
+        }
+        ensure_folder(&path,delim)
+        folders[int32(wd)] = path
+        cnt++
+        if found !=nil{
+            found(path)
+        }
+        return nil
+    })
+    return cnt,err
+}
+
+// inotify_read turns the events into folders to sync. The watches of a folder
+// moved in the root are kept under its new path, those of one moved out are removed.
+func inotify_read(w *Fs_watch,fd int,folders map[int32]string){
+    delim := sys_delim()
+    buf := make([]byte,64*1024)
+    for{
+        n,err := syscall.Read(fd,buf)
+        if err ==syscall.EINTR{
+            continue
+        }
+        if err !=nil || n <=0{
+            fmt.Println("?? watch: reading inotify stopped")
+            return
+        }
+        moved_out := make(map[uint32]string) // cookie -> folder moved from
+        for offset:=0;offset+syscall.SizeofInotifyEvent <=n;{
+            event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+            start := offset+syscall.SizeofInotifyEvent
+            name := strings.TrimRight(string(buf[start:start+int(event.Len)]),"\x00")
+            offset = start+int(event.Len)
+
+            if event.Mask&syscall.IN_Q_OVERFLOW !=0{
+                // events were lost, everything is looked at
+                for _,folder :=range(folders){
+                    w.touch(folder)
+                }
+                continue
+            }
+            folder,ok := folders[event.Wd]
+            if !ok{
+                continue
+            }
+            if event.Mask&syscall.IN_IGNORED !=0{
+                delete(folders,event.Wd)
+                continue
+            }
+            if name =="" || strings.HasPrefix(name,"."){
+                continue
+            }
+            w.touch(folder)
+            if event.Mask&syscall.IN_ISDIR ==0{
+                continue
+            }
+            path := folder+name+delim
+            switch{
+            case event.Mask&syscall.IN_MOVED_FROM !=0:
+                moved_out[event.Cookie] = path
+            case event.Mask&syscall.IN_MOVED_TO !=0 && moved_out[event.Cookie] !="":
+                old_path := moved_out[event.Cookie]
+                delete(moved_out,event.Cookie)
+                for wd,f :=range(folders){
+                    if strings.HasPrefix(f,old_path){
+                        folders[wd] = path+f[len(old_path):]
+                    }
+                }
+            case event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) !=0:
+                // what is already in it was not seen
+                _,err = inotify_add(fd,folders,path,w.touch)
+                if err !=nil{
+                    fmt.Println("?? watch: "+err.Error())
+                }
+            }
+        }
+        for _,old_path :=range(moved_out){
+            for wd,f :=range(folders){
+                if strings.HasPrefix(f,old_path){
+                    syscall.InotifyRmWatch(fd,uint32(wd))
+                    delete(folders,wd)
+                }
+            }
+        }
+    }
+}
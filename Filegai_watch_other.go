@@ -0,0 +1,13 @@
+// +build !linux
+
+package main
+
+import(
+    "errors"
+    "runtime"
+)
+
+// watch_inotify: there is no inotify out of linux, the folders are polled
+func watch_inotify(w *Fs_watch)error{
+    return errors.New("no inotify on "+runtime.GOOS)
+}
@@ -0,0 +1,87 @@
+// bulk operations on the notes of a list
+// the page sets Bulk_query, the query of its list, and holds .bulk_check boxes valued by the note tags
+
+function BulkCheckAll(checked){
+    $(".bulk_check").prop("checked",checked);
+    BulkCount();
+}
+
+// BulkCount shows how many notes the operation goes to
+function BulkCount(){
+    if ($("#bulk_query").prop("checked")){
+        $("#bulk_count").text("all the notes of this list");
+    }else{
+        $("#bulk_count").text($(".bulk_check:checked").length+" notes picked");
+    }
+}
+
+// BulkArgs gives the picked tags, or the query of the list when it is asked for
+function BulkArgs(action){
+    var args = {"action":action};
+    if ($("#bulk_query").prop("checked")){
+        for (var key in Bulk_query){
+            if (Bulk_query[key]){
+                args[key] = Bulk_query[key];
+            }
+        }
+        if (!args["q"] && !args["label"] && !args["orphans"]){
+            args["all"] = "1";
+        }
+        return args;
+    }
+    var tags = [];
+    $(".bulk_check:checked").each(function(){
+        tags.push($(this).val());
+    });
+    if (tags.length==0){
+        alert("No note picked");
+        return null;
+    }
+    args["tags"] = tags.join(",");
+    return args;
+}
+
+function BulkNotes(action){
+    var args = BulkArgs(action);
+    if (args==null){
+        return;
+    }
+    if (action=="color"){
+        args["set_color"] = $("#bulk_color").val();
+    }else if (action=="label_add" || action=="label_del"){
+        if ($("#bulk_label").val()==""){
+            alert("No label chosen");
+            return;
+        }
+        args[action=="label_add"?"add_lids":"del_lids"] = $("#bulk_label").val();
+        args["action"] = "labels";
+    }else if (action=="move"){
+        var folder = prompt("Move the notes to the files of the same names in the folder (path in the served folder, or name:path in another root)","");
+        if (folder==null){
+            return;
+        }
+        args["folder"] = folder;
+    }else if (action=="delete"){
+        if (!confirm("Your are DELETING "+$("#bulk_count").text()+" and the replies to them, ARE YOU SURE?")){
+            return;
+        }
+    }else if (action=="export"){
+        // the zip is downloaded by a form
+        var form = $('<form method="POST" action="/bulk_notes" style="display:none"></form>');
+        for (var key in args){
+            form.append($('<input type="hidden">').attr("name",key).val(args[key]));
+        }
+        $("body").append(form);
+        form.submit();
+        form.remove();
+        return;
+    }
+    $.post("/bulk_notes",args,function(data,status){
+        if(status=="success" && data.match(/^\!\!/)){
+            alert(data.substr(2));
+            window.location.reload();
+        }else{
+            alert("failed:"+data.substr(2));
+        }
+    });
+}
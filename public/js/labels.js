@@ -0,0 +1,50 @@
+// labels of notes(app 1), articles(app 2) and files(app 3)
+// the page sets All_labels and holds the chips of a target in #labels_<target>
+
+function EditLabels(app,target){
+    var labels = All_labels || [];
+    if (labels.length==0){
+        if (confirm("No label yet, define some in Labels?")){
+            window.location.href="/labels";
+        }
+        return;
+    }
+    var checked = {};
+    $("#labels_"+target+" .label_chip").each(function(){
+        checked[$(this).attr("value")] = true;
+    });
+    var html = "";
+    for (var i=0; i<labels.length; i++){
+        var label = labels[i];
+        html += '<p><label><input type="checkbox" class="label_check" value="'+label.Lid+'"'+(checked[label.Lid]?" checked":"")+'> ';
+        html += '<span class="label_chip" style="background-color:'+label.Color+'">'+$("<span>").text(label.Name).html()+'</span></label></p>';
+    }
+    $("#label_checks").html(html);
+    show_dialog("#labels_dialog",false);
+    $("#labels_dialog").show(100);
+
+    $('#submit_labels').unbind("click").click(function(event){
+        var lids = [];
+        $("#label_checks .label_check:checked").each(function(){
+            lids.push($(this).val());
+        });
+        $.post("/label_set",{"app":app,"target":target,"lids":lids.join(",")},function(data,status){
+            if(status=="success" && data.match(/^\!\!/)){
+                window.location.reload();
+            }else{
+                alert("Labels not set:"+data.substr(2));
+            }
+        });
+        $("#labels_dialog").hide(100);
+        event.preventDefault();
+    });
+}
+
+// FilterLabel reloads the page keeping only what has the label, none for all
+function FilterLabel(lid){
+    var url = window.location.pathname;
+    if (lid !=""){
+        url += "?label="+lid;
+    }
+    window.location.href = url;
+}
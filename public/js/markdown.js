@@ -0,0 +1,60 @@
+// notes in markdown: the note dialog has tinymce for html and #md_content for
+// markdown, the checkbox #dialog_markdown picks one. The page keeps the source
+// of a markdown note in #source_<id> and its html in #item_<id>
+
+function NoteFormat(){
+    return $("#dialog_markdown").prop("checked") ? 1 : 0;
+}
+
+// SetNoteFormat shows the editor of the format, a saved note keeps its format
+function SetNoteFormat(format,locked){
+    $("#dialog_markdown").prop("checked",format==1).prop("disabled",locked);
+    if (format==1){
+        $("#add_note_dialog .tox-tinymce").hide();
+        $("#md_content").height($("#add_note_dialog").height()-100).show();
+    }else{
+        $("#md_content").hide();
+        $("#add_note_dialog .tox-tinymce").show();
+    }
+}
+
+function NoteContent(){
+    if (NoteFormat()==1){
+        return $("#md_content").val();
+    }
+    return tinyMCE.get('note_content').getContent();
+}
+
+// ShowMarkdown puts the html of the markdown source into the element
+function ShowMarkdown(elem,src){
+    $.post("/markdown_html",{"text":src},function(data,status){
+        if(status=="success"){
+            $(elem).html(data);
+        }
+    });
+}
+
+// ConvertNote turns the note of tag into the other format
+function ConvertNote(tag,format){
+    if (!tag){
+        alert("No note on this file");
+        return;
+    }
+    var to = (format=="1") ? 0 : 1;
+    if (!confirm("Turn this note into "+(to==1 ? "Markdown" : "HTML")+"? The text before is kept in its history.")){
+        return;
+    }
+    $.post("/note_format",{"tag":tag,"format":to},function(data,status){
+        if(status=="success" && data.match(/^\!\!/)){
+            window.location.reload();
+        }else{
+            alert("failed:"+data.substr(2));
+        }
+    });
+}
+
+$(function(){
+    $("#dialog_markdown").change(function(){
+        SetNoteFormat(NoteFormat(),false);
+    });
+});